@@ -0,0 +1,954 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"bin2.io/internal/apikey"
+	"bin2.io/internal/db"
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+)
+
+// registryTokenRevocationRetention outlives every registry token issued up to
+// now (30 minutes plus clock leeway), so revocations made here cover them all.
+const registryTokenRevocationRetention = time.Hour
+
+func newAdminCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "admin",
+		Short: "Inspect and manage any tenant, the CLI counterpart of the /admin/v1 API",
+	}
+
+	tokenCmd := &cobra.Command{
+		Use:   "token <operator>",
+		Short: "Generate an operator token for the /admin/v1 API and print its ADMIN_API_TOKENS entry",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAdminToken(args[0])
+		},
+	}
+
+	cmd.AddCommand(tokenCmd, newAdminTenantsCmd(), newAdminRegistriesCmd(), newAdminKeysCmd(), newAdminPlansCmd(), newAdminUsageWorkersCmd())
+	return cmd
+}
+
+func newAdminTenantsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tenants",
+		Short: "List and manage tenants",
+	}
+
+	var filter db.TenantFilter
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List tenants with their registry count and size",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAdminTenantsList(cmd.Context(), filter)
+		},
+	}
+	listCmd.Flags().StringVar(&filter.NamePrefix, "name", "", "only tenants whose name starts with this")
+	listCmd.Flags().StringVar(&filter.RegistryName, "registry", "", "only the tenant owning this registry")
+	listCmd.Flags().IntVar(&filter.Limit, "limit", 100, "maximum number of tenants")
+
+	showCmd := &cobra.Command{
+		Use:   "show <tenant-id>",
+		Short: "Show a tenant and its registries",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAdminTenantsShow(cmd.Context(), args[0])
+		},
+	}
+
+	usageCmd := &cobra.Command{
+		Use:   "usage <tenant-id>",
+		Short: "Show a tenant's operations this month and current storage",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAdminTenantsUsage(cmd.Context(), args[0])
+		},
+	}
+
+	var reason string
+	stateCmd := &cobra.Command{
+		Use:   "state <tenant-id> <active|read_only|suspended>",
+		Short: "Set a tenant's access state",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAdminTenantsState(cmd.Context(), args[0], args[1], reason)
+		},
+	}
+	stateCmd.Flags().StringVar(&reason, "reason", "", "reason shown to the tenant")
+
+	planCmd := &cobra.Command{
+		Use:   "plan <tenant-id> <plan>",
+		Short: "Move a tenant to another plan",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAdminTenantsPlan(cmd.Context(), args[0], args[1])
+		},
+	}
+
+	revokeKeysCmd := &cobra.Command{
+		Use:   "revoke-keys <tenant-id>",
+		Short: "Delete every API key for a tenant's registries and revoke their tokens",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAdminTenantsRevokeKeys(cmd.Context(), args[0])
+		},
+	}
+
+	var repair bool
+	storageCmd := &cobra.Command{
+		Use:   "storage <tenant-id>",
+		Short: "Compare a tenant's recorded storage with the blobs it stores, correcting drift with --repair",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAdminTenantsStorage(cmd.Context(), args[0], repair)
+		},
+	}
+	storageCmd.Flags().BoolVar(&repair, "repair", false, "emit a reconciliation usage event correcting the drift")
+
+	cmd.AddCommand(listCmd, showCmd, usageCmd, stateCmd, planCmd, revokeKeysCmd, storageCmd)
+	return cmd
+}
+
+func newAdminRegistriesCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "registries",
+		Short: "List and manage registries of any tenant",
+	}
+
+	var tenant string
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List registries with their cached size",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAdminRegistriesList(cmd.Context(), tenant)
+		},
+	}
+	listCmd.Flags().StringVar(&tenant, "tenant", "", "only registries of this tenant id")
+
+	var reason string
+	stateCmd := &cobra.Command{
+		Use:   "state <registry> <active|read_only|suspended>",
+		Short: "Set a registry's access state; registry is a name or id",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAdminRegistriesState(cmd.Context(), args[0], args[1], reason)
+		},
+	}
+	stateCmd.Flags().StringVar(&reason, "reason", "", "reason shown to the tenant")
+
+	transferCmd := &cobra.Command{
+		Use:   "transfer <registry> <tenant-id>",
+		Short: "Move a registry to another tenant, deleting its API keys",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAdminRegistriesTransfer(cmd.Context(), args[0], args[1])
+		},
+	}
+
+	cmd.AddCommand(listCmd, stateCmd, transferCmd)
+	return cmd
+}
+
+func newAdminKeysCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "keys",
+		Short: "Manage API keys of any tenant",
+	}
+
+	revokeCmd := &cobra.Command{
+		Use:   "revoke <api-key-id>",
+		Short: "Delete an API key and revoke its registry tokens",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAdminKeysRevoke(cmd.Context(), args[0])
+		},
+	}
+
+	cmd.AddCommand(revokeCmd)
+	return cmd
+}
+
+func newAdminPlansCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "plans",
+		Short: "List plans and manage their prices",
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List plans with their price history",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAdminPlansList(cmd.Context())
+		},
+	}
+
+	var description string
+	createCmd := &cobra.Command{
+		Use:   "create <plan>",
+		Short: "Create a plan or update its description",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAdminPlansCreate(cmd.Context(), args[0], description)
+		},
+	}
+	createCmd.Flags().StringVar(&description, "description", "", "description of the plan")
+
+	var price adminPlanPriceFlags
+	priceCmd := &cobra.Command{
+		Use:   "price <plan>",
+		Short: "Schedule a new price for a plan",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAdminPlansPrice(cmd.Context(), args[0], price)
+		},
+	}
+	priceCmd.Flags().StringVar(&price.effectiveFrom, "effective-from", "", "RFC 3339 time the price takes effect (default now)")
+	priceCmd.Flags().StringVar(&price.storage, "storage-usd-per-gib-month", "", "storage rate in USD per GiB-month")
+	priceCmd.Flags().StringVar(&price.push, "push-usd-per-op", "", "push rate in USD per operation")
+	priceCmd.Flags().StringVar(&price.pull, "pull-usd-per-op", "", "pull rate in USD per operation")
+	priceCmd.Flags().StringVar(&price.pullBytes, "pull-usd-per-gib", "0", "pull egress rate in USD per GiB")
+	priceCmd.Flags().StringVar(&price.includedStorage, "included-storage-gib-months", "0", "free storage per month in GiB-months")
+	priceCmd.Flags().Int64Var(&price.includedPush, "included-push-ops", 0, "free push operations per month")
+	priceCmd.Flags().Int64Var(&price.includedPull, "included-pull-ops", 0, "free pull operations per month")
+	priceCmd.Flags().StringVar(&price.includedPullBytes, "included-pull-gib", "0", "free pull egress per month in GiB")
+	priceCmd.Flags().StringVar(&price.minimum, "minimum-charge-usd", "0", "minimum charge per month in USD")
+	for _, name := range []string{"storage-usd-per-gib-month", "push-usd-per-op", "pull-usd-per-op"} {
+		_ = priceCmd.MarkFlagRequired(name)
+	}
+
+	cmd.AddCommand(listCmd, createCmd, priceCmd)
+	return cmd
+}
+
+func newAdminUsageWorkersCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "usage-workers",
+		Short: "Manage the edge workers allowed to submit usage events",
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List usage workers with their allowed metrics",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAdminUsageWorkersList(cmd.Context())
+		},
+	}
+
+	var metrics []string
+	createCmd := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Register a usage worker and print its id and signing secret",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAdminUsageWorkersCreate(cmd.Context(), args[0], metrics)
+		},
+	}
+	createCmd.Flags().StringArrayVar(&metrics, "metric", nil, "metric the worker may submit as metric=min:max, repeatable")
+	_ = createCmd.MarkFlagRequired("metric")
+
+	revokeCmd := &cobra.Command{
+		Use:   "revoke <worker-id>",
+		Short: "Refuse a usage worker's requests from now on",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAdminUsageWorkersRevoke(cmd.Context(), args[0])
+		},
+	}
+
+	cmd.AddCommand(listCmd, createCmd, revokeCmd)
+	return cmd
+}
+
+// generateOperatorToken returns a new operator token and the SHA-256 hex the
+// API is configured with.
+func generateOperatorToken() (token, hashHex string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = "op_" + base64.RawURLEncoding.EncodeToString(b)
+	sum := sha256.Sum256([]byte(token))
+	return token, hex.EncodeToString(sum[:]), nil
+}
+
+func runAdminToken(operator string) error {
+	operator = strings.TrimSpace(operator)
+	if operator == "" || strings.ContainsAny(operator, ":,") {
+		return fmt.Errorf("operator name must be non-empty and contain no ':' or ','")
+	}
+	token, hashHex, err := generateOperatorToken()
+	if err != nil {
+		return fmt.Errorf("could not generate operator token: %w", err)
+	}
+	fmt.Printf("token: %s\n", token)
+	fmt.Printf("ADMIN_API_TOKENS entry: %s:%s\n", operator, hashHex)
+	return nil
+}
+
+func parseTenantID(raw string) (uuid.UUID, error) {
+	id, err := uuid.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("invalid tenant id %q", raw)
+	}
+	return id, nil
+}
+
+// lookupRegistry finds a registry by id or name.
+func lookupRegistry(ctx context.Context, conn *db.DB, ref string) (db.Registry, error) {
+	ref = strings.TrimSpace(ref)
+	var registry db.Registry
+	var err error
+	if id, parseErr := uuid.Parse(ref); parseErr == nil {
+		registry, err = conn.GetRegistryByID(ctx, id)
+	} else {
+		registry, err = conn.GetRegistryByName(ctx, ref)
+	}
+	if errors.Is(err, db.ErrNotFound) {
+		return db.Registry{}, fmt.Errorf("registry %s not found", ref)
+	}
+	if err != nil {
+		return db.Registry{}, fmt.Errorf("could not get registry: %w", err)
+	}
+	return registry, nil
+}
+
+// recordOperatorAudit adds a CLI action to the audit trail of each affected
+// tenant, or to the operator-wide trail when it affects none, naming the local
+// user as the operator.
+func recordOperatorAudit(ctx context.Context, conn *db.DB, event db.AuditEvent, tenantIDs ...uuid.UUID) {
+	event.ActorType = db.AuditActorOperator
+	event.ActorName = "cli"
+	if u, err := user.Current(); err == nil {
+		event.ActorName = "cli:" + u.Username
+	}
+	event.Outcome = db.AuditOutcomeSuccess
+	event.UserAgent = "init admin"
+	if len(tenantIDs) == 0 {
+		event.ID = uuid.New()
+		if err := conn.InsertAuditEvent(ctx, event); err != nil {
+			log.Printf("warning: could not record audit event %s: %v", event.Action, err)
+		}
+		return
+	}
+	for _, tenantID := range tenantIDs {
+		event.ID = uuid.New()
+		event.TenantID = &tenantID
+		if err := conn.InsertAuditEvent(ctx, event); err != nil {
+			log.Printf("warning: could not record audit event %s: %v", event.Action, err)
+		}
+	}
+}
+
+func runAdminTenantsList(ctx context.Context, filter db.TenantFilter) error {
+	conn, err := connectDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tenants, err := conn.ListTenants(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("could not list tenants: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tPLAN\tSTATE\tREGISTRIES\tMEMBERS\tSIZE")
+	for _, t := range tenants {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\n",
+			t.ID, t.Name, t.Plan, t.State, t.RegistryCount, t.MemberCount, t.SizeBytes)
+	}
+	return w.Flush()
+}
+
+func runAdminTenantsShow(ctx context.Context, rawID string) error {
+	tenantID, err := parseTenantID(rawID)
+	if err != nil {
+		return err
+	}
+	conn, err := connectDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	t, err := conn.GetTenant(ctx, tenantID)
+	if errors.Is(err, db.ErrNotFound) {
+		return fmt.Errorf("tenant %s not found", tenantID)
+	}
+	if err != nil {
+		return fmt.Errorf("could not get tenant: %w", err)
+	}
+	registries, err := conn.ListRegistriesByOrg(ctx, tenantID)
+	if err != nil {
+		return fmt.Errorf("could not list registries: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "id:\t%s\n", t.ID)
+	fmt.Fprintf(w, "name:\t%s\n", t.Name)
+	fmt.Fprintf(w, "plan:\t%s\n", t.Plan)
+	fmt.Fprintf(w, "state:\t%s\t%s\n", t.State, t.StateReason)
+	fmt.Fprintf(w, "members:\t%d\n", t.MemberCount)
+	fmt.Fprintf(w, "size:\t%d\n", t.SizeBytes)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Println()
+	return printAdminRegistries(registries)
+}
+
+func runAdminTenantsUsage(ctx context.Context, rawID string) error {
+	tenantID, err := parseTenantID(rawID)
+	if err != nil {
+		return err
+	}
+	conn, err := connectDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	pushOps, err := conn.SumUsageMetricByTenantBetween(ctx, tenantID, db.MetricPushOpCount, from, now)
+	if err != nil {
+		return fmt.Errorf("could not sum push operations: %w", err)
+	}
+	pullOps, err := conn.SumUsageMetricByTenantBetween(ctx, tenantID, db.MetricPullOpCount, from, now)
+	if err != nil {
+		return fmt.Errorf("could not sum pull operations: %w", err)
+	}
+	pullBytes, err := conn.SumUsageMetricByTenantBetween(ctx, tenantID, db.MetricPullBytes, from, now)
+	if err != nil {
+		return fmt.Errorf("could not sum pulled bytes: %w", err)
+	}
+	storageBytes, err := conn.SumUsageMetricByTenantBefore(ctx, tenantID, db.MetricStorageBytes, now)
+	if err != nil {
+		return fmt.Errorf("could not sum storage: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "period:\t%s to %s\n", from.Format(time.RFC3339), now.Format(time.RFC3339))
+	fmt.Fprintf(w, "push operations:\t%d\n", pushOps)
+	fmt.Fprintf(w, "pull operations:\t%d\n", pullOps)
+	fmt.Fprintf(w, "pull bytes:\t%d\n", pullBytes)
+	fmt.Fprintf(w, "storage bytes:\t%d\n", storageBytes)
+	return w.Flush()
+}
+
+func runAdminTenantsState(ctx context.Context, rawID, rawState, reason string) error {
+	tenantID, err := parseTenantID(rawID)
+	if err != nil {
+		return err
+	}
+	state, ok := db.ParseAccessState(rawState)
+	if !ok {
+		return fmt.Errorf("state must be active, read_only, or suspended")
+	}
+	conn, err := connectDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetTenantState(ctx, tenantID, state, reason); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("tenant %s not found", tenantID)
+		}
+		return fmt.Errorf("could not set tenant state: %w", err)
+	}
+	recordOperatorAudit(ctx, conn, db.AuditEvent{Action: "operator.tenant.set_state", Target: tenantID.String()}, tenantID)
+	log.Printf("tenant %s is now %s", tenantID, state)
+	return nil
+}
+
+func runAdminTenantsPlan(ctx context.Context, rawID, plan string) error {
+	tenantID, err := parseTenantID(rawID)
+	if err != nil {
+		return err
+	}
+	plan = strings.TrimSpace(plan)
+	if plan == "" {
+		return fmt.Errorf("plan is required")
+	}
+	conn, err := connectDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetTenantPlan(ctx, tenantID, plan); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("tenant %s not found", tenantID)
+		}
+		if errors.Is(err, db.ErrUnknownPlan) {
+			return fmt.Errorf("plan %s not found; create it with admin plans create", plan)
+		}
+		return fmt.Errorf("could not set tenant plan: %w", err)
+	}
+	recordOperatorAudit(ctx, conn, db.AuditEvent{Action: "operator.tenant.set_plan", Target: tenantID.String()}, tenantID)
+	log.Printf("tenant %s is now on plan %s", tenantID, plan)
+	return nil
+}
+
+func runAdminPlansList(ctx context.Context) error {
+	conn, err := connectDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	plans, err := conn.ListPlans(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list plans: %w", err)
+	}
+	prices, err := conn.ListPlanPrices(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not list plan prices: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PLAN\tEFFECTIVE FROM\tUSD/GIB-MONTH\tUSD/PUSH\tUSD/PULL\tUSD/PULL GIB\tFREE GIB-MONTHS\tFREE PUSHES\tFREE PULLS\tFREE PULL GIB\tMINIMUM USD")
+	for _, p := range plans {
+		priced := false
+		for _, price := range prices {
+			if price.Plan != p.Name {
+				continue
+			}
+			priced = true
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n",
+				p.Name, price.EffectiveFrom.Format(time.RFC3339),
+				price.StorageUSDPerGiBMonth.FloatString(6), price.PushUSDPerOp.FloatString(9), price.PullUSDPerOp.FloatString(9), price.PullUSDPerGiB.FloatString(6),
+				price.IncludedStorageGiBMonths.FloatString(3), price.IncludedPushOps, price.IncludedPullOps, price.IncludedPullGiB.FloatString(3),
+				price.MinimumChargeUSD.FloatString(2))
+		}
+		if !priced {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\t-\t-\t-\t-\t-\n", p.Name)
+		}
+	}
+	return w.Flush()
+}
+
+func runAdminPlansCreate(ctx context.Context, name, description string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return fmt.Errorf("plan is required")
+	}
+	conn, err := connectDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.UpsertPlan(ctx, name, description); err != nil {
+		return fmt.Errorf("could not save plan: %w", err)
+	}
+	recordOperatorAudit(ctx, conn, db.AuditEvent{Action: "operator.plan.save", Target: name})
+	log.Printf("saved plan %s", name)
+	return nil
+}
+
+type adminPlanPriceFlags struct {
+	effectiveFrom     string
+	storage           string
+	push              string
+	pull              string
+	pullBytes         string
+	includedStorage   string
+	includedPush      int64
+	includedPull      int64
+	includedPullBytes string
+	minimum           string
+}
+
+func runAdminPlansPrice(ctx context.Context, name string, flags adminPlanPriceFlags) error {
+	price := db.PlanPrice{
+		Plan:            strings.TrimSpace(name),
+		EffectiveFrom:   time.Now().UTC(),
+		IncludedPushOps: flags.includedPush,
+		IncludedPullOps: flags.includedPull,
+	}
+	if flags.effectiveFrom != "" {
+		t, err := time.Parse(time.RFC3339, flags.effectiveFrom)
+		if err != nil {
+			return fmt.Errorf("invalid --effective-from: %w", err)
+		}
+		if t.Before(price.EffectiveFrom) {
+			return fmt.Errorf("--effective-from must not be in the past")
+		}
+		price.EffectiveFrom = t.UTC()
+	}
+	if price.IncludedPushOps < 0 || price.IncludedPullOps < 0 {
+		return fmt.Errorf("included operations must not be negative")
+	}
+	for _, f := range []struct {
+		name string
+		raw  string
+		dst  **big.Rat
+	}{
+		{"--storage-usd-per-gib-month", flags.storage, &price.StorageUSDPerGiBMonth},
+		{"--push-usd-per-op", flags.push, &price.PushUSDPerOp},
+		{"--pull-usd-per-op", flags.pull, &price.PullUSDPerOp},
+		{"--pull-usd-per-gib", flags.pullBytes, &price.PullUSDPerGiB},
+		{"--included-storage-gib-months", flags.includedStorage, &price.IncludedStorageGiBMonths},
+		{"--included-pull-gib", flags.includedPullBytes, &price.IncludedPullGiB},
+		{"--minimum-charge-usd", flags.minimum, &price.MinimumChargeUSD},
+	} {
+		amount, err := db.ParsePlanAmount(f.raw)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+		*f.dst = amount
+	}
+
+	conn, err := connectDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.AddPlanPrice(ctx, price); err != nil {
+		switch {
+		case errors.Is(err, db.ErrUnknownPlan):
+			return fmt.Errorf("plan %s not found", price.Plan)
+		case errors.Is(err, db.ErrConflict):
+			return fmt.Errorf("plan %s already has a price effective at %s", price.Plan, price.EffectiveFrom.Format(time.RFC3339))
+		}
+		return fmt.Errorf("could not add plan price: %w", err)
+	}
+	recordOperatorAudit(ctx, conn, db.AuditEvent{Action: "operator.plan.add_price", Target: price.Plan})
+	log.Printf("plan %s is priced anew from %s", price.Plan, price.EffectiveFrom.Format(time.RFC3339))
+	return nil
+}
+
+func runAdminTenantsRevokeKeys(ctx context.Context, rawID string) error {
+	tenantID, err := parseTenantID(rawID)
+	if err != nil {
+		return err
+	}
+	conn, err := connectDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	revoked, err := conn.ForceRevokeTenantAPIKeys(ctx, tenantID, time.Now().UTC().Add(registryTokenRevocationRetention))
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("tenant %s not found", tenantID)
+		}
+		return fmt.Errorf("could not revoke api keys: %w", err)
+	}
+	recordOperatorAudit(ctx, conn, db.AuditEvent{Action: "operator.tenant.revoke_api_keys", Target: tenantID.String()}, tenantID)
+	log.Printf("revoked %d api keys of tenant %s", revoked, tenantID)
+	return nil
+}
+
+func runAdminTenantsStorage(ctx context.Context, rawID string, repair bool) error {
+	tenantID, err := parseTenantID(rawID)
+	if err != nil {
+		return err
+	}
+	conn, err := connectDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var r db.StorageReconciliation
+	if repair {
+		r, err = conn.CorrectTenantStorage(ctx, tenantID, time.Now().UTC())
+	} else {
+		r, err = conn.MeasureTenantStorage(ctx, tenantID)
+	}
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("tenant %s not found", tenantID)
+		}
+		return fmt.Errorf("could not reconcile storage: %w", err)
+	}
+	if repair {
+		recordOperatorAudit(ctx, conn, db.AuditEvent{Action: "operator.tenant.reconcile_storage", Target: tenantID.String()}, tenantID)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "actual bytes:\t%d\n", r.ActualBytes)
+	fmt.Fprintf(w, "recorded bytes:\t%d\n", r.RecordedBytes)
+	fmt.Fprintf(w, "drift bytes:\t%d\n", r.DriftBytes())
+	if repair {
+		fmt.Fprintf(w, "corrected bytes:\t%d\n", r.CorrectedBytes)
+	}
+	return w.Flush()
+}
+
+func printAdminRegistries(registries []db.Registry) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tTENANT\tSTATE\tSIZE\tSIZE UPDATED")
+	for _, r := range registries {
+		updated := "-"
+		if r.CachedSizeUpdatedAt != nil {
+			updated = r.CachedSizeUpdatedAt.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", r.ID, r.Name, r.TenantID, r.State, r.CachedSizeBytes, updated)
+	}
+	return w.Flush()
+}
+
+func runAdminRegistriesList(ctx context.Context, rawTenantID string) error {
+	var tenantID *uuid.UUID
+	if strings.TrimSpace(rawTenantID) != "" {
+		id, err := parseTenantID(rawTenantID)
+		if err != nil {
+			return err
+		}
+		tenantID = &id
+	}
+	conn, err := connectDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	registries, err := conn.ListAllRegistries(ctx, tenantID)
+	if err != nil {
+		return fmt.Errorf("could not list registries: %w", err)
+	}
+	return printAdminRegistries(registries)
+}
+
+func runAdminRegistriesState(ctx context.Context, ref, rawState, reason string) error {
+	state, ok := db.ParseAccessState(rawState)
+	if !ok {
+		return fmt.Errorf("state must be active, read_only, or suspended")
+	}
+	conn, err := connectDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	registry, err := lookupRegistry(ctx, conn, ref)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetRegistryState(ctx, registry.ID, state, reason); err != nil {
+		return fmt.Errorf("could not set registry state: %w", err)
+	}
+	recordOperatorAudit(ctx, conn, db.AuditEvent{
+		Action:       "operator.registry.set_state",
+		RegistryID:   &registry.ID,
+		RegistryName: registry.Name,
+		Target:       registry.ID.String(),
+	}, registry.TenantID)
+	log.Printf("registry %s is now %s", registry.Name, state)
+	return nil
+}
+
+func runAdminRegistriesTransfer(ctx context.Context, ref, rawTenantID string) error {
+	toTenantID, err := parseTenantID(rawTenantID)
+	if err != nil {
+		return err
+	}
+	conn, err := connectDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	registry, err := lookupRegistry(ctx, conn, ref)
+	if err != nil {
+		return err
+	}
+	transfer, err := conn.TransferRegistry(ctx, registry.ID, toTenantID, time.Now().UTC().Add(registryTokenRevocationRetention))
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			return fmt.Errorf("tenant %s not found", toTenantID)
+		case errors.Is(err, db.ErrConflict):
+			return fmt.Errorf("registry %s already belongs to tenant %s", registry.Name, toTenantID)
+		}
+		return fmt.Errorf("could not transfer registry: %w", err)
+	}
+	recordOperatorAudit(ctx, conn, db.AuditEvent{
+		Action:       "operator.registry.transfer",
+		RegistryID:   &registry.ID,
+		RegistryName: registry.Name,
+		Target:       toTenantID.String(),
+	}, transfer.FromTenantID, toTenantID)
+	log.Printf("moved registry %s from tenant %s to %s; deleted %d api keys and moved %d storage bytes",
+		registry.Name, transfer.FromTenantID, toTenantID, transfer.RevokedAPIKeys, transfer.MovedStorageBytes)
+	return nil
+}
+
+// parseAdminUsageWorkerMetric parses a --metric flag, metric=min:max.
+func parseAdminUsageWorkerMetric(raw string) (db.UsageWorkerMetric, error) {
+	metric, bounds, ok := strings.Cut(strings.TrimSpace(raw), "=")
+	rawMin, rawMax, ok2 := strings.Cut(bounds, ":")
+	if !ok || !ok2 {
+		return db.UsageWorkerMetric{}, fmt.Errorf("--metric %q must be metric=min:max", raw)
+	}
+	m := db.UsageWorkerMetric{Metric: metric}
+	var err error
+	if m.MinValue, err = strconv.ParseInt(rawMin, 10, 64); err != nil {
+		return db.UsageWorkerMetric{}, fmt.Errorf("--metric %q has an invalid minimum", raw)
+	}
+	if m.MaxValue, err = strconv.ParseInt(rawMax, 10, 64); err != nil {
+		return db.UsageWorkerMetric{}, fmt.Errorf("--metric %q has an invalid maximum", raw)
+	}
+	if err := m.Validate(); err != nil {
+		return db.UsageWorkerMetric{}, err
+	}
+	return m, nil
+}
+
+// generateUsageWorkerSecret returns a new usage worker signing secret.
+func generateUsageWorkerSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "uwsec_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func runAdminUsageWorkersList(ctx context.Context) error {
+	conn, err := connectDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	workers, err := conn.ListUsageWorkers(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list usage workers: %w", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tMETRICS\tCREATED\tREVOKED")
+	for _, worker := range workers {
+		metrics := make([]string, 0, len(worker.Metrics))
+		for _, m := range worker.Metrics {
+			metrics = append(metrics, fmt.Sprintf("%s=%d:%d", m.Metric, m.MinValue, m.MaxValue))
+		}
+		revoked := "-"
+		if worker.RevokedAt != nil {
+			revoked = worker.RevokedAt.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", worker.ID, worker.Name, strings.Join(metrics, ","),
+			worker.CreatedAt.UTC().Format(time.RFC3339), revoked)
+	}
+	return w.Flush()
+}
+
+func runAdminUsageWorkersCreate(ctx context.Context, name string, rawMetrics []string) error {
+	worker := db.UsageWorker{ID: uuid.New(), Name: strings.TrimSpace(name)}
+	if worker.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	seen := map[string]bool{}
+	for _, raw := range rawMetrics {
+		m, err := parseAdminUsageWorkerMetric(raw)
+		if err != nil {
+			return err
+		}
+		if seen[m.Metric] {
+			return fmt.Errorf("metric %s is given twice", m.Metric)
+		}
+		seen[m.Metric] = true
+		worker.Metrics = append(worker.Metrics, m)
+	}
+	encKey, err := loadAPIKeyEncryptionKeyFromEnv()
+	if err != nil {
+		return err
+	}
+	secret, err := generateUsageWorkerSecret()
+	if err != nil {
+		return fmt.Errorf("could not generate usage worker secret: %w", err)
+	}
+	if worker.SecretEncrypted, err = apikey.Encrypt(secret, encKey); err != nil {
+		return fmt.Errorf("could not encrypt usage worker secret: %w", err)
+	}
+
+	conn, err := connectDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.CreateUsageWorker(ctx, worker); err != nil {
+		if errors.Is(err, db.ErrConflict) {
+			return fmt.Errorf("a usage worker named %s already exists", worker.Name)
+		}
+		return fmt.Errorf("could not create usage worker: %w", err)
+	}
+	recordOperatorAudit(ctx, conn, db.AuditEvent{Action: "operator.usage_worker.create", Target: worker.ID.String()})
+	fmt.Printf("USAGE_WORKER_ID: %s\n", worker.ID)
+	fmt.Printf("USAGE_WORKER_SECRET: %s\n", secret)
+	return nil
+}
+
+func runAdminUsageWorkersRevoke(ctx context.Context, rawID string) error {
+	id, err := uuid.Parse(strings.TrimSpace(rawID))
+	if err != nil {
+		return fmt.Errorf("invalid usage worker id %q", rawID)
+	}
+	conn, err := connectDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.RevokeUsageWorker(ctx, id); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("usage worker %s not found or already revoked", id)
+		}
+		return fmt.Errorf("could not revoke usage worker: %w", err)
+	}
+	recordOperatorAudit(ctx, conn, db.AuditEvent{Action: "operator.usage_worker.revoke", Target: id.String()})
+	log.Printf("revoked usage worker %s", id)
+	return nil
+}
+
+func runAdminKeysRevoke(ctx context.Context, rawID string) error {
+	keyID, err := uuid.Parse(strings.TrimSpace(rawID))
+	if err != nil {
+		return fmt.Errorf("invalid api key id %q", rawID)
+	}
+	conn, err := connectDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tenantID, err := conn.ForceRevokeAPIKey(ctx, keyID, time.Now().UTC().Add(registryTokenRevocationRetention))
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("api key %s not found", keyID)
+		}
+		return fmt.Errorf("could not revoke api key: %w", err)
+	}
+	if tenantID != uuid.Nil {
+		recordOperatorAudit(ctx, conn, db.AuditEvent{Action: "operator.api_key.revoke", Target: keyID.String()}, tenantID)
+	}
+	log.Printf("revoked api key %s", keyID)
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"bin2.io/internal/db"
+)
+
+func TestGenerateOperatorToken(t *testing.T) {
+	token, hashHex, err := generateOperatorToken()
+	if err != nil {
+		t.Fatalf("generateOperatorToken: %v", err)
+	}
+	if !strings.HasPrefix(token, "op_") {
+		t.Fatalf("token %q lacks op_ prefix", token)
+	}
+	sum := sha256.Sum256([]byte(token))
+	if hashHex != hex.EncodeToString(sum[:]) {
+		t.Fatalf("hash %q does not match token", hashHex)
+	}
+	other, _, err := generateOperatorToken()
+	if err != nil {
+		t.Fatalf("generateOperatorToken: %v", err)
+	}
+	if token == other {
+		t.Fatal("two generated tokens are equal")
+	}
+}
+
+func TestParseAdminUsageWorkerMetric(t *testing.T) {
+	m, err := parseAdminUsageWorkerMetric("pull-bytes=0:1099511627776")
+	if err != nil {
+		t.Fatalf("parseAdminUsageWorkerMetric: %v", err)
+	}
+	if m != (db.UsageWorkerMetric{Metric: db.MetricPullBytes, MinValue: 0, MaxValue: 1 << 40}) {
+		t.Fatalf("parsed %+v", m)
+	}
+	for _, raw := range []string{"pull-bytes", "pull-bytes=1", "pull-bytes=a:2", "pull-bytes=1:b", "pull-bytes=5:1", "egress=0:1"} {
+		if _, err := parseAdminUsageWorkerMetric(raw); err == nil {
+			t.Errorf("parseAdminUsageWorkerMetric(%q) succeeded", raw)
+		}
+	}
+}
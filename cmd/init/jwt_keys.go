@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"bin2.io/internal/apikey"
+	"bin2.io/internal/db"
+	"github.com/spf13/cobra"
+)
+
+// defaultJWTKeyPromoteDelay leaves time for every API replica to reload its
+// keyset (30s) and for JWKS consumers such as the pull worker to refresh
+// their cached copy (max-age 300s) before the new key signs anything.
+const defaultJWTKeyPromoteDelay = 10 * time.Minute
+
+func newJWTKeysCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "jwt-keys",
+		Short: "Manage registry token signing keys",
+	}
+
+	var promoteAfter time.Duration
+	rotateCmd := &cobra.Command{
+		Use:   "rotate",
+		Short: "Generate a new signing key, publish it now and promote it after a delay",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runJWTKeysRotate(cmd.Context(), promoteAfter)
+		},
+	}
+	rotateCmd.Flags().DurationVar(&promoteAfter, "promote-after", defaultJWTKeyPromoteDelay, "delay before the new key starts signing tokens")
+
+	promoteCmd := &cobra.Command{
+		Use:   "promote <kid>",
+		Short: "Make a published key the signing key immediately",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runJWTKeysPromote(cmd.Context(), args[0])
+		},
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List stored signing keys",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runJWTKeysList(cmd.Context())
+		},
+	}
+
+	cmd.AddCommand(rotateCmd, promoteCmd, listCmd)
+	return cmd
+}
+
+func runJWTKeysRotate(ctx context.Context, promoteAfter time.Duration) error {
+	if promoteAfter < 0 {
+		return fmt.Errorf("--promote-after must not be negative")
+	}
+	if promoteAfter < defaultJWTKeyPromoteDelay {
+		log.Printf("warning: promoting in %s may reject tokens at consumers that have not refreshed their JWKS", promoteAfter)
+	}
+
+	encKey, err := loadAPIKeyEncryptionKeyFromEnv()
+	if err != nil {
+		return err
+	}
+
+	conn, err := connectDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	kid, privatePEM, publicPEM, err := generateJWTKey()
+	if err != nil {
+		return fmt.Errorf("could not generate signing key: %w", err)
+	}
+	encrypted, err := apikey.Encrypt(privatePEM, encKey)
+	if err != nil {
+		return fmt.Errorf("could not encrypt signing key: %w", err)
+	}
+
+	key, err := conn.AddRegistryJWTKey(ctx, db.AddRegistryJWTKeyArgs{
+		KID:                 kid,
+		PrivateKeyEncrypted: encrypted,
+		PublicKeyPEM:        publicPEM,
+		ActivatesAt:         time.Now().UTC().Add(promoteAfter),
+	})
+	if err != nil {
+		return fmt.Errorf("could not store signing key: %w", err)
+	}
+
+	log.Printf("published registry jwt key %s; it will sign tokens from %s", key.KID, key.ActivatesAt.UTC().Format(time.RFC3339))
+	return nil
+}
+
+func runJWTKeysPromote(ctx context.Context, kid string) error {
+	conn, err := connectDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetRegistryJWTKeyActivatesAt(ctx, kid, time.Now().UTC()); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("registry jwt key %s not found", kid)
+		}
+		return fmt.Errorf("could not promote signing key: %w", err)
+	}
+	log.Printf("promoted registry jwt key %s", kid)
+	return nil
+}
+
+func runJWTKeysList(ctx context.Context) error {
+	conn, err := connectDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	keys, err := conn.ListRegistryJWTKeys(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list signing keys: %w", err)
+	}
+
+	now := time.Now().UTC()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KID\tCREATED\tACTIVATES\tSTATE")
+	for i, key := range keys {
+		state := "previous"
+		switch {
+		case key.ActivatesAt.After(now):
+			state = "pending"
+		case i == len(keys)-1 || keys[i+1].ActivatesAt.After(now):
+			state = "active"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			key.KID,
+			key.CreatedAt.UTC().Format(time.RFC3339),
+			key.ActivatesAt.UTC().Format(time.RFC3339),
+			state,
+		)
+	}
+	return w.Flush()
+}
+
+// generateJWTKey returns a new Ed25519 key as PKCS8/PKIX PEM along with its
+// kid, the base64url SHA-256 of the PKIX encoding (matching the API's JWKS).
+func generateJWTKey() (kid, privatePEM, publicPEM string, err error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return "", "", "", err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	sum := sha256.Sum256(publicDER)
+	kid = base64.RawURLEncoding.EncodeToString(sum[:])
+	privatePEM = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}))
+	publicPEM = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}))
+	return kid, privatePEM, publicPEM, nil
+}
+
+func connectDB(ctx context.Context) (*db.DB, error) {
+	cfg, err := db.NewConfigFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("could not read postgres configuration: %w", err)
+	}
+	conn, err := db.New(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to postgres: %w", err)
+	}
+	return conn, nil
+}
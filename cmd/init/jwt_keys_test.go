@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestGenerateJWTKey(t *testing.T) {
+	kid, privatePEM, publicPEM, err := generateJWTKey()
+	if err != nil {
+		t.Fatalf("generateJWTKey: %v", err)
+	}
+	if kid == "" || privatePEM == "" || publicPEM == "" {
+		t.Fatalf("unexpected empty output: kid=%q", kid)
+	}
+	otherKID, _, _, err := generateJWTKey()
+	if err != nil {
+		t.Fatalf("generateJWTKey: %v", err)
+	}
+	if kid == otherKID {
+		t.Fatalf("two generated keys share kid %q", kid)
+	}
+}
@@ -65,7 +65,7 @@ func newRootCmd() *cobra.Command {
 		},
 	}
 
-	cmd.AddCommand(migrateCmd, cleanCmd, seedE2ECmd)
+	cmd.AddCommand(migrateCmd, cleanCmd, seedE2ECmd, newJWTKeysCmd(), newAdminCmd())
 	return cmd
 }
 
@@ -55,7 +55,7 @@ func runSeedE2E(ctx context.Context) error {
 	}
 
 	if !user.Onboarded {
-		if err := conn.SetUserOnboarded(ctx, user.ID, true); err != nil {
+		if err := conn.SetOrgOnboarded(ctx, user.TenantID, true); err != nil {
 			return fmt.Errorf("could not mark seeded user onboarded: %w", err)
 		}
 	}
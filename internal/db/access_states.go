@@ -0,0 +1,94 @@
+package db
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+// AccessState is an operator-controlled restriction on a tenant or registry.
+type AccessState string
+
+const (
+	AccessStateActive    AccessState = "active"
+	AccessStateReadOnly  AccessState = "read_only"
+	AccessStateSuspended AccessState = "suspended"
+)
+
+var accessStateRank = map[AccessState]int{
+	AccessStateActive:    0,
+	AccessStateReadOnly:  1,
+	AccessStateSuspended: 2,
+}
+
+func ParseAccessState(raw string) (AccessState, bool) {
+	state := AccessState(raw)
+	_, ok := accessStateRank[state]
+	return state, ok
+}
+
+// Restrict returns the stricter of s and other.
+func (s AccessState) Restrict(other AccessState) AccessState {
+	if accessStateRank[other] > accessStateRank[s] {
+		return other
+	}
+	return s
+}
+
+// RegistryAccessState is the state in force for a registry: the stricter of
+// its own and its tenant's, with the reason given for it.
+type RegistryAccessState struct {
+	RegistryID uuid.UUID
+	TenantID   uuid.UUID
+	State      AccessState
+	Reason     string
+}
+
+func (d *DB) GetRegistryAccessState(ctx context.Context, name string) (RegistryAccessState, error) {
+	const cmd = `SELECT reg.id, reg.tenant_id, reg.state, reg.state_reason, t.state, t.state_reason
+		FROM registries reg
+		JOIN tenants t ON t.id = reg.tenant_id
+		WHERE reg.name = $1`
+	var out RegistryAccessState
+	var tenantState AccessState
+	var tenantReason string
+	if err := d.conn.QueryRow(ctx, cmd, name).Scan(&out.RegistryID, &out.TenantID, &out.State, &out.Reason, &tenantState, &tenantReason); err != nil {
+		if isNoRows(err) {
+			return RegistryAccessState{}, ErrNotFound
+		}
+		return RegistryAccessState{}, err
+	}
+	if tenantState.Restrict(out.State) != out.State {
+		out.State = tenantState
+		out.Reason = tenantReason
+	}
+	return out, nil
+}
+
+func (d *DB) SetTenantState(ctx context.Context, tenantID uuid.UUID, state AccessState, reason string) error {
+	const cmd = `UPDATE tenants
+		SET state = $2, state_reason = $3, state_changed_at = NOW()
+		WHERE id = $1`
+	tag, err := d.conn.Exec(ctx, cmd, tenantID, state, reason)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (d *DB) SetRegistryState(ctx context.Context, registryID uuid.UUID, state AccessState, reason string) error {
+	const cmd = `UPDATE registries
+		SET state = $2, state_reason = $3, state_changed_at = NOW()
+		WHERE id = $1`
+	tag, err := d.conn.Exec(ctx, cmd, registryID, state, reason)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
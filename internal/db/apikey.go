@@ -21,8 +21,11 @@ type APIKeyScope struct {
 	RegistryID   uuid.UUID
 	RepositoryID *uuid.UUID
 	Repository   *string
-	Permission   APIKeyPermission
-	CreatedAt    time.Time
+	// RepositoryPattern is a glob over repository paths; see
+	// api_key_scopes.repository_pattern.
+	RepositoryPattern *string
+	Permission        APIKeyPermission
+	CreatedAt         time.Time
 }
 
 type APIKey struct {
@@ -33,13 +36,15 @@ type APIKey struct {
 	SecretEncrypted string
 	CreatedAt       time.Time
 	LastUsedAt      *time.Time
+	AllowedCIDRs    []string
 	Scopes          []APIKeyScope
 }
 
 type AddAPIKeyScopeInput struct {
-	RegistryID   uuid.UUID
-	RepositoryID *uuid.UUID
-	Permission   APIKeyPermission
+	RegistryID        uuid.UUID
+	RepositoryID      *uuid.UUID
+	RepositoryPattern *string
+	Permission        APIKeyPermission
 }
 
 type AddAPIKeyArgs struct {
@@ -47,6 +52,7 @@ type AddAPIKeyArgs struct {
 	KeyName         string
 	SecretEncrypted string
 	Prefix          string
+	AllowedCIDRs    []string
 	Scopes          []AddAPIKeyScopeInput
 }
 
@@ -63,11 +69,16 @@ func (d *DB) AddAPIKey(ctx context.Context, args AddAPIKeyArgs) (APIKey, error)
 		KeyName:         args.KeyName,
 		Prefix:          args.Prefix,
 		SecretEncrypted: args.SecretEncrypted,
+		AllowedCIDRs:    args.AllowedCIDRs,
 		Scopes:          make([]APIKeyScope, 0, len(args.Scopes)),
 	}
 
-	const insertKeyCmd = `INSERT INTO api_keys (id, user_id, name, secret_encrypted, prefix)
-		VALUES ($1, $2, $3, $4, $5)
+	if apiKey.AllowedCIDRs == nil {
+		apiKey.AllowedCIDRs = []string{}
+	}
+
+	const insertKeyCmd = `INSERT INTO api_keys (id, user_id, name, secret_encrypted, prefix, allowed_cidrs)
+		VALUES ($1, $2, $3, $4, $5, $6)
 		RETURNING created_at`
 	err = tx.QueryRow(
 		ctx,
@@ -77,6 +88,7 @@ func (d *DB) AddAPIKey(ctx context.Context, args AddAPIKeyArgs) (APIKey, error)
 		apiKey.KeyName,
 		apiKey.SecretEncrypted,
 		apiKey.Prefix,
+		apiKey.AllowedCIDRs,
 	).Scan(&apiKey.CreatedAt)
 	if err != nil {
 		if isUniqueViolation(err) {
@@ -85,16 +97,17 @@ func (d *DB) AddAPIKey(ctx context.Context, args AddAPIKeyArgs) (APIKey, error)
 		return APIKey{}, err
 	}
 
-	const insertScopeCmd = `INSERT INTO api_key_scopes (id, api_key_id, registry_id, repository_id, permission)
-		VALUES ($1, $2, $3, $4, $5)
+	const insertScopeCmd = `INSERT INTO api_key_scopes (id, api_key_id, registry_id, repository_id, repository_pattern, permission)
+		VALUES ($1, $2, $3, $4, $5, $6)
 		RETURNING created_at`
 	for _, scope := range args.Scopes {
 		apiKeyScope := APIKeyScope{
-			ID:           uuid.New(),
-			APIKeyID:     apiKey.ID,
-			RegistryID:   scope.RegistryID,
-			RepositoryID: scope.RepositoryID,
-			Permission:   scope.Permission,
+			ID:                uuid.New(),
+			APIKeyID:          apiKey.ID,
+			RegistryID:        scope.RegistryID,
+			RepositoryID:      scope.RepositoryID,
+			RepositoryPattern: scope.RepositoryPattern,
+			Permission:        scope.Permission,
 		}
 		err = tx.QueryRow(
 			ctx,
@@ -103,6 +116,7 @@ func (d *DB) AddAPIKey(ctx context.Context, args AddAPIKeyArgs) (APIKey, error)
 			apiKeyScope.APIKeyID,
 			apiKeyScope.RegistryID,
 			apiKeyScope.RepositoryID,
+			apiKeyScope.RepositoryPattern,
 			apiKeyScope.Permission,
 		).Scan(&apiKeyScope.CreatedAt)
 		if err != nil {
@@ -127,11 +141,37 @@ func (d *DB) AddAPIKey(ctx context.Context, args AddAPIKeyArgs) (APIKey, error)
 }
 
 func (d *DB) ListAPIKeysByUser(ctx context.Context, userID uuid.UUID) ([]APIKey, error) {
-	const cmd = `SELECT id, user_id, name, secret_encrypted, prefix, created_at, last_used_at
+	const cmd = `SELECT id, user_id, name, secret_encrypted, prefix, created_at, last_used_at, allowed_cidrs
 		FROM api_keys
 		WHERE user_id = $1
 		ORDER BY created_at DESC`
-	rows, err := d.conn.Query(ctx, cmd, userID)
+	return d.listAPIKeys(ctx, cmd, userID)
+}
+
+// apiKeyInOrgCond limits api_keys to keys scoped to any of the registries of
+// the organization $3, as ListAPIKeysByUserInOrg does.
+const apiKeyInOrgCond = `id IN (
+		SELECT s.api_key_id FROM api_key_scopes s
+		JOIN registries r ON r.id = s.registry_id
+		WHERE r.tenant_id = $3
+	)`
+
+// ListAPIKeysByUserInOrg lists the user's keys scoped to any of the
+// organization's registries.
+func (d *DB) ListAPIKeysByUserInOrg(ctx context.Context, userID, orgID uuid.UUID) ([]APIKey, error) {
+	const cmd = `SELECT id, user_id, name, secret_encrypted, prefix, created_at, last_used_at, allowed_cidrs
+		FROM api_keys
+		WHERE user_id = $1 AND id IN (
+			SELECT s.api_key_id FROM api_key_scopes s
+			JOIN registries r ON r.id = s.registry_id
+			WHERE r.tenant_id = $2
+		)
+		ORDER BY created_at DESC`
+	return d.listAPIKeys(ctx, cmd, userID, orgID)
+}
+
+func (d *DB) listAPIKeys(ctx context.Context, cmd string, args ...any) ([]APIKey, error) {
+	rows, err := d.conn.Query(ctx, cmd, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -148,6 +188,7 @@ func (d *DB) ListAPIKeysByUser(ctx context.Context, userID uuid.UUID) ([]APIKey,
 			&key.Prefix,
 			&key.CreatedAt,
 			&key.LastUsedAt,
+			&key.AllowedCIDRs,
 		); err != nil {
 			return nil, err
 		}
@@ -164,7 +205,7 @@ func (d *DB) ListAPIKeysByUser(ctx context.Context, userID uuid.UUID) ([]APIKey,
 }
 
 func (d *DB) GetAPIKeyByPrefix(ctx context.Context, prefix string) (APIKey, error) {
-	const cmd = `SELECT id, user_id, name, secret_encrypted, prefix, created_at, last_used_at
+	const cmd = `SELECT id, user_id, name, secret_encrypted, prefix, created_at, last_used_at, allowed_cidrs
 		FROM api_keys
 		WHERE prefix = $1`
 	var apiKey APIKey
@@ -176,6 +217,31 @@ func (d *DB) GetAPIKeyByPrefix(ctx context.Context, prefix string) (APIKey, erro
 		&apiKey.Prefix,
 		&apiKey.CreatedAt,
 		&apiKey.LastUsedAt,
+		&apiKey.AllowedCIDRs,
+	)
+	if err != nil {
+		if isNoRows(err) {
+			return APIKey{}, ErrNotFound
+		}
+		return APIKey{}, err
+	}
+	return apiKey, nil
+}
+
+func (d *DB) GetAPIKeyByID(ctx context.Context, id uuid.UUID) (APIKey, error) {
+	const cmd = `SELECT id, user_id, name, secret_encrypted, prefix, created_at, last_used_at, allowed_cidrs
+		FROM api_keys
+		WHERE id = $1`
+	var apiKey APIKey
+	err := d.conn.QueryRow(ctx, cmd, id).Scan(
+		&apiKey.ID,
+		&apiKey.UserID,
+		&apiKey.KeyName,
+		&apiKey.SecretEncrypted,
+		&apiKey.Prefix,
+		&apiKey.CreatedAt,
+		&apiKey.LastUsedAt,
+		&apiKey.AllowedCIDRs,
 	)
 	if err != nil {
 		if isNoRows(err) {
@@ -187,7 +253,7 @@ func (d *DB) GetAPIKeyByPrefix(ctx context.Context, prefix string) (APIKey, erro
 }
 
 func (d *DB) ListAPIKeyScopesByAPIKeyID(ctx context.Context, apiKeyID uuid.UUID) ([]APIKeyScope, error) {
-	const cmd = `SELECT s.id, s.api_key_id, s.registry_id, s.repository_id, rr.name, s.permission, s.created_at
+	const cmd = `SELECT s.id, s.api_key_id, s.registry_id, s.repository_id, rr.name, s.repository_pattern, s.permission, s.created_at
 		FROM api_key_scopes s
 		LEFT JOIN repositories rr
 		  ON rr.id = s.repository_id
@@ -208,6 +274,7 @@ func (d *DB) ListAPIKeyScopesByAPIKeyID(ctx context.Context, apiKeyID uuid.UUID)
 			&scope.RegistryID,
 			&scope.RepositoryID,
 			&scope.Repository,
+			&scope.RepositoryPattern,
 			&scope.Permission,
 			&scope.CreatedAt,
 		); err != nil {
@@ -233,6 +300,20 @@ func (d *DB) RemoveAPIKey(ctx context.Context, userID, id uuid.UUID) error {
 	return nil
 }
 
+// SetAPIKeyAllowedCIDRs replaces the allowlist of a key the user owns in the
+// organization.
+func (d *DB) SetAPIKeyAllowedCIDRs(ctx context.Context, userID, orgID, id uuid.UUID, cidrs []string) error {
+	const cmd = `UPDATE api_keys SET allowed_cidrs = $4 WHERE user_id = $1 AND id = $2 AND ` + apiKeyInOrgCond
+	tag, err := d.conn.Exec(ctx, cmd, userID, id, orgID, cidrs)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
 func (d *DB) UpdateAPIKeyLastUsedAt(ctx context.Context, id uuid.UUID) (time.Time, error) {
 	var lastUsedAt time.Time
 	const cmd = `UPDATE api_keys
@@ -0,0 +1,209 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	AuditActorUser      = "user"
+	AuditActorAPIKey    = "api_key"
+	AuditActorAnonymous = "anonymous"
+	AuditActorOperator  = "operator"
+
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeDenied  = "denied"
+	AuditOutcomeFailure = "failure"
+)
+
+type AuditEvent struct {
+	ID           uuid.UUID
+	OccurredAt   time.Time
+	TenantID     *uuid.UUID
+	ActorType    string
+	ActorID      *uuid.UUID
+	ActorName    string
+	Action       string
+	RegistryID   *uuid.UUID
+	RegistryName string
+	Repository   string
+	Reference    string
+	Digest       string
+	Target       string
+	ClientIP     string
+	UserAgent    string
+	Outcome      string
+	StatusCode   int
+}
+
+// AuditEventFilter selects a tenant's audit events. Zero-valued fields do not
+// filter. Before, when set, resumes a newest-first listing after the event
+// identified by (BeforeTime, BeforeID).
+type AuditEventFilter struct {
+	TenantID   uuid.UUID
+	ActorType  string
+	ActorID    *uuid.UUID
+	Action     string
+	RegistryID *uuid.UUID
+	Repository string
+	Outcome    string
+	From       time.Time
+	To         time.Time
+	BeforeTime time.Time
+	BeforeID   uuid.UUID
+}
+
+const insertAuditEventCmd = `INSERT INTO audit_events (
+		id, tenant_id, actor_type, actor_id, actor_name, action, registry_id, registry_name,
+		repository, reference, digest, target, client_ip, user_agent, outcome, status_code, occurred_at
+	) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, COALESCE($17, NOW()))`
+
+// insertAuditEventArgs returns the arguments of insertAuditEventCmd. Events
+// without OccurredAt happen now.
+func insertAuditEventArgs(e AuditEvent) []any {
+	var occurredAt *time.Time
+	if !e.OccurredAt.IsZero() {
+		occurredAt = &e.OccurredAt
+	}
+	return []any{
+		e.ID, e.TenantID, e.ActorType, e.ActorID, e.ActorName, e.Action, e.RegistryID, e.RegistryName,
+		e.Repository, e.Reference, e.Digest, e.Target, e.ClientIP, e.UserAgent, e.Outcome, e.StatusCode, occurredAt,
+	}
+}
+
+func (d *DB) InsertAuditEvent(ctx context.Context, e AuditEvent) error {
+	_, err := d.conn.Exec(ctx, insertAuditEventCmd, insertAuditEventArgs(e)...)
+	return err
+}
+
+// InsertAuditEvents stores events in one round trip.
+func (d *DB) InsertAuditEvents(ctx context.Context, events []AuditEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	batch := &pgx.Batch{}
+	for _, e := range events {
+		batch.Queue(insertAuditEventCmd, insertAuditEventArgs(e)...)
+	}
+	return d.conn.SendBatch(ctx, batch).Close()
+}
+
+// ListAuditEvents returns up to limit events matching the filter, newest first.
+func (d *DB) ListAuditEvents(ctx context.Context, filter AuditEventFilter, limit int) ([]AuditEvent, error) {
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	where, args := auditEventWhere(filter)
+	if !filter.BeforeTime.IsZero() {
+		args = append(args, filter.BeforeTime, filter.BeforeID)
+		where = append(where, fmt.Sprintf("(occurred_at, id) < ($%d, $%d)", len(args)-1, len(args)))
+	}
+	args = append(args, limit)
+
+	query := auditEventSelect + `
+		WHERE ` + strings.Join(where, " AND ") + `
+		ORDER BY occurred_at DESC, id DESC
+		LIMIT $` + fmt.Sprintf("%d", len(args))
+
+	events := make([]AuditEvent, 0)
+	err := d.queryAuditEvents(ctx, query, args, func(e AuditEvent) error {
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// StreamAuditEvents calls fn for every event matching the filter, oldest
+// first, without buffering the result set.
+func (d *DB) StreamAuditEvents(ctx context.Context, filter AuditEventFilter, fn func(AuditEvent) error) error {
+	where, args := auditEventWhere(filter)
+	query := auditEventSelect + `
+		WHERE ` + strings.Join(where, " AND ") + `
+		ORDER BY occurred_at ASC, id ASC`
+	return d.queryAuditEvents(ctx, query, args, fn)
+}
+
+const auditEventSelect = `SELECT id, occurred_at, tenant_id, actor_type, actor_id, actor_name, action, registry_id,
+		registry_name, repository, reference, digest, target, client_ip, user_agent, outcome, status_code
+		FROM audit_events`
+
+func auditEventWhere(filter AuditEventFilter) ([]string, []any) {
+	args := []any{filter.TenantID}
+	where := []string{"tenant_id = $1"}
+
+	add := func(clause string, value any) {
+		args = append(args, value)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+	if filter.ActorType != "" {
+		add("actor_type = $%d", filter.ActorType)
+	}
+	if filter.ActorID != nil {
+		add("actor_id = $%d", *filter.ActorID)
+	}
+	if filter.Action != "" {
+		add("action = $%d", filter.Action)
+	}
+	if filter.RegistryID != nil {
+		add("registry_id = $%d", *filter.RegistryID)
+	}
+	if filter.Repository != "" {
+		add("repository = $%d", filter.Repository)
+	}
+	if filter.Outcome != "" {
+		add("outcome = $%d", filter.Outcome)
+	}
+	if !filter.From.IsZero() {
+		add("occurred_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		add("occurred_at < $%d", filter.To)
+	}
+	return where, args
+}
+
+func (d *DB) queryAuditEvents(ctx context.Context, query string, args []any, fn func(AuditEvent) error) error {
+	rows, err := d.conn.Query(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e AuditEvent
+		if err := rows.Scan(
+			&e.ID,
+			&e.OccurredAt,
+			&e.TenantID,
+			&e.ActorType,
+			&e.ActorID,
+			&e.ActorName,
+			&e.Action,
+			&e.RegistryID,
+			&e.RegistryName,
+			&e.Repository,
+			&e.Reference,
+			&e.Digest,
+			&e.Target,
+			&e.ClientIP,
+			&e.UserAgent,
+			&e.Outcome,
+			&e.StatusCode,
+		); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,234 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Invoice is a tenant's frozen usage and charges for a closed calendar month.
+// Decimal amounts are kept as the strings they were issued with.
+type Invoice struct {
+	ID                  uuid.UUID
+	TenantID            uuid.UUID
+	PeriodStart         time.Time
+	PeriodEnd           time.Time
+	Currency            string
+	PushOpCount         int64
+	PullOpCount         int64
+	PullBytes           int64
+	StorageOpeningBytes int64
+	StorageClosingBytes int64
+	StorageByteSeconds  string
+	StorageGiBMonths    string
+	TotalUSD            string
+	CreatedAt           time.Time
+	Lines               []InvoiceLine
+}
+
+// InvoiceLine is one charge or credit on an invoice, for the part of the
+// period between PeriodStart and PeriodEnd that was on Plan.
+type InvoiceLine struct {
+	PeriodStart  time.Time
+	PeriodEnd    time.Time
+	Plan         string
+	Kind         string
+	Description  string
+	Quantity     string
+	Unit         string
+	UnitPriceUSD string
+	AmountUSD    string
+}
+
+// GetInvoicedThrough returns the first month that has not been invoiced.
+func (d *DB) GetInvoicedThrough(ctx context.Context) (time.Time, error) {
+	const cmd = `SELECT invoiced_through FROM invoicing_state`
+	var month time.Time
+	if err := d.conn.QueryRow(ctx, cmd).Scan(&month); err != nil {
+		return time.Time{}, err
+	}
+	return utcDay(month), nil
+}
+
+// AdvanceInvoicedThrough marks the month starting at month as invoiced. It
+// does nothing if another replica already did.
+func (d *DB) AdvanceInvoicedThrough(ctx context.Context, month time.Time) error {
+	const cmd = `UPDATE invoicing_state SET invoiced_through = $2::DATE
+		WHERE invoiced_through = $1::DATE`
+	_, err := d.conn.Exec(ctx, cmd, month, month.AddDate(0, 1, 0))
+	return err
+}
+
+// ListTenantsToInvoice returns the tenants that existed before periodEnd and
+// have no invoice for the period starting at periodStart.
+func (d *DB) ListTenantsToInvoice(ctx context.Context, periodStart, periodEnd time.Time) ([]uuid.UUID, error) {
+	const cmd = `SELECT t.id FROM tenants t
+		WHERE COALESCE(t.created_at, '-infinity') < $2
+		  AND NOT EXISTS (
+			SELECT 1 FROM invoices i WHERE i.tenant_id = t.id AND i.period_start = $1
+		  )
+		ORDER BY t.id`
+	rows, err := d.conn.Query(ctx, cmd, periodStart, periodEnd)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+}
+
+// InvoiceFailure is a tenant whose invoice for the month starting at
+// PeriodStart could not be issued yet.
+type InvoiceFailure struct {
+	TenantID      uuid.UUID
+	PeriodStart   time.Time
+	Attempts      int
+	LastError     string
+	FirstFailedAt time.Time
+	LastFailedAt  time.Time
+}
+
+// RecordInvoiceFailure records that the tenant's invoice for the period
+// starting at periodStart failed with message, counting the attempt.
+func (d *DB) RecordInvoiceFailure(ctx context.Context, tenantID uuid.UUID, periodStart time.Time, message string) error {
+	const cmd = `INSERT INTO invoice_failures (tenant_id, period_start, last_error)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (tenant_id, period_start) DO UPDATE SET
+			attempts = invoice_failures.attempts + 1,
+			last_error = EXCLUDED.last_error,
+			last_failed_at = NOW()`
+	_, err := d.conn.Exec(ctx, cmd, tenantID, periodStart, message)
+	return err
+}
+
+// ListInvoiceFailures returns the failures last attempted before
+// failedBefore, oldest period first.
+func (d *DB) ListInvoiceFailures(ctx context.Context, failedBefore time.Time) ([]InvoiceFailure, error) {
+	const cmd = `SELECT tenant_id, period_start, attempts, last_error, first_failed_at, last_failed_at
+		FROM invoice_failures
+		WHERE last_failed_at < $1
+		ORDER BY period_start ASC, tenant_id ASC`
+	rows, err := d.conn.Query(ctx, cmd, failedBefore)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (InvoiceFailure, error) {
+		var f InvoiceFailure
+		err := row.Scan(&f.TenantID, &f.PeriodStart, &f.Attempts, &f.LastError, &f.FirstFailedAt, &f.LastFailedAt)
+		f.PeriodStart = f.PeriodStart.UTC()
+		return f, err
+	})
+}
+
+// InsertInvoice stores inv and its lines, reporting false if the tenant
+// already has an invoice for the period. Either way any failure recorded for
+// the tenant and period is cleared.
+func (d *DB) InsertInvoice(ctx context.Context, inv Invoice) (bool, error) {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	const clearFailureCmd = `DELETE FROM invoice_failures WHERE tenant_id = $1 AND period_start = $2`
+	if _, err := tx.Exec(ctx, clearFailureCmd, inv.TenantID, inv.PeriodStart); err != nil {
+		return false, err
+	}
+
+	const invoiceCmd = `INSERT INTO invoices (
+			id, tenant_id, period_start, period_end, currency,
+			push_op_count, pull_op_count, pull_bytes, storage_opening_bytes, storage_closing_bytes,
+			storage_byte_seconds, storage_gib_months, total_usd
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11::NUMERIC, $12::NUMERIC, $13::NUMERIC)
+		ON CONFLICT (tenant_id, period_start) DO NOTHING`
+	tag, err := tx.Exec(ctx, invoiceCmd,
+		inv.ID, inv.TenantID, inv.PeriodStart, inv.PeriodEnd, inv.Currency,
+		inv.PushOpCount, inv.PullOpCount, inv.PullBytes, inv.StorageOpeningBytes, inv.StorageClosingBytes,
+		inv.StorageByteSeconds, inv.StorageGiBMonths, inv.TotalUSD,
+	)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return false, tx.Commit(ctx)
+	}
+
+	const lineCmd = `INSERT INTO invoice_line_items (
+			invoice_id, position, period_start, period_end, plan, kind, description,
+			quantity, unit, unit_price_usd, amount_usd
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8::NUMERIC, $9, $10::NUMERIC, $11::NUMERIC)`
+	for i, l := range inv.Lines {
+		if _, err := tx.Exec(ctx, lineCmd,
+			inv.ID, i, l.PeriodStart, l.PeriodEnd, l.Plan, l.Kind, l.Description,
+			l.Quantity, l.Unit, l.UnitPriceUSD, l.AmountUSD,
+		); err != nil {
+			return false, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+const invoiceSelect = `SELECT id, tenant_id, period_start, period_end, currency,
+		push_op_count, pull_op_count, pull_bytes, storage_opening_bytes, storage_closing_bytes,
+		storage_byte_seconds::TEXT, storage_gib_months::TEXT, total_usd::TEXT, created_at
+	FROM invoices`
+
+func scanInvoice(row pgx.Row) (Invoice, error) {
+	var inv Invoice
+	err := row.Scan(
+		&inv.ID, &inv.TenantID, &inv.PeriodStart, &inv.PeriodEnd, &inv.Currency,
+		&inv.PushOpCount, &inv.PullOpCount, &inv.PullBytes, &inv.StorageOpeningBytes, &inv.StorageClosingBytes,
+		&inv.StorageByteSeconds, &inv.StorageGiBMonths, &inv.TotalUSD, &inv.CreatedAt,
+	)
+	inv.PeriodStart = inv.PeriodStart.UTC()
+	inv.PeriodEnd = inv.PeriodEnd.UTC()
+	return inv, err
+}
+
+// ListInvoicesByTenant returns the tenant's invoices without their lines,
+// newest period first.
+func (d *DB) ListInvoicesByTenant(ctx context.Context, tenantID uuid.UUID) ([]Invoice, error) {
+	rows, err := d.conn.Query(ctx, invoiceSelect+` WHERE tenant_id = $1 ORDER BY period_start DESC`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Invoice, error) {
+		return scanInvoice(row)
+	})
+}
+
+// GetInvoice returns one of the tenant's invoices with its lines, or
+// ErrNotFound.
+func (d *DB) GetInvoice(ctx context.Context, tenantID, id uuid.UUID) (Invoice, error) {
+	inv, err := scanInvoice(d.conn.QueryRow(ctx, invoiceSelect+` WHERE tenant_id = $1 AND id = $2`, tenantID, id))
+	if err != nil {
+		if isNoRows(err) {
+			return Invoice{}, ErrNotFound
+		}
+		return Invoice{}, err
+	}
+
+	const linesCmd = `SELECT period_start, period_end, plan, kind, description,
+			quantity::TEXT, unit, unit_price_usd::TEXT, amount_usd::TEXT
+		FROM invoice_line_items
+		WHERE invoice_id = $1
+		ORDER BY position ASC`
+	rows, err := d.conn.Query(ctx, linesCmd, id)
+	if err != nil {
+		return Invoice{}, err
+	}
+	inv.Lines, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (InvoiceLine, error) {
+		var l InvoiceLine
+		err := row.Scan(&l.PeriodStart, &l.PeriodEnd, &l.Plan, &l.Kind, &l.Description, &l.Quantity, &l.Unit, &l.UnitPriceUSD, &l.AmountUSD)
+		l.PeriodStart = l.PeriodStart.UTC()
+		l.PeriodEnd = l.PeriodEnd.UTC()
+		return l, err
+	})
+	if err != nil {
+		return Invoice{}, err
+	}
+	return inv, nil
+}
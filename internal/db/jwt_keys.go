@@ -0,0 +1,85 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+type RegistryJWTKey struct {
+	KID                 string
+	PrivateKeyEncrypted string
+	PublicKeyPEM        string
+	CreatedAt           time.Time
+	ActivatesAt         time.Time
+}
+
+type AddRegistryJWTKeyArgs struct {
+	KID                 string
+	PrivateKeyEncrypted string
+	PublicKeyPEM        string
+	ActivatesAt         time.Time
+}
+
+func (d *DB) AddRegistryJWTKey(ctx context.Context, args AddRegistryJWTKeyArgs) (RegistryJWTKey, error) {
+	key := RegistryJWTKey{
+		KID:                 args.KID,
+		PrivateKeyEncrypted: args.PrivateKeyEncrypted,
+		PublicKeyPEM:        args.PublicKeyPEM,
+		ActivatesAt:         args.ActivatesAt,
+	}
+
+	const cmd = `INSERT INTO registry_jwt_keys (kid, private_key_encrypted, public_key_pem, activates_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING created_at`
+	err := d.conn.QueryRow(ctx, cmd, key.KID, key.PrivateKeyEncrypted, key.PublicKeyPEM, key.ActivatesAt).Scan(&key.CreatedAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return RegistryJWTKey{}, ErrConflict
+		}
+		return RegistryJWTKey{}, err
+	}
+	return key, nil
+}
+
+// ListRegistryJWTKeys returns every stored key ordered by activation time.
+func (d *DB) ListRegistryJWTKeys(ctx context.Context) ([]RegistryJWTKey, error) {
+	const cmd = `SELECT kid, private_key_encrypted, public_key_pem, created_at, activates_at
+		FROM registry_jwt_keys
+		ORDER BY activates_at ASC, created_at ASC`
+	rows, err := d.conn.Query(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]RegistryJWTKey, 0)
+	for rows.Next() {
+		var key RegistryJWTKey
+		if err := rows.Scan(
+			&key.KID,
+			&key.PrivateKeyEncrypted,
+			&key.PublicKeyPEM,
+			&key.CreatedAt,
+			&key.ActivatesAt,
+		); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (d *DB) SetRegistryJWTKeyActivatesAt(ctx context.Context, kid string, activatesAt time.Time) error {
+	const cmd = `UPDATE registry_jwt_keys SET activates_at = $2 WHERE kid = $1`
+	tag, err := d.conn.Exec(ctx, cmd, kid, activatesAt)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+-- storage quotas: soft and hard limits on stored bytes for a tenant, a
+-- registry or a repository. Usage counts each distinct object once per scope.
+-- Tenants without their own row take their plan's limits from
+-- plan_storage_quotas.
+CREATE TABLE storage_quotas (
+  id UUID PRIMARY KEY,
+  tenant_id UUID NOT NULL
+    REFERENCES tenants(id) ON DELETE CASCADE,
+  registry_id UUID
+    REFERENCES registries(id) ON DELETE CASCADE,
+  repository_id UUID
+    REFERENCES repositories(id) ON DELETE CASCADE,
+  soft_limit_bytes BIGINT CHECK (soft_limit_bytes > 0),
+  hard_limit_bytes BIGINT CHECK (hard_limit_bytes > 0),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  CHECK (soft_limit_bytes IS NOT NULL OR hard_limit_bytes IS NOT NULL),
+  CHECK (soft_limit_bytes IS NULL OR hard_limit_bytes IS NULL OR soft_limit_bytes <= hard_limit_bytes),
+  CHECK (repository_id IS NULL OR registry_id IS NOT NULL)
+);
+CREATE UNIQUE INDEX unique_storage_quota_tenant
+  ON storage_quotas (tenant_id)
+  WHERE registry_id IS NULL;
+CREATE UNIQUE INDEX unique_storage_quota_registry
+  ON storage_quotas (registry_id)
+  WHERE registry_id IS NOT NULL AND repository_id IS NULL;
+CREATE UNIQUE INDEX unique_storage_quota_repository
+  ON storage_quotas (repository_id)
+  WHERE repository_id IS NOT NULL;
+
+CREATE TABLE plan_storage_quotas (
+  plan TEXT PRIMARY KEY,
+  soft_limit_bytes BIGINT CHECK (soft_limit_bytes > 0),
+  hard_limit_bytes BIGINT CHECK (hard_limit_bytes > 0),
+  CHECK (soft_limit_bytes IS NOT NULL OR hard_limit_bytes IS NOT NULL),
+  CHECK (soft_limit_bytes IS NULL OR hard_limit_bytes IS NULL OR soft_limit_bytes <= hard_limit_bytes)
+);
+
+-- storage_quota_breaches records soft limits being exceeded. A scope has at
+-- most one open breach, resolved once its usage falls back under the limit;
+-- notified_at is set once the tenant has been told.
+CREATE TABLE storage_quota_breaches (
+  id UUID PRIMARY KEY,
+  tenant_id UUID NOT NULL
+    REFERENCES tenants(id) ON DELETE CASCADE,
+  scope TEXT NOT NULL CHECK (scope IN ('tenant', 'registry', 'repository')),
+  scope_id UUID NOT NULL,
+  limit_bytes BIGINT NOT NULL,
+  used_bytes BIGINT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  resolved_at TIMESTAMPTZ,
+  notified_at TIMESTAMPTZ
+);
+CREATE UNIQUE INDEX unique_open_storage_quota_breach
+  ON storage_quota_breaches (scope, scope_id)
+  WHERE resolved_at IS NULL;
+CREATE INDEX idx_storage_quota_breaches_tenant
+  ON storage_quota_breaches (tenant_id, created_at);
+CREATE INDEX idx_storage_quota_breaches_unnotified
+  ON storage_quota_breaches (created_at)
+  WHERE notified_at IS NULL;
@@ -0,0 +1,16 @@
+-- access states: operators can put a tenant or a registry into read_only
+-- (pulls only) or suspended (no registry access; a suspended tenant keeps
+-- only billing on the management API). A registry is as restricted as the
+-- stricter of its own and its tenant's state. state_reason is shown to
+-- clients that are refused.
+CREATE TYPE access_state AS ENUM ('active', 'read_only', 'suspended');
+
+ALTER TABLE tenants
+  ADD COLUMN state access_state NOT NULL DEFAULT 'active',
+  ADD COLUMN state_reason TEXT NOT NULL DEFAULT '',
+  ADD COLUMN state_changed_at TIMESTAMPTZ;
+
+ALTER TABLE registries
+  ADD COLUMN state access_state NOT NULL DEFAULT 'active',
+  ADD COLUMN state_reason TEXT NOT NULL DEFAULT '',
+  ADD COLUMN state_changed_at TIMESTAMPTZ;
@@ -0,0 +1,8 @@
+-- operator audit: cross-tenant actions taken through the operator admin API
+-- are recorded in the affected tenant's audit trail. Operators have no row of
+-- their own, so they are identified by the name their token is configured
+-- under.
+ALTER TABLE audit_events DROP CONSTRAINT audit_events_actor_type_check;
+ALTER TABLE audit_events ADD CONSTRAINT audit_events_actor_type_check
+  CHECK (actor_type IN ('user', 'api_key', 'anonymous', 'operator'));
+ALTER TABLE audit_events ADD COLUMN actor_name TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,39 @@
+-- usage rollups: usage_events aggregated into closed UTC days so summaries
+-- read one row per registry, repository, metric and day instead of every
+-- event. day_end_weight is SUM(value * microseconds from the event to the end
+-- of its day); with the opening balance it gives a day's exact storage
+-- byte-seconds. Like audit_events, rollups carry no foreign keys so they
+-- outlive the registries they describe.
+CREATE TABLE usage_daily_rollups (
+  tenant_id UUID NOT NULL,
+  registry_id UUID,
+  repo_id UUID,
+  day DATE NOT NULL,
+  metric TEXT NOT NULL,
+  value BIGINT NOT NULL,
+  event_count BIGINT NOT NULL,
+  day_end_weight NUMERIC NOT NULL
+);
+CREATE UNIQUE INDEX unique_usage_daily_rollups
+  ON usage_daily_rollups (tenant_id, day, metric, registry_id, repo_id) NULLS NOT DISTINCT;
+
+-- usage_storage_checkpoints holds each tenant's storage balance at the end
+-- of every rolled-up day on which it changed.
+CREATE TABLE usage_storage_checkpoints (
+  tenant_id UUID NOT NULL,
+  day DATE NOT NULL,
+  closing_bytes BIGINT NOT NULL,
+  PRIMARY KEY (tenant_id, day)
+);
+
+-- usage_rollup_state records the first day not yet rolled up. Every day
+-- before it is closed: later summaries read its rollups, not its events.
+CREATE TABLE usage_rollup_state (
+  singleton BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (singleton),
+  rolled_through DATE NOT NULL
+);
+INSERT INTO usage_rollup_state (rolled_through)
+SELECT COALESCE(MIN(created_at AT TIME ZONE 'UTC')::DATE, (NOW() AT TIME ZONE 'UTC')::DATE)
+FROM usage_events;
+
+CREATE INDEX idx_usage_events_created_at ON usage_events (created_at);
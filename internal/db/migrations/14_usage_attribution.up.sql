@@ -0,0 +1,12 @@
+-- usage attribution: usage_events charge their registry and repository, and
+-- chargeback must keep that attribution after either is deleted. Like
+-- usage_daily_rollups, the events stop referencing registries and
+-- repositories so deleting one no longer rewrites its history to NULL.
+ALTER TABLE usage_events DROP CONSTRAINT IF EXISTS usage_events_registry_id_fkey;
+ALTER TABLE usage_events DROP CONSTRAINT IF EXISTS usage_events_repo_id_fkey;
+
+-- Negative storage-bytes events are charged where the blob's positive event
+-- was; this finds that event by digest.
+CREATE INDEX idx_usage_events_storage_digest
+  ON usage_events (digest, created_at)
+  WHERE metric = 'storage-bytes' AND value > 0;
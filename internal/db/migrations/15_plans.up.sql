@@ -0,0 +1,52 @@
+-- plans: every plan a tenant can be on. Existing plan names, whether
+-- assigned to tenants or only configured for rate limits and quotas, are
+-- carried over.
+CREATE TABLE plans (
+  name TEXT PRIMARY KEY CHECK (name <> ''),
+  description TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+INSERT INTO plans (name)
+SELECT 'default'
+UNION SELECT plan FROM tenants
+UNION SELECT plan FROM rate_limit_policies
+UNION SELECT plan FROM plan_storage_quotas;
+
+ALTER TABLE tenants
+  ADD CONSTRAINT tenants_plan_fkey FOREIGN KEY (plan) REFERENCES plans(name);
+
+-- plan_prices holds each plan's usage pricing from effective_from until the
+-- plan's next price. Included allowances and the minimum charge are per
+-- calendar month and prorated over the part of a month a price applies to.
+-- Plans without a price in effect fall back to the 'default' plan's, then to
+-- built-in pricing.
+CREATE TABLE plan_prices (
+  plan TEXT NOT NULL
+    REFERENCES plans(name) ON DELETE CASCADE,
+  effective_from TIMESTAMPTZ NOT NULL,
+  storage_usd_per_gib_month NUMERIC NOT NULL CHECK (storage_usd_per_gib_month >= 0),
+  push_usd_per_op NUMERIC NOT NULL CHECK (push_usd_per_op >= 0),
+  pull_usd_per_op NUMERIC NOT NULL CHECK (pull_usd_per_op >= 0),
+  included_storage_gib_months NUMERIC NOT NULL DEFAULT 0 CHECK (included_storage_gib_months >= 0),
+  included_push_ops BIGINT NOT NULL DEFAULT 0 CHECK (included_push_ops >= 0),
+  included_pull_ops BIGINT NOT NULL DEFAULT 0 CHECK (included_pull_ops >= 0),
+  minimum_charge_usd NUMERIC NOT NULL DEFAULT 0 CHECK (minimum_charge_usd >= 0),
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (plan, effective_from)
+);
+INSERT INTO plan_prices (plan, effective_from, storage_usd_per_gib_month, push_usd_per_op, pull_usd_per_op)
+VALUES ('default', '1970-01-01T00:00:00Z', 0.02, 0.00001, 0.000002);
+
+-- tenant_plan_changes records which plan a tenant was on from when, so that
+-- a period spanning a plan change is charged under each plan in turn.
+-- tenants.plan is the plan of the latest change.
+CREATE TABLE tenant_plan_changes (
+  tenant_id UUID NOT NULL
+    REFERENCES tenants(id) ON DELETE CASCADE,
+  effective_from TIMESTAMPTZ NOT NULL,
+  plan TEXT NOT NULL
+    REFERENCES plans(name),
+  PRIMARY KEY (tenant_id, effective_from)
+);
+INSERT INTO tenant_plan_changes (tenant_id, effective_from, plan)
+SELECT id, '1970-01-01T00:00:00Z', plan FROM tenants;
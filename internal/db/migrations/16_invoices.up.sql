@@ -0,0 +1,64 @@
+-- invoices freeze a tenant's usage and charges for a closed calendar month.
+-- Like audit_events, invoices carry no foreign keys so they outlive the
+-- tenants they bill, and are immutable once written.
+CREATE TABLE invoices (
+  id UUID PRIMARY KEY,
+  tenant_id UUID NOT NULL,
+  period_start TIMESTAMPTZ NOT NULL,
+  period_end TIMESTAMPTZ NOT NULL,
+  currency TEXT NOT NULL,
+  push_op_count BIGINT NOT NULL,
+  pull_op_count BIGINT NOT NULL,
+  storage_opening_bytes BIGINT NOT NULL,
+  storage_closing_bytes BIGINT NOT NULL,
+  storage_byte_seconds NUMERIC NOT NULL,
+  storage_gib_months NUMERIC NOT NULL,
+  total_usd NUMERIC NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  CHECK (period_end > period_start),
+  UNIQUE (tenant_id, period_start)
+);
+CREATE INDEX idx_invoices_tenant_period ON invoices (tenant_id, period_start DESC);
+
+-- invoice_line_items are an invoice's charges per plan segment of the
+-- period: usage at the plan's rates, included allowances as credits against
+-- it, and any top-up to the plan's minimum charge. Amounts sum to the
+-- invoice total.
+CREATE TABLE invoice_line_items (
+  invoice_id UUID NOT NULL
+    REFERENCES invoices(id),
+  position INT NOT NULL,
+  period_start TIMESTAMPTZ NOT NULL,
+  period_end TIMESTAMPTZ NOT NULL,
+  plan TEXT NOT NULL,
+  kind TEXT NOT NULL,
+  description TEXT NOT NULL,
+  quantity NUMERIC NOT NULL,
+  unit TEXT NOT NULL,
+  unit_price_usd NUMERIC NOT NULL,
+  amount_usd NUMERIC NOT NULL,
+  PRIMARY KEY (invoice_id, position)
+);
+
+CREATE FUNCTION invoices_immutable() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION '% is immutable', TG_TABLE_NAME;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER invoices_immutable
+  BEFORE UPDATE OR DELETE ON invoices
+  FOR EACH ROW EXECUTE FUNCTION invoices_immutable();
+CREATE TRIGGER invoice_line_items_immutable
+  BEFORE UPDATE OR DELETE ON invoice_line_items
+  FOR EACH ROW EXECUTE FUNCTION invoices_immutable();
+
+-- invoicing_state records the first month not yet invoiced. Months before
+-- the one this migration runs in were priced at built-in rates and are not
+-- invoiced.
+CREATE TABLE invoicing_state (
+  singleton BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (singleton),
+  invoiced_through DATE NOT NULL
+);
+INSERT INTO invoicing_state (invoiced_through)
+VALUES (date_trunc('month', NOW() AT TIME ZONE 'UTC')::DATE);
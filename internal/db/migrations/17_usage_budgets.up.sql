@@ -0,0 +1,37 @@
+-- usage_budgets are monthly limits a tenant sets on its charges or on one
+-- usage metric. Crossing 50, 80 and 100 percent of a limit in a calendar
+-- month notifies webhook_url, signed with the encrypted webhook secret.
+CREATE TABLE usage_budgets (
+  id UUID PRIMARY KEY,
+  tenant_id UUID NOT NULL
+    REFERENCES tenants(id) ON DELETE CASCADE,
+  name TEXT NOT NULL CHECK (name <> ''),
+  metric TEXT NOT NULL
+    CHECK (metric IN ('charge-usd', 'storage-gib-months', 'push-op-count', 'pull-op-count')),
+  limit_value NUMERIC NOT NULL CHECK (limit_value > 0),
+  webhook_url TEXT NOT NULL,
+  webhook_secret_encrypted TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  UNIQUE (tenant_id, name)
+);
+
+-- usage_budget_alerts records each threshold a budget crossed in a period,
+-- so it fires once per period, and doubles as the webhook delivery outbox.
+CREATE TABLE usage_budget_alerts (
+  budget_id UUID NOT NULL
+    REFERENCES usage_budgets(id) ON DELETE CASCADE,
+  period_start TIMESTAMPTZ NOT NULL,
+  threshold_percent INT NOT NULL CHECK (threshold_percent > 0),
+  value NUMERIC NOT NULL,
+  limit_value NUMERIC NOT NULL,
+  fired_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  delivered_at TIMESTAMPTZ,
+  attempts INT NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_error TEXT NOT NULL DEFAULT '',
+  PRIMARY KEY (budget_id, period_start, threshold_percent)
+);
+CREATE INDEX idx_usage_budget_alerts_pending
+  ON usage_budget_alerts (next_attempt_at)
+  WHERE delivered_at IS NULL;
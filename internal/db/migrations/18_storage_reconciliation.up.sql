@@ -0,0 +1,26 @@
+-- Corrective usage events carry the reason they were emitted, so they can be
+-- told apart from usage the tenant generated.
+ALTER TABLE usage_events
+  ADD COLUMN reason TEXT CHECK (reason IN ('reconciliation'));
+
+-- storage_reconciliations records each tenant whose storage-bytes balance
+-- disagreed with the distinct blob bytes its repositories hold. Like
+-- audit_events, rows outlive the tenants they describe.
+CREATE TABLE storage_reconciliations (
+  tenant_id UUID NOT NULL,
+  checked_at TIMESTAMPTZ NOT NULL,
+  actual_bytes BIGINT NOT NULL,
+  recorded_bytes BIGINT NOT NULL,
+  corrected_bytes BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (tenant_id, checked_at)
+);
+CREATE INDEX idx_storage_reconciliations_checked_at
+  ON storage_reconciliations (checked_at);
+
+-- storage_reconciliation_state records when storage was last reconciled;
+-- replicas serialize on it.
+CREATE TABLE storage_reconciliation_state (
+  singleton BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (singleton),
+  reconciled_at TIMESTAMPTZ
+);
+INSERT INTO storage_reconciliation_state (reconciled_at) VALUES (NULL);
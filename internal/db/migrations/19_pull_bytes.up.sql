@@ -0,0 +1,15 @@
+-- pull-bytes records the bytes of blobs actually sent to clients, so that
+-- egress can be billed alongside pull operations.
+ALTER TABLE usage_events
+  DROP CONSTRAINT usage_events_metric_check,
+  ADD CONSTRAINT usage_events_metric_check
+    CHECK (metric IN ('storage-bytes', 'push-op-count', 'pull-op-count', 'pull-bytes'));
+
+-- Egress is priced per GiB with a monthly allowance. Existing prices charge
+-- nothing for it until a new price says otherwise.
+ALTER TABLE plan_prices
+  ADD COLUMN pull_usd_per_gib NUMERIC NOT NULL DEFAULT 0 CHECK (pull_usd_per_gib >= 0),
+  ADD COLUMN included_pull_gib NUMERIC NOT NULL DEFAULT 0 CHECK (included_pull_gib >= 0);
+
+ALTER TABLE invoices
+  ADD COLUMN pull_bytes BIGINT NOT NULL DEFAULT 0;
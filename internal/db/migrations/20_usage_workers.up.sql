@@ -0,0 +1,38 @@
+-- usage_workers are the edge workers allowed to submit usage events and
+-- introspect registry tokens. Each signs its requests with its own secret,
+-- encrypted like webhook secrets. Workers are revoked, not deleted, so the
+-- ingest log keeps naming them.
+CREATE TABLE usage_workers (
+  id UUID PRIMARY KEY,
+  name TEXT NOT NULL UNIQUE CHECK (name <> ''),
+  secret_encrypted TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  revoked_at TIMESTAMPTZ
+);
+
+-- usage_worker_metrics are the metrics a worker may submit and the values
+-- each of its events may carry.
+CREATE TABLE usage_worker_metrics (
+  worker_id UUID NOT NULL REFERENCES usage_workers(id) ON DELETE CASCADE,
+  metric TEXT NOT NULL,
+  min_value BIGINT NOT NULL,
+  max_value BIGINT NOT NULL,
+  CHECK (min_value <= max_value),
+  PRIMARY KEY (worker_id, metric)
+);
+
+-- usage_ingest_batches logs every batch of usage events a worker submitted.
+-- A signed request's nonce is accepted once per worker, which is what rejects
+-- replayed batches.
+CREATE TABLE usage_ingest_batches (
+  id UUID PRIMARY KEY,
+  worker_id UUID NOT NULL REFERENCES usage_workers(id),
+  nonce TEXT NOT NULL,
+  signed_at TIMESTAMPTZ NOT NULL,
+  received_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  client_ip TEXT NOT NULL DEFAULT '',
+  event_ids UUID[] NOT NULL,
+  UNIQUE (worker_id, nonce)
+);
+
+CREATE INDEX idx_usage_ingest_batches_worker_received ON usage_ingest_batches (worker_id, received_at DESC);
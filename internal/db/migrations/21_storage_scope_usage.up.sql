@@ -0,0 +1,141 @@
+-- storage_scope_usage keeps the bytes each tenant, registry and repository
+-- stores, counting each distinct object once per scope, so quota checks read
+-- a running total instead of summing repository_objects. Triggers keep it
+-- current as objects are linked to and unlinked from repositories; a push
+-- that checks quotas locks its scopes' rows, in tenant, registry, repository
+-- order as the triggers do, until it commits.
+CREATE TABLE storage_scope_usage (
+  scope TEXT NOT NULL CHECK (scope IN ('tenant', 'registry', 'repository')),
+  scope_id UUID NOT NULL,
+  used_bytes BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (scope, scope_id)
+);
+
+CREATE FUNCTION repository_objects_storage_usage() RETURNS trigger AS $$
+DECLARE
+  v_repository_id UUID;
+  v_digest TEXT;
+  v_registry_id UUID;
+  v_tenant_id UUID;
+  delta BIGINT;
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    v_repository_id := NEW.repository_id;
+    v_digest := NEW.digest;
+  ELSE
+    v_repository_id := OLD.repository_id;
+    v_digest := OLD.digest;
+  END IF;
+
+  SELECT r.registry_id, reg.tenant_id INTO v_registry_id, v_tenant_id
+  FROM repositories r
+  JOIN registries reg ON reg.id = r.registry_id
+  WHERE r.id = v_repository_id;
+  SELECT o.size_bytes INTO delta FROM objects o WHERE o.digest = v_digest;
+  IF v_tenant_id IS NULL OR delta IS NULL THEN
+    RETURN NULL;
+  END IF;
+  IF TG_OP = 'DELETE' THEN
+    delta := -delta;
+  END IF;
+
+  INSERT INTO storage_scope_usage (scope, scope_id)
+  VALUES ('tenant', v_tenant_id), ('registry', v_registry_id), ('repository', v_repository_id)
+  ON CONFLICT DO NOTHING;
+  PERFORM 1 FROM storage_scope_usage u WHERE u.scope = 'tenant' AND u.scope_id = v_tenant_id FOR UPDATE;
+  PERFORM 1 FROM storage_scope_usage u WHERE u.scope = 'registry' AND u.scope_id = v_registry_id FOR UPDATE;
+  PERFORM 1 FROM storage_scope_usage u WHERE u.scope = 'repository' AND u.scope_id = v_repository_id FOR UPDATE;
+
+  UPDATE storage_scope_usage u SET used_bytes = u.used_bytes + delta
+  WHERE u.scope = 'repository' AND u.scope_id = v_repository_id;
+  IF NOT EXISTS (
+    SELECT 1 FROM repository_objects ro
+    JOIN repositories r ON r.id = ro.repository_id
+    WHERE ro.digest = v_digest
+      AND r.registry_id = v_registry_id
+      AND ro.repository_id <> v_repository_id
+  ) THEN
+    UPDATE storage_scope_usage u SET used_bytes = u.used_bytes + delta
+    WHERE u.scope = 'registry' AND u.scope_id = v_registry_id;
+  END IF;
+  IF NOT EXISTS (
+    SELECT 1 FROM repository_objects ro
+    JOIN repositories r ON r.id = ro.repository_id
+    JOIN registries reg ON reg.id = r.registry_id
+    WHERE ro.digest = v_digest
+      AND reg.tenant_id = v_tenant_id
+      AND ro.repository_id <> v_repository_id
+  ) THEN
+    UPDATE storage_scope_usage u SET used_bytes = u.used_bytes + delta
+    WHERE u.scope = 'tenant' AND u.scope_id = v_tenant_id;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER repository_objects_storage_usage
+  AFTER INSERT OR DELETE ON repository_objects
+  FOR EACH ROW EXECUTE FUNCTION repository_objects_storage_usage();
+
+-- Cascading deletes remove repository_objects rows only once their
+-- repository, registry or object is gone, when the usage trigger can no
+-- longer tell which scopes or how many bytes they counted, so the parents
+-- remove them first.
+CREATE FUNCTION storage_scope_usage_delete_children() RETURNS trigger AS $$
+BEGIN
+  CASE TG_TABLE_NAME
+  WHEN 'objects' THEN
+    DELETE FROM repository_objects WHERE digest = OLD.digest;
+  WHEN 'repositories' THEN
+    DELETE FROM repository_objects WHERE repository_id = OLD.id;
+    DELETE FROM storage_scope_usage WHERE scope = 'repository' AND scope_id = OLD.id;
+  WHEN 'registries' THEN
+    DELETE FROM repositories WHERE registry_id = OLD.id;
+    DELETE FROM storage_scope_usage WHERE scope = 'registry' AND scope_id = OLD.id;
+  WHEN 'tenants' THEN
+    DELETE FROM registries WHERE tenant_id = OLD.id;
+    DELETE FROM storage_scope_usage WHERE scope = 'tenant' AND scope_id = OLD.id;
+  END CASE;
+  RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER objects_storage_scope_usage
+  BEFORE DELETE ON objects
+  FOR EACH ROW EXECUTE FUNCTION storage_scope_usage_delete_children();
+CREATE TRIGGER repositories_storage_scope_usage
+  BEFORE DELETE ON repositories
+  FOR EACH ROW EXECUTE FUNCTION storage_scope_usage_delete_children();
+CREATE TRIGGER registries_storage_scope_usage
+  BEFORE DELETE ON registries
+  FOR EACH ROW EXECUTE FUNCTION storage_scope_usage_delete_children();
+CREATE TRIGGER tenants_storage_scope_usage
+  BEFORE DELETE ON tenants
+  FOR EACH ROW EXECUTE FUNCTION storage_scope_usage_delete_children();
+
+INSERT INTO storage_scope_usage (scope, scope_id, used_bytes)
+SELECT 'repository', ro.repository_id, SUM(o.size_bytes)
+FROM repository_objects ro
+JOIN objects o ON o.digest = ro.digest
+GROUP BY ro.repository_id;
+
+INSERT INTO storage_scope_usage (scope, scope_id, used_bytes)
+SELECT 'registry', s.registry_id, SUM(o.size_bytes)
+FROM (
+  SELECT DISTINCT r.registry_id, ro.digest
+  FROM repository_objects ro
+  JOIN repositories r ON r.id = ro.repository_id
+) s
+JOIN objects o ON o.digest = s.digest
+GROUP BY s.registry_id;
+
+INSERT INTO storage_scope_usage (scope, scope_id, used_bytes)
+SELECT 'tenant', s.tenant_id, SUM(o.size_bytes)
+FROM (
+  SELECT DISTINCT reg.tenant_id, ro.digest
+  FROM repository_objects ro
+  JOIN repositories r ON r.id = ro.repository_id
+  JOIN registries reg ON reg.id = r.registry_id
+) s
+JOIN objects o ON o.digest = s.digest
+GROUP BY s.tenant_id;
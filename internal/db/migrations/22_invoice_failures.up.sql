@@ -0,0 +1,13 @@
+-- invoice_failures records tenants whose invoice for a month could not be
+-- issued. The month is closed without them and only they are retried, until
+-- their invoice is stored, which removes the row.
+CREATE TABLE invoice_failures (
+  tenant_id UUID NOT NULL,
+  period_start TIMESTAMPTZ NOT NULL,
+  attempts INT NOT NULL DEFAULT 1,
+  last_error TEXT NOT NULL,
+  first_failed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_failed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (tenant_id, period_start)
+);
+CREATE INDEX idx_invoice_failures_last_failed_at ON invoice_failures (last_failed_at);
@@ -0,0 +1,13 @@
+-- usage_ingest_rejections records the events of a batch that were not
+-- stored, as the worker sent them, with why. The rest of the batch is stored;
+-- a rejected event can be resent in a batch of its own once it is fixed.
+CREATE TABLE usage_ingest_rejections (
+  batch_id UUID NOT NULL REFERENCES usage_ingest_batches(id) ON DELETE CASCADE,
+  position INT NOT NULL,
+  event_id TEXT NOT NULL,
+  namespace TEXT NOT NULL,
+  metric TEXT NOT NULL,
+  value BIGINT NOT NULL,
+  reason TEXT NOT NULL,
+  PRIMARY KEY (batch_id, position)
+);
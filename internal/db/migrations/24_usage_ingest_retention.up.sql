@@ -0,0 +1,7 @@
+-- usage_ingest_batches, with their rejected events, are pruned once they are
+-- older than USAGE_INGEST_LOG_RETENTION, 30 days by default. Rejecting
+-- replays only needs a batch's nonce while its signature could still be
+-- accepted, up to twice the 5 minute timestamp tolerance after it arrived,
+-- so the retention is never shorter than that; the rest is for operators
+-- reading the ingest log.
+CREATE INDEX idx_usage_ingest_batches_received_at ON usage_ingest_batches (received_at);
@@ -0,0 +1,5 @@
+-- users.email_verified records whether the identity provider verified
+-- users.email. Only a verified address accepts a pending invitation, so
+-- addresses recorded before this column existed start out unverified until
+-- the provider confirms them.
+ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,65 @@
+-- Moving a registry to another tenant moves the bytes it stores between the
+-- two tenants' storage_scope_usage rows. Each tenant counts an object once,
+-- so the old tenant only loses the objects none of its other registries
+-- hold, and the new tenant only gains those none of its registries hold yet.
+-- Both tenant rows are locked in scope_id order before either is changed.
+CREATE FUNCTION registries_transfer_storage_usage() RETURNS trigger AS $$
+DECLARE
+  moved_out BIGINT;
+  moved_in BIGINT;
+BEGIN
+  INSERT INTO storage_scope_usage (scope, scope_id)
+  VALUES ('tenant', OLD.tenant_id), ('tenant', NEW.tenant_id)
+  ON CONFLICT DO NOTHING;
+  PERFORM 1 FROM storage_scope_usage u
+  WHERE u.scope = 'tenant' AND u.scope_id IN (OLD.tenant_id, NEW.tenant_id)
+  ORDER BY u.scope_id
+  FOR UPDATE;
+
+  SELECT COALESCE(SUM(o.size_bytes), 0) INTO moved_out
+  FROM (
+    SELECT DISTINCT ro.digest
+    FROM repository_objects ro
+    JOIN repositories r ON r.id = ro.repository_id
+    WHERE r.registry_id = NEW.id
+  ) d
+  JOIN objects o ON o.digest = d.digest
+  WHERE NOT EXISTS (
+    SELECT 1 FROM repository_objects ro
+    JOIN repositories r ON r.id = ro.repository_id
+    JOIN registries reg ON reg.id = r.registry_id
+    WHERE ro.digest = d.digest
+      AND reg.tenant_id = OLD.tenant_id
+      AND reg.id <> NEW.id
+  );
+
+  SELECT COALESCE(SUM(o.size_bytes), 0) INTO moved_in
+  FROM (
+    SELECT DISTINCT ro.digest
+    FROM repository_objects ro
+    JOIN repositories r ON r.id = ro.repository_id
+    WHERE r.registry_id = NEW.id
+  ) d
+  JOIN objects o ON o.digest = d.digest
+  WHERE NOT EXISTS (
+    SELECT 1 FROM repository_objects ro
+    JOIN repositories r ON r.id = ro.repository_id
+    JOIN registries reg ON reg.id = r.registry_id
+    WHERE ro.digest = d.digest
+      AND reg.tenant_id = NEW.tenant_id
+      AND reg.id <> NEW.id
+  );
+
+  UPDATE storage_scope_usage u SET used_bytes = u.used_bytes - moved_out
+  WHERE u.scope = 'tenant' AND u.scope_id = OLD.tenant_id;
+  UPDATE storage_scope_usage u SET used_bytes = u.used_bytes + moved_in
+  WHERE u.scope = 'tenant' AND u.scope_id = NEW.tenant_id;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER registries_transfer_storage_usage
+  AFTER UPDATE OF tenant_id ON registries
+  FOR EACH ROW
+  WHEN (OLD.tenant_id IS DISTINCT FROM NEW.tenant_id)
+  EXECUTE FUNCTION registries_transfer_storage_usage();
@@ -0,0 +1,13 @@
+-- usage_pipeline_backlogs is each replica's report of the usage events it
+-- has yet to store: those queued in memory and the files of its journal.
+-- Storage drift is measured against the events stored, so a correction made
+-- while events are still pending would be counted again once they arrive;
+-- storage is not repaired while any replica reports a backlog. A replica
+-- that stopped with a journal keeps its row until it is started again and
+-- replays it; if that journal is lost, delete its row to allow repairs.
+CREATE TABLE usage_pipeline_backlogs (
+  replica TEXT PRIMARY KEY,
+  pending_events BIGINT NOT NULL,
+  journal_files INTEGER NOT NULL,
+  reported_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,14 @@
+-- registry refresh tokens: long-lived OAuth2 refresh tokens bound to an API key
+CREATE TABLE registry_refresh_tokens (
+  id UUID PRIMARY KEY,
+  api_key_id UUID NOT NULL
+    REFERENCES api_keys(id) ON DELETE CASCADE,
+  token_hash TEXT NOT NULL,
+  client_id TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMPTZ NOT NULL,
+  last_used_at TIMESTAMPTZ,
+  revoked_at TIMESTAMPTZ
+);
+CREATE UNIQUE INDEX unique_registry_refresh_tokens_hash ON registry_refresh_tokens (token_hash);
+CREATE INDEX idx_registry_refresh_tokens_api_key_id ON registry_refresh_tokens (api_key_id);
@@ -0,0 +1,12 @@
+-- registry jwt keys: Ed25519 signing keys for registry bearer tokens. A key
+-- is published in the JWKS as soon as it exists and becomes the signing key
+-- once activates_at passes; the previous key stays published until its
+-- tokens have expired.
+CREATE TABLE registry_jwt_keys (
+  kid TEXT PRIMARY KEY,
+  private_key_encrypted TEXT NOT NULL,
+  public_key_pem TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  activates_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX idx_registry_jwt_keys_activates_at ON registry_jwt_keys (activates_at);
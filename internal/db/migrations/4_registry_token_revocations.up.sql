@@ -0,0 +1,14 @@
+-- registry token revocations: denylist for issued registry bearer tokens.
+-- A row either names a single token by jti or invalidates every token issued
+-- for an API key up to created_at. Rows are only needed until the tokens they
+-- cover have expired. api_key_id has no foreign key because deleting the key
+-- is exactly when the revocation must outlive it.
+CREATE TABLE registry_token_revocations (
+  id UUID PRIMARY KEY,
+  jti TEXT,
+  api_key_id UUID,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMPTZ NOT NULL,
+  CHECK ((jti IS NULL) <> (api_key_id IS NULL))
+);
+CREATE INDEX idx_registry_token_revocations_expires_at ON registry_token_revocations (expires_at);
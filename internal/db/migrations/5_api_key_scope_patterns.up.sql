@@ -0,0 +1,15 @@
+-- api key scope patterns: scope a key to repositories matching a glob on the
+-- repository path (without the registry namespace), including repositories
+-- created after the key. A scope targets the whole registry, one repository,
+-- or one pattern.
+ALTER TABLE api_key_scopes ADD COLUMN repository_pattern TEXT;
+ALTER TABLE api_key_scopes ADD CONSTRAINT api_key_scopes_single_target
+  CHECK (repository_id IS NULL OR repository_pattern IS NULL);
+
+DROP INDEX unique_api_key_registry_scope;
+CREATE UNIQUE INDEX unique_api_key_registry_scope
+  ON api_key_scopes (api_key_id, registry_id)
+  WHERE repository_id IS NULL AND repository_pattern IS NULL;
+CREATE UNIQUE INDEX unique_api_key_pattern_scope
+  ON api_key_scopes (api_key_id, registry_id, repository_pattern)
+  WHERE repository_pattern IS NOT NULL;
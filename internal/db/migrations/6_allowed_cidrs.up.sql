@@ -0,0 +1,5 @@
+-- CIDR allowlists: when non-empty, registry tokens for the key or registry
+-- are only issued to and accepted from client addresses inside one of the
+-- listed networks. Values are normalized prefixes such as 203.0.113.0/24.
+ALTER TABLE api_keys ADD COLUMN allowed_cidrs TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE registries ADD COLUMN allowed_cidrs TEXT[] NOT NULL DEFAULT '{}';
@@ -0,0 +1,33 @@
+-- audit events: append-only record of registry and management operations.
+-- tenant_id and registry_id carry no foreign keys so the trail outlives the
+-- registries and keys it describes. tenant_id is NULL when the request could
+-- not be attributed to a tenant (e.g. anonymous access to an unknown registry).
+CREATE TABLE audit_events (
+  id UUID PRIMARY KEY,
+  occurred_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  tenant_id UUID,
+  actor_type TEXT NOT NULL CHECK (actor_type IN ('user', 'api_key', 'anonymous')),
+  actor_id UUID,
+  action TEXT NOT NULL,
+  registry_id UUID,
+  registry_name TEXT NOT NULL DEFAULT '',
+  repository TEXT NOT NULL DEFAULT '',
+  reference TEXT NOT NULL DEFAULT '',
+  digest TEXT NOT NULL DEFAULT '',
+  target TEXT NOT NULL DEFAULT '',
+  client_ip TEXT NOT NULL DEFAULT '',
+  user_agent TEXT NOT NULL DEFAULT '',
+  outcome TEXT NOT NULL CHECK (outcome IN ('success', 'denied', 'failure')),
+  status_code INT NOT NULL
+);
+CREATE INDEX idx_audit_events_tenant_occurred_at ON audit_events (tenant_id, occurred_at DESC, id DESC);
+
+CREATE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_append_only
+  BEFORE UPDATE OR DELETE ON audit_events
+  FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
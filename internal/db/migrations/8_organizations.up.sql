@@ -0,0 +1,43 @@
+-- organizations: a tenant is an organization. org_members gives each user a
+-- role in the organization; org_invitations are pending invitations by email,
+-- accepted when the invitee first signs in.
+CREATE TYPE org_role AS ENUM ('owner', 'admin', 'member', 'viewer');
+
+ALTER TABLE users ADD COLUMN email CITEXT;
+
+CREATE TABLE org_members (
+  org_id UUID NOT NULL
+    REFERENCES tenants(id) ON DELETE CASCADE,
+  user_id UUID NOT NULL
+    REFERENCES users(id) ON DELETE CASCADE,
+  role org_role NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (org_id, user_id)
+);
+CREATE INDEX idx_org_members_user_id ON org_members (user_id);
+
+-- Existing users keep the unrestricted access they had before roles existed.
+INSERT INTO org_members (org_id, user_id, role)
+SELECT tenant_id, id, 'owner' FROM users;
+
+CREATE TABLE org_invitations (
+  id UUID PRIMARY KEY,
+  org_id UUID NOT NULL
+    REFERENCES tenants(id) ON DELETE CASCADE,
+  email CITEXT NOT NULL,
+  role org_role NOT NULL,
+  invited_by UUID
+    REFERENCES users(id) ON DELETE SET NULL,
+  workos_invitation_id TEXT,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMPTZ NOT NULL,
+  accepted_at TIMESTAMPTZ,
+  accepted_by UUID
+    REFERENCES users(id) ON DELETE SET NULL
+);
+CREATE UNIQUE INDEX unique_pending_org_invitation
+  ON org_invitations (org_id, email)
+  WHERE accepted_at IS NULL;
+CREATE INDEX idx_org_invitations_pending_email
+  ON org_invitations (email)
+  WHERE accepted_at IS NULL;
@@ -0,0 +1,26 @@
+-- rate limits: tenants are on a plan; rate_limit_policies sets per-plan
+-- token-bucket limits for each request class and subject (client address, API
+-- key or tenant). Plans without a row for a class and subject fall back to
+-- the 'default' plan, then to built-in limits.
+ALTER TABLE tenants ADD COLUMN plan TEXT NOT NULL DEFAULT 'default';
+
+CREATE TABLE rate_limit_policies (
+  plan TEXT NOT NULL,
+  class TEXT NOT NULL
+    CHECK (class IN ('token', 'registry', 'management')),
+  subject TEXT NOT NULL
+    CHECK (subject IN ('ip', 'api_key', 'tenant')),
+  per_minute INTEGER NOT NULL CHECK (per_minute > 0),
+  burst INTEGER NOT NULL CHECK (burst > 0),
+  PRIMARY KEY (plan, class, subject)
+);
+
+-- rate_limit_buckets holds generic cell rate algorithm state shared by every
+-- replica: tat is the theoretical arrival time of the next request. Losing it
+-- on a crash only refills buckets, so the table is unlogged.
+CREATE UNLOGGED TABLE rate_limit_buckets (
+  key TEXT PRIMARY KEY,
+  tat TIMESTAMPTZ NOT NULL,
+  allowed BOOLEAN NOT NULL
+);
+CREATE INDEX idx_rate_limit_buckets_tat ON rate_limit_buckets (tat);
@@ -0,0 +1,400 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// The queries in this file back the operator admin API and CLI. Unlike the
+// rest of the package they are not scoped to a tenant.
+
+// TenantSummary is a tenant as seen by operators.
+type TenantSummary struct {
+	ID            uuid.UUID
+	Name          string
+	Plan          string
+	State         AccessState
+	StateReason   string
+	Onboarded     bool
+	CreatedAt     *time.Time
+	RegistryCount int64
+	MemberCount   int64
+	SizeBytes     int64
+}
+
+// TenantFilter selects tenants. Zero-valued fields do not filter. After
+// resumes a listing ordered by name.
+type TenantFilter struct {
+	NamePrefix   string
+	RegistryName string
+	After        string
+	Limit        int
+}
+
+const selectTenantSummaryCmd = `SELECT t.id, t.name, t.plan, t.state, t.state_reason, t.onboarded, t.created_at,
+		(SELECT COUNT(*) FROM registries r WHERE r.tenant_id = t.id),
+		(SELECT COUNT(*) FROM org_members m WHERE m.org_id = t.id),
+		(SELECT COALESCE(SUM(r.cached_size_bytes), 0)::BIGINT FROM registries r WHERE r.tenant_id = t.id)
+	FROM tenants t`
+
+func scanTenantSummary(row pgx.Row) (TenantSummary, error) {
+	var t TenantSummary
+	err := row.Scan(
+		&t.ID,
+		&t.Name,
+		&t.Plan,
+		&t.State,
+		&t.StateReason,
+		&t.Onboarded,
+		&t.CreatedAt,
+		&t.RegistryCount,
+		&t.MemberCount,
+		&t.SizeBytes,
+	)
+	return t, err
+}
+
+// ListTenants returns up to filter.Limit tenants ordered by name.
+func (d *DB) ListTenants(ctx context.Context, filter TenantFilter) ([]TenantSummary, error) {
+	if filter.Limit <= 0 || filter.Limit > 1000 {
+		filter.Limit = 100
+	}
+
+	var where []string
+	var args []any
+	add := func(clause string, value any) {
+		args = append(args, value)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+	if filter.NamePrefix != "" {
+		add("starts_with(t.name, $%d)", filter.NamePrefix)
+	}
+	if filter.RegistryName != "" {
+		add("t.id = (SELECT tenant_id FROM registries WHERE name = $%d)", filter.RegistryName)
+	}
+	if filter.After != "" {
+		add("t.name > $%d", filter.After)
+	}
+	args = append(args, filter.Limit)
+
+	cmd := selectTenantSummaryCmd
+	if len(where) > 0 {
+		cmd += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	cmd += fmt.Sprintf(` ORDER BY t.name ASC LIMIT $%d`, len(args))
+
+	rows, err := d.conn.Query(ctx, cmd, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (TenantSummary, error) {
+		return scanTenantSummary(row)
+	})
+}
+
+func (d *DB) GetTenant(ctx context.Context, tenantID uuid.UUID) (TenantSummary, error) {
+	const cmd = selectTenantSummaryCmd + ` WHERE t.id = $1`
+	t, err := scanTenantSummary(d.conn.QueryRow(ctx, cmd, tenantID))
+	if err != nil {
+		if isNoRows(err) {
+			return TenantSummary{}, ErrNotFound
+		}
+		return TenantSummary{}, err
+	}
+	return t, nil
+}
+
+// SetTenantPlan moves the tenant onto plan from now on. Usage before now
+// stays charged under the plans it was on. It returns ErrUnknownPlan if the
+// plan does not exist.
+func (d *DB) SetTenantPlan(ctx context.Context, tenantID uuid.UUID, plan string) error {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var exists bool
+	const planExistsCmd = `SELECT EXISTS(SELECT 1 FROM plans WHERE name = $1)`
+	if err := tx.QueryRow(ctx, planExistsCmd, plan).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUnknownPlan
+	}
+
+	// Tenants created since plan changes were recorded have no history yet;
+	// record the plan they have been on so far before changing it.
+	const baseCmd = `INSERT INTO tenant_plan_changes (tenant_id, effective_from, plan)
+		SELECT id, '1970-01-01T00:00:00Z', plan FROM tenants
+		WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM tenant_plan_changes WHERE tenant_id = $1)
+		ON CONFLICT (tenant_id, effective_from) DO NOTHING`
+	if _, err := tx.Exec(ctx, baseCmd, tenantID); err != nil {
+		return err
+	}
+
+	const cmd = `UPDATE tenants SET plan = $2 WHERE id = $1`
+	tag, err := tx.Exec(ctx, cmd, tenantID, plan)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	const changeCmd = `INSERT INTO tenant_plan_changes (tenant_id, effective_from, plan)
+		VALUES ($1, GREATEST(NOW(), (SELECT MAX(effective_from) FROM tenant_plan_changes WHERE tenant_id = $1)), $2)
+		ON CONFLICT (tenant_id, effective_from) DO UPDATE SET plan = EXCLUDED.plan`
+	if _, err := tx.Exec(ctx, changeCmd, tenantID, plan); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ListAllRegistries returns the registries of every tenant, or of tenantID
+// when it is set, ordered by name.
+func (d *DB) ListAllRegistries(ctx context.Context, tenantID *uuid.UUID) ([]Registry, error) {
+	const cmd = `SELECT id, tenant_id, name, cached_size_bytes, cached_size_updated_at, allowed_cidrs, state, state_reason
+		FROM registries
+		WHERE $1::UUID IS NULL OR tenant_id = $1
+		ORDER BY name ASC`
+	rows, err := d.conn.Query(ctx, cmd, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Registry, error) {
+		var registry Registry
+		err := row.Scan(
+			&registry.ID,
+			&registry.TenantID,
+			&registry.Name,
+			&registry.CachedSizeBytes,
+			&registry.CachedSizeUpdatedAt,
+			&registry.AllowedCIDRs,
+			&registry.State,
+			&registry.StateReason,
+		)
+		return registry, err
+	})
+}
+
+// RegistryTransfer describes a completed registry transfer.
+type RegistryTransfer struct {
+	Registry          Registry
+	FromTenantID      uuid.UUID
+	RevokedAPIKeys    int
+	MovedStorageBytes int64
+}
+
+// TransferRegistry moves a registry, its repositories' quotas and open quota
+// breaches to another tenant. API keys scoped to the registry belong to the
+// old tenant's users, so they are deleted and their registry tokens revoked
+// until tokensExpireAt. The storage balance the registry contributed is moved
+// between the tenants' usage so that neither is billed for the other's bytes;
+// the registries_transfer_storage_usage trigger does the same for the running
+// totals their storage quotas are checked against.
+func (d *DB) TransferRegistry(ctx context.Context, registryID, toTenantID uuid.UUID, tokensExpireAt time.Time) (RegistryTransfer, error) {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return RegistryTransfer{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	transfer, err := transferRegistry(ctx, tx, registryID, toTenantID, tokensExpireAt)
+	if err != nil {
+		return RegistryTransfer{}, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return RegistryTransfer{}, err
+	}
+	return transfer, nil
+}
+
+func transferRegistry(ctx context.Context, tx pgx.Tx, registryID, toTenantID uuid.UUID, tokensExpireAt time.Time) (RegistryTransfer, error) {
+	var transfer RegistryTransfer
+	const lockCmd = `SELECT tenant_id FROM registries WHERE id = $1 FOR UPDATE`
+	if err := tx.QueryRow(ctx, lockCmd, registryID).Scan(&transfer.FromTenantID); err != nil {
+		if isNoRows(err) {
+			return RegistryTransfer{}, ErrNotFound
+		}
+		return RegistryTransfer{}, err
+	}
+	if transfer.FromTenantID == toTenantID {
+		return RegistryTransfer{}, ErrConflict
+	}
+
+	var exists bool
+	const tenantExistsCmd = `SELECT EXISTS(SELECT 1 FROM tenants WHERE id = $1)`
+	if err := tx.QueryRow(ctx, tenantExistsCmd, toTenantID).Scan(&exists); err != nil {
+		return RegistryTransfer{}, err
+	}
+	if !exists {
+		return RegistryTransfer{}, ErrNotFound
+	}
+
+	const updateCmd = `UPDATE registries SET tenant_id = $2 WHERE id = $1
+		RETURNING id, tenant_id, name, cached_size_bytes, cached_size_updated_at, allowed_cidrs, state, state_reason`
+	err := tx.QueryRow(ctx, updateCmd, registryID, toTenantID).Scan(
+		&transfer.Registry.ID,
+		&transfer.Registry.TenantID,
+		&transfer.Registry.Name,
+		&transfer.Registry.CachedSizeBytes,
+		&transfer.Registry.CachedSizeUpdatedAt,
+		&transfer.Registry.AllowedCIDRs,
+		&transfer.Registry.State,
+		&transfer.Registry.StateReason,
+	)
+	if err != nil {
+		return RegistryTransfer{}, err
+	}
+
+	const moveQuotasCmd = `UPDATE storage_quotas SET tenant_id = $2 WHERE registry_id = $1`
+	if _, err := tx.Exec(ctx, moveQuotasCmd, registryID, toTenantID); err != nil {
+		return RegistryTransfer{}, err
+	}
+	const moveBreachesCmd = `UPDATE storage_quota_breaches SET tenant_id = $2
+		WHERE resolved_at IS NULL AND (
+			(scope = 'registry' AND scope_id = $1) OR
+			(scope = 'repository' AND scope_id IN (SELECT id FROM repositories WHERE registry_id = $1))
+		)`
+	if _, err := tx.Exec(ctx, moveBreachesCmd, registryID, toTenantID); err != nil {
+		return RegistryTransfer{}, err
+	}
+
+	const deleteKeysCmd = `DELETE FROM api_keys
+		WHERE id IN (SELECT api_key_id FROM api_key_scopes WHERE registry_id = $1)
+		RETURNING id`
+	rows, err := tx.Query(ctx, deleteKeysCmd, registryID)
+	if err != nil {
+		return RegistryTransfer{}, err
+	}
+	keyIDs, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return RegistryTransfer{}, err
+	}
+	for _, keyID := range keyIDs {
+		if err := insertRegistryTokenRevocation(ctx, tx, nil, &keyID, tokensExpireAt); err != nil {
+			return RegistryTransfer{}, err
+		}
+	}
+	transfer.RevokedAPIKeys = len(keyIDs)
+
+	// Move the registry's storage balance one repository at a time so that
+	// usage stays attributed to the repositories that hold it.
+	const balanceCmd = `SELECT repo_id, SUM(value)::BIGINT FROM usage_events
+		WHERE tenant_id = $1 AND registry_id = $2 AND metric = $3
+		GROUP BY repo_id
+		HAVING SUM(value) <> 0`
+	rows, err = tx.Query(ctx, balanceCmd, transfer.FromTenantID, registryID, MetricStorageBytes)
+	if err != nil {
+		return RegistryTransfer{}, err
+	}
+	type repoBalance struct {
+		repoID *uuid.UUID
+		bytes  int64
+	}
+	balances, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (repoBalance, error) {
+		var b repoBalance
+		err := row.Scan(&b.repoID, &b.bytes)
+		return b, err
+	})
+	if err != nil {
+		return RegistryTransfer{}, err
+	}
+	const insertUsageCmd = `INSERT INTO usage_events (id, tenant_id, registry_id, repo_id, metric, value)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+	for _, b := range balances {
+		if _, err := tx.Exec(ctx, insertUsageCmd, uuid.New(), transfer.FromTenantID, registryID, b.repoID, MetricStorageBytes, -b.bytes); err != nil {
+			return RegistryTransfer{}, err
+		}
+		if _, err := tx.Exec(ctx, insertUsageCmd, uuid.New(), toTenantID, registryID, b.repoID, MetricStorageBytes, b.bytes); err != nil {
+			return RegistryTransfer{}, err
+		}
+		transfer.MovedStorageBytes += b.bytes
+	}
+	return transfer, nil
+}
+
+// ForceRevokeAPIKey deletes an API key whoever owns it and revokes its
+// registry tokens until tokensExpireAt, returning the key's tenant.
+func (d *DB) ForceRevokeAPIKey(ctx context.Context, apiKeyID uuid.UUID, tokensExpireAt time.Time) (uuid.UUID, error) {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var tenantID uuid.UUID
+	const tenantCmd = `SELECT r.tenant_id FROM api_key_scopes s
+		JOIN registries r ON r.id = s.registry_id
+		WHERE s.api_key_id = $1
+		LIMIT 1`
+	if err := tx.QueryRow(ctx, tenantCmd, apiKeyID).Scan(&tenantID); err != nil && !isNoRows(err) {
+		return uuid.Nil, err
+	}
+
+	const deleteCmd = `DELETE FROM api_keys WHERE id = $1`
+	tag, err := tx.Exec(ctx, deleteCmd, apiKeyID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		return uuid.Nil, ErrNotFound
+	}
+	if err := insertRegistryTokenRevocation(ctx, tx, nil, &apiKeyID, tokensExpireAt); err != nil {
+		return uuid.Nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return uuid.Nil, err
+	}
+	return tenantID, nil
+}
+
+// ForceRevokeTenantAPIKeys deletes every API key scoped to one of the
+// tenant's registries and revokes their registry tokens until
+// tokensExpireAt, returning how many keys were deleted.
+func (d *DB) ForceRevokeTenantAPIKeys(ctx context.Context, tenantID uuid.UUID, tokensExpireAt time.Time) (int, error) {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var exists bool
+	const existsCmd = `SELECT EXISTS(SELECT 1 FROM tenants WHERE id = $1)`
+	if err := tx.QueryRow(ctx, existsCmd, tenantID).Scan(&exists); err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, ErrNotFound
+	}
+
+	const deleteKeysCmd = `DELETE FROM api_keys
+		WHERE id IN (
+			SELECT s.api_key_id FROM api_key_scopes s
+			JOIN registries r ON r.id = s.registry_id
+			WHERE r.tenant_id = $1
+		)
+		RETURNING id`
+	rows, err := tx.Query(ctx, deleteKeysCmd, tenantID)
+	if err != nil {
+		return 0, err
+	}
+	keyIDs, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return 0, err
+	}
+	for _, keyID := range keyIDs {
+		if err := insertRegistryTokenRevocation(ctx, tx, nil, &keyID, tokensExpireAt); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return len(keyIDs), nil
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+func testTenantStorageUsage(t *testing.T, tx pgx.Tx, tenantID uuid.UUID) int64 {
+	t.Helper()
+	var used int64
+	const cmd = `SELECT COALESCE(SUM(used_bytes), 0)::BIGINT FROM storage_scope_usage WHERE scope = 'tenant' AND scope_id = $1`
+	if err := tx.QueryRow(context.Background(), cmd, tenantID).Scan(&used); err != nil {
+		t.Fatal(err)
+	}
+	return used
+}
+
+func TestTransferRegistryMovesStorageUsage(t *testing.T) {
+	tx := beginTestTx(t)
+	ctx := context.Background()
+
+	from, to := uuid.New(), uuid.New()
+	moved, kept, existing := uuid.New(), uuid.New(), uuid.New()
+	repoMoved, repoKept, repoExisting := uuid.New(), uuid.New(), uuid.New()
+	testExec(t, tx, `INSERT INTO tenants (id, name) VALUES ($1, $2), ($3, $4)`, from, "t-"+from.String(), to, "t-"+to.String())
+	testExec(t, tx, `INSERT INTO registries (id, tenant_id, name) VALUES ($1, $4, $5), ($2, $4, $6), ($3, $7, $8)`,
+		moved, kept, existing, from, "r-"+moved.String(), "r-"+kept.String(), to, "r-"+existing.String())
+	testExec(t, tx, `INSERT INTO repositories (id, registry_id, name) VALUES ($1, $4, 'a'), ($2, $5, 'a'), ($3, $6, 'a')`,
+		repoMoved, repoKept, repoExisting, moved, kept, existing)
+
+	// The moved registry holds shared, which the old tenant keeps through
+	// another registry, and own, which the new tenant already holds.
+	shared, own, only := testDigest(), testDigest(), testDigest()
+	testExec(t, tx, `INSERT INTO objects (digest, size_bytes, type) VALUES ($1, 100, 'blob'), ($2, 50, 'blob'), ($3, 7, 'blob')`, shared, own, only)
+	testExec(t, tx, `INSERT INTO repository_objects (repository_id, digest) VALUES ($1, $4), ($1, $5), ($1, $6), ($2, $4), ($3, $5)`,
+		repoMoved, repoKept, repoExisting, shared, own, only)
+
+	if got := testTenantStorageUsage(t, tx, from); got != 157 {
+		t.Fatalf("old tenant stores %d bytes before the transfer, want 157", got)
+	}
+	if got := testTenantStorageUsage(t, tx, to); got != 50 {
+		t.Fatalf("new tenant stores %d bytes before the transfer, want 50", got)
+	}
+
+	if _, err := transferRegistry(ctx, tx, moved, to, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got := testTenantStorageUsage(t, tx, from); got != 100 {
+		t.Fatalf("old tenant stores %d bytes after the transfer, want 100", got)
+	}
+	if got := testTenantStorageUsage(t, tx, to); got != 157 {
+		t.Fatalf("new tenant stores %d bytes after the transfer, want 157", got)
+	}
+}
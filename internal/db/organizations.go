@@ -2,53 +2,181 @@ package db
 
 import (
 	"context"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 )
 
+// Organizations are tenants: every registry belongs to exactly one, and users
+// may be members of many. Organization IDs are tenant IDs.
+
+type OrgRole string
+
+const (
+	OrgRoleOwner  OrgRole = "owner"
+	OrgRoleAdmin  OrgRole = "admin"
+	OrgRoleMember OrgRole = "member"
+	OrgRoleViewer OrgRole = "viewer"
+)
+
+// ParseOrgRole returns the role named by s, or false if s is not a role.
+func ParseOrgRole(s string) (OrgRole, bool) {
+	switch role := OrgRole(s); role {
+	case OrgRoleOwner, OrgRoleAdmin, OrgRoleMember, OrgRoleViewer:
+		return role, true
+	default:
+		return "", false
+	}
+}
+
+func (r OrgRole) rank() int {
+	switch r {
+	case OrgRoleOwner:
+		return 4
+	case OrgRoleAdmin:
+		return 3
+	case OrgRoleMember:
+		return 2
+	case OrgRoleViewer:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// AtLeast reports whether r grants everything min does.
+func (r OrgRole) AtLeast(min OrgRole) bool {
+	return r.rank() > 0 && r.rank() >= min.rank()
+}
+
+// GrantsAPIKeyPermission reports whether a member with role r may hold keys
+// with permission: viewers may only pull, members may push, and deleting
+// requires an admin.
+func (r OrgRole) GrantsAPIKeyPermission(permission APIKeyPermission) bool {
+	switch permission {
+	case APIKeyPermissionRead:
+		return r.AtLeast(OrgRoleViewer)
+	case APIKeyPermissionWrite:
+		return r.AtLeast(OrgRoleMember)
+	case APIKeyPermissionAdmin:
+		return r.AtLeast(OrgRoleAdmin)
+	default:
+		return false
+	}
+}
+
 type Organization struct {
-	ID          uuid.UUID
-	WorkOSOrgID *string
-	Slug        string
-	Name        string
+	ID   uuid.UUID
+	Name string
 }
 
-func (d *DB) CreateOrganization(ctx context.Context, id uuid.UUID, slug, name string, workosOrgID *string) (Organization, error) {
-	const cmd = `INSERT INTO organizations (id, workos_org_id, slug, name)
-		VALUES ($1, $2, $3, $4)`
-	if _, err := d.conn.Exec(ctx, cmd, id, workosOrgID, slug, name); err != nil {
-		if isUniqueViolation(err) {
-			return Organization{}, ErrConflict
+type OrgMember struct {
+	OrgID     uuid.UUID
+	UserID    uuid.UUID
+	Sub       string
+	Email     *string
+	Role      OrgRole
+	CreatedAt time.Time
+}
+
+type OrgInvitation struct {
+	ID                 uuid.UUID
+	OrgID              uuid.UUID
+	Email              string
+	Role               OrgRole
+	InvitedBy          *uuid.UUID
+	WorkOSInvitationID *string
+	CreatedAt          time.Time
+	ExpiresAt          time.Time
+	AcceptedAt         *time.Time
+}
+
+// OrgMembership is one of a user's organizations as seen by that user.
+type OrgMembership struct {
+	OrgID     uuid.UUID
+	OrgName   string
+	Role      OrgRole
+	Onboarded bool
+	State     AccessState
+	CreatedAt time.Time
+}
+
+const selectOrgMembershipCmd = `SELECT t.id, t.name, m.role, t.onboarded, t.state, m.created_at
+	FROM org_members m
+	JOIN tenants t ON t.id = m.org_id`
+
+func scanOrgMembership(row pgx.Row) (OrgMembership, error) {
+	var membership OrgMembership
+	err := row.Scan(
+		&membership.OrgID,
+		&membership.OrgName,
+		&membership.Role,
+		&membership.Onboarded,
+		&membership.State,
+		&membership.CreatedAt,
+	)
+	return membership, err
+}
+
+func (d *DB) GetUserMembership(ctx context.Context, userID, orgID uuid.UUID) (OrgMembership, error) {
+	const cmd = selectOrgMembershipCmd + ` WHERE m.user_id = $1 AND m.org_id = $2`
+	membership, err := scanOrgMembership(d.conn.QueryRow(ctx, cmd, userID, orgID))
+	if err != nil {
+		if isNoRows(err) {
+			return OrgMembership{}, ErrNotFound
 		}
-		return Organization{}, err
+		return OrgMembership{}, err
 	}
-	return Organization{
-		ID:          id,
-		WorkOSOrgID: workosOrgID,
-		Slug:        slug,
-		Name:        name,
-	}, nil
+	return membership, nil
 }
 
-func (d *DB) AddOrgMember(ctx context.Context, orgID, userID uuid.UUID, role string) error {
-	const cmd = `INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)`
-	if _, err := d.conn.Exec(ctx, cmd, orgID, userID, role); err != nil {
-		if isUniqueViolation(err) {
-			return ErrConflict
+// ListUserMemberships returns every organization the user belongs to, the
+// earliest joined first.
+func (d *DB) ListUserMemberships(ctx context.Context, userID uuid.UUID) ([]OrgMembership, error) {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	return listUserMemberships(ctx, tx, userID)
+}
+
+func listUserMemberships(ctx context.Context, tx pgx.Tx, userID uuid.UUID) ([]OrgMembership, error) {
+	const cmd = selectOrgMembershipCmd + ` WHERE m.user_id = $1 ORDER BY m.created_at ASC`
+	rows, err := tx.Query(ctx, cmd, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := make([]OrgMembership, 0)
+	for rows.Next() {
+		membership, err := scanOrgMembership(rows)
+		if err != nil {
+			return nil, err
 		}
+		memberships = append(memberships, membership)
+	}
+	return memberships, rows.Err()
+}
+
+func (d *DB) SetOrgOnboarded(ctx context.Context, orgID uuid.UUID, onboarded bool) error {
+	const cmd = `UPDATE tenants SET onboarded = $2 WHERE id = $1`
+	tag, err := d.conn.Exec(ctx, cmd, orgID, onboarded)
+	if err != nil {
 		return err
 	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
 	return nil
 }
 
-func (d *DB) GetPersonalOrgByUser(ctx context.Context, userID uuid.UUID) (Organization, error) {
-	const cmd = `SELECT o.id, o.workos_org_id, o.slug, o.name
-		FROM organizations o
-		JOIN org_members m ON m.org_id = o.id
-		WHERE m.user_id = $1 AND o.workos_org_id IS NULL
-		LIMIT 1`
+func (d *DB) GetOrganization(ctx context.Context, orgID uuid.UUID) (Organization, error) {
+	const cmd = `SELECT id, name FROM tenants WHERE id = $1`
 	var org Organization
-	if err := d.conn.QueryRow(ctx, cmd, userID).Scan(&org.ID, &org.WorkOSOrgID, &org.Slug, &org.Name); err != nil {
+	if err := d.conn.QueryRow(ctx, cmd, orgID).Scan(&org.ID, &org.Name); err != nil {
 		if isNoRows(err) {
 			return Organization{}, ErrNotFound
 		}
@@ -57,6 +185,17 @@ func (d *DB) GetPersonalOrgByUser(ctx context.Context, userID uuid.UUID) (Organi
 	return org, nil
 }
 
+func (d *DB) AddOrgMember(ctx context.Context, orgID, userID uuid.UUID, role OrgRole) error {
+	const cmd = `INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)`
+	if _, err := d.conn.Exec(ctx, cmd, orgID, userID, role); err != nil {
+		if isUniqueViolation(err) {
+			return ErrConflict
+		}
+		return err
+	}
+	return nil
+}
+
 func (d *DB) IsOrgMember(ctx context.Context, orgID, userID uuid.UUID) (bool, error) {
 	const cmd = `SELECT EXISTS(SELECT 1 FROM org_members WHERE org_id = $1 AND user_id = $2)`
 	var exists bool
@@ -65,3 +204,433 @@ func (d *DB) IsOrgMember(ctx context.Context, orgID, userID uuid.UUID) (bool, er
 	}
 	return exists, nil
 }
+
+func (d *DB) GetOrgMember(ctx context.Context, orgID, userID uuid.UUID) (OrgMember, error) {
+	const cmd = `SELECT m.org_id, m.user_id, u.sub, u.email, m.role, m.created_at
+		FROM org_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.org_id = $1 AND m.user_id = $2`
+	var member OrgMember
+	err := d.conn.QueryRow(ctx, cmd, orgID, userID).Scan(
+		&member.OrgID,
+		&member.UserID,
+		&member.Sub,
+		&member.Email,
+		&member.Role,
+		&member.CreatedAt,
+	)
+	if err != nil {
+		if isNoRows(err) {
+			return OrgMember{}, ErrNotFound
+		}
+		return OrgMember{}, err
+	}
+	return member, nil
+}
+
+func (d *DB) ListOrgMembers(ctx context.Context, orgID uuid.UUID) ([]OrgMember, error) {
+	const cmd = `SELECT m.org_id, m.user_id, u.sub, u.email, m.role, m.created_at
+		FROM org_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.org_id = $1
+		ORDER BY m.created_at ASC`
+	rows, err := d.conn.Query(ctx, cmd, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make([]OrgMember, 0)
+	for rows.Next() {
+		var member OrgMember
+		if err := rows.Scan(
+			&member.OrgID,
+			&member.UserID,
+			&member.Sub,
+			&member.Email,
+			&member.Role,
+			&member.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// SetOrgMemberRole changes a member's role, refusing to demote the last owner.
+// The member's API keys for the organization's registries with a permission
+// the new role does not grant are deleted and their registry tokens revoked
+// until tokensExpireAt.
+func (d *DB) SetOrgMemberRole(ctx context.Context, orgID, userID uuid.UUID, role OrgRole, tokensExpireAt time.Time) error {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	current, err := lockOrgMemberRole(ctx, tx, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if current == OrgRoleOwner && role != OrgRoleOwner {
+		if err := ensureAnotherOwner(ctx, tx, orgID, userID); err != nil {
+			return err
+		}
+	}
+
+	const cmd = `UPDATE org_members SET role = $3 WHERE org_id = $1 AND user_id = $2`
+	if _, err := tx.Exec(ctx, cmd, orgID, userID, role); err != nil {
+		return err
+	}
+
+	var granted []APIKeyPermission
+	for _, permission := range []APIKeyPermission{APIKeyPermissionRead, APIKeyPermissionWrite, APIKeyPermissionAdmin} {
+		if role.GrantsAPIKeyPermission(permission) {
+			granted = append(granted, permission)
+		}
+	}
+	if err := deleteOrgMemberAPIKeys(ctx, tx, orgID, userID, granted, tokensExpireAt); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// RemoveOrgMember removes a user from the organization, refusing to remove
+// the last owner. The user's API keys for the organization's registries are
+// deleted and their registry tokens revoked until tokensExpireAt.
+func (d *DB) RemoveOrgMember(ctx context.Context, orgID, userID uuid.UUID, tokensExpireAt time.Time) error {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	current, err := lockOrgMemberRole(ctx, tx, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if current == OrgRoleOwner {
+		if err := ensureAnotherOwner(ctx, tx, orgID, userID); err != nil {
+			return err
+		}
+	}
+
+	const deleteCmd = `DELETE FROM org_members WHERE org_id = $1 AND user_id = $2`
+	if _, err := tx.Exec(ctx, deleteCmd, orgID, userID); err != nil {
+		return err
+	}
+
+	if err := deleteOrgMemberAPIKeys(ctx, tx, orgID, userID, nil, tokensExpireAt); err != nil {
+		return err
+	}
+
+	if err := reassignDefaultOrg(ctx, tx, userID, orgID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// deleteOrgMemberAPIKeys deletes the user's API keys for the organization's
+// registries that have any scope with a permission outside granted, all of
+// them when granted is empty, and revokes their registry tokens until
+// tokensExpireAt.
+func deleteOrgMemberAPIKeys(ctx context.Context, tx pgx.Tx, orgID, userID uuid.UUID, granted []APIKeyPermission, tokensExpireAt time.Time) error {
+	keep := make([]string, 0, len(granted))
+	for _, permission := range granted {
+		keep = append(keep, string(permission))
+	}
+	const cmd = `DELETE FROM api_keys
+		WHERE user_id = $2 AND id IN (
+			SELECT s.api_key_id FROM api_key_scopes s
+			JOIN registries r ON r.id = s.registry_id
+			WHERE r.tenant_id = $1 AND s.permission::TEXT <> ALL($3::TEXT[])
+		)
+		RETURNING id`
+	rows, err := tx.Query(ctx, cmd, orgID, userID, keep)
+	if err != nil {
+		return err
+	}
+	keyIDs, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return err
+	}
+	for _, keyID := range keyIDs {
+		if err := insertRegistryTokenRevocation(ctx, tx, nil, &keyID, tokensExpireAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reassignDefaultOrg points a user whose default organization was orgID at
+// their oldest remaining membership, or at their personal organization when
+// they have none left.
+func reassignDefaultOrg(ctx context.Context, tx pgx.Tx, userID, orgID uuid.UUID) error {
+	var sub string
+	var defaultOrgID uuid.UUID
+	const userCmd = `SELECT sub, tenant_id FROM users WHERE id = $1`
+	if err := tx.QueryRow(ctx, userCmd, userID).Scan(&sub, &defaultOrgID); err != nil {
+		return err
+	}
+	if defaultOrgID != orgID {
+		return nil
+	}
+
+	var nextID uuid.UUID
+	const nextCmd = `SELECT org_id FROM org_members WHERE user_id = $1 ORDER BY created_at ASC LIMIT 1`
+	err := tx.QueryRow(ctx, nextCmd, userID).Scan(&nextID)
+	switch {
+	case isNoRows(err):
+		if nextID, err = upsertTenant(ctx, tx, personalTenantName(sub)); err != nil {
+			return err
+		}
+		if _, err := addOrgMemberTx(ctx, tx, nextID, userID, OrgRoleOwner); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE users SET tenant_id = $2 WHERE id = $1`, userID, nextID)
+	return err
+}
+
+func lockOrgMemberRole(ctx context.Context, tx pgx.Tx, orgID, userID uuid.UUID) (OrgRole, error) {
+	// Lock every owner row too, so concurrent demotions cannot both pass the
+	// last-owner check.
+	const lockCmd = `SELECT user_id, role FROM org_members
+		WHERE org_id = $1 AND (user_id = $2 OR role = 'owner')
+		FOR UPDATE`
+	rows, err := tx.Query(ctx, lockCmd, orgID, userID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var current OrgRole
+	for rows.Next() {
+		var id uuid.UUID
+		var role OrgRole
+		if err := rows.Scan(&id, &role); err != nil {
+			return "", err
+		}
+		if id == userID {
+			current = role
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	if current == "" {
+		return "", ErrNotFound
+	}
+	return current, nil
+}
+
+func ensureAnotherOwner(ctx context.Context, tx pgx.Tx, orgID, userID uuid.UUID) error {
+	const cmd = `SELECT EXISTS(
+		SELECT 1 FROM org_members WHERE org_id = $1 AND user_id <> $2 AND role = 'owner'
+	)`
+	var exists bool
+	if err := tx.QueryRow(ctx, cmd, orgID, userID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+// addOrgMemberTx adds a membership unless one already exists, reporting
+// whether it was added.
+func addOrgMemberTx(ctx context.Context, tx pgx.Tx, orgID, userID uuid.UUID, role OrgRole) (bool, error) {
+	const cmd = `INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (org_id, user_id) DO NOTHING`
+	tag, err := tx.Exec(ctx, cmd, orgID, userID, role)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// defaultJoinRole is the role of a user joining an organization without an
+// invitation: owner of an empty organization, member otherwise.
+func defaultJoinRole(ctx context.Context, tx pgx.Tx, orgID uuid.UUID) (OrgRole, error) {
+	var hasMembers bool
+	const cmd = `SELECT EXISTS(SELECT 1 FROM org_members WHERE org_id = $1)`
+	if err := tx.QueryRow(ctx, cmd, orgID).Scan(&hasMembers); err != nil {
+		return "", err
+	}
+	if hasMembers {
+		return OrgRoleMember, nil
+	}
+	return OrgRoleOwner, nil
+}
+
+type CreateOrgInvitationArgs struct {
+	OrgID     uuid.UUID
+	Email     string
+	Role      OrgRole
+	InvitedBy uuid.UUID
+	ExpiresAt time.Time
+}
+
+// CreateOrgInvitation records a pending invitation. An expired pending
+// invitation for the same address is replaced; a live one is a conflict.
+func (d *DB) CreateOrgInvitation(ctx context.Context, args CreateOrgInvitationArgs) (OrgInvitation, error) {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return OrgInvitation{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	const deleteExpiredCmd = `DELETE FROM org_invitations
+		WHERE org_id = $1 AND email = $2 AND accepted_at IS NULL AND expires_at <= NOW()`
+	if _, err := tx.Exec(ctx, deleteExpiredCmd, args.OrgID, args.Email); err != nil {
+		return OrgInvitation{}, err
+	}
+
+	inv := OrgInvitation{
+		ID:        uuid.New(),
+		OrgID:     args.OrgID,
+		Email:     args.Email,
+		Role:      args.Role,
+		InvitedBy: &args.InvitedBy,
+		ExpiresAt: args.ExpiresAt,
+	}
+	const insertCmd = `INSERT INTO org_invitations (id, org_id, email, role, invited_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at`
+	err = tx.QueryRow(ctx, insertCmd, inv.ID, inv.OrgID, inv.Email, inv.Role, inv.InvitedBy, inv.ExpiresAt).Scan(&inv.CreatedAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return OrgInvitation{}, ErrConflict
+		}
+		return OrgInvitation{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return OrgInvitation{}, err
+	}
+	return inv, nil
+}
+
+func (d *DB) SetOrgInvitationWorkOSID(ctx context.Context, id uuid.UUID, workosInvitationID string) error {
+	const cmd = `UPDATE org_invitations SET workos_invitation_id = $2 WHERE id = $1`
+	_, err := d.conn.Exec(ctx, cmd, id, workosInvitationID)
+	return err
+}
+
+func (d *DB) ListPendingOrgInvitations(ctx context.Context, orgID uuid.UUID) ([]OrgInvitation, error) {
+	const cmd = `SELECT id, org_id, email, role, invited_by, workos_invitation_id, created_at, expires_at, accepted_at
+		FROM org_invitations
+		WHERE org_id = $1 AND accepted_at IS NULL AND expires_at > NOW()
+		ORDER BY created_at DESC`
+	rows, err := d.conn.Query(ctx, cmd, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := make([]OrgInvitation, 0)
+	for rows.Next() {
+		inv, err := scanOrgInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+// DeleteOrgInvitation removes a pending invitation and returns it.
+func (d *DB) DeleteOrgInvitation(ctx context.Context, orgID, id uuid.UUID) (OrgInvitation, error) {
+	const cmd = `DELETE FROM org_invitations
+		WHERE org_id = $1 AND id = $2 AND accepted_at IS NULL
+		RETURNING id, org_id, email, role, invited_by, workos_invitation_id, created_at, expires_at, accepted_at`
+	inv, err := scanOrgInvitation(d.conn.QueryRow(ctx, cmd, orgID, id))
+	if err != nil {
+		if isNoRows(err) {
+			return OrgInvitation{}, ErrNotFound
+		}
+		return OrgInvitation{}, err
+	}
+	return inv, nil
+}
+
+func scanOrgInvitation(row pgx.Row) (OrgInvitation, error) {
+	var inv OrgInvitation
+	err := row.Scan(
+		&inv.ID,
+		&inv.OrgID,
+		&inv.Email,
+		&inv.Role,
+		&inv.InvitedBy,
+		&inv.WorkOSInvitationID,
+		&inv.CreatedAt,
+		&inv.ExpiresAt,
+		&inv.AcceptedAt,
+	)
+	return inv, err
+}
+
+// lockPendingOrgInvitation returns the oldest live invitation for email,
+// restricted to orgID when it is set, locked until tx ends. It returns
+// ErrNotFound when there is none.
+func lockPendingOrgInvitation(ctx context.Context, tx pgx.Tx, email string, orgID *uuid.UUID) (OrgInvitation, error) {
+	const cmd = `SELECT id, org_id, email, role, invited_by, workos_invitation_id, created_at, expires_at, accepted_at
+		FROM org_invitations
+		WHERE email = $1
+			AND ($2::uuid IS NULL OR org_id = $2)
+			AND accepted_at IS NULL
+			AND expires_at > NOW()
+		ORDER BY created_at ASC
+		LIMIT 1
+		FOR UPDATE`
+	inv, err := scanOrgInvitation(tx.QueryRow(ctx, cmd, email, orgID))
+	if err != nil {
+		if isNoRows(err) {
+			return OrgInvitation{}, ErrNotFound
+		}
+		return OrgInvitation{}, err
+	}
+	return inv, nil
+}
+
+func markOrgInvitationAccepted(ctx context.Context, tx pgx.Tx, id, userID uuid.UUID) error {
+	const cmd = `UPDATE org_invitations SET accepted_at = NOW(), accepted_by = $2 WHERE id = $1`
+	_, err := tx.Exec(ctx, cmd, id, userID)
+	return err
+}
+
+func (d *DB) CreateOrganization(ctx context.Context, name string) (Organization, error) {
+	const cmd = `INSERT INTO tenants (id, name) VALUES ($1, $2)`
+	org := Organization{ID: uuid.New(), Name: name}
+	if _, err := d.conn.Exec(ctx, cmd, org.ID, org.Name); err != nil {
+		if isUniqueViolation(err) {
+			return Organization{}, ErrConflict
+		}
+		return Organization{}, err
+	}
+	return org, nil
+}
+
+func personalTenantName(sub string) string {
+	return "personal__" + sub
+}
+
+// upsertTenant returns the ID of the tenant named name, creating it if needed.
+// The tenant row stays locked until tx ends, so concurrent first members
+// agree on who becomes owner.
+func upsertTenant(ctx context.Context, tx pgx.Tx, name string) (uuid.UUID, error) {
+	const cmd = `INSERT INTO tenants (id, name)
+		VALUES (gen_random_uuid(), $1)
+		ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+		RETURNING id`
+	var id uuid.UUID
+	if err := tx.QueryRow(ctx, cmd, name).Scan(&id); err != nil {
+		return uuid.Nil, err
+	}
+	return id, nil
+}
@@ -0,0 +1,52 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSyncUserOrgKeepsEarlierMemberships(t *testing.T) {
+	tx := beginTestTx(t)
+	ctx := context.Background()
+
+	first, userID := uuid.New(), uuid.New()
+	testExec(t, tx, `INSERT INTO tenants (id, name) VALUES ($1, $2)`, first, "t-"+first.String())
+	testExec(t, tx, `INSERT INTO users (id, tenant_id, sub) VALUES ($1, $2, $3)`, userID, first, "sub-"+userID.String())
+	testExec(t, tx, `INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, 'admin')`, first, userID)
+
+	// Signing in through a second identity provider organization makes it the
+	// user's default without taking them out of the first.
+	u, err := syncUserOrg(ctx, tx, userID, "t-"+uuid.NewString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.TenantID == first || u.Role != OrgRoleOwner {
+		t.Fatalf("synced user %+v, want owner of the new organization", u)
+	}
+
+	memberships, err := listUserMemberships(ctx, tx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles := map[uuid.UUID]OrgRole{}
+	for _, m := range memberships {
+		roles[m.OrgID] = m.Role
+	}
+	if len(roles) != 2 || roles[first] != OrgRoleAdmin || roles[u.TenantID] != OrgRoleOwner {
+		t.Fatalf("memberships = %+v, want the first organization and the new one", memberships)
+	}
+
+	// Signing in through the first organization again switches back to it,
+	// keeping its role.
+	if u, err = syncUserOrg(ctx, tx, userID, "t-"+first.String()); err != nil {
+		t.Fatal(err)
+	}
+	if u.TenantID != first || u.Role != OrgRoleAdmin {
+		t.Fatalf("synced user %+v, want admin of the first organization", u)
+	}
+	if memberships, err = listUserMemberships(ctx, tx, userID); err != nil || len(memberships) != 2 {
+		t.Fatalf("memberships = %+v, %v, want both kept", memberships, err)
+	}
+}
@@ -0,0 +1,208 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrUnknownPlan is returned when assigning or pricing a plan that does not
+// exist.
+var ErrUnknownPlan = errors.New("unknown plan")
+
+type Plan struct {
+	Name        string
+	Description string
+	CreatedAt   time.Time
+}
+
+// PlanPrice is a plan's usage pricing from EffectiveFrom until its next
+// price. Included allowances and MinimumChargeUSD are per calendar month.
+type PlanPrice struct {
+	Plan                     string
+	EffectiveFrom            time.Time
+	StorageUSDPerGiBMonth    *big.Rat
+	PushUSDPerOp             *big.Rat
+	PullUSDPerOp             *big.Rat
+	PullUSDPerGiB            *big.Rat
+	IncludedStorageGiBMonths *big.Rat
+	IncludedPushOps          int64
+	IncludedPullOps          int64
+	IncludedPullGiB          *big.Rat
+	MinimumChargeUSD         *big.Rat
+}
+
+// TenantPlanChange is a tenant moving onto Plan at EffectiveFrom.
+type TenantPlanChange struct {
+	EffectiveFrom time.Time
+	Plan          string
+}
+
+func (d *DB) ListPlans(ctx context.Context) ([]Plan, error) {
+	const cmd = `SELECT name, description, created_at FROM plans ORDER BY name ASC`
+	rows, err := d.conn.Query(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Plan, error) {
+		var p Plan
+		err := row.Scan(&p.Name, &p.Description, &p.CreatedAt)
+		return p, err
+	})
+}
+
+// UpsertPlan creates the named plan or updates its description.
+func (d *DB) UpsertPlan(ctx context.Context, name, description string) (Plan, error) {
+	const cmd = `INSERT INTO plans (name, description) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET description = EXCLUDED.description
+		RETURNING name, description, created_at`
+	var p Plan
+	if err := d.conn.QueryRow(ctx, cmd, strings.TrimSpace(name), strings.TrimSpace(description)).Scan(&p.Name, &p.Description, &p.CreatedAt); err != nil {
+		return Plan{}, err
+	}
+	return p, nil
+}
+
+// ListPlanPrices returns the prices of the given plans, or of every plan when
+// plans is nil, ordered by plan and effective time.
+func (d *DB) ListPlanPrices(ctx context.Context, plans []string) ([]PlanPrice, error) {
+	const cmd = `SELECT plan, effective_from,
+			storage_usd_per_gib_month::TEXT, push_usd_per_op::TEXT, pull_usd_per_op::TEXT, pull_usd_per_gib::TEXT,
+			included_storage_gib_months::TEXT, included_push_ops, included_pull_ops, included_pull_gib::TEXT,
+			minimum_charge_usd::TEXT
+		FROM plan_prices
+		WHERE $1::TEXT[] IS NULL OR plan = ANY($1)
+		ORDER BY plan ASC, effective_from ASC`
+	rows, err := d.conn.Query(ctx, cmd, plans)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (PlanPrice, error) {
+		var p PlanPrice
+		var storage, push, pull, pullGiB, includedStorage, includedPullGiB, minimum string
+		if err := row.Scan(&p.Plan, &p.EffectiveFrom, &storage, &push, &pull, &pullGiB, &includedStorage, &p.IncludedPushOps, &p.IncludedPullOps, &includedPullGiB, &minimum); err != nil {
+			return PlanPrice{}, err
+		}
+		for _, f := range []struct {
+			dst **big.Rat
+			raw string
+		}{
+			{&p.StorageUSDPerGiBMonth, storage},
+			{&p.PushUSDPerOp, push},
+			{&p.PullUSDPerOp, pull},
+			{&p.PullUSDPerGiB, pullGiB},
+			{&p.IncludedStorageGiBMonths, includedStorage},
+			{&p.IncludedPullGiB, includedPullGiB},
+			{&p.MinimumChargeUSD, minimum},
+		} {
+			r, ok := new(big.Rat).SetString(f.raw)
+			if !ok {
+				return PlanPrice{}, fmt.Errorf("invalid price %q for plan %s", f.raw, p.Plan)
+			}
+			*f.dst = r
+		}
+		p.EffectiveFrom = p.EffectiveFrom.UTC()
+		return p, nil
+	})
+}
+
+// AddPlanPrice adds a price to a plan. It returns ErrUnknownPlan if the plan
+// does not exist and ErrConflict if it already has a price effective at the
+// same time.
+func (d *DB) AddPlanPrice(ctx context.Context, p PlanPrice) error {
+	const cmd = `INSERT INTO plan_prices (
+			plan, effective_from,
+			storage_usd_per_gib_month, push_usd_per_op, pull_usd_per_op, pull_usd_per_gib,
+			included_storage_gib_months, included_push_ops, included_pull_ops, included_pull_gib,
+			minimum_charge_usd
+		)
+		SELECT name, $2, $3::NUMERIC, $4::NUMERIC, $5::NUMERIC, $6::NUMERIC, $7::NUMERIC, $8, $9, $10::NUMERIC, $11::NUMERIC
+		FROM plans WHERE name = $1`
+	tag, err := d.conn.Exec(ctx, cmd,
+		p.Plan, p.EffectiveFrom,
+		numericString(p.StorageUSDPerGiBMonth), numericString(p.PushUSDPerOp), numericString(p.PullUSDPerOp), numericString(p.PullUSDPerGiB),
+		numericString(p.IncludedStorageGiBMonths), p.IncludedPushOps, p.IncludedPullOps, numericString(p.IncludedPullGiB),
+		numericString(p.MinimumChargeUSD),
+	)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrConflict
+		}
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUnknownPlan
+	}
+	return nil
+}
+
+// ParsePlanAmount parses a non-negative decimal rate, allowance or charge
+// such as "0.02". Fractions and exponents are rejected so that amounts are
+// stored exactly as written.
+func ParsePlanAmount(raw string) (*big.Rat, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, fmt.Errorf("amount is required")
+	}
+	if strings.ContainsAny(raw, "/eE") {
+		return nil, fmt.Errorf("amount %q must be a decimal number", raw)
+	}
+	r, ok := new(big.Rat).SetString(raw)
+	if !ok {
+		return nil, fmt.Errorf("amount %q must be a decimal number", raw)
+	}
+	if r.Sign() < 0 {
+		return nil, fmt.Errorf("amount %q must not be negative", raw)
+	}
+	return r, nil
+}
+
+// numericString formats r for a NUMERIC column.
+func numericString(r *big.Rat) string {
+	if r == nil {
+		return "0"
+	}
+	s := r.FloatString(18)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// ListTenantPlanChanges returns the plan the tenant was on at from, as a
+// change effective at from, followed by its plan changes in (from, to),
+// ordered by time.
+func (d *DB) ListTenantPlanChanges(ctx context.Context, tenantID uuid.UUID, from, to time.Time) ([]TenantPlanChange, error) {
+	const cmd = `SELECT $2::TIMESTAMPTZ, COALESCE(
+			(SELECT plan FROM tenant_plan_changes
+			 WHERE tenant_id = $1 AND effective_from <= $2
+			 ORDER BY effective_from DESC
+			 LIMIT 1),
+			(SELECT plan FROM tenants WHERE id = $1)
+		)
+		UNION ALL
+		SELECT effective_from, plan FROM tenant_plan_changes
+		WHERE tenant_id = $1 AND effective_from > $2 AND effective_from < $3
+		ORDER BY 1 ASC`
+	rows, err := d.conn.Query(ctx, cmd, tenantID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (TenantPlanChange, error) {
+		var c TenantPlanChange
+		var plan *string
+		if err := row.Scan(&c.EffectiveFrom, &plan); err != nil {
+			return TenantPlanChange{}, err
+		}
+		if plan == nil {
+			return TenantPlanChange{}, ErrNotFound
+		}
+		c.EffectiveFrom = c.EffectiveFrom.UTC()
+		c.Plan = *plan
+		return c, nil
+	})
+}
@@ -0,0 +1,81 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// DefaultPlan is the plan of tenants that have not been assigned one.
+const DefaultPlan = "default"
+
+type RateLimitPolicy struct {
+	Plan      string
+	Class     string
+	Subject   string
+	PerMinute int
+	Burst     int
+}
+
+func (d *DB) ListRateLimitPolicies(ctx context.Context) ([]RateLimitPolicy, error) {
+	const cmd = `SELECT plan, class, subject, per_minute, burst FROM rate_limit_policies`
+	rows, err := d.conn.Query(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (RateLimitPolicy, error) {
+		var p RateLimitPolicy
+		err := row.Scan(&p.Plan, &p.Class, &p.Subject, &p.PerMinute, &p.Burst)
+		return p, err
+	})
+}
+
+func (d *DB) GetTenantPlan(ctx context.Context, tenantID uuid.UUID) (string, error) {
+	const cmd = `SELECT plan FROM tenants WHERE id = $1`
+	var plan string
+	if err := d.conn.QueryRow(ctx, cmd, tenantID).Scan(&plan); err != nil {
+		if isNoRows(err) {
+			return "", ErrNotFound
+		}
+		return "", err
+	}
+	return plan, nil
+}
+
+// TakeRateLimit spends one request from the bucket named key using the
+// generic cell rate algorithm: a request at now is allowed when the bucket's
+// theoretical arrival time is at most tolerance ahead of now, and then pushes
+// it interval further. It returns the bucket's arrival time after the request
+// and whether the request was allowed.
+func (d *DB) TakeRateLimit(ctx context.Context, key string, now time.Time, interval, tolerance time.Duration) (time.Time, bool, error) {
+	// SET expressions see the row as it was before the update, so allowed and
+	// tat are decided on the same state.
+	const cmd = `INSERT INTO rate_limit_buckets AS b (key, tat, allowed)
+		VALUES ($1, $2::timestamptz + $3::interval, TRUE)
+		ON CONFLICT (key) DO UPDATE SET
+			allowed = GREATEST(b.tat, $2) - $2 <= $4::interval,
+			tat = CASE
+				WHEN GREATEST(b.tat, $2) - $2 <= $4::interval THEN GREATEST(b.tat, $2) + $3::interval
+				ELSE b.tat
+			END
+		RETURNING tat, allowed`
+	var tat time.Time
+	var allowed bool
+	if err := d.conn.QueryRow(ctx, cmd, key, now, interval, tolerance).Scan(&tat, &allowed); err != nil {
+		return time.Time{}, false, err
+	}
+	return tat, allowed, nil
+}
+
+// DeleteIdleRateLimitBuckets drops buckets whose arrival time is before
+// before; such buckets are full, which is the same as having no row.
+func (d *DB) DeleteIdleRateLimitBuckets(ctx context.Context, before time.Time) (int64, error) {
+	const cmd = `DELETE FROM rate_limit_buckets WHERE tat < $1`
+	tag, err := d.conn.Exec(ctx, cmd, before)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type RegistryRefreshToken struct {
+	ID         uuid.UUID
+	APIKeyID   uuid.UUID
+	ClientID   string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+type AddRegistryRefreshTokenArgs struct {
+	APIKeyID  uuid.UUID
+	TokenHash string
+	ClientID  string
+	ExpiresAt time.Time
+}
+
+func (d *DB) AddRegistryRefreshToken(ctx context.Context, args AddRegistryRefreshTokenArgs) (RegistryRefreshToken, error) {
+	token := RegistryRefreshToken{
+		ID:        uuid.New(),
+		APIKeyID:  args.APIKeyID,
+		ClientID:  args.ClientID,
+		ExpiresAt: args.ExpiresAt,
+	}
+
+	const cmd = `INSERT INTO registry_refresh_tokens (id, api_key_id, token_hash, client_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at`
+	err := d.conn.QueryRow(
+		ctx,
+		cmd,
+		token.ID,
+		token.APIKeyID,
+		args.TokenHash,
+		token.ClientID,
+		token.ExpiresAt,
+	).Scan(&token.CreatedAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return RegistryRefreshToken{}, ErrConflict
+		}
+		return RegistryRefreshToken{}, err
+	}
+	return token, nil
+}
+
+// GetLiveRegistryRefreshToken looks up an unrevoked, unexpired refresh token
+// by hash. ErrNotFound covers unknown, revoked and expired tokens alike so
+// callers cannot distinguish them.
+func (d *DB) GetLiveRegistryRefreshToken(ctx context.Context, tokenHash string) (RegistryRefreshToken, error) {
+	const cmd = `SELECT id, api_key_id, client_id, created_at, expires_at, last_used_at, revoked_at
+		FROM registry_refresh_tokens
+		WHERE token_hash = $1
+		  AND revoked_at IS NULL
+		  AND expires_at > NOW()`
+	var token RegistryRefreshToken
+	err := d.conn.QueryRow(ctx, cmd, tokenHash).Scan(
+		&token.ID,
+		&token.APIKeyID,
+		&token.ClientID,
+		&token.CreatedAt,
+		&token.ExpiresAt,
+		&token.LastUsedAt,
+		&token.RevokedAt,
+	)
+	if err != nil {
+		if isNoRows(err) {
+			return RegistryRefreshToken{}, ErrNotFound
+		}
+		return RegistryRefreshToken{}, err
+	}
+	return token, nil
+}
+
+// MarkRegistryRefreshTokenUsed records a use of a live refresh token. It
+// returns ErrNotFound when the token was revoked or expired since it was
+// looked up.
+func (d *DB) MarkRegistryRefreshTokenUsed(ctx context.Context, id uuid.UUID) error {
+	const cmd = `UPDATE registry_refresh_tokens
+		SET last_used_at = NOW()
+		WHERE id = $1
+		  AND revoked_at IS NULL
+		  AND expires_at > NOW()`
+	tag, err := d.conn.Exec(ctx, cmd, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RevokeRegistryRefreshTokensByAPIKey revokes every live refresh token issued
+// for an API key owned by the user. It returns ErrNotFound when the user does
+// not own the key or it is not scoped to the organization.
+func (d *DB) RevokeRegistryRefreshTokensByAPIKey(ctx context.Context, userID, orgID, apiKeyID uuid.UUID) (int64, error) {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockOrgAPIKey(ctx, tx, userID, orgID, apiKeyID); err != nil {
+		return 0, err
+	}
+
+	const revokeCmd = `UPDATE registry_refresh_tokens
+		SET revoked_at = NOW()
+		WHERE api_key_id = $1 AND revoked_at IS NULL`
+	tag, err := tx.Exec(ctx, revokeCmd, apiKeyID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
@@ -13,6 +13,9 @@ type Registry struct {
 	Name                string
 	CachedSizeBytes     int64
 	CachedSizeUpdatedAt *time.Time
+	AllowedCIDRs        []string
+	State               AccessState
+	StateReason         string
 }
 
 type AddRegistryArgs struct {
@@ -22,9 +25,11 @@ type AddRegistryArgs struct {
 
 func (d *DB) AddRegistry(ctx context.Context, args AddRegistryArgs) (Registry, error) {
 	registry := Registry{
-		ID:       uuid.New(),
-		TenantID: args.OrgID,
-		Name:     args.Name,
+		ID:           uuid.New(),
+		TenantID:     args.OrgID,
+		Name:         args.Name,
+		AllowedCIDRs: []string{},
+		State:        AccessStateActive,
 	}
 
 	const cmd = `INSERT INTO registries (id, tenant_id, name)
@@ -46,6 +51,9 @@ type AddRegistryWithKeyArgs struct {
 	KeyName         string
 	SecretEncrypted string
 	Prefix          string
+	// AllowedCIDRs is the default key's client address allowlist; empty
+	// leaves it unrestricted.
+	AllowedCIDRs []string
 }
 
 type AddRegistryWithKeyResult struct {
@@ -63,9 +71,11 @@ func (d *DB) AddRegistryWithKey(ctx context.Context, args AddRegistryWithKeyArgs
 	defer tx.Rollback(ctx)
 
 	registry := Registry{
-		ID:       uuid.New(),
-		TenantID: args.OrgID,
-		Name:     args.Name,
+		ID:           uuid.New(),
+		TenantID:     args.OrgID,
+		Name:         args.Name,
+		AllowedCIDRs: []string{},
+		State:        AccessStateActive,
 	}
 	const insertRegistryCmd = `INSERT INTO registries (id, tenant_id, name) VALUES ($1, $2, $3)`
 	if _, err := tx.Exec(ctx, insertRegistryCmd, registry.ID, registry.TenantID, registry.Name); err != nil {
@@ -81,13 +91,17 @@ func (d *DB) AddRegistryWithKey(ctx context.Context, args AddRegistryWithKeyArgs
 		KeyName:         args.KeyName,
 		Prefix:          args.Prefix,
 		SecretEncrypted: args.SecretEncrypted,
+		AllowedCIDRs:    args.AllowedCIDRs,
 		Scopes:          make([]APIKeyScope, 0, 1),
 	}
-	const insertKeyCmd = `INSERT INTO api_keys (id, user_id, name, secret_encrypted, prefix)
-		VALUES ($1, $2, $3, $4, $5)
+	if apiKey.AllowedCIDRs == nil {
+		apiKey.AllowedCIDRs = []string{}
+	}
+	const insertKeyCmd = `INSERT INTO api_keys (id, user_id, name, secret_encrypted, prefix, allowed_cidrs)
+		VALUES ($1, $2, $3, $4, $5, $6)
 		RETURNING created_at`
 	if err := tx.QueryRow(ctx, insertKeyCmd,
-		apiKey.ID, apiKey.UserID, apiKey.KeyName, apiKey.SecretEncrypted, apiKey.Prefix,
+		apiKey.ID, apiKey.UserID, apiKey.KeyName, apiKey.SecretEncrypted, apiKey.Prefix, apiKey.AllowedCIDRs,
 	).Scan(&apiKey.CreatedAt); err != nil {
 		return AddRegistryWithKeyResult{}, err
 	}
@@ -115,7 +129,7 @@ func (d *DB) AddRegistryWithKey(ctx context.Context, args AddRegistryWithKeyArgs
 }
 
 func (d *DB) ListRegistriesByOrg(ctx context.Context, orgID uuid.UUID) ([]Registry, error) {
-	const cmd = `SELECT id, tenant_id, name, cached_size_bytes, cached_size_updated_at
+	const cmd = `SELECT id, tenant_id, name, cached_size_bytes, cached_size_updated_at, allowed_cidrs, state, state_reason
 		FROM registries
 		WHERE tenant_id = $1
 		ORDER BY name ASC`
@@ -134,6 +148,9 @@ func (d *DB) ListRegistriesByOrg(ctx context.Context, orgID uuid.UUID) ([]Regist
 			&registry.Name,
 			&registry.CachedSizeBytes,
 			&registry.CachedSizeUpdatedAt,
+			&registry.AllowedCIDRs,
+			&registry.State,
+			&registry.StateReason,
 		); err != nil {
 			return nil, err
 		}
@@ -146,7 +163,7 @@ func (d *DB) ListRegistriesByOrg(ctx context.Context, orgID uuid.UUID) ([]Regist
 }
 
 func (d *DB) GetRegistryByID(ctx context.Context, id uuid.UUID) (Registry, error) {
-	const cmd = `SELECT id, tenant_id, name, cached_size_bytes, cached_size_updated_at
+	const cmd = `SELECT id, tenant_id, name, cached_size_bytes, cached_size_updated_at, allowed_cidrs, state, state_reason
 		FROM registries
 		WHERE id = $1`
 	var registry Registry
@@ -156,6 +173,9 @@ func (d *DB) GetRegistryByID(ctx context.Context, id uuid.UUID) (Registry, error
 		&registry.Name,
 		&registry.CachedSizeBytes,
 		&registry.CachedSizeUpdatedAt,
+		&registry.AllowedCIDRs,
+		&registry.State,
+		&registry.StateReason,
 	)
 	if err != nil {
 		if isNoRows(err) {
@@ -167,7 +187,7 @@ func (d *DB) GetRegistryByID(ctx context.Context, id uuid.UUID) (Registry, error
 }
 
 func (d *DB) GetRegistryByName(ctx context.Context, name string) (Registry, error) {
-	const cmd = `SELECT id, tenant_id, name, cached_size_bytes, cached_size_updated_at
+	const cmd = `SELECT id, tenant_id, name, cached_size_bytes, cached_size_updated_at, allowed_cidrs, state, state_reason
 		FROM registries
 		WHERE name = $1`
 	var registry Registry
@@ -177,6 +197,9 @@ func (d *DB) GetRegistryByName(ctx context.Context, name string) (Registry, erro
 		&registry.Name,
 		&registry.CachedSizeBytes,
 		&registry.CachedSizeUpdatedAt,
+		&registry.AllowedCIDRs,
+		&registry.State,
+		&registry.StateReason,
 	)
 	if err != nil {
 		if isNoRows(err) {
@@ -187,6 +210,18 @@ func (d *DB) GetRegistryByName(ctx context.Context, name string) (Registry, erro
 	return registry, nil
 }
 
+func (d *DB) SetRegistryAllowedCIDRs(ctx context.Context, id, orgID uuid.UUID, cidrs []string) error {
+	const cmd = `UPDATE registries SET allowed_cidrs = $3 WHERE id = $1 AND tenant_id = $2`
+	tag, err := d.conn.Exec(ctx, cmd, id, orgID, cidrs)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
 func (d *DB) DeleteRegistryByIDAndOrg(ctx context.Context, id, orgID uuid.UUID) error {
 	const cmd = `DELETE FROM registries WHERE id = $1 AND tenant_id = $2`
 	tag, err := d.conn.Exec(ctx, cmd, id, orgID)
@@ -79,6 +79,10 @@ func (d *DB) NoteObjectExistenceCheck(ctx context.Context, digest string) error
 	return err
 }
 
+// UpsertManifest stores the manifest in the repository, creating it if
+// needed, and links the manifest and its blobs to it. It returns a
+// *StorageQuotaExceededError, storing nothing, when the objects the
+// repository does not already store would exceed a hard limit.
 func (d *DB) UpsertManifest(ctx context.Context, args UpsertManifestArgs) error {
 	repository := strings.TrimSpace(args.Repository)
 	manifestDigest := strings.TrimSpace(args.ManifestDigest)
@@ -129,6 +133,11 @@ func (d *DB) UpsertManifest(ctx context.Context, args UpsertManifestArgs) error
 		return err
 	}
 
+	repositoryDigests := append([]string{manifestDigest}, dedupeNonEmpty(args.BlobDigests)...)
+	if err := enforceStorageQuotas(ctx, tx, args.RegistryID, repositoryID, repositoryDigests); err != nil {
+		return err
+	}
+
 	const upsertRepoObjCmd = `INSERT INTO repository_objects (repository_id, digest)
 		VALUES ($1, $2)
 		ON CONFLICT DO NOTHING`
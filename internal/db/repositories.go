@@ -66,6 +66,43 @@ func (d *DB) TouchRegistryRepositoryPush(ctx context.Context, registryID uuid.UU
 	return repo, nil
 }
 
+// GetRepositoryID returns the id of the named repository in the registry, or
+// ErrNotFound.
+func (d *DB) GetRepositoryID(ctx context.Context, registryID uuid.UUID, name string) (uuid.UUID, error) {
+	const cmd = `SELECT id FROM repositories WHERE registry_id = $1 AND name = $2`
+	var repositoryID uuid.UUID
+	if err := d.conn.QueryRow(ctx, cmd, registryID, strings.TrimSpace(name)).Scan(&repositoryID); err != nil {
+		if isNoRows(err) {
+			return uuid.Nil, ErrNotFound
+		}
+		return uuid.Nil, err
+	}
+	return repositoryID, nil
+}
+
+// GetRepositoryRegistryID returns the id of the registry holding the
+// repository, or ErrNotFound.
+func (d *DB) GetRepositoryRegistryID(ctx context.Context, repositoryID uuid.UUID) (uuid.UUID, error) {
+	const cmd = `SELECT registry_id FROM repositories WHERE id = $1`
+	var registryID uuid.UUID
+	if err := d.conn.QueryRow(ctx, cmd, repositoryID).Scan(&registryID); err != nil {
+		if isNoRows(err) {
+			return uuid.Nil, ErrNotFound
+		}
+		return uuid.Nil, err
+	}
+	return registryID, nil
+}
+
+// RepositoryBelongsToRegistry reports whether the repository id is in the
+// registry.
+func (d *DB) RepositoryBelongsToRegistry(ctx context.Context, repositoryID, registryID uuid.UUID) (bool, error) {
+	const cmd = `SELECT EXISTS (SELECT 1 FROM repositories WHERE id = $1 AND registry_id = $2)`
+	var exists bool
+	err := d.conn.QueryRow(ctx, cmd, repositoryID, registryID).Scan(&exists)
+	return exists, err
+}
+
 func (d *DB) ListRepositoriesByRegistryID(ctx context.Context, registryID uuid.UUID) ([]RegistryRepository, error) {
 	const cmd = `SELECT
 			r.id,
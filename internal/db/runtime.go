@@ -3,6 +3,7 @@ package db
 import (
 	"context"
 	"errors"
+	"strings"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
@@ -14,6 +15,8 @@ var (
 	ErrConflict          = errors.New("conflict")
 	ErrScopeConflict     = errors.New("scope conflict")
 	ErrManifestHasParent = errors.New("manifest is referenced by a parent index")
+	ErrLastOwner         = errors.New("organization must keep at least one owner")
+	ErrUsageBacklog      = errors.New("usage events are still queued or journaled")
 )
 
 type DB struct {
@@ -43,6 +46,16 @@ func isUniqueViolation(err error) bool {
 	return false
 }
 
+// IsRejected reports whether Postgres refused the data written, such as a
+// constraint violation, as opposed to failing to run the statement at all.
+func IsRejected(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")
+	}
+	return false
+}
+
 func isNoRows(err error) bool {
 	return errors.Is(err, pgx.ErrNoRows)
 }
@@ -0,0 +1,517 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	StorageQuotaScopeTenant     = "tenant"
+	StorageQuotaScopeRegistry   = "registry"
+	StorageQuotaScopeRepository = "repository"
+)
+
+type StorageQuota struct {
+	// ID is uuid.Nil for a tenant's limits taken from its plan.
+	ID             uuid.UUID
+	TenantID       uuid.UUID
+	RegistryID     *uuid.UUID
+	RepositoryID   *uuid.UUID
+	SoftLimitBytes *int64
+	HardLimitBytes *int64
+	UpdatedAt      time.Time
+	// Plan names the plan a tenant's limits come from, "" for a quota of
+	// its own.
+	Plan string
+}
+
+// Scope returns which level the quota applies to and the ID of the tenant,
+// registry or repository at that level.
+func (q StorageQuota) Scope() (string, uuid.UUID) {
+	switch {
+	case q.RepositoryID != nil:
+		return StorageQuotaScopeRepository, *q.RepositoryID
+	case q.RegistryID != nil:
+		return StorageQuotaScopeRegistry, *q.RegistryID
+	default:
+		return StorageQuotaScopeTenant, q.TenantID
+	}
+}
+
+// StorageQuotaUsage is a quota with the bytes its scope stores.
+type StorageQuotaUsage struct {
+	Quota StorageQuota
+	// Name is the registry or repository name; "" for tenants.
+	Name      string
+	UsedBytes int64
+	// AddedBytes is what a pending push would add, counting only objects
+	// the scope does not already store.
+	AddedBytes int64
+}
+
+func (u StorageQuotaUsage) ExceedsHardLimit() bool {
+	return u.AddedBytes > 0 && u.Quota.HardLimitBytes != nil && u.UsedBytes+u.AddedBytes > *u.Quota.HardLimitBytes
+}
+
+func (u StorageQuotaUsage) exceedsSoftLimit() bool {
+	return u.Quota.SoftLimitBytes != nil && u.UsedBytes+u.AddedBytes > *u.Quota.SoftLimitBytes
+}
+
+type SetStorageQuotaArgs struct {
+	TenantID uuid.UUID
+	// RegistryID or RepositoryID select the scope; both nil sets the
+	// tenant's own quota.
+	RegistryID     *uuid.UUID
+	RepositoryID   *uuid.UUID
+	SoftLimitBytes *int64
+	HardLimitBytes *int64
+}
+
+const selectStorageQuotaColumns = `id, tenant_id, registry_id, repository_id, soft_limit_bytes, hard_limit_bytes, updated_at`
+
+func scanStorageQuota(row pgx.Row) (StorageQuota, error) {
+	var q StorageQuota
+	err := row.Scan(&q.ID, &q.TenantID, &q.RegistryID, &q.RepositoryID, &q.SoftLimitBytes, &q.HardLimitBytes, &q.UpdatedAt)
+	return q, err
+}
+
+// SetStorageQuota creates or replaces the quota on a scope. It returns
+// ErrNotFound when the registry or repository is not the tenant's.
+func (d *DB) SetStorageQuota(ctx context.Context, args SetStorageQuotaArgs) (StorageQuota, error) {
+	registryID := args.RegistryID
+	conflict := `(tenant_id) WHERE registry_id IS NULL`
+	switch {
+	case args.RepositoryID != nil:
+		const cmd = `SELECT r.registry_id
+			FROM repositories r
+			JOIN registries reg ON reg.id = r.registry_id
+			WHERE r.id = $1 AND reg.tenant_id = $2`
+		var id uuid.UUID
+		if err := d.conn.QueryRow(ctx, cmd, *args.RepositoryID, args.TenantID).Scan(&id); err != nil {
+			if isNoRows(err) {
+				return StorageQuota{}, ErrNotFound
+			}
+			return StorageQuota{}, err
+		}
+		registryID = &id
+		conflict = `(repository_id) WHERE repository_id IS NOT NULL`
+	case args.RegistryID != nil:
+		const cmd = `SELECT EXISTS (SELECT 1 FROM registries WHERE id = $1 AND tenant_id = $2)`
+		var exists bool
+		if err := d.conn.QueryRow(ctx, cmd, *args.RegistryID, args.TenantID).Scan(&exists); err != nil {
+			return StorageQuota{}, err
+		}
+		if !exists {
+			return StorageQuota{}, ErrNotFound
+		}
+		conflict = `(registry_id) WHERE registry_id IS NOT NULL AND repository_id IS NULL`
+	}
+
+	cmd := `INSERT INTO storage_quotas (id, tenant_id, registry_id, repository_id, soft_limit_bytes, hard_limit_bytes)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT ` + conflict + ` DO UPDATE SET
+			soft_limit_bytes = EXCLUDED.soft_limit_bytes,
+			hard_limit_bytes = EXCLUDED.hard_limit_bytes,
+			updated_at = NOW()
+		RETURNING ` + selectStorageQuotaColumns
+	return scanStorageQuota(d.conn.QueryRow(ctx, cmd, uuid.New(), args.TenantID, registryID, args.RepositoryID, args.SoftLimitBytes, args.HardLimitBytes))
+}
+
+// DeleteStorageQuota removes the quota on a scope, selected as for
+// SetStorageQuota, and any open breach of it.
+func (d *DB) DeleteStorageQuota(ctx context.Context, tenantID uuid.UUID, registryID, repositoryID *uuid.UUID) error {
+	var cmd string
+	args := []any{tenantID}
+	scope, scopeID := StorageQuotaScopeTenant, tenantID
+	switch {
+	case repositoryID != nil:
+		cmd = `DELETE FROM storage_quotas WHERE tenant_id = $1 AND repository_id = $2`
+		args = append(args, *repositoryID)
+		scope, scopeID = StorageQuotaScopeRepository, *repositoryID
+	case registryID != nil:
+		cmd = `DELETE FROM storage_quotas WHERE tenant_id = $1 AND registry_id = $2 AND repository_id IS NULL`
+		args = append(args, *registryID)
+		scope, scopeID = StorageQuotaScopeRegistry, *registryID
+	default:
+		cmd = `DELETE FROM storage_quotas WHERE tenant_id = $1 AND registry_id IS NULL`
+	}
+
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, cmd, args...)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	if err := resolveStorageQuotaBreach(ctx, tx, scope, scopeID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// tenantStorageQuota returns the tenant's own quota, or the limits of its
+// plan. ok is false when neither sets any.
+func tenantStorageQuota(ctx context.Context, tx pgx.Tx, tenantID uuid.UUID) (StorageQuota, bool, error) {
+	const cmd = `SELECT ` + selectStorageQuotaColumns + `
+		FROM storage_quotas
+		WHERE tenant_id = $1 AND registry_id IS NULL`
+	quota, err := scanStorageQuota(tx.QueryRow(ctx, cmd, tenantID))
+	if err == nil {
+		return quota, true, nil
+	}
+	if !isNoRows(err) {
+		return StorageQuota{}, false, err
+	}
+
+	const planCmd = `SELECT t.plan, p.soft_limit_bytes, p.hard_limit_bytes
+		FROM tenants t
+		JOIN plan_storage_quotas p ON p.plan = t.plan
+		WHERE t.id = $1`
+	quota = StorageQuota{TenantID: tenantID}
+	if err := tx.QueryRow(ctx, planCmd, tenantID).Scan(&quota.Plan, &quota.SoftLimitBytes, &quota.HardLimitBytes); err != nil {
+		if isNoRows(err) {
+			return StorageQuota{}, false, nil
+		}
+		return StorageQuota{}, false, err
+	}
+	return quota, true, nil
+}
+
+// storageScopeUsage returns the bytes stored by a scope, counting each
+// object once, and which of digests it already stores.
+func storageScopeUsage(ctx context.Context, tx pgx.Tx, scope string, scopeID uuid.UUID, digests []string) (int64, []string, error) {
+	const cmd = `SELECT used_bytes FROM storage_scope_usage WHERE scope = $1 AND scope_id = $2`
+	var used int64
+	if err := tx.QueryRow(ctx, cmd, scope, scopeID).Scan(&used); err != nil && !isNoRows(err) {
+		return 0, nil, err
+	}
+	if len(digests) == 0 {
+		return used, nil, nil
+	}
+
+	var filter string
+	switch scope {
+	case StorageQuotaScopeTenant:
+		filter = `reg.tenant_id = $1`
+	case StorageQuotaScopeRegistry:
+		filter = `r.registry_id = $1`
+	default:
+		filter = `ro.repository_id = $1`
+	}
+	presentCmd := `SELECT ARRAY(
+			SELECT DISTINCT ro.digest
+			FROM repository_objects ro
+			JOIN repositories r ON r.id = ro.repository_id
+			JOIN registries reg ON reg.id = r.registry_id
+			WHERE ` + filter + ` AND ro.digest = ANY($2)
+		)`
+	var present []string
+	if err := tx.QueryRow(ctx, presentCmd, scopeID, digests).Scan(&present); err != nil {
+		return 0, nil, err
+	}
+	return used, present, nil
+}
+
+// lockStorageScopeUsage locks the scope's running total until tx ends. The
+// repository_objects trigger takes the same locks, so objects cannot be
+// linked to the scope meanwhile.
+func lockStorageScopeUsage(ctx context.Context, tx pgx.Tx, scope string, scopeID uuid.UUID) error {
+	const insertCmd = `INSERT INTO storage_scope_usage (scope, scope_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	if _, err := tx.Exec(ctx, insertCmd, scope, scopeID); err != nil {
+		return err
+	}
+	const cmd = `SELECT 1 FROM storage_scope_usage WHERE scope = $1 AND scope_id = $2 FOR UPDATE`
+	_, err := tx.Exec(ctx, cmd, scope, scopeID)
+	return err
+}
+
+// ListStorageQuotaUsage returns the tenant's usage against its own or its
+// plan's limits, whether or not it has any, followed by every registry and
+// repository quota it has set.
+func (d *DB) ListStorageQuotaUsage(ctx context.Context, tenantID uuid.UUID) ([]StorageQuotaUsage, error) {
+	tx, err := d.conn.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	tenantQuota, ok, err := tenantStorageQuota(ctx, tx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		tenantQuota = StorageQuota{TenantID: tenantID}
+	}
+	out := []StorageQuotaUsage{{Quota: tenantQuota}}
+
+	const cmd = `SELECT q.id, q.tenant_id, q.registry_id, q.repository_id, q.soft_limit_bytes, q.hard_limit_bytes, q.updated_at,
+			COALESCE(reg.name || '/' || r.name, reg.name)
+		FROM storage_quotas q
+		JOIN registries reg ON reg.id = q.registry_id
+		LEFT JOIN repositories r ON r.id = q.repository_id
+		WHERE q.tenant_id = $1
+		ORDER BY reg.name, r.name NULLS FIRST`
+	rows, err := tx.Query(ctx, cmd, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	scoped, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (StorageQuotaUsage, error) {
+		var u StorageQuotaUsage
+		q := &u.Quota
+		err := row.Scan(&q.ID, &q.TenantID, &q.RegistryID, &q.RepositoryID, &q.SoftLimitBytes, &q.HardLimitBytes, &q.UpdatedAt, &u.Name)
+		return u, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, scoped...)
+
+	for i := range out {
+		scope, scopeID := out[i].Quota.Scope()
+		if out[i].UsedBytes, _, err = storageScopeUsage(ctx, tx, scope, scopeID, nil); err != nil {
+			return nil, err
+		}
+	}
+	return out, tx.Commit(ctx)
+}
+
+// StorageQuotaExceededError is returned when storing a push would exceed a
+// hard limit.
+type StorageQuotaExceededError struct {
+	Usage StorageQuotaUsage
+}
+
+func (e *StorageQuotaExceededError) Error() string {
+	scope, _ := e.Usage.Quota.Scope()
+	return fmt.Sprintf("%s storage quota exceeded", scope)
+}
+
+// CheckStorageQuotas returns the quotas of the registry's tenant, the
+// registry and the named repository with what storing objects, a map of
+// digest to size, would add to each. When no hard limit would be exceeded it
+// records soft limits the push crosses and resolves those it no longer
+// exceeds. It lets uploads be refused early; UpsertManifest checks the hard
+// limits again while storing the manifest.
+func (d *DB) CheckStorageQuotas(ctx context.Context, registryID uuid.UUID, repository string, objects map[string]int64) ([]StorageQuotaUsage, error) {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	const cmd = `SELECT reg.tenant_id, r.id
+		FROM registries reg
+		LEFT JOIN repositories r ON r.registry_id = reg.id AND r.name = $2
+		WHERE reg.id = $1`
+	var tenantID uuid.UUID
+	var repositoryID *uuid.UUID
+	if err := tx.QueryRow(ctx, cmd, registryID, repository).Scan(&tenantID, &repositoryID); err != nil {
+		if isNoRows(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	out, err := checkStorageQuotas(ctx, tx, tenantID, registryID, repositoryID, objects, false)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(out, StorageQuotaUsage.ExceedsHardLimit) {
+		if err := recordStorageQuotaBreaches(ctx, tx, tenantID, out); err != nil {
+			return nil, err
+		}
+	}
+	return out, tx.Commit(ctx)
+}
+
+// enforceStorageQuotas returns a *StorageQuotaExceededError if linking
+// digests to the repository would exceed a hard limit of its tenant, registry
+// or repository, and otherwise records the soft limits it crosses. The
+// scopes' running totals stay locked until tx ends, so concurrent pushes to
+// them are checked one after another.
+func enforceStorageQuotas(ctx context.Context, tx pgx.Tx, registryID, repositoryID uuid.UUID, digests []string) error {
+	const cmd = `SELECT tenant_id FROM registries WHERE id = $1`
+	var tenantID uuid.UUID
+	if err := tx.QueryRow(ctx, cmd, registryID).Scan(&tenantID); err != nil {
+		if isNoRows(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	const sizesCmd = `SELECT digest, size_bytes FROM objects WHERE digest = ANY($1)`
+	rows, err := tx.Query(ctx, sizesCmd, digests)
+	if err != nil {
+		return err
+	}
+	objects := make(map[string]int64, len(digests))
+	var digest string
+	var size int64
+	if _, err := pgx.ForEachRow(rows, []any{&digest, &size}, func() error {
+		objects[digest] = size
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	usages, err := checkStorageQuotas(ctx, tx, tenantID, registryID, &repositoryID, objects, true)
+	if err != nil {
+		return err
+	}
+	for _, usage := range usages {
+		if usage.ExceedsHardLimit() {
+			return &StorageQuotaExceededError{Usage: usage}
+		}
+	}
+	return recordStorageQuotaBreaches(ctx, tx, tenantID, usages)
+}
+
+// checkStorageQuotas returns the quotas of the tenant, the registry and the
+// repository, nil when the push creates it, with what storing objects would
+// add to each. With lock set it first locks the scopes' running totals, in
+// the order the repository_objects trigger does.
+func checkStorageQuotas(ctx context.Context, tx pgx.Tx, tenantID, registryID uuid.UUID, repositoryID *uuid.UUID, objects map[string]int64, lock bool) ([]StorageQuotaUsage, error) {
+	quotas := make([]StorageQuota, 0, 3)
+	tenantQuota, ok, err := tenantStorageQuota(ctx, tx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		quotas = append(quotas, tenantQuota)
+	}
+	const scopedCmd = `SELECT ` + selectStorageQuotaColumns + `
+		FROM storage_quotas
+		WHERE (registry_id = $1 AND repository_id IS NULL) OR repository_id = $2
+		ORDER BY repository_id NULLS FIRST`
+	rows, err := tx.Query(ctx, scopedCmd, registryID, repositoryID)
+	if err != nil {
+		return nil, err
+	}
+	scoped, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (StorageQuota, error) {
+		return scanStorageQuota(row)
+	})
+	if err != nil {
+		return nil, err
+	}
+	quotas = append(quotas, scoped...)
+	if len(quotas) == 0 {
+		return nil, nil
+	}
+
+	if lock {
+		if err := lockStorageScopeUsage(ctx, tx, StorageQuotaScopeTenant, tenantID); err != nil {
+			return nil, err
+		}
+		if err := lockStorageScopeUsage(ctx, tx, StorageQuotaScopeRegistry, registryID); err != nil {
+			return nil, err
+		}
+		if repositoryID != nil {
+			if err := lockStorageScopeUsage(ctx, tx, StorageQuotaScopeRepository, *repositoryID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	digests := make([]string, 0, len(objects))
+	for digest := range objects {
+		digests = append(digests, digest)
+	}
+	out := make([]StorageQuotaUsage, 0, len(quotas))
+	for _, quota := range quotas {
+		scope, scopeID := quota.Scope()
+		usage := StorageQuotaUsage{Quota: quota}
+		if scope == StorageQuotaScopeRepository && repositoryID == nil {
+			// The repository is created by this push.
+			scopeID = uuid.Nil
+		}
+		var present []string
+		if scopeID != uuid.Nil {
+			if usage.UsedBytes, present, err = storageScopeUsage(ctx, tx, scope, scopeID, digests); err != nil {
+				return nil, err
+			}
+		}
+		for digest, size := range objects {
+			if !slices.Contains(present, digest) {
+				usage.AddedBytes += size
+			}
+		}
+		out = append(out, usage)
+	}
+	return out, nil
+}
+
+// recordStorageQuotaBreaches records the soft limits usages cross and
+// resolves those they no longer exceed.
+func recordStorageQuotaBreaches(ctx context.Context, tx pgx.Tx, tenantID uuid.UUID, usages []StorageQuotaUsage) error {
+	for _, usage := range usages {
+		if usage.Quota.SoftLimitBytes == nil {
+			continue
+		}
+		scope, scopeID := usage.Quota.Scope()
+		if usage.exceedsSoftLimit() {
+			const breachCmd = `INSERT INTO storage_quota_breaches (id, tenant_id, scope, scope_id, limit_bytes, used_bytes)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				ON CONFLICT (scope, scope_id) WHERE resolved_at IS NULL DO NOTHING`
+			if _, err := tx.Exec(ctx, breachCmd, uuid.New(), tenantID, scope, scopeID, *usage.Quota.SoftLimitBytes, usage.UsedBytes+usage.AddedBytes); err != nil {
+				return err
+			}
+		} else if err := resolveStorageQuotaBreach(ctx, tx, scope, scopeID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resolveStorageQuotaBreach(ctx context.Context, tx pgx.Tx, scope string, scopeID uuid.UUID) error {
+	const cmd = `UPDATE storage_quota_breaches
+		SET resolved_at = NOW()
+		WHERE scope = $1 AND scope_id = $2 AND resolved_at IS NULL`
+	_, err := tx.Exec(ctx, cmd, scope, scopeID)
+	return err
+}
+
+type StorageQuotaBreach struct {
+	ID       uuid.UUID
+	TenantID uuid.UUID
+	Scope    string
+	ScopeID  uuid.UUID
+	// RegistryID is the registry a registry or repository breach is in, nil
+	// for the tenant's own quota or a repository that has been deleted.
+	RegistryID *uuid.UUID
+	LimitBytes int64
+	UsedBytes  int64
+	CreatedAt  time.Time
+	ResolvedAt *time.Time
+	NotifiedAt *time.Time
+}
+
+func (d *DB) ListStorageQuotaBreaches(ctx context.Context, tenantID uuid.UUID) ([]StorageQuotaBreach, error) {
+	const cmd = `SELECT b.id, b.tenant_id, b.scope, b.scope_id,
+			CASE b.scope WHEN 'registry' THEN b.scope_id ELSE r.registry_id END,
+			b.limit_bytes, b.used_bytes, b.created_at, b.resolved_at, b.notified_at
+		FROM storage_quota_breaches b
+		LEFT JOIN repositories r ON b.scope = 'repository' AND r.id = b.scope_id
+		WHERE b.tenant_id = $1
+		ORDER BY b.created_at DESC
+		LIMIT 100`
+	rows, err := d.conn.Query(ctx, cmd, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (StorageQuotaBreach, error) {
+		var b StorageQuotaBreach
+		err := row.Scan(&b.ID, &b.TenantID, &b.Scope, &b.ScopeID, &b.RegistryID, &b.LimitBytes, &b.UsedBytes, &b.CreatedAt, &b.ResolvedAt, &b.NotifiedAt)
+		return b, err
+	})
+}
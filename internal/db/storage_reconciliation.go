@@ -0,0 +1,329 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// StorageReconciliation compares a tenant's recorded storage-bytes balance
+// with the bytes of the distinct blobs its repositories actually hold.
+type StorageReconciliation struct {
+	TenantID      uuid.UUID
+	CheckedAt     time.Time
+	ActualBytes   int64
+	RecordedBytes int64
+	// CorrectedBytes is the value of the corrective storage-bytes event
+	// emitted for the drift, or 0 if none was.
+	CorrectedBytes int64
+}
+
+// DriftBytes is how many bytes the recorded balance is short of actual
+// storage; it is negative when tenants are charged for more than they store.
+func (r StorageReconciliation) DriftBytes() int64 {
+	return r.ActualBytes - r.RecordedBytes
+}
+
+// RemainingDriftBytes is the drift left once the correction emitted for it,
+// if any, is counted in the recorded balance.
+func (r StorageReconciliation) RemainingDriftBytes() int64 {
+	return r.DriftBytes() - r.CorrectedBytes
+}
+
+// PlanStorageCorrections returns the measured tenants that have drift,
+// setting CorrectedBytes on those whose drift equals their remaining drift in
+// previous, the previous run's, by tenant. Drift seen once is only recorded.
+func PlanStorageCorrections(measured []StorageReconciliation, previous map[uuid.UUID]int64) []StorageReconciliation {
+	var drifted []StorageReconciliation
+	for _, r := range measured {
+		drift := r.DriftBytes()
+		if drift == 0 {
+			continue
+		}
+		if prev, ok := previous[r.TenantID]; ok && prev == drift {
+			r.CorrectedBytes = drift
+		}
+		drifted = append(drifted, r)
+	}
+	return drifted
+}
+
+// measureStorageCmd returns each tenant's actual and recorded storage, for
+// one tenant or all when $1 is NULL. Being one statement, both are read from
+// the same snapshot. Recorded storage is the last checkpoint of a rolled-up
+// day plus the events since.
+const measureStorageCmd = `WITH state AS (
+		SELECT rolled_through, rolled_through::TIMESTAMP AT TIME ZONE 'UTC' AS rolled_through_at
+		FROM usage_rollup_state
+	),
+	actual AS (
+		SELECT d.tenant_id, SUM(o.size_bytes)::BIGINT AS bytes
+		FROM (
+			SELECT DISTINCT reg.tenant_id, ro.digest
+			FROM repository_objects ro
+			JOIN repositories r ON r.id = ro.repository_id
+			JOIN registries reg ON reg.id = r.registry_id
+			WHERE $1::UUID IS NULL OR reg.tenant_id = $1
+		) d
+		JOIN objects o ON o.digest = d.digest AND o.type = 'blob'
+		GROUP BY d.tenant_id
+	),
+	recorded AS (
+		SELECT b.tenant_id, SUM(b.bytes)::BIGINT AS bytes
+		FROM (
+			(
+				SELECT DISTINCT ON (c.tenant_id) c.tenant_id, c.closing_bytes AS bytes
+				FROM usage_storage_checkpoints c, state
+				WHERE c.day < state.rolled_through AND ($1::UUID IS NULL OR c.tenant_id = $1)
+				ORDER BY c.tenant_id, c.day DESC
+			)
+			UNION ALL
+			SELECT e.tenant_id, SUM(e.value) AS bytes
+			FROM usage_events e, state
+			WHERE e.metric = $2 AND e.created_at >= state.rolled_through_at
+				AND ($1::UUID IS NULL OR e.tenant_id = $1)
+			GROUP BY e.tenant_id
+		) b
+		GROUP BY b.tenant_id
+	)
+	SELECT t.id, COALESCE(a.bytes, 0), COALESCE(r.bytes, 0)
+	FROM tenants t
+	LEFT JOIN actual a ON a.tenant_id = t.id
+	LEFT JOIN recorded r ON r.tenant_id = t.id
+	WHERE $1::UUID IS NULL OR t.id = $1
+	ORDER BY t.id ASC`
+
+func measureStorage(ctx context.Context, tx pgx.Tx, tenantID uuid.UUID, now time.Time) ([]StorageReconciliation, error) {
+	var filter *uuid.UUID
+	if tenantID != uuid.Nil {
+		filter = &tenantID
+	}
+	rows, err := tx.Query(ctx, measureStorageCmd, filter, MetricStorageBytes)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (StorageReconciliation, error) {
+		r := StorageReconciliation{CheckedAt: now}
+		err := row.Scan(&r.TenantID, &r.ActualBytes, &r.RecordedBytes)
+		return r, err
+	})
+}
+
+// MeasureTenantStorage reconciles the tenant's storage without recording or
+// correcting anything, returning ErrNotFound if there is no such tenant.
+func (d *DB) MeasureTenantStorage(ctx context.Context, tenantID uuid.UUID) (StorageReconciliation, error) {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return StorageReconciliation{}, err
+	}
+	defer tx.Rollback(ctx)
+	measured, err := measureStorage(ctx, tx, tenantID, time.Now().UTC())
+	if err != nil {
+		return StorageReconciliation{}, err
+	}
+	if len(measured) == 0 {
+		return StorageReconciliation{}, ErrNotFound
+	}
+	return measured[0], nil
+}
+
+// usageBacklogReplicas counts the replicas reporting usage events they have
+// yet to store.
+func usageBacklogReplicas(ctx context.Context, tx pgx.Tx) (int, error) {
+	const cmd = `SELECT COUNT(*) FROM usage_pipeline_backlogs
+		WHERE pending_events > 0 OR journal_files > 0`
+	var n int
+	err := tx.QueryRow(ctx, cmd).Scan(&n)
+	return n, err
+}
+
+// ReportUsageBacklog records how many usage events the replica has queued
+// and how many journal files it has yet to replay.
+func (d *DB) ReportUsageBacklog(ctx context.Context, replica string, pendingEvents, journalFiles int) error {
+	const cmd = `INSERT INTO usage_pipeline_backlogs (replica, pending_events, journal_files, reported_at)
+		VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (replica) DO UPDATE
+		SET pending_events = EXCLUDED.pending_events,
+			journal_files = EXCLUDED.journal_files,
+			reported_at = EXCLUDED.reported_at`
+	_, err := d.conn.Exec(ctx, cmd, replica, pendingEvents, journalFiles)
+	return err
+}
+
+// ReconcileStorage reconciles every tenant's storage if it was last done at
+// least interval before now, recording each tenant with drift and reporting
+// whether it ran. With repair, drift that is unchanged since the previous
+// run is corrected with a storage-bytes event; drift seen once may just be a
+// push between its blobs and its manifest. Replicas serialize on the
+// reconciliation state row.
+//
+// Recorded storage only counts stored usage events. While any replica
+// reports events still queued or journaled, drift is recorded but not
+// corrected: those events would count again once stored.
+func (d *DB) ReconcileStorage(ctx context.Context, now time.Time, interval time.Duration, repair bool) ([]StorageReconciliation, bool, error) {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var last *time.Time
+	const lockCmd = `SELECT reconciled_at FROM storage_reconciliation_state FOR UPDATE`
+	if err := tx.QueryRow(ctx, lockCmd).Scan(&last); err != nil {
+		return nil, false, err
+	}
+	if last != nil && now.Before(last.Add(interval)) {
+		return nil, false, nil
+	}
+
+	if repair {
+		backlogged, err := usageBacklogReplicas(ctx, tx)
+		if err != nil {
+			return nil, false, err
+		}
+		repair = backlogged == 0
+	}
+	measured, err := measureStorage(ctx, tx, uuid.Nil, now)
+	if err != nil {
+		return nil, false, err
+	}
+
+	previous := map[uuid.UUID]int64{}
+	if repair && last != nil {
+		const previousCmd = `SELECT tenant_id, actual_bytes, recorded_bytes, corrected_bytes
+			FROM storage_reconciliations
+			WHERE checked_at = $1`
+		rows, err := tx.Query(ctx, previousCmd, *last)
+		if err != nil {
+			return nil, false, err
+		}
+		var r StorageReconciliation
+		_, err = pgx.ForEachRow(rows, []any{&r.TenantID, &r.ActualBytes, &r.RecordedBytes, &r.CorrectedBytes}, func() error {
+			previous[r.TenantID] = r.RemainingDriftBytes()
+			return nil
+		})
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	drifted := PlanStorageCorrections(measured, previous)
+	for _, r := range drifted {
+		if r.CorrectedBytes != 0 {
+			if err := insertStorageCorrection(ctx, tx, r.TenantID, r.CorrectedBytes); err != nil {
+				return nil, false, err
+			}
+		}
+		if err := insertStorageReconciliation(ctx, tx, r); err != nil {
+			return nil, false, err
+		}
+	}
+
+	const advanceCmd = `UPDATE storage_reconciliation_state SET reconciled_at = $1`
+	if _, err := tx.Exec(ctx, advanceCmd, now); err != nil {
+		return nil, false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, false, err
+	}
+	return drifted, true, nil
+}
+
+// CorrectTenantStorage reconciles the tenant's storage now, correcting and
+// recording any drift regardless of earlier runs. It returns ErrUsageBacklog
+// while any replica reports usage events it has yet to store.
+func (d *DB) CorrectTenantStorage(ctx context.Context, tenantID uuid.UUID, now time.Time) (StorageReconciliation, error) {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return StorageReconciliation{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	r, err := correctTenantStorage(ctx, tx, tenantID, now)
+	if err != nil {
+		return StorageReconciliation{}, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return StorageReconciliation{}, err
+	}
+	return r, nil
+}
+
+func correctTenantStorage(ctx context.Context, tx pgx.Tx, tenantID uuid.UUID, now time.Time) (StorageReconciliation, error) {
+	const lockCmd = `SELECT 1 FROM storage_reconciliation_state FOR UPDATE`
+	if _, err := tx.Exec(ctx, lockCmd); err != nil {
+		return StorageReconciliation{}, err
+	}
+	backlogged, err := usageBacklogReplicas(ctx, tx)
+	if err != nil {
+		return StorageReconciliation{}, err
+	}
+	if backlogged > 0 {
+		return StorageReconciliation{}, ErrUsageBacklog
+	}
+	measured, err := measureStorage(ctx, tx, tenantID, now)
+	if err != nil {
+		return StorageReconciliation{}, err
+	}
+	if len(measured) == 0 {
+		return StorageReconciliation{}, ErrNotFound
+	}
+	r := measured[0]
+	if drift := r.DriftBytes(); drift != 0 {
+		if err := insertStorageCorrection(ctx, tx, tenantID, drift); err != nil {
+			return StorageReconciliation{}, err
+		}
+		r.CorrectedBytes = drift
+		if err := insertStorageReconciliation(ctx, tx, r); err != nil {
+			return StorageReconciliation{}, err
+		}
+	}
+	return r, nil
+}
+
+// insertStorageCorrection emits a storage-bytes event of drift bytes, dated
+// now. It is attributed to no registry: drift is measured across the tenant.
+// A balance the drift had taken below zero stays so until now; summaries
+// accrue nothing for that time rather than failing.
+func insertStorageCorrection(ctx context.Context, tx pgx.Tx, tenantID uuid.UUID, drift int64) error {
+	const cmd = `INSERT INTO usage_events (id, tenant_id, metric, value, reason)
+		VALUES ($1, $2, $3, $4, $5)`
+	_, err := tx.Exec(ctx, cmd, uuid.New(), tenantID, MetricStorageBytes, drift, UsageReasonReconciliation)
+	return err
+}
+
+func insertStorageReconciliation(ctx context.Context, tx pgx.Tx, r StorageReconciliation) error {
+	const cmd = `INSERT INTO storage_reconciliations (tenant_id, checked_at, actual_bytes, recorded_bytes, corrected_bytes)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT DO NOTHING`
+	_, err := tx.Exec(ctx, cmd, r.TenantID, r.CheckedAt, r.ActualBytes, r.RecordedBytes, r.CorrectedBytes)
+	return err
+}
+
+// ListStorageReconciliations returns up to limit recorded drifts, newest
+// first, for the tenant or every tenant when tenantID is uuid.Nil.
+func (d *DB) ListStorageReconciliations(ctx context.Context, tenantID uuid.UUID, limit int) ([]StorageReconciliation, error) {
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	const cmd = `SELECT tenant_id, checked_at, actual_bytes, recorded_bytes, corrected_bytes
+		FROM storage_reconciliations
+		WHERE $1::UUID IS NULL OR tenant_id = $1
+		ORDER BY checked_at DESC, tenant_id ASC
+		LIMIT $2`
+	var filter *uuid.UUID
+	if tenantID != uuid.Nil {
+		filter = &tenantID
+	}
+	rows, err := d.conn.Query(ctx, cmd, filter, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (StorageReconciliation, error) {
+		var r StorageReconciliation
+		err := row.Scan(&r.TenantID, &r.CheckedAt, &r.ActualBytes, &r.RecordedBytes, &r.CorrectedBytes)
+		return r, err
+	})
+}
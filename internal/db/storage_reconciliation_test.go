@@ -0,0 +1,162 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// openTestDB connects to the database configured by the POSTGRES_*
+// environment, migrated, skipping the test when none is configured.
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	cfg, err := NewConfigFromEnv()
+	if err != nil {
+		t.Skipf("no test database: %v", err)
+	}
+	ctx := context.Background()
+	if err := RunMigrations(ctx, cfg); err != nil {
+		t.Fatal(err)
+	}
+	d, err := New(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Close)
+	return d
+}
+
+// beginTestTx returns a transaction on the test database that is rolled back
+// when the test ends.
+func beginTestTx(t *testing.T) pgx.Tx {
+	t.Helper()
+	return beginTestTxOn(t, openTestDB(t))
+}
+
+func beginTestTxOn(t *testing.T, d *DB) pgx.Tx {
+	t.Helper()
+	ctx := context.Background()
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tx.Rollback(ctx) })
+	return tx
+}
+
+func testExec(t *testing.T, tx pgx.Tx, cmd string, args ...any) {
+	t.Helper()
+	if _, err := tx.Exec(context.Background(), cmd, args...); err != nil {
+		t.Fatalf("%s: %v", cmd, err)
+	}
+}
+
+// testDigest returns a digest no other test object has.
+func testDigest() string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(uuid.NewString())))
+}
+
+func TestMeasureStorage(t *testing.T) {
+	tx := beginTestTx(t)
+	ctx := context.Background()
+	rolledThrough := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+	testExec(t, tx, `UPDATE usage_rollup_state SET rolled_through = $1::DATE`, rolledThrough)
+
+	tenantID, registryID := uuid.New(), uuid.New()
+	repoA, repoB := uuid.New(), uuid.New()
+	testExec(t, tx, `INSERT INTO tenants (id, name) VALUES ($1, $2)`, tenantID, "t-"+tenantID.String())
+	testExec(t, tx, `INSERT INTO registries (id, tenant_id, name) VALUES ($1, $2, $3)`, registryID, tenantID, "r-"+registryID.String())
+	testExec(t, tx, `INSERT INTO repositories (id, registry_id, name) VALUES ($1, $3, 'a'), ($2, $3, 'b')`, repoA, repoB, registryID)
+
+	// A blob in both repositories counts once; manifests are not storage.
+	shared, own, manifest := testDigest(), testDigest(), testDigest()
+	testExec(t, tx, `INSERT INTO objects (digest, size_bytes, type) VALUES ($1, 100, 'blob'), ($2, 50, 'blob'), ($3, 7, 'manifest')`, shared, own, manifest)
+	testExec(t, tx, `INSERT INTO repository_objects (repository_id, digest) VALUES ($1, $3), ($1, $5), ($2, $3), ($2, $4)`,
+		repoA, repoB, shared, own, manifest)
+
+	// The recorded balance is the last checkpoint of a rolled-up day plus the
+	// events from the rolled-through day on. Earlier events are in that
+	// checkpoint already, and a checkpoint of a day not rolled up is not final.
+	testExec(t, tx, `INSERT INTO usage_storage_checkpoints (tenant_id, day, closing_bytes)
+		VALUES ($1, '2026-03-08', 40), ($1, '2026-03-09', 90), ($1, '2026-03-10', 999)`, tenantID)
+	testExec(t, tx, `INSERT INTO usage_events (id, created_at, tenant_id, metric, value) VALUES
+		($1, '2026-03-09T23:59:59Z', $5, 'storage-bytes', 1000),
+		($2, '2026-03-10T00:00:00Z', $5, 'storage-bytes', 30),
+		($3, '2026-03-11T08:00:00Z', $5, 'storage-bytes', 5),
+		($4, '2026-03-11T09:00:00Z', $5, 'pull-op-count', 1)`,
+		uuid.New(), uuid.New(), uuid.New(), uuid.New(), tenantID)
+
+	now := rolledThrough.Add(36 * time.Hour)
+	got, err := measureStorage(ctx, tx, tenantID, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := StorageReconciliation{TenantID: tenantID, CheckedAt: now, ActualBytes: 150, RecordedBytes: 125}
+	if len(got) != 1 || got[0] != want {
+		t.Fatalf("measured %+v, want %+v", got, want)
+	}
+
+	// Without a checkpoint, the balance is the events alone.
+	testExec(t, tx, `DELETE FROM usage_storage_checkpoints WHERE tenant_id = $1`, tenantID)
+	got, err = measureStorage(ctx, tx, tenantID, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].RecordedBytes != 35 {
+		t.Fatalf("measured %+v without a checkpoint, want 35 recorded bytes", got)
+	}
+}
+
+func TestMeasureStorageEmptyTenant(t *testing.T) {
+	tx := beginTestTx(t)
+	tenantID := uuid.New()
+	testExec(t, tx, `INSERT INTO tenants (id, name) VALUES ($1, $2)`, tenantID, "t-"+tenantID.String())
+
+	got, err := measureStorage(context.Background(), tx, tenantID, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].ActualBytes != 0 || got[0].RecordedBytes != 0 {
+		t.Fatalf("measured %+v, want nothing stored or recorded", got)
+	}
+	if got, err := measureStorage(context.Background(), tx, uuid.New(), time.Now().UTC()); err != nil || len(got) != 0 {
+		t.Fatalf("measured %+v, %v for a missing tenant", got, err)
+	}
+}
+
+func TestCorrectTenantStorageWaitsForUsageBacklog(t *testing.T) {
+	tx := beginTestTx(t)
+	ctx := context.Background()
+	testExec(t, tx, `DELETE FROM usage_pipeline_backlogs`)
+
+	tenantID, registryID, repoID := uuid.New(), uuid.New(), uuid.New()
+	testExec(t, tx, `INSERT INTO tenants (id, name) VALUES ($1, $2)`, tenantID, "t-"+tenantID.String())
+	testExec(t, tx, `INSERT INTO registries (id, tenant_id, name) VALUES ($1, $2, $3)`, registryID, tenantID, "r-"+registryID.String())
+	testExec(t, tx, `INSERT INTO repositories (id, registry_id, name) VALUES ($1, $2, 'a')`, repoID, registryID)
+	blob := testDigest()
+	testExec(t, tx, `INSERT INTO objects (digest, size_bytes, type) VALUES ($1, 100, 'blob')`, blob)
+	testExec(t, tx, `INSERT INTO repository_objects (repository_id, digest) VALUES ($1, $2)`, repoID, blob)
+
+	// The push's storage-bytes event is still journaled on a replica; a
+	// correction now would be counted again once it is replayed.
+	testExec(t, tx, `INSERT INTO usage_pipeline_backlogs (replica, pending_events, journal_files)
+		VALUES ('a', 0, 0), ('b', 0, 1)`)
+	if _, err := correctTenantStorage(ctx, tx, tenantID, time.Now().UTC()); !errors.Is(err, ErrUsageBacklog) {
+		t.Fatalf("corrected with a journal pending: %v, want ErrUsageBacklog", err)
+	}
+
+	testExec(t, tx, `UPDATE usage_pipeline_backlogs SET journal_files = 0`)
+	r, err := correctTenantStorage(ctx, tx, tenantID, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.CorrectedBytes != 100 {
+		t.Fatalf("corrected %d bytes, want 100", r.CorrectedBytes)
+	}
+}
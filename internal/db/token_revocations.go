@@ -0,0 +1,182 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// RegistryTokenRevocationsChannel is the LISTEN/NOTIFY channel signalled
+// whenever a registry token revocation is recorded.
+const RegistryTokenRevocationsChannel = "registry_token_revocations"
+
+type RegistryTokenRevocation struct {
+	ID        uuid.UUID
+	JTI       *string
+	APIKeyID  *uuid.UUID
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// RevokeRegistryToken denylists a single token by jti until expiresAt.
+func (d *DB) RevokeRegistryToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := insertRegistryTokenRevocation(ctx, tx, &jti, nil, expiresAt); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// RevokeAPIKey deletes an API key the user owns in the organization and, in
+// the same transaction, invalidates every registry token already issued for
+// it.
+func (d *DB) RevokeAPIKey(ctx context.Context, userID, orgID, apiKeyID uuid.UUID, tokensExpireAt time.Time) error {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := revokeAPIKey(ctx, tx, userID, orgID, apiKeyID, tokensExpireAt); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func revokeAPIKey(ctx context.Context, tx pgx.Tx, userID, orgID, apiKeyID uuid.UUID, tokensExpireAt time.Time) error {
+	const deleteCmd = `DELETE FROM api_keys WHERE user_id = $1 AND id = $2 AND ` + apiKeyInOrgCond
+	tag, err := tx.Exec(ctx, deleteCmd, userID, apiKeyID, orgID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return insertRegistryTokenRevocation(ctx, tx, nil, &apiKeyID, tokensExpireAt)
+}
+
+// RevokeAPIKeyTokens invalidates every registry access and refresh token
+// issued so far for an API key the user owns in the organization, leaving the
+// key usable for new tokens.
+func (d *DB) RevokeAPIKeyTokens(ctx context.Context, userID, orgID, apiKeyID uuid.UUID, tokensExpireAt time.Time) error {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockOrgAPIKey(ctx, tx, userID, orgID, apiKeyID); err != nil {
+		return err
+	}
+
+	const revokeRefreshCmd = `UPDATE registry_refresh_tokens
+		SET revoked_at = NOW()
+		WHERE api_key_id = $1 AND revoked_at IS NULL`
+	if _, err := tx.Exec(ctx, revokeRefreshCmd, apiKeyID); err != nil {
+		return err
+	}
+
+	if err := insertRegistryTokenRevocation(ctx, tx, nil, &apiKeyID, tokensExpireAt); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// lockOrgAPIKey locks an API key the user owns in the organization,
+// returning ErrNotFound if there is none.
+func lockOrgAPIKey(ctx context.Context, tx pgx.Tx, userID, orgID, apiKeyID uuid.UUID) error {
+	const cmd = `SELECT 1 FROM api_keys WHERE user_id = $1 AND id = $2 AND ` + apiKeyInOrgCond + ` FOR UPDATE`
+	var one int
+	if err := tx.QueryRow(ctx, cmd, userID, apiKeyID, orgID).Scan(&one); err != nil {
+		if isNoRows(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func insertRegistryTokenRevocation(ctx context.Context, tx pgx.Tx, jti *string, apiKeyID *uuid.UUID, expiresAt time.Time) error {
+	const insertCmd = `INSERT INTO registry_token_revocations (id, jti, api_key_id, expires_at)
+		VALUES ($1, $2, $3, $4)`
+	if _, err := tx.Exec(ctx, insertCmd, uuid.New(), jti, apiKeyID, expiresAt); err != nil {
+		return err
+	}
+	// pg_notify is transactional: listeners hear about the revocation only
+	// once it has committed.
+	const notifyCmd = `SELECT pg_notify($1, '')`
+	_, err := tx.Exec(ctx, notifyCmd, RegistryTokenRevocationsChannel)
+	return err
+}
+
+func (d *DB) ListActiveRegistryTokenRevocations(ctx context.Context) ([]RegistryTokenRevocation, error) {
+	const cmd = `SELECT id, jti, api_key_id, created_at, expires_at
+		FROM registry_token_revocations
+		WHERE expires_at > NOW()`
+	rows, err := d.conn.Query(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revocations := make([]RegistryTokenRevocation, 0)
+	for rows.Next() {
+		var r RegistryTokenRevocation
+		if err := rows.Scan(&r.ID, &r.JTI, &r.APIKeyID, &r.CreatedAt, &r.ExpiresAt); err != nil {
+			return nil, err
+		}
+		revocations = append(revocations, r)
+	}
+	return revocations, rows.Err()
+}
+
+func (d *DB) DeleteExpiredRegistryTokenRevocations(ctx context.Context) (int64, error) {
+	const cmd = `DELETE FROM registry_token_revocations WHERE expires_at <= NOW()`
+	tag, err := d.conn.Exec(ctx, cmd)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// ListenRegistryTokenRevocations holds a dedicated connection LISTENing on
+// RegistryTokenRevocationsChannel and calls onNotify once LISTEN is in place
+// (so callers can catch up on anything missed while disconnected), then for
+// every notification, or with timedOut set when idle for pollInterval. It
+// returns when ctx is cancelled or the connection fails.
+func (d *DB) ListenRegistryTokenRevocations(ctx context.Context, pollInterval time.Duration, onNotify func(timedOut bool)) error {
+	conn, err := d.conn.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{RegistryTokenRevocationsChannel}.Sanitize()); err != nil {
+		return err
+	}
+	onNotify(false)
+
+	for {
+		waitCtx, cancel := context.WithTimeout(ctx, pollInterval)
+		_, err := conn.Conn().WaitForNotification(waitCtx)
+		cancel()
+		switch {
+		case err == nil:
+			onNotify(false)
+		case errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil:
+			onNotify(true)
+		default:
+			// A timed-out wait leaves the connection unusable for reuse.
+			conn.Hijack().Close(context.Background())
+			return err
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestRevokeAPIKeyOnlyInItsOrganization(t *testing.T) {
+	tx := beginTestTx(t)
+	ctx := context.Background()
+
+	orgA, orgB, userID := uuid.New(), uuid.New(), uuid.New()
+	registryA, keyID := uuid.New(), uuid.New()
+	testExec(t, tx, `INSERT INTO tenants (id, name) VALUES ($1, $2), ($3, $4)`, orgA, "t-"+orgA.String(), orgB, "t-"+orgB.String())
+	testExec(t, tx, `INSERT INTO users (id, tenant_id, sub) VALUES ($1, $2, $3)`, userID, orgA, "sub-"+userID.String())
+	testExec(t, tx, `INSERT INTO registries (id, tenant_id, name) VALUES ($1, $2, $3)`, registryA, orgA, "r-"+registryA.String())
+	testExec(t, tx, `INSERT INTO api_keys (id, user_id, name, secret_encrypted, prefix) VALUES ($1, $2, 'ci', '', $3)`, keyID, userID, "sk_"+keyID.String())
+	testExec(t, tx, `INSERT INTO api_key_scopes (id, api_key_id, registry_id, permission) VALUES ($1, $2, $3, 'admin')`, uuid.New(), keyID, registryA)
+
+	// Acting in another of their organizations, the owner cannot reach the key.
+	expires := time.Now().UTC().Add(time.Hour)
+	if err := revokeAPIKey(ctx, tx, userID, orgB, keyID, expires); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("revoked from another organization: %v, want ErrNotFound", err)
+	}
+	if err := lockOrgAPIKey(ctx, tx, userID, orgB, keyID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("found from another organization: %v, want ErrNotFound", err)
+	}
+
+	if err := lockOrgAPIKey(ctx, tx, userID, orgA, keyID); err != nil {
+		t.Fatal(err)
+	}
+	if err := revokeAPIKey(ctx, tx, userID, orgA, keyID, expires); err != nil {
+		t.Fatal(err)
+	}
+	var exists bool
+	if err := tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM api_keys WHERE id = $1)`, keyID).Scan(&exists); err != nil || exists {
+		t.Fatalf("key exists = %v, %v after revoking it in its organization", exists, err)
+	}
+}
@@ -13,8 +13,13 @@ const (
 	MetricStorageBytes = "storage-bytes"
 	MetricPushOpCount  = "push-op-count"
 	MetricPullOpCount  = "pull-op-count"
+	MetricPullBytes    = "pull-bytes"
 )
 
+// UsageReasonReconciliation marks storage-bytes events that correct drift
+// between recorded and actual storage rather than record usage.
+const UsageReasonReconciliation = "reconciliation"
+
 type UsageEvent struct {
 	ID         uuid.UUID
 	CreatedAt  time.Time
@@ -24,6 +29,8 @@ type UsageEvent struct {
 	Digest     string
 	Metric     string
 	Value      int64
+	// Reason is empty for usage the tenant generated.
+	Reason string
 }
 
 type UsageEventDelta struct {
@@ -31,25 +38,56 @@ type UsageEventDelta struct {
 	Value     int64
 }
 
+// InsertUsageEvents stores events in one statement, skipping any already
+// stored. Events without CreatedAt happen now; events that happened before the
+// first day not yet rolled up are moved to its start, so usage that arrives
+// late is still rolled up and invoiced. The rollup state row is share-locked
+// until the events commit, so a day cannot be rolled up past them meanwhile.
 func (d *DB) InsertUsageEvents(ctx context.Context, events []UsageEvent) error {
 	if len(events) == 0 {
 		return nil
 	}
-	tx, err := d.conn.Begin(ctx)
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback(ctx)
+	_, err := d.conn.Exec(ctx, insertUsageEventsCmd, insertUsageEventsArgs(events)...)
+	return err
+}
 
-	const cmd = `INSERT INTO usage_events (id, tenant_id, registry_id, repo_id, digest, metric, value)
-		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7)
-		ON CONFLICT (id) DO NOTHING`
-	for _, e := range events {
-		if _, err := tx.Exec(ctx, cmd, e.ID, e.TenantID, e.RegistryID, e.RepoID, e.Digest, e.Metric, e.Value); err != nil {
-			return err
+const insertUsageEventsCmd = `INSERT INTO usage_events (id, created_at, tenant_id, registry_id, repo_id, digest, metric, value, reason)
+	SELECT e.id, GREATEST(COALESCE(e.created_at, NOW()), s.rolled_through::TIMESTAMP AT TIME ZONE 'UTC'),
+		e.tenant_id, e.registry_id, e.repo_id, NULLIF(e.digest, ''), e.metric, e.value, NULLIF(e.reason, '')
+	FROM unnest($1::UUID[], $2::TIMESTAMPTZ[], $3::UUID[], $4::UUID[], $5::UUID[], $6::TEXT[], $7::TEXT[], $8::BIGINT[], $9::TEXT[])
+		AS e (id, created_at, tenant_id, registry_id, repo_id, digest, metric, value, reason),
+		usage_rollup_state s
+	FOR SHARE OF s
+	ON CONFLICT (id) DO NOTHING`
+
+// insertUsageEventsArgs returns the column arrays of insertUsageEventsCmd.
+func insertUsageEventsArgs(events []UsageEvent) []any {
+	var (
+		ids         = make([]uuid.UUID, len(events))
+		createdAts  = make([]*time.Time, len(events))
+		tenantIDs   = make([]uuid.UUID, len(events))
+		registryIDs = make([]*uuid.UUID, len(events))
+		repoIDs     = make([]*uuid.UUID, len(events))
+		digests     = make([]string, len(events))
+		metrics     = make([]string, len(events))
+		values      = make([]int64, len(events))
+		reasons     = make([]string, len(events))
+	)
+	for i, e := range events {
+		ids[i] = e.ID
+		if !e.CreatedAt.IsZero() {
+			createdAt := e.CreatedAt
+			createdAts[i] = &createdAt
 		}
+		tenantIDs[i] = e.TenantID
+		registryIDs[i] = e.RegistryID
+		repoIDs[i] = e.RepoID
+		digests[i] = e.Digest
+		metrics[i] = e.Metric
+		values[i] = e.Value
+		reasons[i] = e.Reason
 	}
-	return tx.Commit(ctx)
+	return []any{ids, createdAts, tenantIDs, registryIDs, repoIDs, digests, metrics, values, reasons}
 }
 
 func (d *DB) ListUsageEventsByTenant(ctx context.Context, tenantID uuid.UUID, metric string, limit int, after time.Time) ([]UsageEvent, error) {
@@ -70,7 +108,7 @@ func (d *DB) ListUsageEventsByTenant(ctx context.Context, tenantID uuid.UUID, me
 	}
 	args = append(args, limit)
 
-	query := `SELECT id, created_at, tenant_id, registry_id, repo_id, COALESCE(digest, ''), metric, value
+	query := `SELECT id, created_at, tenant_id, registry_id, repo_id, COALESCE(digest, ''), metric, value, COALESCE(reason, '')
 		FROM usage_events
 		WHERE ` + strings.Join(where, " AND ") + `
 		ORDER BY created_at ASC
@@ -85,7 +123,7 @@ func (d *DB) ListUsageEventsByTenant(ctx context.Context, tenantID uuid.UUID, me
 	events := make([]UsageEvent, 0)
 	for rows.Next() {
 		var e UsageEvent
-		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.TenantID, &e.RegistryID, &e.RepoID, &e.Digest, &e.Metric, &e.Value); err != nil {
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.TenantID, &e.RegistryID, &e.RepoID, &e.Digest, &e.Metric, &e.Value, &e.Reason); err != nil {
 			return nil, err
 		}
 		events = append(events, e)
@@ -93,6 +131,31 @@ func (d *DB) ListUsageEventsByTenant(ctx context.Context, tenantID uuid.UUID, me
 	return events, rows.Err()
 }
 
+// StreamUsageEvents calls fn with each of the tenant's usage events in
+// [from, to), ordered by time, stopping at the first error fn returns.
+func (d *DB) StreamUsageEvents(ctx context.Context, tenantID uuid.UUID, from, to time.Time, fn func(UsageEvent) error) error {
+	const cmd = `SELECT id, created_at, tenant_id, registry_id, repo_id, COALESCE(digest, ''), metric, value, COALESCE(reason, '')
+		FROM usage_events
+		WHERE tenant_id = $1 AND created_at >= $2 AND created_at < $3
+		ORDER BY created_at ASC, id ASC`
+	rows, err := d.conn.Query(ctx, cmd, tenantID, from, to)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e UsageEvent
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.TenantID, &e.RegistryID, &e.RepoID, &e.Digest, &e.Metric, &e.Value, &e.Reason); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
 func (d *DB) SumUsageMetricByTenantBetween(ctx context.Context, tenantID uuid.UUID, metric string, from, to time.Time) (int64, error) {
 	const cmd = `SELECT COALESCE(SUM(value), 0)::BIGINT
 		FROM usage_events
@@ -149,6 +212,42 @@ func (d *DB) ListUsageMetricDeltasByTenantBetween(ctx context.Context, tenantID
 	return deltas, rows.Err()
 }
 
+// UsageBucketTotal is the sum of one metric over one bucket of a series.
+type UsageBucketTotal struct {
+	Bucket int
+	Metric string
+	Value  int64
+}
+
+// SumUsageOpsByBucket sums the tenant's push and pull operations and pulled
+// bytes in [from, to) into the buckets starting at each of starts, which must
+// be ascending and begin no later than from. Bucket is the index into starts.
+func (d *DB) SumUsageOpsByBucket(ctx context.Context, tenantID uuid.UUID, starts []time.Time, from, to time.Time) ([]UsageBucketTotal, error) {
+	const cmd = `SELECT width_bucket(created_at, $2::TIMESTAMPTZ[]) - 1 AS bucket, metric, SUM(value)::BIGINT
+		FROM usage_events
+		WHERE tenant_id = $1
+		  AND metric IN ($3, $4, $5)
+		  AND created_at >= $6
+		  AND created_at < $7
+		GROUP BY bucket, metric
+		ORDER BY bucket ASC, metric ASC`
+	rows, err := d.conn.Query(ctx, cmd, tenantID, starts, MetricPushOpCount, MetricPullOpCount, MetricPullBytes, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make([]UsageBucketTotal, 0)
+	for rows.Next() {
+		var t UsageBucketTotal
+		if err := rows.Scan(&t.Bucket, &t.Metric, &t.Value); err != nil {
+			return nil, err
+		}
+		totals = append(totals, t)
+	}
+	return totals, rows.Err()
+}
+
 // TenantHasBlob reports whether any repository in the tenant already has a
 // repository_objects entry for the given blob digest.
 func (d *DB) TenantHasBlob(ctx context.Context, tenantID uuid.UUID, digest string) (bool, error) {
@@ -0,0 +1,195 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// UsageAttribution is the registry and repository usage is charged to.
+// RepoID, or both, are uuid.Nil for usage not attributed that finely.
+type UsageAttribution struct {
+	RegistryID uuid.UUID
+	RepoID     uuid.UUID
+}
+
+func newUsageAttribution(registryID, repoID *uuid.UUID) UsageAttribution {
+	var a UsageAttribution
+	if registryID != nil {
+		a.RegistryID = *registryID
+	}
+	if repoID != nil {
+		a.RepoID = *repoID
+	}
+	return a
+}
+
+// UsageAttributedTotal is the sum of one metric for one attribution.
+type UsageAttributedTotal struct {
+	UsageAttribution
+	Metric string
+	Value  int64
+}
+
+// UsageAttributedDelta is a storage change at one instant for one
+// attribution.
+type UsageAttributedDelta struct {
+	UsageAttribution
+	UsageEventDelta
+}
+
+// UsageAttributedRollup is a daily rollup for one attribution.
+type UsageAttributedRollup struct {
+	UsageAttribution
+	UsageDailyRollup
+}
+
+// GetUsageStorageAttribution returns where the positive storage-bytes event
+// for digest was charged, so that its removal is charged to the same place.
+// It prefers the tenant's own events and falls back to events of the
+// registry, which may have been charged to a tenant it was transferred from.
+// It returns ErrNotFound when there is no such event.
+func (d *DB) GetUsageStorageAttribution(ctx context.Context, tenantID, registryID uuid.UUID, digest string) (UsageAttribution, error) {
+	const cmd = `SELECT registry_id, repo_id
+		FROM usage_events
+		WHERE digest = $1
+		  AND metric = $2
+		  AND value > 0
+		  AND (tenant_id = $3 OR registry_id = $4)
+		ORDER BY tenant_id = $3 DESC, created_at DESC
+		LIMIT 1`
+	var registry, repo *uuid.UUID
+	if err := d.conn.QueryRow(ctx, cmd, digest, MetricStorageBytes, tenantID, registryID).Scan(&registry, &repo); err != nil {
+		if isNoRows(err) {
+			return UsageAttribution{}, ErrNotFound
+		}
+		return UsageAttribution{}, err
+	}
+	return newUsageAttribution(registry, repo), nil
+}
+
+// ListUsageStorageBalancesByAttribution returns each attribution's storage
+// balance at the start of day from rollups, so day must not be after the
+// rolled-through day.
+func (d *DB) ListUsageStorageBalancesByAttribution(ctx context.Context, tenantID uuid.UUID, day time.Time) ([]UsageAttributedTotal, error) {
+	const cmd = `SELECT registry_id, repo_id, metric, SUM(value)::BIGINT
+		FROM usage_daily_rollups
+		WHERE tenant_id = $1 AND metric = $2 AND day < $3::DATE
+		GROUP BY registry_id, repo_id, metric`
+	rows, err := d.conn.Query(ctx, cmd, tenantID, MetricStorageBytes, day)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanUsageAttributedTotal)
+}
+
+// SumUsageMetricsByAttributionBetween sums the tenant's usage events in
+// [from, to) by attribution and metric.
+func (d *DB) SumUsageMetricsByAttributionBetween(ctx context.Context, tenantID uuid.UUID, from, to time.Time) ([]UsageAttributedTotal, error) {
+	const cmd = `SELECT registry_id, repo_id, metric, SUM(value)::BIGINT
+		FROM usage_events
+		WHERE tenant_id = $1
+		  AND created_at >= $2
+		  AND created_at < $3
+		GROUP BY registry_id, repo_id, metric`
+	rows, err := d.conn.Query(ctx, cmd, tenantID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanUsageAttributedTotal)
+}
+
+func scanUsageAttributedTotal(row pgx.CollectableRow) (UsageAttributedTotal, error) {
+	var t UsageAttributedTotal
+	var registry, repo *uuid.UUID
+	if err := row.Scan(&registry, &repo, &t.Metric, &t.Value); err != nil {
+		return UsageAttributedTotal{}, err
+	}
+	t.UsageAttribution = newUsageAttribution(registry, repo)
+	return t, nil
+}
+
+// ListUsageStorageDeltasByAttributionBetween returns the tenant's storage
+// changes in [from, to) by attribution, ordered by time.
+func (d *DB) ListUsageStorageDeltasByAttributionBetween(ctx context.Context, tenantID uuid.UUID, from, to time.Time) ([]UsageAttributedDelta, error) {
+	const cmd = `SELECT registry_id, repo_id, created_at, SUM(value)::BIGINT
+		FROM usage_events
+		WHERE tenant_id = $1
+		  AND metric = $2
+		  AND created_at >= $3
+		  AND created_at < $4
+		GROUP BY registry_id, repo_id, created_at
+		ORDER BY created_at ASC`
+	rows, err := d.conn.Query(ctx, cmd, tenantID, MetricStorageBytes, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (UsageAttributedDelta, error) {
+		var delta UsageAttributedDelta
+		var registry, repo *uuid.UUID
+		if err := row.Scan(&registry, &repo, &delta.CreatedAt, &delta.Value); err != nil {
+			return UsageAttributedDelta{}, err
+		}
+		delta.UsageAttribution = newUsageAttribution(registry, repo)
+		return delta, nil
+	})
+}
+
+// ListUsageDailyRollupsByAttribution returns the tenant's rollups for days in
+// [from, to) by attribution, ordered by day.
+func (d *DB) ListUsageDailyRollupsByAttribution(ctx context.Context, tenantID uuid.UUID, from, to time.Time) ([]UsageAttributedRollup, error) {
+	const cmd = `SELECT registry_id, repo_id, day, metric, SUM(value)::BIGINT, SUM(day_end_weight)::TEXT
+		FROM usage_daily_rollups
+		WHERE tenant_id = $1 AND day >= $2::DATE AND day < $3::DATE
+		GROUP BY registry_id, repo_id, day, metric
+		ORDER BY day ASC, metric ASC`
+	rows, err := d.conn.Query(ctx, cmd, tenantID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (UsageAttributedRollup, error) {
+		var r UsageAttributedRollup
+		var registry, repo *uuid.UUID
+		var weight string
+		if err := row.Scan(&registry, &repo, &r.Day, &r.Metric, &r.Value, &weight); err != nil {
+			return UsageAttributedRollup{}, err
+		}
+		rollup, err := newUsageDailyRollup(r.Day, r.Metric, r.Value, weight)
+		if err != nil {
+			return UsageAttributedRollup{}, err
+		}
+		r.UsageAttribution = newUsageAttribution(registry, repo)
+		r.UsageDailyRollup = rollup
+		return r, nil
+	})
+}
+
+// GetUsageAttributionNames returns the names of the given registries and
+// repositories that still exist, keyed by id.
+func (d *DB) GetUsageAttributionNames(ctx context.Context, registryIDs, repoIDs []uuid.UUID) (map[uuid.UUID]string, map[uuid.UUID]string, error) {
+	registries := make(map[uuid.UUID]string)
+	repos := make(map[uuid.UUID]string)
+	const cmd = `SELECT id, name, 'registry' FROM registries WHERE id = ANY($1)
+		UNION ALL
+		SELECT id, name, 'repository' FROM repositories WHERE id = ANY($2)`
+	rows, err := d.conn.Query(ctx, cmd, registryIDs, repoIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id uuid.UUID
+		var name, kind string
+		if err := rows.Scan(&id, &name, &kind); err != nil {
+			return nil, nil, err
+		}
+		if kind == "registry" {
+			registries[id] = name
+		} else {
+			repos[id] = name
+		}
+	}
+	return registries, repos, rows.Err()
+}
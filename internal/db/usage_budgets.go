@@ -0,0 +1,267 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Metrics a usage budget can limit.
+const (
+	BudgetMetricChargeUSD        = "charge-usd"
+	BudgetMetricStorageGiBMonths = "storage-gib-months"
+	BudgetMetricPushOpCount      = MetricPushOpCount
+	BudgetMetricPullOpCount      = MetricPullOpCount
+)
+
+// UsageBudgetThresholds are the percentages of a budget's limit that fire an
+// alert when crossed.
+var UsageBudgetThresholds = []int{50, 80, 100}
+
+// UsageBudget is a tenant's monthly limit on its charges or one metric.
+type UsageBudget struct {
+	ID                     uuid.UUID
+	TenantID               uuid.UUID
+	Name                   string
+	Metric                 string
+	Limit                  *big.Rat
+	WebhookURL             string
+	WebhookSecretEncrypted string
+	CreatedAt              time.Time
+	UpdatedAt              time.Time
+}
+
+// UsageBudgetAlert is a budget crossing ThresholdPercent of its limit in the
+// period starting at PeriodStart.
+type UsageBudgetAlert struct {
+	BudgetID         uuid.UUID
+	PeriodStart      time.Time
+	ThresholdPercent int
+	Value            *big.Rat
+	Limit            *big.Rat
+	FiredAt          time.Time
+	DeliveredAt      *time.Time
+	Attempts         int
+	LastError        string
+}
+
+// UsageBudgetDelivery is an alert claimed for webhook delivery with the
+// budget it belongs to.
+type UsageBudgetDelivery struct {
+	Alert  UsageBudgetAlert
+	Budget UsageBudget
+}
+
+func parseNumeric(raw string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(raw)
+	if !ok {
+		return nil, fmt.Errorf("invalid numeric %q", raw)
+	}
+	return r, nil
+}
+
+// usageBudgetColumns are read from usage_budgets aliased as b.
+const usageBudgetColumns = `b.id, b.tenant_id, b.name, b.metric, b.limit_value::TEXT,
+	b.webhook_url, b.webhook_secret_encrypted, b.created_at, b.updated_at`
+
+func scanUsageBudget(row pgx.Row) (UsageBudget, error) {
+	var b UsageBudget
+	var limit string
+	if err := row.Scan(&b.ID, &b.TenantID, &b.Name, &b.Metric, &limit, &b.WebhookURL, &b.WebhookSecretEncrypted, &b.CreatedAt, &b.UpdatedAt); err != nil {
+		return UsageBudget{}, err
+	}
+	var err error
+	b.Limit, err = parseNumeric(limit)
+	return b, err
+}
+
+// CreateUsageBudget stores a new budget, returning ErrConflict if the tenant
+// already has one with the same name.
+func (d *DB) CreateUsageBudget(ctx context.Context, b UsageBudget) (UsageBudget, error) {
+	cmd := `INSERT INTO usage_budgets AS b (id, tenant_id, name, metric, limit_value, webhook_url, webhook_secret_encrypted)
+		VALUES ($1, $2, $3, $4, $5::NUMERIC, $6, $7)
+		RETURNING ` + usageBudgetColumns
+	created, err := scanUsageBudget(d.conn.QueryRow(ctx, cmd, b.ID, b.TenantID, b.Name, b.Metric, numericString(b.Limit), b.WebhookURL, b.WebhookSecretEncrypted))
+	if err != nil {
+		if isUniqueViolation(err) {
+			return UsageBudget{}, ErrConflict
+		}
+		return UsageBudget{}, err
+	}
+	return created, nil
+}
+
+// UpdateUsageBudget changes a budget's name, limit and webhook URL. Alerts
+// already fired this period are not repeated. It returns ErrNotFound or
+// ErrConflict.
+func (d *DB) UpdateUsageBudget(ctx context.Context, tenantID, id uuid.UUID, name string, limit *big.Rat, webhookURL string) (UsageBudget, error) {
+	cmd := `UPDATE usage_budgets AS b
+		SET name = $3, limit_value = $4::NUMERIC, webhook_url = $5, updated_at = NOW()
+		WHERE tenant_id = $1 AND id = $2
+		RETURNING ` + usageBudgetColumns
+	b, err := scanUsageBudget(d.conn.QueryRow(ctx, cmd, tenantID, id, name, numericString(limit), webhookURL))
+	if err != nil {
+		if isNoRows(err) {
+			return UsageBudget{}, ErrNotFound
+		}
+		if isUniqueViolation(err) {
+			return UsageBudget{}, ErrConflict
+		}
+		return UsageBudget{}, err
+	}
+	return b, nil
+}
+
+// DeleteUsageBudget deletes a budget and its alerts, returning ErrNotFound if
+// the tenant has no such budget.
+func (d *DB) DeleteUsageBudget(ctx context.Context, tenantID, id uuid.UUID) error {
+	const cmd = `DELETE FROM usage_budgets WHERE tenant_id = $1 AND id = $2`
+	tag, err := d.conn.Exec(ctx, cmd, tenantID, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListUsageBudgets returns the tenant's budgets ordered by name, or every
+// tenant's ordered by tenant when tenantID is uuid.Nil.
+func (d *DB) ListUsageBudgets(ctx context.Context, tenantID uuid.UUID) ([]UsageBudget, error) {
+	cmd := `SELECT ` + usageBudgetColumns + ` FROM usage_budgets b
+		WHERE $1::UUID IS NULL OR b.tenant_id = $1
+		ORDER BY b.tenant_id ASC, b.name ASC`
+	var filter *uuid.UUID
+	if tenantID != uuid.Nil {
+		filter = &tenantID
+	}
+	rows, err := d.conn.Query(ctx, cmd, filter)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (UsageBudget, error) {
+		return scanUsageBudget(row)
+	})
+}
+
+// InsertUsageBudgetAlert records an alert for delivery, reporting false if
+// the threshold already fired for the period.
+func (d *DB) InsertUsageBudgetAlert(ctx context.Context, a UsageBudgetAlert) (bool, error) {
+	const cmd = `INSERT INTO usage_budget_alerts (budget_id, period_start, threshold_percent, value, limit_value)
+		VALUES ($1, $2, $3, $4::NUMERIC, $5::NUMERIC)
+		ON CONFLICT DO NOTHING`
+	tag, err := d.conn.Exec(ctx, cmd, a.BudgetID, a.PeriodStart, a.ThresholdPercent, numericString(a.Value), numericString(a.Limit))
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// usageBudgetAlertColumns are read from usage_budget_alerts aliased as a.
+const usageBudgetAlertColumns = `a.budget_id, a.period_start, a.threshold_percent, a.value::TEXT, a.limit_value::TEXT,
+	a.fired_at, a.delivered_at, a.attempts, a.last_error`
+
+func scanUsageBudgetAlert(row pgx.Row, extra ...any) (UsageBudgetAlert, error) {
+	var a UsageBudgetAlert
+	var value, limit string
+	dest := append([]any{&a.BudgetID, &a.PeriodStart, &a.ThresholdPercent, &value, &limit, &a.FiredAt, &a.DeliveredAt, &a.Attempts, &a.LastError}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return UsageBudgetAlert{}, err
+	}
+	var err error
+	if a.Value, err = parseNumeric(value); err != nil {
+		return UsageBudgetAlert{}, err
+	}
+	if a.Limit, err = parseNumeric(limit); err != nil {
+		return UsageBudgetAlert{}, err
+	}
+	a.PeriodStart = a.PeriodStart.UTC()
+	return a, nil
+}
+
+// ListUsageBudgetAlerts returns the alerts the tenant's budgets fired in the
+// period starting at periodStart, ordered by budget and threshold.
+func (d *DB) ListUsageBudgetAlerts(ctx context.Context, tenantID uuid.UUID, periodStart time.Time) ([]UsageBudgetAlert, error) {
+	cmd := `SELECT ` + usageBudgetAlertColumns + `
+		FROM usage_budget_alerts a
+		JOIN usage_budgets b ON b.id = a.budget_id
+		WHERE b.tenant_id = $1 AND a.period_start = $2
+		ORDER BY a.budget_id ASC, a.threshold_percent ASC`
+	rows, err := d.conn.Query(ctx, cmd, tenantID, periodStart)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (UsageBudgetAlert, error) {
+		return scanUsageBudgetAlert(row)
+	})
+}
+
+// ClaimUsageBudgetAlerts returns up to limit undelivered alerts that are due
+// at now and have been tried fewer than maxAttempts times, counting this
+// attempt and pushing their next attempt back by retryAfter(attempts) so
+// other replicas skip them while they are delivered.
+func (d *DB) ClaimUsageBudgetAlerts(ctx context.Context, now time.Time, limit, maxAttempts int, retryAfter func(attempts int) time.Duration) ([]UsageBudgetDelivery, error) {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	cmd := `SELECT ` + usageBudgetAlertColumns + `, ` + usageBudgetColumns + `
+		FROM usage_budget_alerts a
+		JOIN usage_budgets b ON b.id = a.budget_id
+		WHERE a.delivered_at IS NULL AND a.next_attempt_at <= $1 AND a.attempts < $2
+		ORDER BY a.next_attempt_at ASC
+		LIMIT $3
+		FOR UPDATE OF a SKIP LOCKED`
+	rows, err := tx.Query(ctx, cmd, now, maxAttempts, limit)
+	if err != nil {
+		return nil, err
+	}
+	deliveries, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (UsageBudgetDelivery, error) {
+		var del UsageBudgetDelivery
+		var budgetLimit string
+		b := &del.Budget
+		a, err := scanUsageBudgetAlert(row, &b.ID, &b.TenantID, &b.Name, &b.Metric, &budgetLimit, &b.WebhookURL, &b.WebhookSecretEncrypted, &b.CreatedAt, &b.UpdatedAt)
+		if err != nil {
+			return UsageBudgetDelivery{}, err
+		}
+		del.Alert = a
+		b.Limit, err = parseNumeric(budgetLimit)
+		return del, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	const claimCmd = `UPDATE usage_budget_alerts
+		SET attempts = attempts + 1, next_attempt_at = $4
+		WHERE budget_id = $1 AND period_start = $2 AND threshold_percent = $3`
+	for i := range deliveries {
+		a := &deliveries[i].Alert
+		a.Attempts++
+		if _, err := tx.Exec(ctx, claimCmd, a.BudgetID, a.PeriodStart, a.ThresholdPercent, now.Add(retryAfter(a.Attempts))); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// FinishUsageBudgetAlertDelivery records the outcome of delivering an
+// alert: delivered when deliveryErr is empty, otherwise the error is kept
+// and the alert retried at its next attempt time.
+func (d *DB) FinishUsageBudgetAlertDelivery(ctx context.Context, a UsageBudgetAlert, deliveryErr string) error {
+	const cmd = `UPDATE usage_budget_alerts
+		SET delivered_at = CASE WHEN $4 = '' THEN NOW() END, last_error = $4
+		WHERE budget_id = $1 AND period_start = $2 AND threshold_percent = $3`
+	_, err := d.conn.Exec(ctx, cmd, a.BudgetID, a.PeriodStart, a.ThresholdPercent, deliveryErr)
+	return err
+}
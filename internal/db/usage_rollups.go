@@ -0,0 +1,155 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// UsageRollupSettle is how long after a UTC day ends before it is rolled up,
+// so that events still being written for it are included.
+const UsageRollupSettle = 10 * time.Minute
+
+// UsageDailyRollup is a tenant's usage of one metric on one closed UTC day.
+// DayEndWeight is the sum of each event's value times the nanoseconds from
+// the event to the end of the day.
+type UsageDailyRollup struct {
+	Day          time.Time
+	Metric       string
+	Value        int64
+	DayEndWeight *big.Int
+}
+
+// GetUsageRolledThrough returns the first UTC day that has not been rolled
+// up; usage before it is served from rollups.
+func (d *DB) GetUsageRolledThrough(ctx context.Context) (time.Time, error) {
+	const cmd = `SELECT rolled_through FROM usage_rollup_state`
+	var day time.Time
+	if err := d.conn.QueryRow(ctx, cmd).Scan(&day); err != nil {
+		return time.Time{}, err
+	}
+	return utcDay(day), nil
+}
+
+// RollupUsageDay rolls up the oldest day not yet rolled up if it ended at
+// least UsageRollupSettle before now, reporting the day and whether one was
+// rolled up. Replicas serialize on the rollup state row.
+func (d *DB) RollupUsageDay(ctx context.Context, now time.Time) (time.Time, bool, error) {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var day time.Time
+	const lockCmd = `SELECT rolled_through FROM usage_rollup_state FOR UPDATE`
+	if err := tx.QueryRow(ctx, lockCmd).Scan(&day); err != nil {
+		return time.Time{}, false, err
+	}
+	day = utcDay(day)
+	dayEnd := day.AddDate(0, 0, 1)
+	if now.Before(dayEnd.Add(UsageRollupSettle)) {
+		return time.Time{}, false, nil
+	}
+
+	const rollupCmd = `INSERT INTO usage_daily_rollups
+			(tenant_id, registry_id, repo_id, day, metric, value, event_count, day_end_weight)
+		SELECT tenant_id, registry_id, repo_id, $1::DATE, metric, SUM(value), COUNT(*),
+			ROUND(SUM(value::NUMERIC * EXTRACT(EPOCH FROM ($3::TIMESTAMPTZ - created_at)) * 1000000))
+		FROM usage_events
+		WHERE created_at >= $2 AND created_at < $3
+		GROUP BY tenant_id, registry_id, repo_id, metric`
+	if _, err := tx.Exec(ctx, rollupCmd, day, day, dayEnd); err != nil {
+		return time.Time{}, false, fmt.Errorf("could not roll up usage for %s: %w", day.Format(time.DateOnly), err)
+	}
+
+	const checkpointCmd = `INSERT INTO usage_storage_checkpoints (tenant_id, day, closing_bytes)
+		SELECT r.tenant_id, $1::DATE,
+			COALESCE((
+				SELECT c.closing_bytes FROM usage_storage_checkpoints c
+				WHERE c.tenant_id = r.tenant_id AND c.day < $1::DATE
+				ORDER BY c.day DESC
+				LIMIT 1
+			), 0) + SUM(r.value)
+		FROM usage_daily_rollups r
+		WHERE r.day = $1::DATE AND r.metric = $2
+		GROUP BY r.tenant_id`
+	if _, err := tx.Exec(ctx, checkpointCmd, day, MetricStorageBytes); err != nil {
+		return time.Time{}, false, fmt.Errorf("could not checkpoint storage for %s: %w", day.Format(time.DateOnly), err)
+	}
+
+	const advanceCmd = `UPDATE usage_rollup_state SET rolled_through = $1::DATE`
+	if _, err := tx.Exec(ctx, advanceCmd, dayEnd); err != nil {
+		return time.Time{}, false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return time.Time{}, false, err
+	}
+	return day, true, nil
+}
+
+// ListUsageDailyRollupsByTenant returns the tenant's rollups for days in
+// [from, to), summed over registries and repositories, ordered by day.
+func (d *DB) ListUsageDailyRollupsByTenant(ctx context.Context, tenantID uuid.UUID, from, to time.Time) ([]UsageDailyRollup, error) {
+	const cmd = `SELECT day, metric, SUM(value)::BIGINT, SUM(day_end_weight)::TEXT
+		FROM usage_daily_rollups
+		WHERE tenant_id = $1 AND day >= $2::DATE AND day < $3::DATE
+		GROUP BY day, metric
+		ORDER BY day ASC, metric ASC`
+	rows, err := d.conn.Query(ctx, cmd, tenantID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanUsageDailyRollup)
+}
+
+func scanUsageDailyRollup(row pgx.CollectableRow) (UsageDailyRollup, error) {
+	var r UsageDailyRollup
+	var weight string
+	if err := row.Scan(&r.Day, &r.Metric, &r.Value, &weight); err != nil {
+		return UsageDailyRollup{}, err
+	}
+	return newUsageDailyRollup(r.Day, r.Metric, r.Value, weight)
+}
+
+// newUsageDailyRollup builds a rollup from its stored columns; weight is the
+// day_end_weight in microseconds as text.
+func newUsageDailyRollup(day time.Time, metric string, value int64, weight string) (UsageDailyRollup, error) {
+	micros, ok := new(big.Int).SetString(weight, 10)
+	if !ok {
+		return UsageDailyRollup{}, fmt.Errorf("invalid usage rollup weight %q", weight)
+	}
+	return UsageDailyRollup{
+		Day:          utcDay(day),
+		Metric:       metric,
+		Value:        value,
+		DayEndWeight: micros.Mul(micros, big.NewInt(int64(time.Microsecond))),
+	}, nil
+}
+
+// GetUsageStorageBalance returns the tenant's storage balance at the start of
+// day, which must not be after the rolled-through day.
+func (d *DB) GetUsageStorageBalance(ctx context.Context, tenantID uuid.UUID, day time.Time) (int64, error) {
+	const cmd = `SELECT closing_bytes FROM usage_storage_checkpoints
+		WHERE tenant_id = $1 AND day < $2::DATE
+		ORDER BY day DESC
+		LIMIT 1`
+	var balance int64
+	if err := d.conn.QueryRow(ctx, cmd, tenantID, day).Scan(&balance); err != nil {
+		if isNoRows(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return balance, nil
+}
+
+// utcDay returns midnight UTC of the day containing t.
+func utcDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,47 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func isLockNotAvailable(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "55P03"
+}
+
+func TestInsertUsageEventsSerializesWithRollupAdvance(t *testing.T) {
+	d := openTestDB(t)
+	ctx := context.Background()
+
+	// A late event, clamped to the first day not yet rolled up.
+	tenantID := uuid.New()
+	e := UsageEvent{ID: uuid.New(), CreatedAt: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), TenantID: tenantID, Metric: MetricPullOpCount, Value: 1}
+
+	// An insert that has read the rollup state holds it until it commits, so
+	// the day it was clamped to cannot be rolled up before it lands.
+	insertTx := beginTestTxOn(t, d)
+	testExec(t, insertTx, `INSERT INTO tenants (id, name) VALUES ($1, $2)`, tenantID, "t-"+tenantID.String())
+	testExec(t, insertTx, insertUsageEventsCmd, insertUsageEventsArgs([]UsageEvent{e})...)
+	advanceTx := beginTestTxOn(t, d)
+	if _, err := advanceTx.Exec(ctx, `SELECT rolled_through FROM usage_rollup_state FOR UPDATE NOWAIT`); !isLockNotAvailable(err) {
+		t.Fatalf("advance did not wait for the insert: %v", err)
+	}
+	insertTx.Rollback(ctx)
+	advanceTx.Rollback(ctx)
+
+	// An insert waits for an advance in progress, then reads the new day.
+	advanceTx = beginTestTxOn(t, d)
+	testExec(t, advanceTx, `SELECT rolled_through FROM usage_rollup_state FOR UPDATE`)
+	insertTx = beginTestTxOn(t, d)
+	testExec(t, insertTx, `SET LOCAL lock_timeout = '100ms'`)
+	testExec(t, insertTx, `INSERT INTO tenants (id, name) VALUES ($1, $2)`, tenantID, "t-"+tenantID.String())
+	if _, err := insertTx.Exec(ctx, insertUsageEventsCmd, insertUsageEventsArgs([]UsageEvent{e})...); !isLockNotAvailable(err) {
+		t.Fatalf("insert did not wait for the advance: %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// UsageWorker is an edge worker that submits usage events, signing each
+// request with its own secret.
+type UsageWorker struct {
+	ID              uuid.UUID
+	Name            string
+	SecretEncrypted string
+	Metrics         []UsageWorkerMetric
+	CreatedAt       time.Time
+	RevokedAt       *time.Time
+}
+
+// UsageWorkerMetric is a metric a worker may submit, with the range of values
+// each of its events may carry.
+type UsageWorkerMetric struct {
+	Metric   string
+	MinValue int64
+	MaxValue int64
+}
+
+// Validate checks that m names a known metric and a non-empty range.
+func (m UsageWorkerMetric) Validate() error {
+	switch m.Metric {
+	case MetricStorageBytes, MetricPushOpCount, MetricPullOpCount, MetricPullBytes:
+	default:
+		return fmt.Errorf("unknown metric %q", m.Metric)
+	}
+	if m.MinValue > m.MaxValue {
+		return fmt.Errorf("%s: minimum %d is above maximum %d", m.Metric, m.MinValue, m.MaxValue)
+	}
+	return nil
+}
+
+// Metric returns the worker's allowance for metric, if it has one.
+func (w UsageWorker) Metric(metric string) (UsageWorkerMetric, bool) {
+	for _, m := range w.Metrics {
+		if m.Metric == metric {
+			return m, true
+		}
+	}
+	return UsageWorkerMetric{}, false
+}
+
+// UsageIngestBatch records a batch of usage events a worker submitted.
+type UsageIngestBatch struct {
+	ID         uuid.UUID
+	WorkerID   uuid.UUID
+	Nonce      string
+	SignedAt   time.Time
+	ReceivedAt time.Time
+	ClientIP   string
+	EventIDs   []uuid.UUID
+	Rejected   []UsageIngestRejection
+}
+
+// UsageIngestRejection is an event of a batch that was not stored, as the
+// worker sent it, with the reason. Position is its index in the batch.
+type UsageIngestRejection struct {
+	Position  int
+	EventID   string
+	Namespace string
+	Metric    string
+	Value     int64
+	Reason    string
+}
+
+// CreateUsageWorker stores a new worker with its metrics, returning
+// ErrConflict if a worker already has its name.
+func (d *DB) CreateUsageWorker(ctx context.Context, w UsageWorker) (UsageWorker, error) {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return UsageWorker{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	const cmd = `INSERT INTO usage_workers (id, name, secret_encrypted)
+		VALUES ($1, $2, $3)
+		RETURNING created_at`
+	if err := tx.QueryRow(ctx, cmd, w.ID, w.Name, w.SecretEncrypted).Scan(&w.CreatedAt); err != nil {
+		if isUniqueViolation(err) {
+			return UsageWorker{}, ErrConflict
+		}
+		return UsageWorker{}, err
+	}
+	const metricCmd = `INSERT INTO usage_worker_metrics (worker_id, metric, min_value, max_value)
+		VALUES ($1, $2, $3, $4)`
+	for _, m := range w.Metrics {
+		if _, err := tx.Exec(ctx, metricCmd, w.ID, m.Metric, m.MinValue, m.MaxValue); err != nil {
+			if isUniqueViolation(err) {
+				return UsageWorker{}, ErrConflict
+			}
+			return UsageWorker{}, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return UsageWorker{}, err
+	}
+	return w, nil
+}
+
+const usageWorkerColumns = `id, name, secret_encrypted, created_at, revoked_at`
+
+func scanUsageWorker(row pgx.Row) (UsageWorker, error) {
+	var w UsageWorker
+	err := row.Scan(&w.ID, &w.Name, &w.SecretEncrypted, &w.CreatedAt, &w.RevokedAt)
+	return w, err
+}
+
+// GetUsageWorker returns the worker, revoked or not, with its metrics, or
+// ErrNotFound.
+func (d *DB) GetUsageWorker(ctx context.Context, id uuid.UUID) (UsageWorker, error) {
+	const cmd = `SELECT ` + usageWorkerColumns + ` FROM usage_workers WHERE id = $1`
+	w, err := scanUsageWorker(d.conn.QueryRow(ctx, cmd, id))
+	if err != nil {
+		if isNoRows(err) {
+			return UsageWorker{}, ErrNotFound
+		}
+		return UsageWorker{}, err
+	}
+	workers := []UsageWorker{w}
+	if err := d.loadUsageWorkerMetrics(ctx, workers); err != nil {
+		return UsageWorker{}, err
+	}
+	return workers[0], nil
+}
+
+// ListUsageWorkers returns every worker, revoked ones included, by name.
+func (d *DB) ListUsageWorkers(ctx context.Context) ([]UsageWorker, error) {
+	const cmd = `SELECT ` + usageWorkerColumns + ` FROM usage_workers ORDER BY name ASC`
+	rows, err := d.conn.Query(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	workers, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (UsageWorker, error) {
+		return scanUsageWorker(row)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := d.loadUsageWorkerMetrics(ctx, workers); err != nil {
+		return nil, err
+	}
+	return workers, nil
+}
+
+// loadUsageWorkerMetrics sets the metrics of workers.
+func (d *DB) loadUsageWorkerMetrics(ctx context.Context, workers []UsageWorker) error {
+	if len(workers) == 0 {
+		return nil
+	}
+	ids := make([]uuid.UUID, len(workers))
+	index := make(map[uuid.UUID]int, len(workers))
+	for i, w := range workers {
+		ids[i] = w.ID
+		index[w.ID] = i
+	}
+	const cmd = `SELECT worker_id, metric, min_value, max_value
+		FROM usage_worker_metrics
+		WHERE worker_id = ANY($1)
+		ORDER BY worker_id, metric ASC`
+	rows, err := d.conn.Query(ctx, cmd, ids)
+	if err != nil {
+		return err
+	}
+	var workerID uuid.UUID
+	var m UsageWorkerMetric
+	_, err = pgx.ForEachRow(rows, []any{&workerID, &m.Metric, &m.MinValue, &m.MaxValue}, func() error {
+		i := index[workerID]
+		workers[i].Metrics = append(workers[i].Metrics, m)
+		return nil
+	})
+	return err
+}
+
+// RevokeUsageWorker stops accepting the worker's requests, returning
+// ErrNotFound if there is no such worker that is not revoked already.
+func (d *DB) RevokeUsageWorker(ctx context.Context, id uuid.UUID) error {
+	const cmd = `UPDATE usage_workers SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`
+	tag, err := d.conn.Exec(ctx, cmd, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// IngestUsageBatch logs the batch with its rejected events and stores its
+// events together, skipping events already stored. It returns ErrConflict if
+// the worker already submitted a batch with the same nonce, that is for a
+// replayed request.
+func (d *DB) IngestUsageBatch(ctx context.Context, batch UsageIngestBatch, events []UsageEvent) error {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	eventIDs := make([]uuid.UUID, len(events))
+	for i, e := range events {
+		eventIDs[i] = e.ID
+	}
+	const cmd = `INSERT INTO usage_ingest_batches (id, worker_id, nonce, signed_at, client_ip, event_ids)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+	if _, err := tx.Exec(ctx, cmd, batch.ID, batch.WorkerID, batch.Nonce, batch.SignedAt, batch.ClientIP, eventIDs); err != nil {
+		if isUniqueViolation(err) {
+			return ErrConflict
+		}
+		return err
+	}
+	const rejectionCmd = `INSERT INTO usage_ingest_rejections (batch_id, position, event_id, namespace, metric, value, reason)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	for _, r := range batch.Rejected {
+		if _, err := tx.Exec(ctx, rejectionCmd, batch.ID, r.Position, r.EventID, r.Namespace, r.Metric, r.Value, r.Reason); err != nil {
+			return err
+		}
+	}
+	if len(events) > 0 {
+		if _, err := tx.Exec(ctx, insertUsageEventsCmd, insertUsageEventsArgs(events)...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// ListUsageIngestBatches returns up to limit batches the worker submitted,
+// newest first.
+func (d *DB) ListUsageIngestBatches(ctx context.Context, workerID uuid.UUID, limit int) ([]UsageIngestBatch, error) {
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	const cmd = `SELECT id, worker_id, nonce, signed_at, received_at, client_ip, event_ids
+		FROM usage_ingest_batches
+		WHERE worker_id = $1
+		ORDER BY received_at DESC, id ASC
+		LIMIT $2`
+	rows, err := d.conn.Query(ctx, cmd, workerID, limit)
+	if err != nil {
+		return nil, err
+	}
+	batches, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (UsageIngestBatch, error) {
+		var b UsageIngestBatch
+		err := row.Scan(&b.ID, &b.WorkerID, &b.Nonce, &b.SignedAt, &b.ReceivedAt, &b.ClientIP, &b.EventIDs)
+		return b, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := d.loadUsageIngestRejections(ctx, batches); err != nil {
+		return nil, err
+	}
+	return batches, nil
+}
+
+// DeleteUsageIngestBatchesBefore deletes up to limit of the batches received
+// before before, oldest first, with their rejected events, and returns how
+// many it deleted.
+func (d *DB) DeleteUsageIngestBatchesBefore(ctx context.Context, before time.Time, limit int) (int64, error) {
+	const cmd = `DELETE FROM usage_ingest_batches
+		WHERE id IN (
+			SELECT id FROM usage_ingest_batches
+			WHERE received_at < $1
+			ORDER BY received_at ASC
+			LIMIT $2
+		)`
+	tag, err := d.conn.Exec(ctx, cmd, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// loadUsageIngestRejections sets the rejected events of batches.
+func (d *DB) loadUsageIngestRejections(ctx context.Context, batches []UsageIngestBatch) error {
+	if len(batches) == 0 {
+		return nil
+	}
+	ids := make([]uuid.UUID, len(batches))
+	index := make(map[uuid.UUID]int, len(batches))
+	for i, b := range batches {
+		ids[i] = b.ID
+		index[b.ID] = i
+	}
+	const cmd = `SELECT batch_id, position, event_id, namespace, metric, value, reason
+		FROM usage_ingest_rejections
+		WHERE batch_id = ANY($1)
+		ORDER BY batch_id, position ASC`
+	rows, err := d.conn.Query(ctx, cmd, ids)
+	if err != nil {
+		return err
+	}
+	var batchID uuid.UUID
+	var r UsageIngestRejection
+	_, err = pgx.ForEachRow(rows, []any{&batchID, &r.Position, &r.EventID, &r.Namespace, &r.Metric, &r.Value, &r.Reason}, func() error {
+		i := index[batchID]
+		batches[i].Rejected = append(batches[i].Rejected, r)
+		return nil
+	})
+	return err
+}
@@ -2,54 +2,239 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 )
 
+// User is a signed-in identity. TenantID is their default organization, used
+// when a request does not select one explicitly.
 type User struct {
-	ID        uuid.UUID
-	Sub       string
-	TenantID  uuid.UUID
-	Onboarded bool
+	ID    uuid.UUID
+	Sub   string
+	Email *string
+	// EmailVerified is whether the identity provider verified Email.
+	EmailVerified bool
+	TenantID      uuid.UUID
+	TenantName    string
+	Onboarded     bool
+	TenantState   AccessState
+	// Role is the user's role in TenantID, empty if they are not a member.
+	Role OrgRole
 }
 
-func (d *DB) GetOrCreateUser(
-	ctx context.Context,
-	sub string,
-	org string,
-) (User, error) {
-	if sub == "" {
+const selectUserCmd = `SELECT u.id, u.sub, u.email, u.email_verified, u.tenant_id, t.name, t.onboarded, t.state, COALESCE(m.role::text, '')
+	FROM users u
+	JOIN tenants t ON t.id = u.tenant_id
+	LEFT JOIN org_members m ON m.org_id = u.tenant_id AND m.user_id = u.id`
+
+func scanUser(row pgx.Row) (User, error) {
+	var user User
+	var role string
+	err := row.Scan(
+		&user.ID,
+		&user.Sub,
+		&user.Email,
+		&user.EmailVerified,
+		&user.TenantID,
+		&user.TenantName,
+		&user.Onboarded,
+		&user.TenantState,
+		&role,
+	)
+	user.Role = OrgRole(role)
+	return user, err
+}
+
+func (d *DB) GetUserBySub(ctx context.Context, sub string) (User, error) {
+	user, err := scanUser(d.conn.QueryRow(ctx, selectUserCmd+` WHERE u.sub = $1`, sub))
+	if err != nil {
+		if isNoRows(err) {
+			return User{}, ErrNotFound
+		}
+		return User{}, err
+	}
+	return user, nil
+}
+
+func getUserTx(ctx context.Context, tx pgx.Tx, userID uuid.UUID) (User, error) {
+	return scanUser(tx.QueryRow(ctx, selectUserCmd+` WHERE u.id = $1`, userID))
+}
+
+type CreateUserArgs struct {
+	Sub string
+	// Org is the organization named by the identity provider, if any.
+	Org   string
+	Email string
+	// EmailVerified allows Email to accept a pending invitation.
+	EmailVerified bool
+}
+
+// CreateUser creates a user on first sign in. A user signing in with an
+// organization joins it; otherwise they join the organization of a pending
+// invitation for their email, falling back to a personal organization. The
+// role comes from the invitation, or is owner for the first member of an
+// organization and member after that.
+func (d *DB) CreateUser(ctx context.Context, args CreateUserArgs) (User, error) {
+	if args.Sub == "" {
 		return User{}, fmt.Errorf("sub not specified")
 	}
 
-	tenantName := org
-	if tenantName == "" {
-		tenantName = "personal__" + sub
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return User{}, err
 	}
+	defer tx.Rollback(ctx)
 
-	var user User
-	err := d.conn.QueryRow(ctx, `
-		WITH t AS (
-			INSERT INTO tenants (id, name)
-			VALUES (gen_random_uuid(), $1)
-			ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
-			RETURNING id, onboarded
-		)
-		INSERT INTO users (id, tenant_id, sub)
-		VALUES (gen_random_uuid(), (SELECT id FROM t), $2)
-		ON CONFLICT (sub) DO UPDATE SET tenant_id = (SELECT id FROM t)
-		RETURNING id, tenant_id, sub, (SELECT onboarded FROM t)
-	`, tenantName, sub).Scan(&user.ID, &user.TenantID, &user.Sub, &user.Onboarded)
+	var tenantID uuid.UUID
+	if args.Org != "" {
+		if tenantID, err = upsertTenant(ctx, tx, args.Org); err != nil {
+			return User{}, err
+		}
+	}
+
+	var inv *OrgInvitation
+	if args.Email != "" && args.EmailVerified {
+		var orgID *uuid.UUID
+		if args.Org != "" {
+			orgID = &tenantID
+		}
+		found, err := lockPendingOrgInvitation(ctx, tx, args.Email, orgID)
+		switch {
+		case err == nil:
+			inv = &found
+			tenantID = found.OrgID
+		case !errors.Is(err, ErrNotFound):
+			return User{}, err
+		}
+	}
+
+	if tenantID == uuid.Nil {
+		if tenantID, err = upsertTenant(ctx, tx, personalTenantName(args.Sub)); err != nil {
+			return User{}, err
+		}
+	}
+
+	var role OrgRole
+	if inv != nil {
+		role = inv.Role
+	} else if role, err = defaultJoinRole(ctx, tx, tenantID); err != nil {
+		return User{}, err
+	}
+
+	userID := uuid.New()
+	var email *string
+	if args.Email != "" {
+		email = &args.Email
+	}
+	const insertCmd = `INSERT INTO users (id, tenant_id, sub, email, email_verified) VALUES ($1, $2, $3, $4, $5)`
+	if _, err := tx.Exec(ctx, insertCmd, userID, tenantID, args.Sub, email, email != nil && args.EmailVerified); err != nil {
+		if isUniqueViolation(err) {
+			return User{}, ErrConflict
+		}
+		return User{}, err
+	}
+	if _, err := addOrgMemberTx(ctx, tx, tenantID, userID, role); err != nil {
+		return User{}, err
+	}
+	if inv != nil {
+		if err := markOrgInvitationAccepted(ctx, tx, inv.ID, userID); err != nil {
+			return User{}, err
+		}
+	}
+
+	user, err := getUserTx(ctx, tx, userID)
 	if err != nil {
-		return user, err
+		return User{}, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return User{}, err
 	}
 	return user, nil
 }
 
-func (d *DB) SetUserOnboarded(ctx context.Context, userID uuid.UUID, onboarded bool) error {
-	const cmd = `UPDATE tenants SET onboarded = $1 WHERE id = (SELECT tenant_id FROM users where id = $2)`
-	tag, err := d.conn.Exec(ctx, cmd, onboarded, userID)
+// SyncUserOrg makes the organization named by the identity provider the
+// user's default. A user who is not yet a member joins with the role of their
+// pending invitation, accepted only with a verified email as in CreateUser,
+// or the default role without one; other memberships are kept.
+func (d *DB) SyncUserOrg(ctx context.Context, userID uuid.UUID, org string) (User, error) {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	user, err := syncUserOrg(ctx, tx, userID, org)
+	if err != nil {
+		return User{}, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func syncUserOrg(ctx context.Context, tx pgx.Tx, userID uuid.UUID, org string) (User, error) {
+	tenantID, err := upsertTenant(ctx, tx, org)
+	if err != nil {
+		return User{}, err
+	}
+	var isMember bool
+	const memberCmd = `SELECT EXISTS(SELECT 1 FROM org_members WHERE org_id = $1 AND user_id = $2)`
+	if err := tx.QueryRow(ctx, memberCmd, tenantID, userID).Scan(&isMember); err != nil {
+		return User{}, err
+	}
+	if !isMember {
+		var email *string
+		var emailVerified bool
+		const emailCmd = `SELECT email, email_verified FROM users WHERE id = $1`
+		if err := tx.QueryRow(ctx, emailCmd, userID).Scan(&email, &emailVerified); err != nil {
+			if isNoRows(err) {
+				return User{}, ErrNotFound
+			}
+			return User{}, err
+		}
+		role, err := defaultJoinRole(ctx, tx, tenantID)
+		if err != nil {
+			return User{}, err
+		}
+		if email != nil && emailVerified {
+			inv, err := lockPendingOrgInvitation(ctx, tx, *email, &tenantID)
+			switch {
+			case err == nil:
+				role = inv.Role
+				if err := markOrgInvitationAccepted(ctx, tx, inv.ID, userID); err != nil {
+					return User{}, err
+				}
+			case !errors.Is(err, ErrNotFound):
+				return User{}, err
+			}
+		}
+		if _, err := addOrgMemberTx(ctx, tx, tenantID, userID, role); err != nil {
+			return User{}, err
+		}
+	}
+	if _, err := tx.Exec(ctx, `UPDATE users SET tenant_id = $2 WHERE id = $1`, userID, tenantID); err != nil {
+		return User{}, err
+	}
+
+	user, err := getUserTx(ctx, tx, userID)
+	if err != nil {
+		if isNoRows(err) {
+			return User{}, ErrNotFound
+		}
+		return User{}, err
+	}
+	return user, nil
+}
+
+// SetUserEmail records the user's email and whether the identity provider
+// verified it.
+func (d *DB) SetUserEmail(ctx context.Context, userID uuid.UUID, email string, verified bool) error {
+	const cmd = `UPDATE users SET email = $2, email_verified = $3 WHERE id = $1`
+	tag, err := d.conn.Exec(ctx, cmd, userID, email, verified)
 	if err != nil {
 		return err
 	}
@@ -59,20 +244,64 @@ func (d *DB) SetUserOnboarded(ctx context.Context, userID uuid.UUID, onboarded b
 	return nil
 }
 
+// GetOrCreateUser returns the user for sub, creating them on first use and
+// making org their default organization when it is set.
+func (d *DB) GetOrCreateUser(
+	ctx context.Context,
+	sub string,
+	org string,
+) (User, error) {
+	user, err := d.GetUserBySub(ctx, sub)
+	if errors.Is(err, ErrNotFound) {
+		user, err = d.CreateUser(ctx, CreateUserArgs{Sub: sub, Org: org})
+		if errors.Is(err, ErrConflict) {
+			user, err = d.GetUserBySub(ctx, sub)
+		}
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if org != "" && org != user.TenantName {
+		return d.SyncUserOrg(ctx, user.ID, org)
+	}
+	return user, nil
+}
+
+// GetOrCreateUserInTenant makes sub an owner of tenantID and makes it their
+// default organization.
 func (d *DB) GetOrCreateUserInTenant(ctx context.Context, sub string, tenantID uuid.UUID) (User, error) {
 	if sub == "" {
 		return User{}, fmt.Errorf("sub not specified")
 	}
 
-	var user User
-	err := d.conn.QueryRow(ctx, `
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	var userID uuid.UUID
+	err = tx.QueryRow(ctx, `
 		INSERT INTO users (id, tenant_id, sub)
 		VALUES (gen_random_uuid(), $1, $2)
 		ON CONFLICT (sub) DO UPDATE SET tenant_id = EXCLUDED.tenant_id
-		RETURNING id, tenant_id, sub, (SELECT onboarded FROM tenants WHERE id = $1)
-	`, tenantID, sub).Scan(&user.ID, &user.TenantID, &user.Sub, &user.Onboarded)
+		RETURNING id
+	`, tenantID, sub).Scan(&userID)
 	if err != nil {
-		return user, err
+		return User{}, err
+	}
+	const memberCmd = `INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, 'owner')
+		ON CONFLICT (org_id, user_id) DO UPDATE SET role = 'owner'`
+	if _, err := tx.Exec(ctx, memberCmd, tenantID, userID); err != nil {
+		return User{}, err
+	}
+
+	user, err := getUserTx(ctx, tx, userID)
+	if err != nil {
+		return User{}, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return User{}, err
 	}
 	return user, nil
 }
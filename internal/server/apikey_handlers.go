@@ -17,31 +17,37 @@ import (
 var keyNameRe = regexp.MustCompile(`^[A-Za-z0-9._-]{2,32}$`)
 
 type createAPIKeyRequest struct {
-	KeyName string              `json:"keyName"`
-	Scopes  []createAPIKeyScope `json:"scopes"`
+	KeyName      string              `json:"keyName"`
+	AllowedCIDRs []string            `json:"allowedCidrs,omitempty"`
+	Scopes       []createAPIKeyScope `json:"scopes"`
 }
 
 type createAPIKeyScope struct {
 	RegistryID string  `json:"registryId"`
 	Repository *string `json:"repository,omitempty"`
-	Permission string  `json:"permission"`
+	// RepositoryPattern scopes the key to every repository, existing or
+	// future, whose path matches the glob, e.g. "my-registry/team-a/**".
+	RepositoryPattern *string `json:"repositoryPattern,omitempty"`
+	Permission        string  `json:"permission"`
 }
 
 type apiKeyResponse struct {
-	ID         uuid.UUID             `json:"id"`
-	KeyName    string                `json:"keyName"`
-	Prefix     string                `json:"prefix"`
-	SecretKey  string                `json:"secretKey"`
-	CreatedAt  time.Time             `json:"createdAt"`
-	LastUsedAt *time.Time            `json:"lastUsedAt,omitempty"`
-	Scopes     []apiKeyScopeResponse `json:"scopes"`
+	ID           uuid.UUID             `json:"id"`
+	KeyName      string                `json:"keyName"`
+	Prefix       string                `json:"prefix"`
+	SecretKey    string                `json:"secretKey"`
+	CreatedAt    time.Time             `json:"createdAt"`
+	LastUsedAt   *time.Time            `json:"lastUsedAt,omitempty"`
+	AllowedCIDRs []string              `json:"allowedCidrs"`
+	Scopes       []apiKeyScopeResponse `json:"scopes"`
 }
 
 type apiKeyScopeResponse struct {
-	RegistryID uuid.UUID `json:"registryId"`
-	Repository *string   `json:"repository,omitempty"`
-	Permission string    `json:"permission"`
-	CreatedAt  time.Time `json:"createdAt"`
+	RegistryID        uuid.UUID `json:"registryId"`
+	Repository        *string   `json:"repository,omitempty"`
+	RepositoryPattern *string   `json:"repositoryPattern,omitempty"`
+	Permission        string    `json:"permission"`
+	CreatedAt         time.Time `json:"createdAt"`
 }
 
 type listAPIKeysResponse struct {
@@ -58,13 +64,14 @@ func (e apiKeyRequestError) Error() string {
 
 func (s *Server) buildAPIKeyResponse(key db.APIKey, secretKey string) apiKeyResponse {
 	return apiKeyResponse{
-		ID:         key.ID,
-		KeyName:    key.KeyName,
-		Prefix:     key.Prefix,
-		SecretKey:  secretKey,
-		CreatedAt:  key.CreatedAt,
-		LastUsedAt: key.LastUsedAt,
-		Scopes:     apiKeyScopesResponse(key.Scopes),
+		ID:           key.ID,
+		KeyName:      key.KeyName,
+		Prefix:       key.Prefix,
+		SecretKey:    secretKey,
+		CreatedAt:    key.CreatedAt,
+		LastUsedAt:   key.LastUsedAt,
+		AllowedCIDRs: key.AllowedCIDRs,
+		Scopes:       apiKeyScopesResponse(key.Scopes),
 	}
 }
 
@@ -86,12 +93,26 @@ func (s *Server) addAPIKeyHandler(c *gin.Context) {
 		return
 	}
 
+	allowedCIDRs, err := normalizeCIDRAllowlist(req.AllowedCIDRs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !u.grantsCIDRs(allowedCIDRs) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "allowedCidrs must lie within the calling API key's"})
+		return
+	}
+
 	scopes, err := s.resolveCreateAPIKeyScopes(c, u, req.Scopes)
 	if err != nil {
 		if errors.Is(err, errUnauthorized) {
 			c.JSON(http.StatusForbidden, gin.H{"error": "not allowed to create key for that registry"})
 			return
 		}
+		if errors.Is(err, errInsufficientRole) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "your role cannot grant that permission"})
+			return
+		}
 		var reqErr apiKeyRequestError
 		if errors.As(err, &reqErr) {
 			c.JSON(http.StatusBadRequest, gin.H{"error": reqErr.Error()})
@@ -120,6 +141,7 @@ func (s *Server) addAPIKeyHandler(c *gin.Context) {
 		KeyName:         req.KeyName,
 		SecretEncrypted: encrypted,
 		Prefix:          prefix,
+		AllowedCIDRs:    allowedCIDRs,
 		Scopes:          scopes,
 	})
 	if err != nil {
@@ -136,6 +158,7 @@ func (s *Server) addAPIKeyHandler(c *gin.Context) {
 		return
 	}
 
+	setAuditTarget(c, apiKeyRec.ID.String())
 	c.JSON(http.StatusCreated, s.buildAPIKeyResponse(apiKeyRec, fullKey))
 }
 
@@ -146,7 +169,7 @@ func (s *Server) listAPIKeysHandler(c *gin.Context) {
 		return
 	}
 
-	apiKeyRecs, err := s.db.ListAPIKeysByUser(c.Request.Context(), u.id)
+	apiKeyRecs, err := s.db.ListAPIKeysByUserInOrg(c.Request.Context(), u.id, u.tenantID)
 	if err != nil {
 		logError(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
@@ -155,6 +178,9 @@ func (s *Server) listAPIKeysHandler(c *gin.Context) {
 
 	keys := make([]apiKeyResponse, 0, len(apiKeyRecs))
 	for _, rec := range apiKeyRecs {
+		if !u.managesAPIKey(rec.Scopes) {
+			continue
+		}
 		fullKey, err := apikey.Decrypt(rec.SecretEncrypted, s.apiKeyEncryptionKey)
 		if err != nil {
 			logError(err)
@@ -180,7 +206,11 @@ func (s *Server) removeAPIKeyHandler(c *gin.Context) {
 		return
 	}
 
-	err = s.db.RemoveAPIKey(c.Request.Context(), u.id, id)
+	if !s.requireManagedAPIKey(c, u, id) {
+		return
+	}
+
+	err = s.db.RevokeAPIKey(c.Request.Context(), u.id, u.tenantID, id, registryTokensExpireAt(time.Now().UTC()))
 	if err != nil {
 		if errors.Is(err, db.ErrNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
@@ -194,14 +224,142 @@ func (s *Server) removeAPIKeyHandler(c *gin.Context) {
 	c.Status(http.StatusNoContent)
 }
 
+func (s *Server) revokeAPIKeyRefreshTokensHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Key ID malformed"})
+		return
+	}
+
+	if !s.requireManagedAPIKey(c, u, id) {
+		return
+	}
+
+	if _, err := s.db.RevokeRegistryRefreshTokensByAPIKey(c.Request.Context(), u.id, u.tenantID, id); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// revokeAPIKeyTokensHandler invalidates every registry access and refresh
+// token issued so far for the key without deleting the key itself.
+func (s *Server) revokeAPIKeyTokensHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Key ID malformed"})
+		return
+	}
+
+	if !s.requireManagedAPIKey(c, u, id) {
+		return
+	}
+
+	if err := s.db.RevokeAPIKeyTokens(c.Request.Context(), u.id, u.tenantID, id, registryTokensExpireAt(time.Now().UTC())); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// setAPIKeyAllowedCIDRsHandler replaces the key's client address allowlist.
+// An empty list lifts the restriction.
+func (s *Server) setAPIKeyAllowedCIDRsHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Key ID malformed"})
+		return
+	}
+
+	var req setAllowedCIDRsRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	cidrs, err := normalizeCIDRAllowlist(req.AllowedCIDRs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !u.grantsCIDRs(cidrs) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "allowedCidrs must lie within the calling API key's"})
+		return
+	}
+	if !s.requireManagedAPIKey(c, u, id) {
+		return
+	}
+
+	if err := s.db.SetAPIKeyAllowedCIDRs(c.Request.Context(), u.id, u.tenantID, id, cidrs); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, setAllowedCIDRsRequest{AllowedCIDRs: cidrs})
+}
+
+// requireManagedAPIKey writes a 404 unless u may manage key id, as described
+// by user.managesAPIKey. Keys that do not exist are left to the caller.
+func (s *Server) requireManagedAPIKey(c *gin.Context, u user, id uuid.UUID) bool {
+	if u.apiKeyID == uuid.Nil {
+		return true
+	}
+	scopes, err := s.db.ListAPIKeyScopesByAPIKeyID(c.Request.Context(), id)
+	if err != nil {
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return false
+	}
+	if !u.managesAPIKey(scopes) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return false
+	}
+	return true
+}
+
 func apiKeyScopesResponse(scopes []db.APIKeyScope) []apiKeyScopeResponse {
 	out := make([]apiKeyScopeResponse, 0, len(scopes))
 	for _, scope := range scopes {
 		out = append(out, apiKeyScopeResponse{
-			RegistryID: scope.RegistryID,
-			Repository: scope.Repository,
-			Permission: string(scope.Permission),
-			CreatedAt:  scope.CreatedAt,
+			RegistryID:        scope.RegistryID,
+			Repository:        scope.Repository,
+			RepositoryPattern: scope.RepositoryPattern,
+			Permission:        string(scope.Permission),
+			CreatedAt:         scope.CreatedAt,
 		})
 	}
 	return out
@@ -225,6 +383,9 @@ func (s *Server) resolveCreateAPIKeyScopes(c *gin.Context, u user, rawScopes []c
 		if err != nil {
 			return nil, apiKeyRequestError{message: "registryId is malformed"}
 		}
+		if !u.managesRegistry(registryID) {
+			return nil, errUnauthorized
+		}
 
 		registryRec, err := s.db.GetRegistryByID(c.Request.Context(), registryID)
 		if err != nil {
@@ -242,6 +403,9 @@ func (s *Server) resolveCreateAPIKeyScopes(c *gin.Context, u user, rawScopes []c
 		if err != nil {
 			return nil, err
 		}
+		if !u.role.GrantsAPIKeyPermission(permission) {
+			return nil, errInsufficientRole
+		}
 
 		var repositoryID *uuid.UUID
 		normalizedRepository := ""
@@ -264,6 +428,25 @@ func (s *Server) resolveCreateAPIKeyScopes(c *gin.Context, u user, rawScopes []c
 			}
 		}
 
+		var repositoryPattern *string
+		if rawScope.RepositoryPattern != nil {
+			pattern := strings.TrimSpace(*rawScope.RepositoryPattern)
+			if pattern != "" {
+				if repositoryID != nil {
+					return nil, apiKeyRequestError{message: "repository and repositoryPattern are mutually exclusive"}
+				}
+				if !strings.Contains(pattern, "/") || !validRepoPattern(pattern) {
+					return nil, apiKeyRequestError{message: "repository pattern is invalid"}
+				}
+				if registryNamespace(pattern) != registryRec.Name {
+					return nil, apiKeyRequestError{message: "repository pattern must belong to the selected registry"}
+				}
+				leafPattern := repoLeaf(pattern)
+				repositoryPattern = &leafPattern
+				normalizedRepository = "pattern:" + leafPattern
+			}
+		}
+
 		scopeKey := normalizedScope{registryID: registryID, repository: normalizedRepository}
 		if _, ok := seen[scopeKey]; ok {
 			return nil, apiKeyRequestError{message: "duplicate scope target"}
@@ -271,9 +454,10 @@ func (s *Server) resolveCreateAPIKeyScopes(c *gin.Context, u user, rawScopes []c
 		seen[scopeKey] = struct{}{}
 
 		out = append(out, db.AddAPIKeyScopeInput{
-			RegistryID:   registryID,
-			RepositoryID: repositoryID,
-			Permission:   permission,
+			RegistryID:        registryID,
+			RepositoryID:      repositoryID,
+			RepositoryPattern: repositoryPattern,
+			Permission:        permission,
 		})
 	}
 
@@ -289,7 +473,17 @@ func (s *Server) resolveCreateAPIKeyScopes(c *gin.Context, u user, rawScopes []c
 		if b.RepositoryID != nil {
 			bRepo = b.RepositoryID.String()
 		}
-		return strings.Compare(aRepo, bRepo)
+		if aRepo != bRepo {
+			return strings.Compare(aRepo, bRepo)
+		}
+		aPattern, bPattern := "", ""
+		if a.RepositoryPattern != nil {
+			aPattern = *a.RepositoryPattern
+		}
+		if b.RepositoryPattern != nil {
+			bPattern = *b.RepositoryPattern
+		}
+		return strings.Compare(aPattern, bPattern)
 	})
 
 	return out, nil
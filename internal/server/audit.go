@@ -0,0 +1,568 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	auditTargetKey   = "auditTarget"
+	auditRegistryKey = "auditRegistry"
+)
+
+// managementAuditActions maps audited /api/v1 routes ("METHOD full-path") to
+// audit actions. Read-only routes are not audited.
+var managementAuditActions = map[string]string{
+	"POST /api/v1/registries":                    "registry.create",
+	"DELETE /api/v1/registries/:id":              "registry.delete",
+	"PUT /api/v1/registries/:id/allowed-cidrs":   "registry.update_allowed_cidrs",
+	"PUT /api/v1/registries/:id/quota":           "registry.set_quota",
+	"DELETE /api/v1/registries/:id/quota":        "registry.remove_quota",
+	"DELETE /api/v1/repositories/:id":            "repository.delete",
+	"PUT /api/v1/repositories/:id/quota":         "repository.set_quota",
+	"DELETE /api/v1/repositories/:id/quota":      "repository.remove_quota",
+	"POST /api/v1/api-keys":                      "api_key.create",
+	"DELETE /api/v1/api-keys/:id":                "api_key.delete",
+	"DELETE /api/v1/api-keys/:id/refresh-tokens": "api_key.revoke_refresh_tokens",
+	"POST /api/v1/api-keys/:id/revoke-tokens":    "api_key.revoke_tokens",
+	"PUT /api/v1/api-keys/:id/allowed-cidrs":     "api_key.update_allowed_cidrs",
+	"POST /api/v1/registry-tokens/revoke":        "registry_token.revoke",
+	"PUT /api/v1/org/members/:id/role":           "org.member.update_role",
+	"DELETE /api/v1/org/members/:id":             "org.member.remove",
+	"POST /api/v1/org/invitations":               "org.invitation.create",
+	"DELETE /api/v1/org/invitations/:id":         "org.invitation.delete",
+	"POST /api/v1/budgets":                       "usage_budget.create",
+	"PUT /api/v1/budgets/:id":                    "usage_budget.update",
+	"DELETE /api/v1/budgets/:id":                 "usage_budget.delete",
+	"GET /api/v1/audit/export":                   "audit.export",
+}
+
+// setAuditTarget records the affected object for the current request's audit
+// event when it is not the :id route parameter, e.g. a newly created key.
+func setAuditTarget(c *gin.Context, target string) {
+	c.Set(auditTargetKey, target)
+}
+
+// setAuditRegistry attributes the current request's audit event to a registry
+// that the route does not identify, e.g. a newly created one.
+func setAuditRegistry(c *gin.Context, registry db.Registry) {
+	c.Set(auditRegistryKey, registry)
+}
+
+func auditOutcome(status int) string {
+	switch {
+	case status < http.StatusBadRequest:
+		return db.AuditOutcomeSuccess
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return db.AuditOutcomeDenied
+	default:
+		return db.AuditOutcomeFailure
+	}
+}
+
+// withAuditRequest fills in the request-derived fields of event.
+func withAuditRequest(c *gin.Context, event db.AuditEvent) db.AuditEvent {
+	event.ID = uuid.New()
+	event.OccurredAt = time.Now().UTC()
+	event.ClientIP = c.ClientIP()
+	event.UserAgent = c.Request.UserAgent()
+	event.StatusCode = c.Writer.Status()
+	event.Outcome = auditOutcome(event.StatusCode)
+	return event
+}
+
+// recordAuditEvent fills in the request-derived fields and stores the event,
+// logging but not propagating any error.
+func (s *Server) recordAuditEvent(c *gin.Context, event db.AuditEvent) {
+	if s.db == nil {
+		return
+	}
+	event = withAuditRequest(c, event)
+
+	// The client may already have gone away; the trail must still be written.
+	ctx := context.WithoutCancel(c.Request.Context())
+	if err := s.db.InsertAuditEvent(ctx, event); err != nil {
+		logError(fmt.Errorf("recordAuditEvent %s: %w", event.Action, err))
+	}
+}
+
+// registryAuditMiddleware records pushes, pulls, deletes and token issuance on
+// the /v2 API once the request has been handled, including requests rejected
+// by authentication. Being on the pull path, it takes the registry from the
+// request's authentication and leaves storing the event to s.registryAudit.
+func (s *Server) registryAuditMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		relative := strings.TrimPrefix(c.Param("path"), "/")
+		action, repository, reference := registryAuditAction(relative, c.Request.Method)
+		if action == "" || s.db == nil {
+			return
+		}
+
+		event := db.AuditEvent{
+			ActorType:  db.AuditActorAnonymous,
+			Action:     action,
+			Repository: repository,
+		}
+		if reDigest.MatchString(reference) {
+			event.Digest = reference
+		} else {
+			event.Reference = reference
+		}
+		if digest := c.Writer.Header().Get("Docker-Content-Digest"); digest != "" {
+			event.Digest = digest
+		} else if action == "blob.push" {
+			event.Digest = strings.TrimSpace(c.Query("digest"))
+		}
+
+		namespace := registryNamespace(repository)
+		if auth, err := s.getRegistryAuth(c); err == nil {
+			if auth.apiKeyID != uuid.Nil {
+				event.ActorType = db.AuditActorAPIKey
+				event.ActorID = &auth.apiKeyID
+			}
+			if namespace == "" {
+				namespace = auth.namespace
+			}
+			if namespace == auth.namespace && auth.registryID != uuid.Nil {
+				event.TenantID = &auth.tenantID
+				event.RegistryID = &auth.registryID
+			}
+		}
+		event.RegistryName = namespace
+
+		event = withAuditRequest(c, event)
+		if s.registryAudit != nil {
+			s.registryAudit.enqueue(event)
+			return
+		}
+		storeRegistryAuditEvents(context.WithoutCancel(c.Request.Context()), s.db, []db.AuditEvent{event})
+	}
+}
+
+const (
+	// registryAuditCapacity is how many /v2 audit events wait in memory
+	// before further ones are stored inline.
+	registryAuditCapacity = 10000
+	// registryAuditBatchSize is the most events stored in one round trip.
+	registryAuditBatchSize = 200
+	// registryAuditFlushInterval is the longest an event waits in memory.
+	registryAuditFlushInterval = time.Second
+	// registryAuditInsertTimeout bounds storing one batch.
+	registryAuditInsertTimeout = 10 * time.Second
+)
+
+// registryAuditWriter stores /v2 audit events in batches, off the request
+// path. When it is full or closed events are stored inline instead, so the
+// trail is slowed down rather than dropped.
+type registryAuditWriter struct {
+	store  func(context.Context, []db.AuditEvent)
+	events chan db.AuditEvent
+	done   chan struct{}
+
+	// mu guards closed against sends on events while it is being closed.
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newRegistryAuditWriter(store func(context.Context, []db.AuditEvent)) *registryAuditWriter {
+	w := &registryAuditWriter{
+		store:  store,
+		events: make(chan db.AuditEvent, registryAuditCapacity),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *registryAuditWriter) enqueue(event db.AuditEvent) {
+	w.mu.RLock()
+	if !w.closed {
+		select {
+		case w.events <- event:
+			w.mu.RUnlock()
+			return
+		default:
+		}
+	}
+	w.mu.RUnlock()
+	w.store(context.Background(), []db.AuditEvent{event})
+}
+
+// close stores queued events and waits until done or ctx expires.
+func (w *registryAuditWriter) close(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.events)
+	}
+	w.mu.Unlock()
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *registryAuditWriter) run() {
+	defer close(w.done)
+	flush := time.NewTicker(registryAuditFlushInterval)
+	defer flush.Stop()
+
+	batch := make([]db.AuditEvent, 0, registryAuditBatchSize)
+	for {
+		select {
+		case e, ok := <-w.events:
+			if !ok {
+				w.store(context.Background(), batch)
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= registryAuditBatchSize {
+				w.store(context.Background(), batch)
+				batch = batch[:0]
+			}
+		case <-flush.C:
+			if len(batch) > 0 {
+				w.store(context.Background(), batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// storeRegistryAuditEvents stores events, first attributing those whose
+// registry the request's authentication did not identify, e.g. rejected
+// ones, by looking their registry up by name. Errors are logged.
+func storeRegistryAuditEvents(ctx context.Context, conn *db.DB, events []db.AuditEvent) {
+	if len(events) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, registryAuditInsertTimeout)
+	defer cancel()
+
+	registries := map[string]*db.Registry{}
+	for i, e := range events {
+		if e.RegistryID != nil || e.RegistryName == "" {
+			continue
+		}
+		reg, seen := registries[e.RegistryName]
+		if !seen {
+			if found, err := conn.GetRegistryByName(ctx, e.RegistryName); err == nil {
+				reg = &found
+			}
+			registries[e.RegistryName] = reg
+		}
+		if reg != nil {
+			events[i].TenantID = &reg.TenantID
+			events[i].RegistryID = &reg.ID
+		}
+	}
+	if err := conn.InsertAuditEvents(ctx, events); err != nil {
+		logError(fmt.Errorf("could not store %d registry audit events: %w", len(events), err))
+	}
+}
+
+// registryAuditAction classifies a /v2 request. Manifest HEADs, blob reads and
+// upload chunks are too frequent to be useful in the audit trail and are
+// skipped; an image pull is recorded once, as its manifest GET.
+func registryAuditAction(relative, method string) (action, repository, reference string) {
+	if isRegistryTokenPath(relative) {
+		if method == http.MethodGet || method == http.MethodPost {
+			return "token.issue", "", ""
+		}
+		return "", "", ""
+	}
+	if m := reUploadChunk.FindStringSubmatch(relative); m != nil {
+		if method == http.MethodPut {
+			return "blob.push", m[1], ""
+		}
+		return "", "", ""
+	}
+	if m := reManifestRef.FindStringSubmatch(relative); m != nil {
+		switch method {
+		case http.MethodGet:
+			return "manifest.pull", m[1], m[2]
+		case http.MethodPut:
+			return "manifest.push", m[1], m[2]
+		case http.MethodDelete:
+			return "manifest.delete", m[1], m[2]
+		}
+		return "", "", ""
+	}
+	if m := reBlobPath.FindStringSubmatch(relative); m != nil && method == http.MethodDelete {
+		return "blob.delete", m[1], m[2]
+	}
+	return "", "", ""
+}
+
+// managementAuditMiddleware records state-changing /api/v1 requests listed in
+// managementAuditActions.
+func (s *Server) managementAuditMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		action, ok := managementAuditActions[c.Request.Method+" "+c.FullPath()]
+		if !ok || s.db == nil {
+			return
+		}
+
+		event := db.AuditEvent{
+			ActorType: db.AuditActorAnonymous,
+			Action:    action,
+			Target:    c.Param("id"),
+		}
+		if u, err := s.getUser(c); err == nil {
+			event.ActorType = db.AuditActorUser
+			event.ActorID = &u.id
+			if u.apiKeyID != uuid.Nil {
+				event.ActorType = db.AuditActorAPIKey
+				event.ActorID = &u.apiKeyID
+			}
+			event.TenantID = &u.tenantID
+		}
+		if target, ok := c.Get(auditTargetKey); ok {
+			event.Target, _ = target.(string)
+		}
+		if strings.HasPrefix(c.FullPath(), "/api/v1/registries/:id") {
+			if registryID, err := uuid.Parse(c.Param("id")); err == nil {
+				event.RegistryID = &registryID
+			}
+		}
+		if obj, ok := c.Get(auditRegistryKey); ok {
+			if registry, ok := obj.(db.Registry); ok {
+				event.RegistryID = &registry.ID
+				event.RegistryName = registry.Name
+				event.Target = registry.ID.String()
+			}
+		}
+
+		s.recordAuditEvent(c, event)
+	}
+}
+
+type auditEventResponse struct {
+	ID           string  `json:"id"`
+	OccurredAt   string  `json:"occurredAt"`
+	ActorType    string  `json:"actorType"`
+	ActorID      *string `json:"actorId,omitempty"`
+	ActorName    string  `json:"actorName,omitempty"`
+	Action       string  `json:"action"`
+	RegistryID   *string `json:"registryId,omitempty"`
+	RegistryName string  `json:"registryName,omitempty"`
+	Repository   string  `json:"repository,omitempty"`
+	Reference    string  `json:"reference,omitempty"`
+	Digest       string  `json:"digest,omitempty"`
+	Target       string  `json:"target,omitempty"`
+	ClientIP     string  `json:"clientIp,omitempty"`
+	UserAgent    string  `json:"userAgent,omitempty"`
+	Outcome      string  `json:"outcome"`
+	StatusCode   int     `json:"statusCode"`
+}
+
+type listAuditEventsResponse struct {
+	Events     []auditEventResponse `json:"events"`
+	NextCursor string               `json:"nextCursor,omitempty"`
+}
+
+func auditEventToResponse(e db.AuditEvent) auditEventResponse {
+	resp := auditEventResponse{
+		ID:           e.ID.String(),
+		OccurredAt:   e.OccurredAt.UTC().Format(time.RFC3339Nano),
+		ActorType:    e.ActorType,
+		ActorName:    e.ActorName,
+		Action:       e.Action,
+		RegistryName: e.RegistryName,
+		Repository:   e.Repository,
+		Reference:    e.Reference,
+		Digest:       e.Digest,
+		Target:       e.Target,
+		ClientIP:     e.ClientIP,
+		UserAgent:    e.UserAgent,
+		Outcome:      e.Outcome,
+		StatusCode:   e.StatusCode,
+	}
+	if e.ActorID != nil {
+		id := e.ActorID.String()
+		resp.ActorID = &id
+	}
+	if e.RegistryID != nil {
+		id := e.RegistryID.String()
+		resp.RegistryID = &id
+	}
+	return resp
+}
+
+// listAuditEventsHandler handles GET /api/v1/audit. Results are newest first;
+// pass nextCursor back as cursor to fetch the following page.
+func (s *Server) listAuditEventsHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	filter, err := parseAuditEventFilter(c, u.tenantID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if cursor := strings.TrimSpace(c.Query("cursor")); cursor != "" {
+		filter.BeforeTime, filter.BeforeID, err = decodeAuditCursor(cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return
+		}
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	events, err := s.db.ListAuditEvents(c.Request.Context(), filter, limit)
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list audit events"})
+		return
+	}
+
+	resp := listAuditEventsResponse{Events: make([]auditEventResponse, 0, len(events))}
+	for _, e := range events {
+		resp.Events = append(resp.Events, auditEventToResponse(e))
+	}
+	if len(events) == limit {
+		last := events[len(events)-1]
+		resp.NextCursor = encodeAuditCursor(last.OccurredAt, last.ID)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// exportAuditEventsHandler handles GET /api/v1/audit/export, streaming every
+// matching event oldest first as newline-delimited JSON.
+func (s *Server) exportAuditEventsHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	filter, err := parseAuditEventFilter(c, u.tenantID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", `attachment; filename="audit-events.ndjson"`)
+	c.Status(http.StatusOK)
+
+	enc := json.NewEncoder(c.Writer)
+	written := 0
+	err = s.db.StreamAuditEvents(c.Request.Context(), filter, func(e db.AuditEvent) error {
+		if err := enc.Encode(auditEventToResponse(e)); err != nil {
+			return err
+		}
+		written++
+		if written%500 == 0 {
+			c.Writer.Flush()
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		// Headers are already sent; the truncated body is the only signal.
+		logError(fmt.Errorf("exportAuditEvents: %w", err))
+	}
+}
+
+func parseAuditEventFilter(c *gin.Context, tenantID uuid.UUID) (db.AuditEventFilter, error) {
+	filter := db.AuditEventFilter{
+		TenantID:   tenantID,
+		Action:     strings.TrimSpace(c.Query("action")),
+		Repository: strings.TrimSpace(c.Query("repository")),
+	}
+
+	switch actorType := strings.TrimSpace(c.Query("actorType")); actorType {
+	case "", db.AuditActorUser, db.AuditActorAPIKey, db.AuditActorAnonymous, db.AuditActorOperator:
+		filter.ActorType = actorType
+	default:
+		return db.AuditEventFilter{}, fmt.Errorf("actorType must be user, api_key, anonymous, or operator")
+	}
+	switch outcome := strings.TrimSpace(c.Query("outcome")); outcome {
+	case "", db.AuditOutcomeSuccess, db.AuditOutcomeDenied, db.AuditOutcomeFailure:
+		filter.Outcome = outcome
+	default:
+		return db.AuditEventFilter{}, fmt.Errorf("outcome must be success, denied, or failure")
+	}
+
+	if raw := strings.TrimSpace(c.Query("actorId")); raw != "" {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			return db.AuditEventFilter{}, fmt.Errorf("invalid actorId")
+		}
+		filter.ActorID = &id
+	}
+	if raw := strings.TrimSpace(c.Query("registryId")); raw != "" {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			return db.AuditEventFilter{}, fmt.Errorf("invalid registryId")
+		}
+		filter.RegistryID = &id
+	}
+	if raw := strings.TrimSpace(c.Query("from")); raw != "" {
+		from, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return db.AuditEventFilter{}, fmt.Errorf("from must be RFC3339")
+		}
+		filter.From = from
+	}
+	if raw := strings.TrimSpace(c.Query("to")); raw != "" {
+		to, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return db.AuditEventFilter{}, fmt.Errorf("to must be RFC3339")
+		}
+		filter.To = to
+	}
+	return filter, nil
+}
+
+func encodeAuditCursor(occurredAt time.Time, id uuid.UUID) string {
+	raw := occurredAt.UTC().Format(time.RFC3339Nano) + "|" + id.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeAuditCursor(cursor string) (time.Time, uuid.UUID, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, uuid.Nil, err
+	}
+	ts, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return time.Time{}, uuid.Nil, fmt.Errorf("malformed cursor")
+	}
+	occurredAt, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return time.Time{}, uuid.Nil, err
+	}
+	parsedID, err := uuid.Parse(id)
+	if err != nil {
+		return time.Time{}, uuid.Nil, err
+	}
+	return occurredAt, parsedID, nil
+}
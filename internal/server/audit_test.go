@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func TestRegistryAuditAction(t *testing.T) {
+	const digest = "sha256:abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789"
+	tests := []struct {
+		path       string
+		method     string
+		wantAction string
+		wantRepo   string
+		wantRef    string
+	}{
+		{path: "token", method: http.MethodGet, wantAction: "token.issue"},
+		{path: "token", method: http.MethodPost, wantAction: "token.issue"},
+		{path: "alpha/app/manifests/latest", method: http.MethodGet, wantAction: "manifest.pull", wantRepo: "alpha/app", wantRef: "latest"},
+		{path: "alpha/app/manifests/latest", method: http.MethodPut, wantAction: "manifest.push", wantRepo: "alpha/app", wantRef: "latest"},
+		{path: "alpha/app/manifests/latest", method: http.MethodDelete, wantAction: "manifest.delete", wantRepo: "alpha/app", wantRef: "latest"},
+		{path: "alpha/app/manifests/latest", method: http.MethodHead},
+		{path: "alpha/app/blobs/" + digest, method: http.MethodDelete, wantAction: "blob.delete", wantRepo: "alpha/app", wantRef: digest},
+		{path: "alpha/app/blobs/" + digest, method: http.MethodGet},
+		{path: "alpha/app/blobs/uploads/123", method: http.MethodPut, wantAction: "blob.push", wantRepo: "alpha/app"},
+		{path: "alpha/app/blobs/uploads/123", method: http.MethodPatch},
+		{path: "alpha/app/tags/list", method: http.MethodGet},
+		{path: "", method: http.MethodGet},
+	}
+
+	for _, tt := range tests {
+		action, repo, ref := registryAuditAction(tt.path, tt.method)
+		if action != tt.wantAction || repo != tt.wantRepo || ref != tt.wantRef {
+			t.Fatalf("%s %q = (%q, %q, %q), want (%q, %q, %q)", tt.method, tt.path, action, repo, ref, tt.wantAction, tt.wantRepo, tt.wantRef)
+		}
+	}
+}
+
+func TestAuditCursorRoundTrip(t *testing.T) {
+	occurredAt := time.Date(2026, 3, 4, 5, 6, 7, 123456000, time.UTC)
+	id := uuid.New()
+
+	gotTime, gotID, err := decodeAuditCursor(encodeAuditCursor(occurredAt, id))
+	if err != nil {
+		t.Fatalf("decodeAuditCursor: %v", err)
+	}
+	if !gotTime.Equal(occurredAt) || gotID != id {
+		t.Fatalf("cursor = (%s, %s), want (%s, %s)", gotTime, gotID, occurredAt, id)
+	}
+
+	if _, _, err := decodeAuditCursor("not-a-cursor"); err == nil {
+		t.Fatalf("expected malformed cursor to be rejected")
+	}
+}
+
+func TestManagementAuditActionsMatchRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := &Server{
+		router:          gin.New(),
+		registryJWTKeys: newTestRegistryJWTKeyring(t),
+	}
+	s.addRoutes()
+
+	registered := map[string]bool{}
+	for _, route := range s.router.Routes() {
+		registered[route.Method+" "+route.Path] = true
+	}
+	for key := range managementAuditActions {
+		if !registered[key] {
+			t.Fatalf("audited route %q is not registered", key)
+		}
+	}
+}
+
+func TestRegistryAuditMiddlewareAttributesFromAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var mu sync.Mutex
+	var stored []db.AuditEvent
+	writer := newRegistryAuditWriter(func(ctx context.Context, events []db.AuditEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		stored = append(stored, events...)
+	})
+	// db is never queried: the registry comes from the authentication.
+	s := &Server{db: &db.DB{}, registryAudit: writer}
+	auth := registryAuthContext{namespace: "alpha", registryID: uuid.New(), tenantID: uuid.New(), apiKeyID: uuid.New()}
+
+	router := gin.New()
+	router.GET("/v2/*path", s.registryAuditMiddleware(), func(c *gin.Context) {
+		c.Set("registryAuth", auth)
+		c.Status(http.StatusOK)
+	})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/alpha/app/manifests/latest", nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := writer.close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if len(stored) != 1 {
+		t.Fatalf("stored %d events, want 1", len(stored))
+	}
+	e := stored[0]
+	if e.Action != "manifest.pull" || e.RegistryName != "alpha" || e.OccurredAt.IsZero() {
+		t.Fatalf("stored %+v", e)
+	}
+	if e.RegistryID == nil || *e.RegistryID != auth.registryID || e.TenantID == nil || *e.TenantID != auth.tenantID {
+		t.Fatalf("event not attributed to the authenticated registry: %+v", e)
+	}
+	if e.ActorID == nil || *e.ActorID != auth.apiKeyID {
+		t.Fatalf("actor = %v, want api key %s", e.ActorID, auth.apiKeyID)
+	}
+}
+
+func TestRegistryAuditWriterBatchesAndStoresAfterClose(t *testing.T) {
+	var mu sync.Mutex
+	var batches [][]db.AuditEvent
+	writer := newRegistryAuditWriter(func(ctx context.Context, events []db.AuditEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		batches = append(batches, append([]db.AuditEvent(nil), events...))
+	})
+	for range registryAuditBatchSize + 1 {
+		writer.enqueue(db.AuditEvent{ID: uuid.New()})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := writer.close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	writer.enqueue(db.AuditEvent{ID: uuid.New()})
+
+	total := 0
+	for _, b := range batches {
+		if len(b) > registryAuditBatchSize {
+			t.Fatalf("batch of %d events, want at most %d", len(b), registryAuditBatchSize)
+		}
+		total += len(b)
+	}
+	if total != registryAuditBatchSize+2 {
+		t.Fatalf("stored %d events, want %d", total, registryAuditBatchSize+2)
+	}
+}
@@ -1,34 +1,54 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"strings"
+	"time"
 
+	"bin2.io/internal/db"
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 )
 
-var errUnauthorized = errors.New("unauthorized")
+var (
+	errUnauthorized     = errors.New("unauthorized")
+	errInsufficientRole = errors.New("insufficient organization role")
+)
 
-type user struct {
-	id        uuid.UUID
-	sub       string
-	tenantID  uuid.UUID
-	onboarded bool
-}
+// orgHeader selects the organization a management API request acts on. It
+// defaults to the user's default organization.
+const orgHeader = "X-Org-ID"
 
-type workosJWTClaims struct {
-	jwt.RegisteredClaims
-	SID   string `json:"sid"`
-	OrgID string `json:"org_id"`
+// user is the caller of a management API request. tenantID, onboarded and
+// role describe the organization the request acts on.
+type user struct {
+	id uuid.UUID
+	// apiKeyID is set when the caller authenticated with an API key acting
+	// for user id rather than with a WorkOS session. apiScopes and
+	// apiKeyCIDRs are that key's scopes and client address allowlist, which
+	// bound what it may manage and grant.
+	apiKeyID        uuid.UUID
+	apiScopes       []db.APIKeyScope
+	apiKeyCIDRs     []string
+	sub             string
+	email           string
+	defaultTenantID uuid.UUID
+	tenantID        uuid.UUID
+	onboarded       bool
+	role            db.OrgRole
+	tenantState     db.AccessState
 }
 
 func (s *Server) authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if s.managementRateLimited(c, rateLimitRequest{addr: registryClientAddr(c)}) {
+			return
+		}
+
 		authHeader := strings.TrimSpace(c.GetHeader("Authorization"))
 		if authHeader == "" {
 			slog.Debug("Auth", slog.String("Bearer", "Missing header"))
@@ -44,44 +64,146 @@ func (s *Server) authMiddleware() gin.HandlerFunc {
 		}
 		tokenString := strings.TrimSpace(authHeader[len(prefix):])
 
-		var claims workosJWTClaims
-		_, err := jwt.ParseWithClaims(tokenString, &claims, s.jwks.Keyfunc,
-			jwt.WithIssuedAt(),
-			jwt.WithExpirationRequired(),
-			jwt.WithIssuer(fmt.Sprintf("https://api.workos.com/user_management/%s", s.workosClientID)),
-		)
-		if err != nil {
-			slog.Debug("Auth", slog.String("Bearer", "Claims"), slog.String("err", err.Error()))
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized - jwt"})
+		if strings.HasPrefix(tokenString, "sk_") {
+			u, err := s.authenticateManagementAPIKey(c, tokenString)
+			if err != nil {
+				switch {
+				case errors.Is(err, errUnauthorized):
+					c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized - api key"})
+				case errors.Is(err, errInsufficientRole):
+					c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key needs admin permission on a whole registry"})
+				case errors.Is(err, errRegistryClientAddrDenied):
+					c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "client address not allowed"})
+				default:
+					logError(err)
+					c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "could not resolve user"})
+				}
+				return
+			}
+			if rawOrgID := strings.TrimSpace(c.GetHeader(orgHeader)); rawOrgID != "" && rawOrgID != u.tenantID.String() {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key does not belong to this organization"})
+				return
+			}
+			if !managementTenantStateAllows(c, u) {
+				return
+			}
+			if s.managementRateLimited(c, rateLimitRequest{apiKeyID: u.apiKeyID, tenantID: u.tenantID}) {
+				return
+			}
+			c.Set("user", u)
+			c.Next()
 			return
 		}
 
-		sub := strings.TrimSpace(claims.Subject)
-		if sub == "" {
+		id, err := s.identity.authenticate(c.Request.Context(), tokenString)
+		if err != nil {
+			if errors.Is(err, errUnauthorized) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized - jwt"})
+				return
+			}
+			logError(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "could not resolve user"})
+			return
+		}
+		if id.sub == "" {
 			slog.Debug("Auth", slog.String("Bearer", "Missing sub"))
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized - sub"})
 			return
 		}
 
-		org := strings.TrimSpace(claims.OrgID)
-		dbUser, err := s.db.GetOrCreateUser(c.Request.Context(), sub, org)
+		dbUser, err := s.resolveUser(c.Request.Context(), id)
 		if err != nil {
 			logError(err)
 			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "could not resolve user"})
 			return
 		}
-
 		u := user{
-			id:        dbUser.ID,
-			sub:       dbUser.Sub,
-			tenantID:  dbUser.TenantID,
-			onboarded: dbUser.Onboarded,
+			id:              dbUser.ID,
+			sub:             dbUser.Sub,
+			defaultTenantID: dbUser.TenantID,
+			tenantID:        dbUser.TenantID,
+			onboarded:       dbUser.Onboarded,
+			role:            dbUser.Role,
+			tenantState:     dbUser.TenantState,
+		}
+		if dbUser.Email != nil {
+			u.email = *dbUser.Email
+		}
+
+		u, ok := selectManagementOrg(c, u, s.db.GetUserMembership)
+		if !ok {
+			return
+		}
+		if !managementTenantStateAllows(c, u) {
+			return
+		}
+		if s.managementRateLimited(c, rateLimitRequest{tenantID: u.tenantID}) {
+			return
 		}
 		c.Set("user", u)
 		c.Next()
 	}
 }
 
+// selectManagementOrg returns u acting in the organization named by
+// orgHeader, looking up their membership there, or in their default
+// organization without the header. It aborts the request unless u is a
+// member of the organization selected.
+func selectManagementOrg(c *gin.Context, u user, membershipOf func(ctx context.Context, userID, orgID uuid.UUID) (db.OrgMembership, error)) (user, bool) {
+	if rawOrgID := strings.TrimSpace(c.GetHeader(orgHeader)); rawOrgID != "" {
+		orgID, err := uuid.Parse(rawOrgID)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": orgHeader + " malformed"})
+			return user{}, false
+		}
+		if orgID != u.tenantID {
+			membership, err := membershipOf(c.Request.Context(), u.id, orgID)
+			if err != nil {
+				if errors.Is(err, db.ErrNotFound) {
+					c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "not a member of this organization"})
+					return user{}, false
+				}
+				logError(err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "could not resolve user"})
+				return user{}, false
+			}
+			u.tenantID = membership.OrgID
+			u.onboarded = membership.Onboarded
+			u.role = membership.Role
+			u.tenantState = membership.State
+		}
+	}
+	if u.role == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "not a member of this organization"})
+		return user{}, false
+	}
+	return u, true
+}
+
+// suspendedTenantRoutes are the management routes ("METHOD full-path") a
+// suspended organization keeps: enough to see who it is and settle its bill.
+var suspendedTenantRoutes = map[string]bool{
+	"GET /api/v1/users/me":            true,
+	"GET /api/v1/org":                 true,
+	"GET /api/v1/usage/summary":       true,
+	"GET /api/v1/usage/breakdown":     true,
+	"GET /api/v1/usage/series":        true,
+	"GET /api/v1/usage/export":        true,
+	"GET /api/v1/invoices":            true,
+	"GET /api/v1/invoices/:invoiceId": true,
+	"GET /api/v1/budgets":             true,
+}
+
+// managementTenantStateAllows limits suspended organizations to
+// suspendedTenantRoutes, aborting other requests.
+func managementTenantStateAllows(c *gin.Context, u user) bool {
+	if u.tenantState != db.AccessStateSuspended || suspendedTenantRoutes[c.Request.Method+" "+c.FullPath()] {
+		return true
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "organization is suspended"})
+	return false
+}
+
 func (s *Server) getUser(c *gin.Context) (user, error) {
 	userObj, exists := c.Get("user")
 	if !exists {
@@ -93,3 +215,197 @@ func (s *Server) getUser(c *gin.Context) (user, error) {
 	}
 	return u, nil
 }
+
+// resolveUser returns the user for id, creating them on first sign in and
+// applying the organization and role their token asserts. An email address,
+// needed to accept invitations, is taken from the token or looked up with the
+// identity provider only while none is recorded, and replaced when the token
+// asserts a verified address for a user whose recorded one is unverified.
+func (s *Server) resolveUser(ctx context.Context, id identity) (db.User, error) {
+	dbUser, err := s.db.GetUserBySub(ctx, id.sub)
+	if errors.Is(err, db.ErrNotFound) {
+		email, verified := s.identityEmail(ctx, id)
+		dbUser, err = s.db.CreateUser(ctx, db.CreateUserArgs{
+			Sub:           id.sub,
+			Org:           id.org,
+			Email:         email,
+			EmailVerified: verified,
+		})
+		if errors.Is(err, db.ErrConflict) {
+			dbUser, err = s.db.GetUserBySub(ctx, id.sub)
+		}
+	}
+	if err != nil {
+		return db.User{}, err
+	}
+
+	if dbUser.Email == nil || (!dbUser.EmailVerified && id.emailVerified) {
+		if email, verified := s.identityEmail(ctx, id); email != "" {
+			if err := s.db.SetUserEmail(ctx, dbUser.ID, email, verified); err != nil {
+				return db.User{}, err
+			}
+			dbUser.Email, dbUser.EmailVerified = &email, verified
+		}
+	}
+
+	if id.org != "" && id.org != dbUser.TenantName {
+		if dbUser, err = s.db.SyncUserOrg(ctx, dbUser.ID, id.org); err != nil {
+			return db.User{}, err
+		}
+	}
+	if id.role != "" && dbUser.Role != "" && id.role != dbUser.Role {
+		err := s.db.SetOrgMemberRole(ctx, dbUser.TenantID, dbUser.ID, id.role, registryTokensExpireAt(time.Now().UTC()))
+		switch {
+		case err == nil:
+			dbUser.Role = id.role
+		case errors.Is(err, db.ErrLastOwner):
+			slog.Warn("Not applying identity provider role to last owner", slog.String("sub", id.sub), slog.String("role", string(id.role)))
+		default:
+			return db.User{}, err
+		}
+	}
+	return dbUser, nil
+}
+
+func (s *Server) identityEmail(ctx context.Context, id identity) (email string, verified bool) {
+	if id.email != "" {
+		return id.email, id.emailVerified
+	}
+	email, verified, err := s.identity.lookupEmail(ctx, id.sub)
+	if err != nil {
+		slog.Warn("Could not look up user email", slog.String("sub", id.sub), slog.String("err", err.Error()))
+		return "", false
+	}
+	return email, verified
+}
+
+// apiKeyMaxOrgRole caps the role an API key acts with on the management API,
+// so automation never holds owner-only powers such as deleting registries.
+const apiKeyMaxOrgRole = db.OrgRoleAdmin
+
+// authenticateManagementAPIKey accepts an sk_ key holding admin permission on
+// a whole registry. The key acts in its registry's organization with its
+// owner's role there, capped at apiKeyMaxOrgRole.
+func (s *Server) authenticateManagementAPIKey(c *gin.Context, rawKey string) (user, error) {
+	ctx := c.Request.Context()
+	auth, err := s.authenticateRegistryAPIKey(ctx, rawKey)
+	if err != nil {
+		return user{}, err
+	}
+	if !apiKeyScopesAllowManagement(auth.apiScopes) {
+		return user{}, errInsufficientRole
+	}
+	if err := checkRegistryClientAddr(c, auth); err != nil {
+		return user{}, err
+	}
+
+	membership, err := s.db.GetUserMembership(ctx, auth.userID, auth.tenantID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return user{}, errUnauthorized
+		}
+		return user{}, err
+	}
+	role := membership.Role
+	if role.AtLeast(apiKeyMaxOrgRole) {
+		role = apiKeyMaxOrgRole
+	}
+
+	return user{
+		id:              auth.userID,
+		apiKeyID:        auth.apiKeyID,
+		apiScopes:       auth.apiScopes,
+		apiKeyCIDRs:     auth.keyCIDRs,
+		defaultTenantID: auth.tenantID,
+		tenantID:        auth.tenantID,
+		onboarded:       membership.Onboarded,
+		role:            role,
+		tenantState:     membership.State,
+	}, nil
+}
+
+// apiKeyScopesAllowManagement reports whether a key may call the management
+// API: it needs admin permission on a registry as a whole, not just on some
+// of its repositories.
+func apiKeyScopesAllowManagement(scopes []db.APIKeyScope) bool {
+	for _, scope := range scopes {
+		if scope.Permission == db.APIKeyPermissionAdmin && scope.RepositoryID == nil && scope.RepositoryPattern == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// managesRegistry reports whether u may manage the registry. People manage
+// every registry of the organization they act in; an API key only manages the
+// registries it holds registry-wide admin permission on.
+func (u user) managesRegistry(registryID uuid.UUID) bool {
+	if u.apiKeyID == uuid.Nil {
+		return true
+	}
+	for _, scope := range u.apiScopes {
+		if scope.RegistryID == registryID && scope.Permission == db.APIKeyPermissionAdmin &&
+			scope.RepositoryID == nil && scope.RepositoryPattern == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// managesAPIKey reports whether u may manage a key with the given scopes: an
+// API key only manages keys confined to registries it manages itself.
+func (u user) managesAPIKey(scopes []db.APIKeyScope) bool {
+	if u.apiKeyID == uuid.Nil {
+		return true
+	}
+	if len(scopes) == 0 {
+		return false
+	}
+	for _, scope := range scopes {
+		if !u.managesRegistry(scope.RegistryID) {
+			return false
+		}
+	}
+	return true
+}
+
+// grantsCIDRs reports whether u may give a key the client address allowlist
+// cidrs. An API key restricted to an allowlist cannot grant addresses outside
+// it, so it cannot escape its own restriction through a key it creates.
+func (u user) grantsCIDRs(cidrs []string) bool {
+	return u.apiKeyID == uuid.Nil || cidrAllowlistCovers(u.apiKeyCIDRs, cidrs)
+}
+
+// requireUserActor rejects API keys on routes reserved for people, such as
+// managing organization membership.
+func (s *Server) requireUserActor() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, err := s.getUser(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		if u.apiKeyID != uuid.Nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "not available to API keys"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireOrgRole rejects users whose role in their organization is below min.
+// It must run after authMiddleware.
+func (s *Server) requireOrgRole(min db.OrgRole) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, err := s.getUser(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		if !u.role.AtLeast(min) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("requires %s role", min)})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"bin2.io/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func TestAPIKeyScopesAllowManagement(t *testing.T) {
+	repoID := uuid.New()
+	pattern := "team-*"
+
+	tests := []struct {
+		name   string
+		scopes []db.APIKeyScope
+		want   bool
+	}{
+		{name: "registry admin", scopes: []db.APIKeyScope{{Permission: db.APIKeyPermissionAdmin}}, want: true},
+		{name: "registry write", scopes: []db.APIKeyScope{{Permission: db.APIKeyPermissionWrite}}, want: false},
+		{name: "repository admin", scopes: []db.APIKeyScope{{Permission: db.APIKeyPermissionAdmin, RepositoryID: &repoID}}, want: false},
+		{name: "pattern admin", scopes: []db.APIKeyScope{{Permission: db.APIKeyPermissionAdmin, RepositoryPattern: &pattern}}, want: false},
+		{
+			name: "mixed",
+			scopes: []db.APIKeyScope{
+				{Permission: db.APIKeyPermissionRead, RepositoryID: &repoID},
+				{Permission: db.APIKeyPermissionAdmin},
+			},
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		if got := apiKeyScopesAllowManagement(tt.scopes); got != tt.want {
+			t.Fatalf("%s: apiKeyScopesAllowManagement = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestManagementActorChecks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := &Server{}
+	newRouter := func(u user) *gin.Engine {
+		router := gin.New()
+		router.Use(func(c *gin.Context) {
+			c.Set("user", u)
+		})
+		router.GET("/admin", s.requireOrgRole(db.OrgRoleAdmin), func(c *gin.Context) {
+			c.Status(http.StatusNoContent)
+		})
+		router.GET("/people", s.requireUserActor(), func(c *gin.Context) {
+			c.Status(http.StatusNoContent)
+		})
+		return router
+	}
+
+	tests := []struct {
+		name string
+		u    user
+		path string
+		want int
+	}{
+		{name: "admin", u: user{role: db.OrgRoleAdmin}, path: "/admin", want: http.StatusNoContent},
+		{name: "owner", u: user{role: db.OrgRoleOwner}, path: "/admin", want: http.StatusNoContent},
+		{name: "member", u: user{role: db.OrgRoleMember}, path: "/admin", want: http.StatusForbidden},
+		{name: "person", u: user{role: db.OrgRoleViewer}, path: "/people", want: http.StatusNoContent},
+		{name: "api key", u: user{role: db.OrgRoleAdmin, apiKeyID: uuid.New()}, path: "/people", want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		res := httptest.NewRecorder()
+		newRouter(tt.u).ServeHTTP(res, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if res.Code != tt.want {
+			t.Fatalf("%s: status = %d, want %d", tt.name, res.Code, tt.want)
+		}
+	}
+}
+
+func TestAPIKeyActorConfinedToItsRegistries(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	registryA, registryB := uuid.New(), uuid.New()
+	repoID := uuid.New()
+	key := user{
+		id:       uuid.New(),
+		apiKeyID: uuid.New(),
+		tenantID: uuid.New(),
+		role:     db.OrgRoleAdmin,
+		apiScopes: []db.APIKeyScope{
+			{RegistryID: registryA, Permission: db.APIKeyPermissionAdmin},
+			{RegistryID: registryB, RepositoryID: &repoID, Permission: db.APIKeyPermissionAdmin},
+		},
+		apiKeyCIDRs: []string{"10.0.0.0/8"},
+	}
+	if !key.managesRegistry(registryA) {
+		t.Fatalf("key does not manage its own registry")
+	}
+	if key.managesRegistry(registryB) {
+		t.Fatalf("key manages a registry it only holds a repository scope on")
+	}
+	if person := (user{role: db.OrgRoleAdmin}); !person.managesRegistry(registryB) {
+		t.Fatalf("person does not manage a registry of their organization")
+	}
+
+	s := &Server{}
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("user", key)
+	})
+	router.POST("/api-keys", s.addAPIKeyHandler)
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{
+			name: "other registry",
+			body: `{"keyName":"escape","allowedCidrs":["10.0.0.0/16"],"scopes":[{"registryId":"` + registryB.String() + `","permission":"admin"}]}`,
+		},
+		{
+			name: "no allowlist",
+			body: `{"keyName":"escape","scopes":[{"registryId":"` + registryA.String() + `","permission":"admin"}]}`,
+		},
+		{
+			name: "wider allowlist",
+			body: `{"keyName":"escape","allowedCidrs":["0.0.0.0/0"],"scopes":[{"registryId":"` + registryA.String() + `","permission":"admin"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/api-keys", strings.NewReader(tt.body)))
+		if res.Code != http.StatusForbidden {
+			t.Fatalf("%s: status = %d, want %d", tt.name, res.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestSelectManagementOrg(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	defaultOrg, memberOrg, otherOrg := uuid.New(), uuid.New(), uuid.New()
+	caller := user{id: uuid.New(), defaultTenantID: defaultOrg, tenantID: defaultOrg, role: db.OrgRoleOwner, onboarded: true}
+	membershipOf := func(ctx context.Context, userID, orgID uuid.UUID) (db.OrgMembership, error) {
+		if userID == caller.id && orgID == memberOrg {
+			return db.OrgMembership{OrgID: memberOrg, Role: db.OrgRoleViewer, State: db.AccessStateSuspended}, nil
+		}
+		return db.OrgMembership{}, db.ErrNotFound
+	}
+
+	tests := []struct {
+		name     string
+		header   string
+		want     int
+		wantOrg  uuid.UUID
+		wantRole db.OrgRole
+	}{
+		{name: "no header", want: http.StatusOK, wantOrg: defaultOrg, wantRole: db.OrgRoleOwner},
+		{name: "default org", header: defaultOrg.String(), want: http.StatusOK, wantOrg: defaultOrg, wantRole: db.OrgRoleOwner},
+		{name: "member org", header: memberOrg.String(), want: http.StatusOK, wantOrg: memberOrg, wantRole: db.OrgRoleViewer},
+		{name: "other org", header: otherOrg.String(), want: http.StatusForbidden},
+		{name: "malformed", header: "acme", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		var got user
+		router := gin.New()
+		router.GET("/org", func(c *gin.Context) {
+			u, ok := selectManagementOrg(c, caller, membershipOf)
+			if !ok {
+				return
+			}
+			got = u
+			c.Status(http.StatusOK)
+		})
+		req := httptest.NewRequest(http.MethodGet, "/org", nil)
+		if tt.header != "" {
+			req.Header.Set(orgHeader, tt.header)
+		}
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		if res.Code != tt.want {
+			t.Fatalf("%s: status = %d, want %d", tt.name, res.Code, tt.want)
+		}
+		if tt.want != http.StatusOK {
+			continue
+		}
+		if got.tenantID != tt.wantOrg || got.role != tt.wantRole || got.defaultTenantID != defaultOrg {
+			t.Fatalf("%s: acting as %+v, want org %s as %s", tt.name, got, tt.wantOrg, tt.wantRole)
+		}
+	}
+}
+
+func TestSuspendedTenantRoutesAreRegistered(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := &Server{
+		router:          gin.New(),
+		registryJWTKeys: newTestRegistryJWTKeyring(t),
+	}
+	s.addRoutes()
+
+	registered := map[string]bool{}
+	for _, route := range s.router.Routes() {
+		registered[route.Method+" "+route.Path] = true
+	}
+	for key := range suspendedTenantRoutes {
+		if !registered[key] {
+			t.Fatalf("suspended tenant route %q is not registered", key)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"bin2.io/internal/db"
+)
+
+// identityProvider authenticates management API users and reaches the user
+// directory behind them.
+type identityProvider interface {
+	// authenticate verifies a bearer token, returning errUnauthorized when it
+	// is not acceptable.
+	authenticate(ctx context.Context, token string) (identity, error)
+	// lookupEmail returns the address the provider holds for sub, or "" when
+	// it has none or cannot be asked.
+	lookupEmail(ctx context.Context, sub string) (email string, verified bool, err error)
+	// sendInvitation emails an invitation and returns the provider's ID for
+	// it, or "" when the provider does not send invitations itself.
+	sendInvitation(ctx context.Context, inv identityInvitation) (string, error)
+	revokeInvitation(ctx context.Context, id string) error
+}
+
+// identity is an authenticated management API caller.
+type identity struct {
+	sub string
+	// org names the caller's organization, "" if the token carries none.
+	org           string
+	email         string
+	emailVerified bool
+	// role is the caller's role in org mapped from their groups, "" if the
+	// provider does not assign roles.
+	role db.OrgRole
+}
+
+type identityInvitation struct {
+	email string
+	// orgName is the name of the inviting tenant.
+	orgName       string
+	inviterSub    string
+	expiresInDays int
+}
+
+// newIdentityProviderFromEnv selects the provider named by
+// IDENTITY_PROVIDER, defaulting to WorkOS.
+func newIdentityProviderFromEnv(ctx context.Context) (identityProvider, error) {
+	switch provider := strings.ToLower(getenvDefault("IDENTITY_PROVIDER", "workos")); provider {
+	case "workos":
+		return newWorkOSIdentityProviderFromEnv(ctx)
+	case "oidc":
+		cfg, err := oidcConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return newOIDCIdentityProvider(ctx, cfg)
+	default:
+		return nil, fmt.Errorf("unknown IDENTITY_PROVIDER %q", provider)
+	}
+}
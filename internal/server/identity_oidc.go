@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const oidcDiscoveryTimeout = 10 * time.Second
+
+type oidcConfig struct {
+	issuer string
+	// audience must appear in the token's aud claim, so that tokens the
+	// issuer mints for other clients are not accepted.
+	audience string
+	// orgClaim and roleClaim are claim names, with dots descending into
+	// nested objects (e.g. realm_access.roles). Empty disables them.
+	orgClaim  string
+	roleClaim string
+	// groupRoles maps values of roleClaim to organization roles.
+	groupRoles map[string]db.OrgRole
+}
+
+// oidcConfigFromEnv reads OIDC_ISSUER, OIDC_AUDIENCE, OIDC_ORG_CLAIM,
+// OIDC_ROLE_CLAIM and OIDC_GROUP_ROLES, a comma-separated list of
+// group=role pairs. OIDC_ISSUER and OIDC_AUDIENCE are required.
+func oidcConfigFromEnv() (oidcConfig, error) {
+	cfg := oidcConfig{
+		issuer:    strings.TrimSpace(os.Getenv("OIDC_ISSUER")),
+		audience:  strings.TrimSpace(os.Getenv("OIDC_AUDIENCE")),
+		orgClaim:  strings.TrimSpace(os.Getenv("OIDC_ORG_CLAIM")),
+		roleClaim: getenvDefault("OIDC_ROLE_CLAIM", "groups"),
+	}
+	if cfg.issuer == "" {
+		return oidcConfig{}, fmt.Errorf("OIDC_ISSUER is not defined")
+	}
+	if cfg.audience == "" {
+		return oidcConfig{}, fmt.Errorf("OIDC_AUDIENCE is not defined")
+	}
+	groupRoles, err := parseOIDCGroupRoles(os.Getenv("OIDC_GROUP_ROLES"))
+	if err != nil {
+		return oidcConfig{}, err
+	}
+	cfg.groupRoles = groupRoles
+	return cfg, nil
+}
+
+func parseOIDCGroupRoles(raw string) (map[string]db.OrgRole, error) {
+	out := map[string]db.OrgRole{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		group, rawRole, ok := strings.Cut(entry, "=")
+		group = strings.TrimSpace(group)
+		role, valid := db.ParseOrgRole(strings.TrimSpace(rawRole))
+		if !ok || group == "" || !valid {
+			return nil, fmt.Errorf("invalid OIDC_GROUP_ROLES entry %q", entry)
+		}
+		out[group] = role
+	}
+	return out, nil
+}
+
+// oidcIdentityProvider verifies tokens from any OpenID Connect issuer, such
+// as Keycloak or Okta. It cannot look users up or send email, so invitations
+// are accepted through the email claim on first sign in.
+type oidcIdentityProvider struct {
+	cfg  oidcConfig
+	jwks keyfunc.Keyfunc
+}
+
+type oidcDiscoveryDocument struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+func newOIDCIdentityProvider(ctx context.Context, cfg oidcConfig) (*oidcIdentityProvider, error) {
+	doc, err := discoverOIDC(ctx, cfg.issuer)
+	if err != nil {
+		return nil, fmt.Errorf("could not discover OIDC issuer: %w", err)
+	}
+	jwks, err := keyfunc.NewDefaultCtx(ctx, []string{doc.JWKSURI})
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize JWKS: %w", err)
+	}
+	return &oidcIdentityProvider{cfg: cfg, jwks: jwks}, nil
+}
+
+func discoverOIDC(ctx context.Context, issuer string) (oidcDiscoveryDocument, error) {
+	ctx, cancel := context.WithTimeout(ctx, oidcDiscoveryTimeout)
+	defer cancel()
+
+	url := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return oidcDiscoveryDocument{}, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return oidcDiscoveryDocument{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return oidcDiscoveryDocument{}, fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+
+	var doc oidcDiscoveryDocument
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return oidcDiscoveryDocument{}, err
+	}
+	if doc.Issuer != issuer {
+		return oidcDiscoveryDocument{}, fmt.Errorf("discovery issuer %q does not match %q", doc.Issuer, issuer)
+	}
+	if doc.JWKSURI == "" {
+		return oidcDiscoveryDocument{}, fmt.Errorf("discovery document has no jwks_uri")
+	}
+	return doc, nil
+}
+
+func (p *oidcIdentityProvider) authenticate(_ context.Context, token string) (identity, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithIssuedAt(),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuer(p.cfg.issuer),
+		jwt.WithAudience(p.cfg.audience),
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, p.jwks.Keyfunc, opts...); err != nil {
+		slog.Debug("Auth", slog.String("Bearer", "Claims"), slog.String("err", err.Error()))
+		return identity{}, errUnauthorized
+	}
+
+	sub, _ := claims.GetSubject()
+	id := identity{
+		sub:   strings.TrimSpace(sub),
+		email: strings.TrimSpace(oidcClaimString(claims, "email")),
+	}
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		id.emailVerified = verified
+	case string:
+		id.emailVerified = verified == "true"
+	}
+	if p.cfg.orgClaim != "" {
+		id.org = strings.TrimSpace(oidcClaimString(claims, p.cfg.orgClaim))
+	}
+	if p.cfg.roleClaim != "" {
+		id.role = oidcGroupsRole(oidcClaimStrings(claims, p.cfg.roleClaim), p.cfg.groupRoles)
+	}
+	return id, nil
+}
+
+func (p *oidcIdentityProvider) lookupEmail(context.Context, string) (string, bool, error) {
+	return "", false, nil
+}
+
+func (p *oidcIdentityProvider) sendInvitation(context.Context, identityInvitation) (string, error) {
+	return "", nil
+}
+
+func (p *oidcIdentityProvider) revokeInvitation(context.Context, string) error {
+	return nil
+}
+
+// oidcGroupsRole returns the highest role any of groups maps to.
+func oidcGroupsRole(groups []string, groupRoles map[string]db.OrgRole) db.OrgRole {
+	var best db.OrgRole
+	for _, group := range groups {
+		if role, ok := groupRoles[group]; ok && !best.AtLeast(role) {
+			best = role
+		}
+	}
+	return best
+}
+
+func oidcClaim(claims jwt.MapClaims, name string) any {
+	var value any = map[string]any(claims)
+	for _, part := range strings.Split(name, ".") {
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = obj[part]
+	}
+	return value
+}
+
+func oidcClaimString(claims jwt.MapClaims, name string) string {
+	s, _ := oidcClaim(claims, name).(string)
+	return s
+}
+
+// oidcClaimStrings reads a claim holding a string or a list of strings.
+func oidcClaimStrings(claims jwt.MapClaims, name string) []string {
+	switch value := oidcClaim(claims, name).(type) {
+	case string:
+		return []string{value}
+	case []any:
+		out := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testOIDCIssuer is a local stand-in OpenID Connect issuer serving discovery
+// and a JWKS with a single Ed25519 key.
+type testOIDCIssuer struct {
+	server *httptest.Server
+	key    ed25519.PrivateKey
+}
+
+func newTestOIDCIssuer(t *testing.T) *testOIDCIssuer {
+	t.Helper()
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	issuer := &testOIDCIssuer{key: key}
+
+	router := gin.New()
+	router.GET("/.well-known/openid-configuration", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"issuer":   issuer.server.URL,
+			"jwks_uri": issuer.server.URL + "/jwks",
+		})
+	})
+	router.GET("/jwks", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"keys": []gin.H{{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"alg": "EdDSA",
+			"use": "sig",
+			"kid": "test",
+			"x":   base64.RawURLEncoding.EncodeToString(pub),
+		}}})
+	})
+	issuer.server = httptest.NewServer(router)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+func (i *testOIDCIssuer) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+
+	now := time.Now()
+	base := jwt.MapClaims{
+		"iss": i.server.URL,
+		"sub": "user-1",
+		"aud": "bin2",
+		"iat": now.Unix(),
+		"exp": now.Add(time.Minute).Unix(),
+	}
+	for k, v := range claims {
+		base[k] = v
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, base)
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString(i.key)
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+	return signed
+}
+
+func TestOIDCIdentityProviderAuthenticate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	issuer := newTestOIDCIssuer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	p, err := newOIDCIdentityProvider(ctx, oidcConfig{
+		issuer:    issuer.server.URL,
+		audience:  "bin2",
+		orgClaim:  "tenant",
+		roleClaim: "realm_access.roles",
+		groupRoles: map[string]db.OrgRole{
+			"registry-admins": db.OrgRoleAdmin,
+			"developers":      db.OrgRoleMember,
+		},
+	})
+	if err != nil {
+		t.Fatalf("newOIDCIdentityProvider: %v", err)
+	}
+
+	id, err := p.authenticate(ctx, issuer.sign(t, jwt.MapClaims{
+		"tenant":         "platform",
+		"email":          "dev@example.com",
+		"email_verified": true,
+		"realm_access":   map[string]any{"roles": []any{"developers", "registry-admins", "other"}},
+	}))
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	want := identity{
+		sub:           "user-1",
+		org:           "platform",
+		email:         "dev@example.com",
+		emailVerified: true,
+		role:          db.OrgRoleAdmin,
+	}
+	if id != want {
+		t.Fatalf("identity = %+v, want %+v", id, want)
+	}
+
+	for name, claims := range map[string]jwt.MapClaims{
+		"wrong audience": {"aud": "other"},
+		"no audience":    {"aud": nil},
+		"wrong issuer":   {"iss": "https://issuer.invalid"},
+		"expired":        {"exp": time.Now().Add(-time.Minute).Unix()},
+	} {
+		if _, err := p.authenticate(ctx, issuer.sign(t, claims)); !errors.Is(err, errUnauthorized) {
+			t.Fatalf("%s: err = %v, want errUnauthorized", name, err)
+		}
+	}
+}
+
+func TestOIDCConfigFromEnvRequiresAudience(t *testing.T) {
+	t.Setenv("OIDC_ISSUER", "https://issuer.example.com")
+	t.Setenv("OIDC_AUDIENCE", "")
+	if _, err := oidcConfigFromEnv(); err == nil {
+		t.Fatalf("oidcConfigFromEnv accepted a missing OIDC_AUDIENCE")
+	}
+
+	t.Setenv("OIDC_AUDIENCE", "bin2")
+	cfg, err := oidcConfigFromEnv()
+	if err != nil {
+		t.Fatalf("oidcConfigFromEnv: %v", err)
+	}
+	if cfg.audience != "bin2" {
+		t.Fatalf("audience = %q, want bin2", cfg.audience)
+	}
+}
+
+func TestParseOIDCGroupRoles(t *testing.T) {
+	got, err := parseOIDCGroupRoles(" admins=admin, devs = member ,")
+	if err != nil {
+		t.Fatalf("parseOIDCGroupRoles: %v", err)
+	}
+	if len(got) != 2 || got["admins"] != db.OrgRoleAdmin || got["devs"] != db.OrgRoleMember {
+		t.Fatalf("groupRoles = %v", got)
+	}
+
+	for _, invalid := range []string{"admins", "admins=root", "=admin"} {
+		if _, err := parseOIDCGroupRoles(invalid); err == nil {
+			t.Fatalf("parseOIDCGroupRoles(%q) unexpectedly succeeded", invalid)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// invoiceCurrency is the currency every plan is priced in.
+const invoiceCurrency = "USD"
+
+// invoiceDecimalScale is the number of decimal places invoice quantities and
+// amounts are issued with.
+const invoiceDecimalScale = 12
+
+// usageLineLabels describe each kind of usage line item on an invoice.
+var usageLineLabels = map[string]struct{ description, unit string }{
+	usageLineStorage:           {"Storage", "GiB-month"},
+	usageLineStorageIncluded:   {"Storage included in plan", "GiB-month"},
+	usageLinePushOps:           {"Push operations", "operation"},
+	usageLinePushIncluded:      {"Push operations included in plan", "operation"},
+	usageLinePullOps:           {"Pull operations", "operation"},
+	usageLinePullIncluded:      {"Pull operations included in plan", "operation"},
+	usageLinePullBytes:         {"Pull egress", "GiB"},
+	usageLinePullBytesIncluded: {"Pull egress included in plan", "GiB"},
+	usageLineMinimum:           {"Minimum charge top-up", "month"},
+}
+
+// buildUsageInvoice freezes the tenant's usage over the calendar month
+// [from, to) into an invoice. Amounts are rounded per line and the total is
+// the sum of the rounded amounts, so the lines always add up.
+func buildUsageInvoice(tenantID uuid.UUID, from, to time.Time, parts []usagePricedSummary) (db.Invoice, error) {
+	summary := mergeUsagePeriodSummaries(from, to, to, parts)
+	inv := db.Invoice{
+		ID:                  uuid.New(),
+		TenantID:            tenantID,
+		PeriodStart:         from,
+		PeriodEnd:           to,
+		Currency:            invoiceCurrency,
+		PushOpCount:         summary.PushOpCount,
+		PullOpCount:         summary.PullOpCount,
+		PullBytes:           summary.PullBytes,
+		StorageOpeningBytes: summary.StorageOpeningBytes,
+		StorageClosingBytes: summary.StorageClosingBytes,
+		StorageByteSeconds:  formatUsageDecimal(summary.storageByteSeconds(), 9),
+		StorageGiBMonths:    formatUsageDecimal(summary.storageGiBMonths(), invoiceDecimalScale),
+	}
+
+	total := new(big.Rat)
+	for _, line := range calculateUsageLineItems(from, to, parts) {
+		label := usageLineLabels[line.Kind]
+		amount := formatUsageDecimal(line.amountUSD(), invoiceDecimalScale)
+		rounded, ok := new(big.Rat).SetString(amount)
+		if !ok {
+			return db.Invoice{}, fmt.Errorf("invalid invoice amount %q", amount)
+		}
+		total.Add(total, rounded)
+		inv.Lines = append(inv.Lines, db.InvoiceLine{
+			PeriodStart:  line.From,
+			PeriodEnd:    line.To,
+			Plan:         line.Plan,
+			Kind:         line.Kind,
+			Description:  label.description,
+			Quantity:     formatUsageDecimal(line.Quantity, invoiceDecimalScale),
+			Unit:         label.unit,
+			UnitPriceUSD: formatUsageDecimal(line.UnitPriceUSD, invoiceDecimalScale),
+			AmountUSD:    amount,
+		})
+	}
+	inv.TotalUSD = formatUsageDecimal(total, invoiceDecimalScale)
+	return inv, nil
+}
+
+// invoiceRetryInterval is how long a tenant whose invoice failed waits
+// before it is tried again.
+const invoiceRetryInterval = time.Hour
+
+// invoiceClosedMonths invoices every tenant for each calendar month whose
+// days have all been rolled up, so late usage events are included and the
+// invoice matches what the tenant's summary will always show. Replicas may
+// race; each tenant gets one invoice per month regardless. Tenants whose
+// invoice failed are retried on their own, without holding later months.
+func (s *Server) invoiceClosedMonths(ctx context.Context) {
+	for {
+		month, ok, err := s.invoiceNextMonth(ctx)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				logError(err)
+			}
+			return
+		}
+		if !ok {
+			break
+		}
+		slog.Info("Usage", slog.String("invoiced", month.Format("2006-01")))
+	}
+	if err := s.retryFailedInvoices(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		logError(err)
+	}
+}
+
+// invoiceNextMonth invoices the first month not yet invoiced if all its days
+// have been rolled up, reporting the month and whether it was invoiced.
+func (s *Server) invoiceNextMonth(ctx context.Context) (time.Time, bool, error) {
+	month, err := s.db.GetInvoicedThrough(ctx)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	rolledThrough, err := s.db.GetUsageRolledThrough(ctx)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if rolledThrough.Before(month.AddDate(0, 1, 0)) {
+		return time.Time{}, false, nil
+	}
+	if err := s.invoiceMonth(ctx, month); err != nil {
+		return time.Time{}, false, err
+	}
+	if err := s.db.AdvanceInvoicedThrough(ctx, month); err != nil {
+		return time.Time{}, false, err
+	}
+	return month, true, nil
+}
+
+// invoiceMonth invoices every tenant not yet invoiced for the calendar month
+// starting at month. A tenant that cannot be invoiced is recorded as failed
+// and the others are still invoiced.
+func (s *Server) invoiceMonth(ctx context.Context, month time.Time) error {
+	from, to := month, month.AddDate(0, 1, 0)
+	tenantIDs, err := s.db.ListTenantsToInvoice(ctx, from, to)
+	if err != nil {
+		return err
+	}
+	for _, tenantID := range tenantIDs {
+		if err := s.invoiceTenant(ctx, tenantID, from, to); err != nil {
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return err
+			}
+			s.recordInvoiceFailure(ctx, tenantID, from, err)
+		}
+	}
+	return nil
+}
+
+// retryFailedInvoices tries again to invoice the tenants whose invoices
+// failed at least invoiceRetryInterval ago.
+func (s *Server) retryFailedInvoices(ctx context.Context) error {
+	failures, err := s.db.ListInvoiceFailures(ctx, time.Now().Add(-invoiceRetryInterval))
+	if err != nil {
+		return err
+	}
+	for _, f := range failures {
+		err := s.invoiceTenant(ctx, f.TenantID, f.PeriodStart, f.PeriodStart.AddDate(0, 1, 0))
+		if err == nil {
+			slog.Info("Usage",
+				slog.String("invoiced", f.PeriodStart.Format("2006-01")),
+				slog.String("tenant", f.TenantID.String()),
+				slog.Int("attempts", f.Attempts+1),
+			)
+			continue
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+		s.recordInvoiceFailure(ctx, f.TenantID, f.PeriodStart, err)
+	}
+	return nil
+}
+
+// invoiceTenant invoices the tenant for the calendar month [from, to).
+func (s *Server) invoiceTenant(ctx context.Context, tenantID uuid.UUID, from, to time.Time) error {
+	parts, _, err := s.loadPricedUsageParts(ctx, tenantID, from, to, to)
+	if err != nil {
+		return fmt.Errorf("could not summarize usage of tenant %s for %s: %w", tenantID, from.Format("2006-01"), err)
+	}
+	inv, err := buildUsageInvoice(tenantID, from, to, parts)
+	if err != nil {
+		return fmt.Errorf("could not build invoice of tenant %s for %s: %w", tenantID, from.Format("2006-01"), err)
+	}
+	if _, err := s.db.InsertInvoice(ctx, inv); err != nil {
+		return fmt.Errorf("could not store invoice of tenant %s for %s: %w", tenantID, from.Format("2006-01"), err)
+	}
+	return nil
+}
+
+// recordInvoiceFailure logs that the tenant could not be invoiced for the
+// month starting at from and records it to be retried.
+func (s *Server) recordInvoiceFailure(ctx context.Context, tenantID uuid.UUID, from time.Time, err error) {
+	logError(err)
+	if err := s.db.RecordInvoiceFailure(ctx, tenantID, from, err.Error()); err != nil {
+		logError(fmt.Errorf("could not record invoice failure of tenant %s for %s: %w", tenantID, from.Format("2006-01"), err))
+	}
+}
+
+type invoiceLineResponse struct {
+	PeriodStart  string `json:"periodStart"`
+	PeriodEnd    string `json:"periodEnd"`
+	Plan         string `json:"plan"`
+	Kind         string `json:"kind"`
+	Description  string `json:"description"`
+	Quantity     string `json:"quantity"`
+	Unit         string `json:"unit"`
+	UnitPriceUSD string `json:"unitPriceUsd"`
+	AmountUSD    string `json:"amountUsd"`
+}
+
+type invoiceResponse struct {
+	ID                  string                `json:"id"`
+	PeriodStart         string                `json:"periodStart"`
+	PeriodEnd           string                `json:"periodEnd"`
+	Currency            string                `json:"currency"`
+	PushOpCount         int64                 `json:"pushOpCount"`
+	PullOpCount         int64                 `json:"pullOpCount"`
+	PullBytes           int64                 `json:"pullBytes"`
+	StorageOpeningBytes int64                 `json:"storageOpeningBytes"`
+	StorageClosingBytes int64                 `json:"storageClosingBytes"`
+	StorageByteSeconds  string                `json:"storageByteSeconds"`
+	StorageGiBMonths    string                `json:"storageGiBMonths"`
+	TotalUSD            string                `json:"totalUsd"`
+	CreatedAt           string                `json:"createdAt"`
+	Lines               []invoiceLineResponse `json:"lines,omitempty"`
+}
+
+func newInvoiceResponse(inv db.Invoice) invoiceResponse {
+	resp := invoiceResponse{
+		ID:                  inv.ID.String(),
+		PeriodStart:         inv.PeriodStart.Format(time.RFC3339),
+		PeriodEnd:           inv.PeriodEnd.Format(time.RFC3339),
+		Currency:            inv.Currency,
+		PushOpCount:         inv.PushOpCount,
+		PullOpCount:         inv.PullOpCount,
+		PullBytes:           inv.PullBytes,
+		StorageOpeningBytes: inv.StorageOpeningBytes,
+		StorageClosingBytes: inv.StorageClosingBytes,
+		StorageByteSeconds:  inv.StorageByteSeconds,
+		StorageGiBMonths:    inv.StorageGiBMonths,
+		TotalUSD:            inv.TotalUSD,
+		CreatedAt:           inv.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	for _, l := range inv.Lines {
+		resp.Lines = append(resp.Lines, invoiceLineResponse{
+			PeriodStart:  l.PeriodStart.Format(time.RFC3339),
+			PeriodEnd:    l.PeriodEnd.Format(time.RFC3339),
+			Plan:         l.Plan,
+			Kind:         l.Kind,
+			Description:  l.Description,
+			Quantity:     l.Quantity,
+			Unit:         l.Unit,
+			UnitPriceUSD: l.UnitPriceUSD,
+			AmountUSD:    l.AmountUSD,
+		})
+	}
+	return resp
+}
+
+func (s *Server) listInvoicesHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	s.writeInvoices(c, u.tenantID)
+}
+
+// writeInvoices responds with the tenant's invoices, newest first, without
+// their line items.
+func (s *Server) writeInvoices(c *gin.Context, tenantID uuid.UUID) {
+	invoices, err := s.db.ListInvoicesByTenant(c.Request.Context(), tenantID)
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list invoices"})
+		return
+	}
+	resp := make([]invoiceResponse, 0, len(invoices))
+	for _, inv := range invoices {
+		resp = append(resp, newInvoiceResponse(inv))
+	}
+	c.JSON(http.StatusOK, gin.H{"invoices": resp})
+}
+
+func (s *Server) getInvoiceHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	s.writeInvoice(c, u.tenantID)
+}
+
+// writeInvoice responds with one of the tenant's invoices and its line items
+// as JSON or, with format=csv, as a CSV of the line items.
+func (s *Server) writeInvoice(c *gin.Context, tenantID uuid.UUID) {
+	id, err := uuid.Parse(c.Param("invoiceId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid invoice id"})
+		return
+	}
+	format := strings.TrimSpace(c.DefaultQuery("format", "json"))
+	if format != "json" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+		return
+	}
+
+	inv, err := s.db.GetInvoice(c.Request.Context(), tenantID, id)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "invoice not found"})
+			return
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get invoice"})
+		return
+	}
+
+	if format == "json" {
+		c.JSON(http.StatusOK, newInvoiceResponse(inv))
+		return
+	}
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="invoice-%s.csv"`, inv.PeriodStart.Format("2006-01")))
+	c.Status(http.StatusOK)
+	if err := writeInvoiceCSV(c.Writer, inv); err != nil && !errors.Is(err, context.Canceled) {
+		logError(fmt.Errorf("writeInvoice: %w", err))
+	}
+}
+
+// writeInvoiceCSV writes inv's line items followed by a total row.
+func writeInvoiceCSV(w io.Writer, inv db.Invoice) error {
+	cw := csv.NewWriter(w)
+	records := [][]string{{
+		"invoice_id", "period_start", "period_end", "plan", "kind", "description",
+		"quantity", "unit", "unit_price_usd", "amount_usd",
+	}}
+	for _, l := range inv.Lines {
+		records = append(records, []string{
+			inv.ID.String(), l.PeriodStart.Format(time.RFC3339), l.PeriodEnd.Format(time.RFC3339), l.Plan, l.Kind, l.Description,
+			l.Quantity, l.Unit, l.UnitPriceUSD, l.AmountUSD,
+		})
+	}
+	records = append(records, []string{
+		inv.ID.String(), inv.PeriodStart.Format(time.RFC3339), inv.PeriodEnd.Format(time.RFC3339), "", "total", "Total",
+		"", "", "", inv.TotalUSD,
+	})
+	if err := cw.WriteAll(records); err != nil {
+		return err
+	}
+	return cw.Error()
+}
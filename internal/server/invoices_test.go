@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/csv"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/google/uuid"
+)
+
+func TestBuildUsageInvoiceLinesSumToCharges(t *testing.T) {
+	from := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	upgrade := from.AddDate(0, 0, 10)
+
+	starter := db.PlanPrice{
+		StorageUSDPerGiBMonth:    big.NewRat(1, 50),
+		PushUSDPerOp:             big.NewRat(1, 100000),
+		PullUSDPerOp:             big.NewRat(1, 500000),
+		PullUSDPerGiB:            big.NewRat(1, 100),
+		IncludedStorageGiBMonths: big.NewRat(1, 1),
+		IncludedPullOps:          10000,
+		IncludedPullGiB:          big.NewRat(100, 1),
+		MinimumChargeUSD:         new(big.Rat),
+	}
+	pro := planRatesOnly(starter)
+	pro.StorageUSDPerGiBMonth = big.NewRat(1, 100)
+	pro.MinimumChargeUSD = big.NewRat(20, 1)
+
+	first, err := calculateUsagePeriodSummary(from, upgrade, upgrade, 3<<30, nil, 12, 4000)
+	if err != nil {
+		t.Fatalf("calculateUsagePeriodSummary: %v", err)
+	}
+	second, err := calculateUsagePeriodSummary(upgrade, to, to, 3<<30, nil, 7, 90000)
+	if err != nil {
+		t.Fatalf("calculateUsagePeriodSummary: %v", err)
+	}
+	first.PullBytes, second.PullBytes = 20<<30, 500<<30
+	parts := []usagePricedSummary{
+		{Summary: first, Plan: "starter", Price: starter},
+		{Summary: second, Plan: "pro", Price: pro},
+	}
+
+	tenantID := uuid.New()
+	inv, err := buildUsageInvoice(tenantID, from, to, parts)
+	if err != nil {
+		t.Fatalf("buildUsageInvoice: %v", err)
+	}
+	if inv.TenantID != tenantID || !inv.PeriodStart.Equal(from) || !inv.PeriodEnd.Equal(to) || inv.Currency != "USD" {
+		t.Fatalf("invoice = %+v, want the tenant's March invoice in USD", inv)
+	}
+	if inv.PushOpCount != 19 || inv.PullOpCount != 94000 || inv.PullBytes != 520<<30 || inv.StorageClosingBytes != 3<<30 {
+		t.Fatalf("invoice usage = %d/%d/%d/%d, want 19/94000/%d/%d", inv.PushOpCount, inv.PullOpCount, inv.PullBytes, inv.StorageClosingBytes, 520<<30, 3<<30)
+	}
+
+	kinds := map[string]int{}
+	sum := new(big.Rat)
+	for _, l := range inv.Lines {
+		kinds[l.Plan+"/"+l.Kind]++
+		amount, ok := new(big.Rat).SetString(l.AmountUSD)
+		if !ok {
+			t.Fatalf("line %+v has invalid amount", l)
+		}
+		sum.Add(sum, amount)
+		if l.Description == "" || l.Unit == "" {
+			t.Fatalf("line %+v has no description or unit", l)
+		}
+	}
+	for _, want := range []string{"starter/storage-included", "starter/pull-ops-included", "starter/pull-bytes-included", "pro/pull-bytes", "pro/minimum"} {
+		if kinds[want] != 1 {
+			t.Fatalf("lines = %v, want one %s", kinds, want)
+		}
+	}
+	if kinds["pro/storage-included"] != 0 {
+		t.Fatalf("lines = %v, want no allowance on pro", kinds)
+	}
+
+	if got := formatUsageDecimal(sum, invoiceDecimalScale); got != inv.TotalUSD {
+		t.Fatalf("lines sum to %s, total is %s", got, inv.TotalUSD)
+	}
+	charges := calculateUsageCharges(from, to, parts)
+	if got := formatUsageDecimal(charges.totalUSD(), 6); formatUsageDecimal(sum, 6) != got {
+		t.Fatalf("invoice total = %s, summary total = %s", inv.TotalUSD, got)
+	}
+}
+
+func TestWriteInvoiceCSV(t *testing.T) {
+	from := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	inv := db.Invoice{
+		ID:          uuid.New(),
+		PeriodStart: from,
+		PeriodEnd:   from.AddDate(0, 1, 0),
+		TotalUSD:    "1.5",
+		Lines: []db.InvoiceLine{{
+			PeriodStart:  from,
+			PeriodEnd:    from.AddDate(0, 1, 0),
+			Plan:         "default",
+			Kind:         usageLineStorage,
+			Description:  "Storage, \"hot\"",
+			Quantity:     "75",
+			Unit:         "GiB-month",
+			UnitPriceUSD: "0.02",
+			AmountUSD:    "1.5",
+		}},
+	}
+
+	var b strings.Builder
+	if err := writeInvoiceCSV(&b, inv); err != nil {
+		t.Fatalf("writeInvoiceCSV: %v", err)
+	}
+	records, err := csv.NewReader(strings.NewReader(b.String())).ReadAll()
+	if err != nil {
+		t.Fatalf("reading CSV: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("records = %d, want header, line and total", len(records))
+	}
+	if records[1][5] != "Storage, \"hot\"" || records[1][9] != "1.5" {
+		t.Fatalf("line = %v", records[1])
+	}
+	if records[2][4] != "total" || records[2][9] != "1.5" {
+		t.Fatalf("total = %v", records[2])
+	}
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"bin2.io/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	operatorKey           = "operator"
+	auditTenantsKey       = "auditTenants"
+	operatorTokensEnvName = "ADMIN_API_TOKENS"
+)
+
+// operatorToken is an operator's admin API credential. Only the SHA-256 of
+// the token is configured, so the environment does not hold usable secrets.
+type operatorToken struct {
+	name string
+	hash [sha256.Size]byte
+}
+
+// operatorAuditActions maps audited /admin/v1 routes ("METHOD full-path") to
+// audit actions.
+var operatorAuditActions = map[string]string{
+	"PUT /admin/v1/tenants/:id/state":              "operator.tenant.set_state",
+	"PUT /admin/v1/tenants/:id/plan":               "operator.tenant.set_plan",
+	"POST /admin/v1/tenants/:id/revoke-api-keys":   "operator.tenant.revoke_api_keys",
+	"POST /admin/v1/tenants/:id/storage/reconcile": "operator.tenant.reconcile_storage",
+	"PUT /admin/v1/registries/:id/state":           "operator.registry.set_state",
+	"POST /admin/v1/registries/:id/transfer":       "operator.registry.transfer",
+	"DELETE /admin/v1/api-keys/:id":                "operator.api_key.revoke",
+	"PUT /admin/v1/plans/:name":                    "operator.plan.save",
+	"POST /admin/v1/plans/:name/prices":            "operator.plan.add_price",
+	"POST /admin/v1/usage-workers":                 "operator.usage_worker.create",
+	"DELETE /admin/v1/usage-workers/:id":           "operator.usage_worker.revoke",
+}
+
+// parseOperatorTokens reads ADMIN_API_TOKENS: a comma-separated list of
+// name:sha256-hex entries.
+func parseOperatorTokens(raw string) ([]operatorToken, error) {
+	var tokens []operatorToken
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, hashHex, ok := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s entries must be name:sha256", operatorTokensEnvName)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%s lists operator %q twice", operatorTokensEnvName, name)
+		}
+		hash, err := hex.DecodeString(strings.TrimSpace(hashHex))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("%s entry for %q must be a 64-char hex SHA-256", operatorTokensEnvName, name)
+		}
+		token := operatorToken{name: name}
+		copy(token.hash[:], hash)
+		tokens = append(tokens, token)
+		seen[name] = true
+	}
+	return tokens, nil
+}
+
+func operatorTokensFromEnv() ([]operatorToken, error) {
+	return parseOperatorTokens(os.Getenv(operatorTokensEnvName))
+}
+
+// authenticateOperator returns the name of the operator whose token is
+// provided. Every configured token is compared so timing does not reveal
+// which one matched.
+func authenticateOperator(tokens []operatorToken, provided string) (string, bool) {
+	if provided == "" {
+		return "", false
+	}
+	hash := sha256.Sum256([]byte(provided))
+	name := ""
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare(hash[:], token.hash[:]) == 1 {
+			name = token.name
+		}
+	}
+	return name, name != ""
+}
+
+// operatorAuthMiddleware authenticates /admin/v1 requests with an operator
+// token. Management credentials are never accepted here, and the API is
+// closed when no operator tokens are configured.
+func (s *Server) operatorAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.managementRateLimited(c, rateLimitRequest{addr: registryClientAddr(c)}) {
+			return
+		}
+
+		authHeader := strings.TrimSpace(c.GetHeader("Authorization"))
+		const prefix = "Bearer "
+		if len(authHeader) < len(prefix) || !strings.EqualFold(authHeader[:len(prefix)], prefix) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		name, ok := authenticateOperator(s.operatorTokens, strings.TrimSpace(authHeader[len(prefix):]))
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		c.Set(operatorKey, name)
+		c.Next()
+	}
+}
+
+func getOperator(c *gin.Context) string {
+	name, _ := c.Get(operatorKey)
+	s, _ := name.(string)
+	return s
+}
+
+// setAuditTenants records the tenants whose audit trails should show the
+// current operator request. Requests that touch two tenants, such as a
+// registry transfer, are recorded in both.
+func setAuditTenants(c *gin.Context, tenantIDs ...uuid.UUID) {
+	c.Set(auditTenantsKey, tenantIDs)
+}
+
+// operatorAuditMiddleware records state-changing /admin/v1 requests listed in
+// operatorAuditActions in the audit trail of each affected tenant.
+func (s *Server) operatorAuditMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		action, ok := operatorAuditActions[c.Request.Method+" "+c.FullPath()]
+		if !ok || s.db == nil {
+			return
+		}
+
+		event := db.AuditEvent{
+			ActorType: db.AuditActorOperator,
+			ActorName: getOperator(c),
+			Action:    action,
+			Target:    c.Param("id"),
+		}
+		if event.ActorName == "" {
+			event.ActorType = db.AuditActorAnonymous
+		}
+		if target, ok := c.Get(auditTargetKey); ok {
+			event.Target, _ = target.(string)
+		}
+		if obj, ok := c.Get(auditRegistryKey); ok {
+			if registry, ok := obj.(db.Registry); ok {
+				event.RegistryID = &registry.ID
+				event.RegistryName = registry.Name
+			}
+		}
+
+		var tenantIDs []uuid.UUID
+		if obj, ok := c.Get(auditTenantsKey); ok {
+			tenantIDs, _ = obj.([]uuid.UUID)
+		}
+		if len(tenantIDs) == 0 {
+			s.recordAuditEvent(c, event)
+			return
+		}
+		for _, tenantID := range tenantIDs {
+			event.TenantID = &tenantID
+			s.recordAuditEvent(c, event)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func operatorTokenEntry(name, token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return name + ":" + hex.EncodeToString(hash[:])
+}
+
+func TestParseOperatorTokens(t *testing.T) {
+	tokens, err := parseOperatorTokens(" " + operatorTokenEntry("alice", "op_a") + ", ," + operatorTokenEntry("bob", "op_b"))
+	if err != nil {
+		t.Fatalf("parseOperatorTokens: %v", err)
+	}
+	if len(tokens) != 2 || tokens[0].name != "alice" || tokens[1].name != "bob" {
+		t.Fatalf("tokens = %+v", tokens)
+	}
+
+	if tokens, err := parseOperatorTokens(""); err != nil || len(tokens) != 0 {
+		t.Fatalf("empty: tokens = %+v, err = %v", tokens, err)
+	}
+	for _, raw := range []string{
+		"alice",
+		":" + hex.EncodeToString(make([]byte, sha256.Size)),
+		"alice:not-hex",
+		"alice:abcd",
+		operatorTokenEntry("alice", "op_a") + "," + operatorTokenEntry("alice", "op_b"),
+	} {
+		if _, err := parseOperatorTokens(raw); err == nil {
+			t.Fatalf("parseOperatorTokens(%q) accepted", raw)
+		}
+	}
+}
+
+func TestAuthenticateOperator(t *testing.T) {
+	tokens, err := parseOperatorTokens(operatorTokenEntry("alice", "op_a") + "," + operatorTokenEntry("bob", "op_b"))
+	if err != nil {
+		t.Fatalf("parseOperatorTokens: %v", err)
+	}
+	if name, ok := authenticateOperator(tokens, "op_b"); !ok || name != "bob" {
+		t.Fatalf("op_b: name = %q, ok = %v", name, ok)
+	}
+	for _, provided := range []string{"", "op_c", "OP_A"} {
+		if _, ok := authenticateOperator(tokens, provided); ok {
+			t.Fatalf("%q authenticated", provided)
+		}
+	}
+	if _, ok := authenticateOperator(nil, "op_a"); ok {
+		t.Fatal("authenticated without configured tokens")
+	}
+}
+
+func TestOperatorAuthMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tokens, err := parseOperatorTokens(operatorTokenEntry("alice", "op_a"))
+	if err != nil {
+		t.Fatalf("parseOperatorTokens: %v", err)
+	}
+	s := &Server{operatorTokens: tokens}
+	router := gin.New()
+	router.GET("/admin/v1/tenants", s.operatorAuthMiddleware(), func(c *gin.Context) {
+		c.String(http.StatusOK, getOperator(c))
+	})
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{name: "operator", header: "Bearer op_a", want: http.StatusOK},
+		{name: "missing", header: "", want: http.StatusUnauthorized},
+		{name: "wrong token", header: "Bearer op_b", want: http.StatusUnauthorized},
+		{name: "api key", header: "Bearer sk_test", want: http.StatusUnauthorized},
+		{name: "basic", header: "Basic b3BfYQ==", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/admin/v1/tenants", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		if res.Code != tt.want {
+			t.Fatalf("%s: status = %d, want %d", tt.name, res.Code, tt.want)
+		}
+		if tt.want == http.StatusOK && res.Body.String() != "alice" {
+			t.Fatalf("%s: operator = %q", tt.name, res.Body.String())
+		}
+	}
+}
+
+func TestOperatorAuditActionsMatchRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := &Server{
+		router:          gin.New(),
+		registryJWTKeys: newTestRegistryJWTKeyring(t),
+	}
+	s.addRoutes()
+
+	registered := map[string]bool{}
+	for _, route := range s.router.Routes() {
+		registered[route.Method+" "+route.Path] = true
+	}
+	for key := range operatorAuditActions {
+		if !registered[key] {
+			t.Fatalf("audited operator route %q is not registered", key)
+		}
+	}
+}
@@ -0,0 +1,695 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type operatorTenantResponse struct {
+	ID            string  `json:"id"`
+	Name          string  `json:"name"`
+	Plan          string  `json:"plan"`
+	State         string  `json:"state"`
+	StateReason   string  `json:"stateReason,omitempty"`
+	Onboarded     bool    `json:"onboarded"`
+	CreatedAt     *string `json:"createdAt,omitempty"`
+	RegistryCount int64   `json:"registryCount"`
+	MemberCount   int64   `json:"memberCount"`
+	SizeBytes     int64   `json:"sizeBytes"`
+}
+
+type operatorRegistryResponse struct {
+	ID            string   `json:"id"`
+	TenantID      string   `json:"tenantId"`
+	Name          string   `json:"name"`
+	SizeBytes     int64    `json:"sizeBytes"`
+	SizeUpdatedAt *string  `json:"sizeUpdatedAt,omitempty"`
+	AllowedCIDRs  []string `json:"allowedCidrs"`
+	State         string   `json:"state"`
+	StateReason   string   `json:"stateReason,omitempty"`
+}
+
+type operatorStateRequest struct {
+	State  string `json:"state"`
+	Reason string `json:"reason"`
+}
+
+type operatorPlanRequest struct {
+	Plan string `json:"plan"`
+}
+
+type operatorTransferRequest struct {
+	TenantID string `json:"tenantId"`
+}
+
+func newOperatorTenantResponse(t db.TenantSummary) operatorTenantResponse {
+	resp := operatorTenantResponse{
+		ID:            t.ID.String(),
+		Name:          t.Name,
+		Plan:          t.Plan,
+		State:         string(t.State),
+		StateReason:   t.StateReason,
+		Onboarded:     t.Onboarded,
+		RegistryCount: t.RegistryCount,
+		MemberCount:   t.MemberCount,
+		SizeBytes:     t.SizeBytes,
+	}
+	if t.CreatedAt != nil {
+		createdAt := t.CreatedAt.UTC().Format(time.RFC3339)
+		resp.CreatedAt = &createdAt
+	}
+	return resp
+}
+
+func newOperatorRegistryResponse(r db.Registry) operatorRegistryResponse {
+	resp := operatorRegistryResponse{
+		ID:           r.ID.String(),
+		TenantID:     r.TenantID.String(),
+		Name:         r.Name,
+		SizeBytes:    r.CachedSizeBytes,
+		AllowedCIDRs: r.AllowedCIDRs,
+		State:        string(r.State),
+		StateReason:  r.StateReason,
+	}
+	if r.CachedSizeUpdatedAt != nil {
+		updatedAt := r.CachedSizeUpdatedAt.UTC().Format(time.RFC3339)
+		resp.SizeUpdatedAt = &updatedAt
+	}
+	return resp
+}
+
+// operatorID reads the :id route parameter, writing a 400 when it is not a
+// UUID.
+func operatorID(c *gin.Context, kind string) (uuid.UUID, bool) {
+	id, err := uuid.Parse(strings.TrimSpace(c.Param("id")))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + kind + " id"})
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+// forgetRegistryAccessState drops a cached registry state so this replica
+// applies an operator's change immediately; others pick it up within
+// registryAccessStateTTL.
+func (s *Server) forgetRegistryAccessState(namespace string) {
+	if s.registryStates == nil {
+		return
+	}
+	s.registryStates.mu.Lock()
+	delete(s.registryStates.entries, namespace)
+	s.registryStates.mu.Unlock()
+}
+
+// listOperatorTenantsHandler handles GET /admin/v1/tenants. name filters by
+// name prefix and registry by the name of a registry the tenant owns; pass
+// nextCursor back as cursor to fetch the following page.
+func (s *Server) listOperatorTenantsHandler(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	tenants, err := s.db.ListTenants(c.Request.Context(), db.TenantFilter{
+		NamePrefix:   strings.TrimSpace(c.Query("name")),
+		RegistryName: strings.TrimSpace(c.Query("registry")),
+		After:        strings.TrimSpace(c.Query("cursor")),
+		Limit:        limit,
+	})
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list tenants"})
+		return
+	}
+
+	out := make([]operatorTenantResponse, 0, len(tenants))
+	for _, t := range tenants {
+		out = append(out, newOperatorTenantResponse(t))
+	}
+	resp := gin.H{"tenants": out}
+	if len(tenants) == limit {
+		resp["nextCursor"] = tenants[len(tenants)-1].Name
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) getOperatorTenantHandler(c *gin.Context) {
+	tenantID, ok := operatorID(c, "tenant")
+	if !ok {
+		return
+	}
+	tenant, err := s.db.GetTenant(c.Request.Context(), tenantID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "tenant not found"})
+			return
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not get tenant"})
+		return
+	}
+	c.JSON(http.StatusOK, newOperatorTenantResponse(tenant))
+}
+
+// operatorTenantUsageHandler handles GET /admin/v1/tenants/:id/usage/summary,
+// /usage/breakdown, /usage/series, /usage/export and /invoices with write,
+// taking the same parameters and giving the same response as the tenant's own
+// /api/v1/usage and /api/v1/invoices endpoints.
+func (s *Server) operatorTenantUsageHandler(write func(*gin.Context, uuid.UUID)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenantID, ok := operatorID(c, "tenant")
+		if !ok {
+			return
+		}
+		if _, err := s.db.GetOrganization(c.Request.Context(), tenantID); err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "tenant not found"})
+				return
+			}
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return
+			}
+			logError(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to summarize usage"})
+			return
+		}
+		write(c, tenantID)
+	}
+}
+
+// bindOperatorStateRequest reads and validates a state change request.
+func bindOperatorStateRequest(c *gin.Context) (db.AccessState, string, bool) {
+	var req operatorStateRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return "", "", false
+	}
+	state, ok := db.ParseAccessState(strings.TrimSpace(req.State))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "state must be active, read_only, or suspended"})
+		return "", "", false
+	}
+	reason := strings.TrimSpace(req.Reason)
+	if state == db.AccessStateActive {
+		reason = ""
+	}
+	return state, reason, true
+}
+
+func (s *Server) setOperatorTenantStateHandler(c *gin.Context) {
+	tenantID, ok := operatorID(c, "tenant")
+	if !ok {
+		return
+	}
+	setAuditTenants(c, tenantID)
+	state, reason, ok := bindOperatorStateRequest(c)
+	if !ok {
+		return
+	}
+
+	if err := s.db.SetTenantState(c.Request.Context(), tenantID, state, reason); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "tenant not found"})
+			return
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not set tenant state"})
+		return
+	}
+	if registries, err := s.db.ListRegistriesByOrg(c.Request.Context(), tenantID); err == nil {
+		for _, registry := range registries {
+			s.forgetRegistryAccessState(registry.Name)
+		}
+	}
+	c.JSON(http.StatusOK, operatorStateRequest{State: string(state), Reason: reason})
+}
+
+func (s *Server) setOperatorTenantPlanHandler(c *gin.Context) {
+	tenantID, ok := operatorID(c, "tenant")
+	if !ok {
+		return
+	}
+	setAuditTenants(c, tenantID)
+
+	var req operatorPlanRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	req.Plan = strings.TrimSpace(req.Plan)
+	if req.Plan == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "plan is required"})
+		return
+	}
+
+	if err := s.db.SetTenantPlan(c.Request.Context(), tenantID, req.Plan); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "tenant not found"})
+			return
+		}
+		if errors.Is(err, db.ErrUnknownPlan) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown plan"})
+			return
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not set tenant plan"})
+		return
+	}
+	c.JSON(http.StatusOK, req)
+}
+
+// revokeOperatorTenantAPIKeysHandler handles
+// POST /admin/v1/tenants/:id/revoke-api-keys, deleting every API key for the
+// tenant's registries and revoking the registry tokens issued for them.
+func (s *Server) revokeOperatorTenantAPIKeysHandler(c *gin.Context) {
+	tenantID, ok := operatorID(c, "tenant")
+	if !ok {
+		return
+	}
+	setAuditTenants(c, tenantID)
+
+	revoked, err := s.db.ForceRevokeTenantAPIKeys(c.Request.Context(), tenantID, registryTokensExpireAt(time.Now().UTC()))
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "tenant not found"})
+			return
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not revoke api keys"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revokedApiKeys": revoked})
+}
+
+// listOperatorRegistriesHandler handles GET /admin/v1/registries, optionally
+// narrowed to one tenant or to the registry with an exact name.
+func (s *Server) listOperatorRegistriesHandler(c *gin.Context) {
+	if name := strings.TrimSpace(c.Query("name")); name != "" {
+		registry, err := s.db.GetRegistryByName(c.Request.Context(), name)
+		if err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				c.JSON(http.StatusOK, gin.H{"registries": []operatorRegistryResponse{}})
+				return
+			}
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return
+			}
+			logError(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list registries"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"registries": []operatorRegistryResponse{newOperatorRegistryResponse(registry)}})
+		return
+	}
+
+	var tenantID *uuid.UUID
+	if raw := strings.TrimSpace(c.Query("tenant")); raw != "" {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid tenant id"})
+			return
+		}
+		tenantID = &id
+	}
+
+	registries, err := s.db.ListAllRegistries(c.Request.Context(), tenantID)
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list registries"})
+		return
+	}
+	out := make([]operatorRegistryResponse, 0, len(registries))
+	for _, registry := range registries {
+		out = append(out, newOperatorRegistryResponse(registry))
+	}
+	c.JSON(http.StatusOK, gin.H{"registries": out})
+}
+
+// operatorRegistry loads the :id registry and attributes the request's audit
+// event to it and its tenant.
+func (s *Server) operatorRegistry(c *gin.Context) (db.Registry, bool) {
+	registryID, ok := operatorID(c, "registry")
+	if !ok {
+		return db.Registry{}, false
+	}
+	registry, err := s.db.GetRegistryByID(c.Request.Context(), registryID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "registry not found"})
+			return db.Registry{}, false
+		}
+		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			logError(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not get registry"})
+		}
+		return db.Registry{}, false
+	}
+	setAuditRegistry(c, registry)
+	setAuditTenants(c, registry.TenantID)
+	return registry, true
+}
+
+func (s *Server) setOperatorRegistryStateHandler(c *gin.Context) {
+	registry, ok := s.operatorRegistry(c)
+	if !ok {
+		return
+	}
+	state, reason, ok := bindOperatorStateRequest(c)
+	if !ok {
+		return
+	}
+
+	if err := s.db.SetRegistryState(c.Request.Context(), registry.ID, state, reason); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "registry not found"})
+			return
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not set registry state"})
+		return
+	}
+	s.forgetRegistryAccessState(registry.Name)
+	c.JSON(http.StatusOK, operatorStateRequest{State: string(state), Reason: reason})
+}
+
+// transferOperatorRegistryHandler handles
+// POST /admin/v1/registries/:id/transfer, moving a registry to another
+// tenant. API keys for the registry are deleted because they belong to the
+// previous tenant's users.
+func (s *Server) transferOperatorRegistryHandler(c *gin.Context) {
+	registry, ok := s.operatorRegistry(c)
+	if !ok {
+		return
+	}
+
+	var req operatorTransferRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	toTenantID, err := uuid.Parse(strings.TrimSpace(req.TenantID))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid tenantId"})
+		return
+	}
+
+	transfer, err := s.db.TransferRegistry(c.Request.Context(), registry.ID, toTenantID, registryTokensExpireAt(time.Now().UTC()))
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "registry or tenant not found"})
+		case errors.Is(err, db.ErrConflict):
+			c.JSON(http.StatusConflict, gin.H{"error": "registry already belongs to this tenant"})
+		case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		default:
+			logError(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not transfer registry"})
+		}
+		return
+	}
+	setAuditTenants(c, transfer.FromTenantID, toTenantID)
+	setAuditTarget(c, toTenantID.String())
+	s.forgetRegistryAccessState(registry.Name)
+
+	c.JSON(http.StatusOK, gin.H{
+		"registry":          newOperatorRegistryResponse(transfer.Registry),
+		"fromTenantId":      transfer.FromTenantID.String(),
+		"revokedApiKeys":    transfer.RevokedAPIKeys,
+		"movedStorageBytes": transfer.MovedStorageBytes,
+	})
+}
+
+// revokeOperatorAPIKeyHandler handles DELETE /admin/v1/api-keys/:id, deleting
+// any tenant's API key and revoking the registry tokens issued for it.
+func (s *Server) revokeOperatorAPIKeyHandler(c *gin.Context) {
+	keyID, ok := operatorID(c, "api key")
+	if !ok {
+		return
+	}
+
+	tenantID, err := s.db.ForceRevokeAPIKey(c.Request.Context(), keyID, registryTokensExpireAt(time.Now().UTC()))
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "api key not found"})
+			return
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not revoke api key"})
+		return
+	}
+	if tenantID != uuid.Nil {
+		setAuditTenants(c, tenantID)
+	}
+	c.Status(http.StatusNoContent)
+}
+
+type operatorPlanResponse struct {
+	Name        string                      `json:"name"`
+	Description string                      `json:"description"`
+	CreatedAt   string                      `json:"createdAt"`
+	Prices      []operatorPlanPriceResponse `json:"prices"`
+}
+
+type operatorPlanPriceResponse struct {
+	EffectiveFrom            string `json:"effectiveFrom"`
+	StorageUSDPerGiBMonth    string `json:"storageUsdPerGibMonth"`
+	PushUSDPerOp             string `json:"pushUsdPerOp"`
+	PullUSDPerOp             string `json:"pullUsdPerOp"`
+	PullUSDPerGiB            string `json:"pullUsdPerGib"`
+	IncludedStorageGiBMonths string `json:"includedStorageGibMonths"`
+	IncludedPushOps          int64  `json:"includedPushOps"`
+	IncludedPullOps          int64  `json:"includedPullOps"`
+	IncludedPullGiB          string `json:"includedPullGib"`
+	MinimumChargeUSD         string `json:"minimumChargeUsd"`
+}
+
+func newOperatorPlanPriceResponse(p db.PlanPrice) operatorPlanPriceResponse {
+	return operatorPlanPriceResponse{
+		EffectiveFrom:            p.EffectiveFrom.UTC().Format(time.RFC3339),
+		StorageUSDPerGiBMonth:    formatUsageDecimal(p.StorageUSDPerGiBMonth, 12),
+		PushUSDPerOp:             formatUsageDecimal(p.PushUSDPerOp, 12),
+		PullUSDPerOp:             formatUsageDecimal(p.PullUSDPerOp, 12),
+		PullUSDPerGiB:            formatUsageDecimal(p.PullUSDPerGiB, 12),
+		IncludedStorageGiBMonths: formatUsageDecimal(p.IncludedStorageGiBMonths, 12),
+		IncludedPushOps:          p.IncludedPushOps,
+		IncludedPullOps:          p.IncludedPullOps,
+		IncludedPullGiB:          formatUsageDecimal(p.IncludedPullGiB, 12),
+		MinimumChargeUSD:         formatUsageDecimal(p.MinimumChargeUSD, 12),
+	}
+}
+
+type operatorPlanRequestBody struct {
+	Description string `json:"description"`
+}
+
+// operatorPlanPriceRequest carries amounts as decimal strings so they are
+// never rounded through floating point.
+type operatorPlanPriceRequest struct {
+	EffectiveFrom            string `json:"effectiveFrom"`
+	StorageUSDPerGiBMonth    string `json:"storageUsdPerGibMonth"`
+	PushUSDPerOp             string `json:"pushUsdPerOp"`
+	PullUSDPerOp             string `json:"pullUsdPerOp"`
+	PullUSDPerGiB            string `json:"pullUsdPerGib"`
+	IncludedStorageGiBMonths string `json:"includedStorageGibMonths"`
+	IncludedPushOps          int64  `json:"includedPushOps"`
+	IncludedPullOps          int64  `json:"includedPullOps"`
+	IncludedPullGiB          string `json:"includedPullGib"`
+	MinimumChargeUSD         string `json:"minimumChargeUsd"`
+}
+
+// planPrice validates the request as a price for plan. Egress, allowances and
+// the minimum charge default to zero; prices cannot take effect in the past, since
+// that would change charges already reported to tenants.
+func (req operatorPlanPriceRequest) planPrice(plan string, now time.Time) (db.PlanPrice, error) {
+	price := db.PlanPrice{
+		Plan:            plan,
+		EffectiveFrom:   now,
+		IncludedPushOps: req.IncludedPushOps,
+		IncludedPullOps: req.IncludedPullOps,
+	}
+	if raw := strings.TrimSpace(req.EffectiveFrom); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return db.PlanPrice{}, fmt.Errorf("invalid effectiveFrom")
+		}
+		if t.Before(now) {
+			return db.PlanPrice{}, fmt.Errorf("effectiveFrom must not be in the past")
+		}
+		price.EffectiveFrom = t.UTC()
+	}
+	if price.IncludedPushOps < 0 || price.IncludedPullOps < 0 {
+		return db.PlanPrice{}, fmt.Errorf("included operations must not be negative")
+	}
+	for _, f := range []struct {
+		name     string
+		raw      string
+		optional bool
+		dst      **big.Rat
+	}{
+		{"storageUsdPerGibMonth", req.StorageUSDPerGiBMonth, false, &price.StorageUSDPerGiBMonth},
+		{"pushUsdPerOp", req.PushUSDPerOp, false, &price.PushUSDPerOp},
+		{"pullUsdPerOp", req.PullUSDPerOp, false, &price.PullUSDPerOp},
+		{"pullUsdPerGib", req.PullUSDPerGiB, true, &price.PullUSDPerGiB},
+		{"includedStorageGibMonths", req.IncludedStorageGiBMonths, true, &price.IncludedStorageGiBMonths},
+		{"includedPullGib", req.IncludedPullGiB, true, &price.IncludedPullGiB},
+		{"minimumChargeUsd", req.MinimumChargeUSD, true, &price.MinimumChargeUSD},
+	} {
+		if f.optional && strings.TrimSpace(f.raw) == "" {
+			*f.dst = new(big.Rat)
+			continue
+		}
+		amount, err := db.ParsePlanAmount(f.raw)
+		if err != nil {
+			return db.PlanPrice{}, fmt.Errorf("%s: %v", f.name, err)
+		}
+		*f.dst = amount
+	}
+	return price, nil
+}
+
+// listOperatorPlansHandler handles GET /admin/v1/plans, listing every plan
+// with its price history.
+func (s *Server) listOperatorPlansHandler(c *gin.Context) {
+	plans, err := s.db.ListPlans(c.Request.Context())
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list plans"})
+		return
+	}
+	prices, err := s.db.ListPlanPrices(c.Request.Context(), nil)
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list plans"})
+		return
+	}
+
+	resp := make([]operatorPlanResponse, 0, len(plans))
+	for _, p := range plans {
+		item := operatorPlanResponse{
+			Name:        p.Name,
+			Description: p.Description,
+			CreatedAt:   p.CreatedAt.UTC().Format(time.RFC3339),
+			Prices:      []operatorPlanPriceResponse{},
+		}
+		for _, price := range prices {
+			if price.Plan == p.Name {
+				item.Prices = append(item.Prices, newOperatorPlanPriceResponse(price))
+			}
+		}
+		resp = append(resp, item)
+	}
+	c.JSON(http.StatusOK, gin.H{"plans": resp})
+}
+
+// putOperatorPlanHandler handles PUT /admin/v1/plans/:name, creating the plan
+// or updating its description.
+func (s *Server) putOperatorPlanHandler(c *gin.Context) {
+	name := strings.TrimSpace(c.Param("name"))
+	setAuditTarget(c, name)
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "plan name is required"})
+		return
+	}
+	var req operatorPlanRequestBody
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+
+	plan, err := s.db.UpsertPlan(c.Request.Context(), name, req.Description)
+	var prices []db.PlanPrice
+	if err == nil {
+		prices, err = s.db.ListPlanPrices(c.Request.Context(), []string{plan.Name})
+	}
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save plan"})
+		return
+	}
+
+	resp := operatorPlanResponse{
+		Name:        plan.Name,
+		Description: plan.Description,
+		CreatedAt:   plan.CreatedAt.UTC().Format(time.RFC3339),
+		Prices:      make([]operatorPlanPriceResponse, 0, len(prices)),
+	}
+	for _, price := range prices {
+		resp.Prices = append(resp.Prices, newOperatorPlanPriceResponse(price))
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// addOperatorPlanPriceHandler handles POST /admin/v1/plans/:name/prices,
+// scheduling a new price for the plan. Tenants are charged at it from its
+// effective time on, so price changes need no redeploy.
+func (s *Server) addOperatorPlanPriceHandler(c *gin.Context) {
+	name := strings.TrimSpace(c.Param("name"))
+	setAuditTarget(c, name)
+	var req operatorPlanPriceRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	price, err := req.planPrice(name, time.Now().UTC())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.db.AddPlanPrice(c.Request.Context(), price); err != nil {
+		switch {
+		case errors.Is(err, db.ErrUnknownPlan):
+			c.JSON(http.StatusNotFound, gin.H{"error": "plan not found"})
+		case errors.Is(err, db.ErrConflict):
+			c.JSON(http.StatusConflict, gin.H{"error": "plan already has a price effective at this time"})
+		case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		default:
+			logError(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not add plan price"})
+		}
+		return
+	}
+	c.JSON(http.StatusCreated, newOperatorPlanPriceResponse(price))
+}
@@ -0,0 +1,386 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const orgInvitationTTLDays = 7
+
+type orgResponse struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+type orgMemberResponse struct {
+	UserID    string    `json:"userId"`
+	Email     *string   `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type listOrgMembersResponse struct {
+	Members []orgMemberResponse `json:"members"`
+}
+
+type setOrgMemberRoleRequest struct {
+	Role string `json:"role"`
+}
+
+type createOrgInvitationRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+type orgInvitationResponse struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type listOrgInvitationsResponse struct {
+	Invitations []orgInvitationResponse `json:"invitations"`
+}
+
+// canManageOrgRole reports whether a member with role actor may move another
+// member from role current to role next, or invite someone (current empty).
+// Admins manage admins, members and viewers; only owners manage owners.
+func canManageOrgRole(actor, current, next db.OrgRole) bool {
+	if !actor.AtLeast(db.OrgRoleAdmin) {
+		return false
+	}
+	if current == db.OrgRoleOwner || next == db.OrgRoleOwner {
+		return actor == db.OrgRoleOwner
+	}
+	return true
+}
+
+func normalizeInvitationEmail(raw string) (string, bool) {
+	raw = strings.TrimSpace(raw)
+	addr, err := mail.ParseAddress(raw)
+	if err != nil || addr.Address != raw {
+		return "", false
+	}
+	return raw, true
+}
+
+func (s *Server) getOrgHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	org, err := s.db.GetOrganization(c.Request.Context(), u.tenantID)
+	if err != nil {
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, orgResponse{
+		ID:   org.ID.String(),
+		Name: org.Name,
+		Role: string(u.role),
+	})
+}
+
+func (s *Server) listOrgMembersHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	members, err := s.db.ListOrgMembers(c.Request.Context(), u.tenantID)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	out := make([]orgMemberResponse, 0, len(members))
+	for _, member := range members {
+		out = append(out, orgMemberResponse{
+			UserID:    member.UserID.String(),
+			Email:     member.Email,
+			Role:      string(member.Role),
+			CreatedAt: member.CreatedAt,
+		})
+	}
+	c.JSON(http.StatusOK, listOrgMembersResponse{Members: out})
+}
+
+// setOrgMemberRoleHandler changes a member's role. Their API keys for the
+// organization's registries that the new role could not create are deleted.
+func (s *Server) setOrgMemberRoleHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	memberID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Member ID malformed"})
+		return
+	}
+
+	var req setOrgMemberRoleRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	role, ok := db.ParseOrgRole(req.Role)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be owner, admin, member, or viewer"})
+		return
+	}
+
+	member, err := s.db.GetOrgMember(c.Request.Context(), u.tenantID, memberID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	if !canManageOrgRole(u.role, member.Role, role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only owners can grant or revoke the owner role"})
+		return
+	}
+
+	if err := s.db.SetOrgMemberRole(c.Request.Context(), u.tenantID, memberID, role, registryTokensExpireAt(time.Now().UTC())); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		if errors.Is(err, db.ErrLastOwner) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, orgMemberResponse{
+		UserID:    member.UserID.String(),
+		Email:     member.Email,
+		Role:      string(role),
+		CreatedAt: member.CreatedAt,
+	})
+}
+
+// removeOrgMemberHandler removes a member, deleting their API keys for the
+// organization's registries. Members may always remove themselves.
+func (s *Server) removeOrgMemberHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	memberID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Member ID malformed"})
+		return
+	}
+
+	member, err := s.db.GetOrgMember(c.Request.Context(), u.tenantID, memberID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	if memberID != u.id && !canManageOrgRole(u.role, member.Role, "") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "not allowed to remove that member"})
+		return
+	}
+
+	err = s.db.RemoveOrgMember(c.Request.Context(), u.tenantID, memberID, registryTokensExpireAt(time.Now().UTC()))
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		if errors.Is(err, db.ErrLastOwner) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) listOrgInvitationsHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	invitations, err := s.db.ListPendingOrgInvitations(c.Request.Context(), u.tenantID)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	out := make([]orgInvitationResponse, 0, len(invitations))
+	for _, inv := range invitations {
+		out = append(out, orgInvitationResponseFrom(inv))
+	}
+	c.JSON(http.StatusOK, listOrgInvitationsResponse{Invitations: out})
+}
+
+// createOrgInvitationHandler records an invitation and has the identity
+// provider email it. The invitee joins with the invited role when they first
+// sign in with that address.
+func (s *Server) createOrgInvitationHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	var req createOrgInvitationRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	email, ok := normalizeInvitationEmail(req.Email)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email is invalid"})
+		return
+	}
+	role, ok := db.ParseOrgRole(req.Role)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be owner, admin, member, or viewer"})
+		return
+	}
+	if !canManageOrgRole(u.role, "", role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only owners can invite owners"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	org, err := s.db.GetOrganization(ctx, u.tenantID)
+	if err != nil {
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	inv, err := s.db.CreateOrgInvitation(ctx, db.CreateOrgInvitationArgs{
+		OrgID:     u.tenantID,
+		Email:     email,
+		Role:      role,
+		InvitedBy: u.id,
+		ExpiresAt: time.Now().UTC().AddDate(0, 0, orgInvitationTTLDays),
+	})
+	if err != nil {
+		if errors.Is(err, db.ErrConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": "invitation already pending"})
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	setAuditTarget(c, inv.ID.String())
+
+	externalID, err := s.identity.sendInvitation(ctx, identityInvitation{
+		email:         email,
+		orgName:       org.Name,
+		inviterSub:    u.sub,
+		expiresInDays: orgInvitationTTLDays,
+	})
+	if err != nil {
+		logError(err)
+		if _, err := s.db.DeleteOrgInvitation(context.WithoutCancel(ctx), u.tenantID, inv.ID); err != nil {
+			logError(err)
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": "could not send invitation"})
+		return
+	}
+	if externalID != "" {
+		if err := s.db.SetOrgInvitationWorkOSID(ctx, inv.ID, externalID); err != nil {
+			logError(err)
+		}
+	}
+
+	c.JSON(http.StatusCreated, orgInvitationResponseFrom(inv))
+}
+
+func (s *Server) removeOrgInvitationHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invitation ID malformed"})
+		return
+	}
+
+	inv, err := s.db.DeleteOrgInvitation(c.Request.Context(), u.tenantID, id)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	// The invitation no longer grants a role once its row is gone, so a
+	// failure to revoke the emailed invitation only leaves a dead link behind.
+	if inv.WorkOSInvitationID != nil {
+		if err := s.identity.revokeInvitation(c.Request.Context(), *inv.WorkOSInvitationID); err != nil {
+			slog.Warn("Could not revoke invitation", slog.String("invitation", *inv.WorkOSInvitationID), slog.String("err", err.Error()))
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func orgInvitationResponseFrom(inv db.OrgInvitation) orgInvitationResponse {
+	return orgInvitationResponse{
+		ID:        inv.ID.String(),
+		Email:     inv.Email,
+		Role:      string(inv.Role),
+		CreatedAt: inv.CreatedAt,
+		ExpiresAt: inv.ExpiresAt,
+	}
+}
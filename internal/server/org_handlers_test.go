@@ -0,0 +1,64 @@
+package server
+
+import (
+	"testing"
+
+	"bin2.io/internal/db"
+)
+
+func TestCanManageOrgRole(t *testing.T) {
+	tests := []struct {
+		actor, current, next db.OrgRole
+		want                 bool
+	}{
+		{actor: db.OrgRoleOwner, current: db.OrgRoleOwner, next: db.OrgRoleAdmin, want: true},
+		{actor: db.OrgRoleOwner, current: "", next: db.OrgRoleOwner, want: true},
+		{actor: db.OrgRoleAdmin, current: db.OrgRoleMember, next: db.OrgRoleAdmin, want: true},
+		{actor: db.OrgRoleAdmin, current: db.OrgRoleAdmin, next: db.OrgRoleViewer, want: true},
+		{actor: db.OrgRoleAdmin, current: "", next: db.OrgRoleMember, want: true},
+		{actor: db.OrgRoleAdmin, current: db.OrgRoleOwner, next: db.OrgRoleAdmin, want: false},
+		{actor: db.OrgRoleAdmin, current: db.OrgRoleMember, next: db.OrgRoleOwner, want: false},
+		{actor: db.OrgRoleAdmin, current: "", next: db.OrgRoleOwner, want: false},
+		{actor: db.OrgRoleMember, current: db.OrgRoleViewer, next: db.OrgRoleMember, want: false},
+		{actor: db.OrgRoleViewer, current: "", next: db.OrgRoleViewer, want: false},
+	}
+
+	for _, tt := range tests {
+		if got := canManageOrgRole(tt.actor, tt.current, tt.next); got != tt.want {
+			t.Fatalf("canManageOrgRole(%q, %q, %q) = %v, want %v", tt.actor, tt.current, tt.next, got, tt.want)
+		}
+	}
+}
+
+func TestOrgRoleGrantsAPIKeyPermission(t *testing.T) {
+	tests := []struct {
+		role       db.OrgRole
+		permission db.APIKeyPermission
+		want       bool
+	}{
+		{role: db.OrgRoleViewer, permission: db.APIKeyPermissionRead, want: true},
+		{role: db.OrgRoleViewer, permission: db.APIKeyPermissionWrite, want: false},
+		{role: db.OrgRoleMember, permission: db.APIKeyPermissionWrite, want: true},
+		{role: db.OrgRoleMember, permission: db.APIKeyPermissionAdmin, want: false},
+		{role: db.OrgRoleAdmin, permission: db.APIKeyPermissionAdmin, want: true},
+		{role: db.OrgRoleOwner, permission: db.APIKeyPermissionAdmin, want: true},
+		{role: "", permission: db.APIKeyPermissionRead, want: false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.role.GrantsAPIKeyPermission(tt.permission); got != tt.want {
+			t.Fatalf("%q.GrantsAPIKeyPermission(%q) = %v, want %v", tt.role, tt.permission, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeInvitationEmail(t *testing.T) {
+	if got, ok := normalizeInvitationEmail("  dev@example.com "); !ok || got != "dev@example.com" {
+		t.Fatalf("normalizeInvitationEmail = %q, %v", got, ok)
+	}
+	for _, invalid := range []string{"", "not-an-email", "Dev <dev@example.com>"} {
+		if _, ok := normalizeInvitationEmail(invalid); ok {
+			t.Fatalf("normalizeInvitationEmail(%q) unexpectedly succeeded", invalid)
+		}
+	}
+}
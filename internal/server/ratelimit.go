@@ -0,0 +1,451 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// rateLimitRefreshInterval bounds how stale cached policies and tenant
+	// plans can get, and how often idle buckets are dropped.
+	rateLimitRefreshInterval = time.Minute
+	rateLimitPlanTTL         = time.Minute
+)
+
+// rateLimitClass groups requests that share a budget.
+type rateLimitClass string
+
+const (
+	rateLimitClassToken      rateLimitClass = "token"
+	rateLimitClassRegistry   rateLimitClass = "registry"
+	rateLimitClassManagement rateLimitClass = "management"
+)
+
+// rateLimitSubject is what a budget is counted against.
+type rateLimitSubject string
+
+const (
+	rateLimitSubjectIP     rateLimitSubject = "ip"
+	rateLimitSubjectAPIKey rateLimitSubject = "api_key"
+	rateLimitSubjectTenant rateLimitSubject = "tenant"
+)
+
+// rateLimitSubjects is checked in this order, so a client address already
+// over its budget does not spend its key's or tenant's.
+var rateLimitSubjects = []rateLimitSubject{rateLimitSubjectIP, rateLimitSubjectAPIKey, rateLimitSubjectTenant}
+
+// rateLimit is a token bucket refilling perMinute requests a minute and
+// holding at most burst.
+type rateLimit struct {
+	perMinute int
+	burst     int
+}
+
+// interval is the time one request takes to refill.
+func (l rateLimit) interval() time.Duration {
+	return time.Minute / time.Duration(l.perMinute)
+}
+
+// tolerance is how far ahead of now a bucket's arrival time may run while
+// still admitting a request: a full bucket admits burst requests at once.
+func (l rateLimit) tolerance() time.Duration {
+	return l.interval() * time.Duration(l.burst-1)
+}
+
+// defaultRateLimits apply when neither the tenant's plan nor the default plan
+// has a rate_limit_policies row. Registry operations are not limited by
+// client address, since whole CI fleets often share one NAT address.
+var defaultRateLimits = map[rateLimitClass]map[rateLimitSubject]rateLimit{
+	rateLimitClassToken: {
+		rateLimitSubjectIP:     {perMinute: 120, burst: 60},
+		rateLimitSubjectAPIKey: {perMinute: 60, burst: 30},
+		rateLimitSubjectTenant: {perMinute: 600, burst: 200},
+	},
+	rateLimitClassRegistry: {
+		rateLimitSubjectAPIKey: {perMinute: 3000, burst: 1000},
+		rateLimitSubjectTenant: {perMinute: 12000, burst: 3000},
+	},
+	rateLimitClassManagement: {
+		rateLimitSubjectIP:     {perMinute: 600, burst: 120},
+		rateLimitSubjectAPIKey: {perMinute: 300, burst: 100},
+		rateLimitSubjectTenant: {perMinute: 1200, burst: 300},
+	},
+}
+
+// gcra applies the generic cell rate algorithm, the token bucket expressed
+// as a single theoretical arrival time per bucket. It returns the bucket's
+// new arrival time and whether a request at now is admitted.
+func gcra(tat, now time.Time, interval, tolerance time.Duration) (time.Time, bool) {
+	if tat.Before(now) {
+		tat = now
+	}
+	if tat.Sub(now) > tolerance {
+		return tat, false
+	}
+	return tat.Add(interval), true
+}
+
+// rateLimitRetryAfter is how long a denied request must wait before its
+// bucket admits one again.
+func rateLimitRetryAfter(tat, now time.Time, tolerance time.Duration) time.Duration {
+	return max(tat.Add(-tolerance).Sub(now), 0)
+}
+
+// rateLimitStore holds bucket state. The postgres store shares it across
+// replicas; the memory store is per process.
+type rateLimitStore interface {
+	take(ctx context.Context, key string, now time.Time, interval, tolerance time.Duration) (tat time.Time, allowed bool, err error)
+	// purge drops buckets that have fully refilled by before.
+	purge(ctx context.Context, before time.Time) error
+}
+
+type postgresRateLimitStore struct {
+	db *db.DB
+}
+
+func (p postgresRateLimitStore) take(ctx context.Context, key string, now time.Time, interval, tolerance time.Duration) (time.Time, bool, error) {
+	return p.db.TakeRateLimit(ctx, key, now, interval, tolerance)
+}
+
+func (p postgresRateLimitStore) purge(ctx context.Context, before time.Time) error {
+	_, err := p.db.DeleteIdleRateLimitBuckets(ctx, before)
+	return err
+}
+
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]time.Time{}}
+}
+
+func (m *memoryRateLimitStore) take(_ context.Context, key string, now time.Time, interval, tolerance time.Duration) (time.Time, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tat, allowed := gcra(m.buckets[key], now, interval, tolerance)
+	m.buckets[key] = tat
+	return tat, allowed, nil
+}
+
+func (m *memoryRateLimitStore) purge(_ context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, tat := range m.buckets {
+		if tat.Before(before) {
+			delete(m.buckets, key)
+		}
+	}
+	return nil
+}
+
+type rateLimitPolicyKey struct {
+	plan    string
+	class   rateLimitClass
+	subject rateLimitSubject
+}
+
+type cachedTenantPlan struct {
+	plan      string
+	expiresAt time.Time
+}
+
+// rateLimiter enforces per-plan limits for client addresses, API keys and
+// tenants. A nil limiter admits everything. It fails open: a request is
+// never refused because the store is unavailable.
+type rateLimiter struct {
+	store rateLimitStore
+	// classStores overrides store for some classes.
+	classStores map[rateLimitClass]rateLimitStore
+	// db supplies policies and tenant plans; nil means built-in limits only.
+	db  *db.DB
+	now func() time.Time
+
+	mu       sync.RWMutex
+	policies map[rateLimitPolicyKey]rateLimit
+	plans    map[uuid.UUID]cachedTenantPlan
+}
+
+func newRateLimiter(store rateLimitStore, conn *db.DB) *rateLimiter {
+	return &rateLimiter{
+		store:       store,
+		classStores: map[rateLimitClass]rateLimitStore{},
+		db:          conn,
+		now:         time.Now,
+		policies:    map[rateLimitPolicyKey]rateLimit{},
+		plans:       map[uuid.UUID]cachedTenantPlan{},
+	}
+}
+
+// newRateLimiterFromEnv selects the bucket store named by RATE_LIMIT_STORE:
+// postgres (the default), memory, or off to disable rate limiting.
+// RATE_LIMIT_REGISTRY_STORE selects the store for /v2 registry requests
+// separately and defaults to memory: every pull and HEAD is counted, and a
+// shared store would put a write to the same per-tenant row on each of them.
+// Each replica then admits the registry limits on its own, so they bound a
+// client's rate per replica rather than overall.
+func newRateLimiterFromEnv(ctx context.Context, conn *db.DB) (*rateLimiter, error) {
+	name := strings.ToLower(getenvDefault("RATE_LIMIT_STORE", "postgres"))
+	if name == "off" {
+		return nil, nil
+	}
+	store, err := rateLimitStoreFromName("RATE_LIMIT_STORE", name, conn)
+	if err != nil {
+		return nil, err
+	}
+	l := newRateLimiter(store, conn)
+
+	name = strings.ToLower(getenvDefault("RATE_LIMIT_REGISTRY_STORE", "memory"))
+	if l.classStores[rateLimitClassRegistry], err = rateLimitStoreFromName("RATE_LIMIT_REGISTRY_STORE", name, conn); err != nil {
+		return nil, err
+	}
+	if err := l.reloadPolicies(ctx); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func rateLimitStoreFromName(env, name string, conn *db.DB) (rateLimitStore, error) {
+	switch name {
+	case "postgres":
+		return postgresRateLimitStore{db: conn}, nil
+	case "memory":
+		return newMemoryRateLimitStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown %s %q", env, name)
+	}
+}
+
+// storeFor returns the store holding the buckets of class.
+func (l *rateLimiter) storeFor(class rateLimitClass) rateLimitStore {
+	if store, ok := l.classStores[class]; ok {
+		return store
+	}
+	return l.store
+}
+
+func (l *rateLimiter) reloadPolicies(ctx context.Context) error {
+	if l.db == nil {
+		return nil
+	}
+	rows, err := l.db.ListRateLimitPolicies(ctx)
+	if err != nil {
+		return err
+	}
+	policies := make(map[rateLimitPolicyKey]rateLimit, len(rows))
+	for _, row := range rows {
+		key := rateLimitPolicyKey{plan: row.Plan, class: rateLimitClass(row.Class), subject: rateLimitSubject(row.Subject)}
+		policies[key] = rateLimit{perMinute: row.PerMinute, burst: row.Burst}
+	}
+
+	l.mu.Lock()
+	l.policies = policies
+	l.mu.Unlock()
+	return nil
+}
+
+// run refreshes policies and drops idle buckets until ctx is cancelled.
+func (l *rateLimiter) run(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := l.reloadPolicies(ctx); err != nil {
+			logError(err)
+		}
+		if err := l.store.purge(ctx, l.now()); err != nil {
+			logError(err)
+		}
+		for _, store := range l.classStores {
+			if err := store.purge(ctx, l.now()); err != nil {
+				logError(err)
+			}
+		}
+		l.mu.Lock()
+		now := l.now()
+		for tenantID, cached := range l.plans {
+			if now.After(cached.expiresAt) {
+				delete(l.plans, tenantID)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// limit returns the limit for class and subject on plan, falling back to the
+// default plan and then to defaultRateLimits.
+func (l *rateLimiter) limit(plan string, class rateLimitClass, subject rateLimitSubject) (rateLimit, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if limit, ok := l.policies[rateLimitPolicyKey{plan: plan, class: class, subject: subject}]; ok {
+		return limit, true
+	}
+	if limit, ok := l.policies[rateLimitPolicyKey{plan: db.DefaultPlan, class: class, subject: subject}]; ok {
+		return limit, true
+	}
+	limit, ok := defaultRateLimits[class][subject]
+	return limit, ok
+}
+
+func (l *rateLimiter) tenantPlan(ctx context.Context, tenantID uuid.UUID) string {
+	if l.db == nil || tenantID == uuid.Nil {
+		return db.DefaultPlan
+	}
+	now := l.now()
+	l.mu.RLock()
+	cached, ok := l.plans[tenantID]
+	l.mu.RUnlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached.plan
+	}
+
+	plan, err := l.db.GetTenantPlan(ctx, tenantID)
+	if err != nil {
+		if !errors.Is(err, db.ErrNotFound) {
+			logError(err)
+		}
+		plan = db.DefaultPlan
+	}
+	l.mu.Lock()
+	l.plans[tenantID] = cachedTenantPlan{plan: plan, expiresAt: now.Add(rateLimitPlanTTL)}
+	l.mu.Unlock()
+	return plan
+}
+
+// rateLimitRequest identifies who a request is counted against; zero fields
+// are not limited.
+type rateLimitRequest struct {
+	addr     netip.Addr
+	apiKeyID uuid.UUID
+	tenantID uuid.UUID
+}
+
+func (r rateLimitRequest) subjectKey(subject rateLimitSubject) string {
+	switch subject {
+	case rateLimitSubjectIP:
+		if r.addr.IsValid() {
+			return r.addr.String()
+		}
+	case rateLimitSubjectAPIKey:
+		if r.apiKeyID != uuid.Nil {
+			return r.apiKeyID.String()
+		}
+	case rateLimitSubjectTenant:
+		if r.tenantID != uuid.Nil {
+			return r.tenantID.String()
+		}
+	}
+	return ""
+}
+
+// allow spends one request of class from every subject of req, stopping at
+// the first that is exhausted, and returns how long the caller should wait
+// when it is refused.
+func (l *rateLimiter) allow(ctx context.Context, class rateLimitClass, req rateLimitRequest) (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+	plan := db.DefaultPlan
+	if req.tenantID != uuid.Nil {
+		plan = l.tenantPlan(ctx, req.tenantID)
+	}
+	store := l.storeFor(class)
+	for _, subject := range rateLimitSubjects {
+		value := req.subjectKey(subject)
+		if value == "" {
+			continue
+		}
+		limitPlan := plan
+		if subject == rateLimitSubjectIP {
+			// Client addresses are not tied to a tenant.
+			limitPlan = db.DefaultPlan
+		}
+		limit, ok := l.limit(limitPlan, class, subject)
+		if !ok {
+			continue
+		}
+
+		now := l.now()
+		key := string(class) + ":" + string(subject) + ":" + value
+		tat, allowed, err := store.take(ctx, key, now, limit.interval(), limit.tolerance())
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				slog.Warn("Rate limit store unavailable", slog.String("err", err.Error()))
+			}
+			return 0, true
+		}
+		if !allowed {
+			return rateLimitRetryAfter(tat, now, limit.tolerance()), false
+		}
+	}
+	return 0, true
+}
+
+// setRetryAfter sets Retry-After in whole seconds, rounding up.
+func setRetryAfter(c *gin.Context, retryAfter time.Duration) {
+	seconds := max(int64(math.Ceil(retryAfter.Seconds())), 1)
+	c.Header("Retry-After", strconv.FormatInt(seconds, 10))
+}
+
+// registryRateLimited spends one request of class for req and, when it is
+// refused, writes the OCI TOOMANYREQUESTS error and aborts.
+func (s *Server) registryRateLimited(c *gin.Context, class rateLimitClass, req rateLimitRequest) bool {
+	retryAfter, ok := s.rateLimiter.allow(c.Request.Context(), class, req)
+	if ok {
+		return false
+	}
+	setRetryAfter(c, retryAfter)
+	writeOCIError(c, http.StatusTooManyRequests, "TOOMANYREQUESTS", "rate limit exceeded")
+	c.Abort()
+	return true
+}
+
+// managementRateLimited is registryRateLimited for the management API.
+func (s *Server) managementRateLimited(c *gin.Context, req rateLimitRequest) bool {
+	retryAfter, ok := s.rateLimiter.allow(c.Request.Context(), rateLimitClassManagement, req)
+	if ok {
+		return false
+	}
+	setRetryAfter(c, retryAfter)
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+	return true
+}
+
+// registryRateLimitMiddleware limits token requests by client address, the
+// token handlers limiting them further by key and tenant once authenticated,
+// and every other registry request by the key and tenant its token was
+// issued for. It must run after registryBearerAuthMiddleware.
+func (s *Server) registryRateLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if isRegistryTokenPath(strings.TrimPrefix(c.Param("path"), "/")) {
+			if s.registryRateLimited(c, rateLimitClassToken, rateLimitRequest{addr: registryClientAddr(c)}) {
+				return
+			}
+			c.Next()
+			return
+		}
+		auth, err := s.getRegistryAuth(c)
+		if err == nil && s.registryRateLimited(c, rateLimitClassRegistry, rateLimitRequest{apiKeyID: auth.apiKeyID, tenantID: auth.tenantID}) {
+			return
+		}
+		c.Next()
+	}
+}
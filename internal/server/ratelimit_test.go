@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func TestGCRA(t *testing.T) {
+	limit := rateLimit{perMinute: 60, burst: 3}
+	now := time.Unix(1_700_000_000, 0)
+
+	var tat time.Time
+	for i := range 3 {
+		var allowed bool
+		tat, allowed = gcra(tat, now, limit.interval(), limit.tolerance())
+		if !allowed {
+			t.Fatalf("request %d denied within burst", i)
+		}
+	}
+	denied, allowed := gcra(tat, now, limit.interval(), limit.tolerance())
+	if allowed {
+		t.Fatal("request beyond burst allowed")
+	}
+	if !denied.Equal(tat) {
+		t.Fatalf("denied request moved tat to %v, want %v", denied, tat)
+	}
+	if got := rateLimitRetryAfter(tat, now, limit.tolerance()); got != time.Second {
+		t.Fatalf("retry after = %v, want 1s", got)
+	}
+
+	if _, allowed := gcra(tat, now.Add(time.Second), limit.interval(), limit.tolerance()); !allowed {
+		t.Fatal("request denied after one interval")
+	}
+	tat, allowed = gcra(tat, now.Add(time.Hour), limit.interval(), limit.tolerance())
+	if !allowed || !tat.Equal(now.Add(time.Hour+time.Second)) {
+		t.Fatalf("idle bucket: tat = %v, allowed = %v", tat, allowed)
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	l := newRateLimiter(newMemoryRateLimitStore(), nil)
+	l.now = func() time.Time { return now }
+	l.policies[rateLimitPolicyKey{plan: "default", class: rateLimitClassToken, subject: rateLimitSubjectAPIKey}] = rateLimit{perMinute: 60, burst: 2}
+
+	keyA := rateLimitRequest{apiKeyID: uuid.New()}
+	keyB := rateLimitRequest{apiKeyID: uuid.New()}
+	for i := range 2 {
+		if _, ok := l.allow(context.Background(), rateLimitClassToken, keyA); !ok {
+			t.Fatalf("request %d denied within burst", i)
+		}
+	}
+	retryAfter, ok := l.allow(context.Background(), rateLimitClassToken, keyA)
+	if ok {
+		t.Fatal("request beyond burst allowed")
+	}
+	if retryAfter != time.Second {
+		t.Fatalf("retry after = %v, want 1s", retryAfter)
+	}
+	if _, ok := l.allow(context.Background(), rateLimitClassToken, keyB); !ok {
+		t.Fatal("other key denied")
+	}
+	if _, ok := l.allow(context.Background(), rateLimitClassRegistry, keyA); !ok {
+		t.Fatal("other class denied")
+	}
+
+	now = now.Add(time.Second)
+	if _, ok := l.allow(context.Background(), rateLimitClassToken, keyA); !ok {
+		t.Fatal("request denied after refill")
+	}
+
+	var nilLimiter *rateLimiter
+	if _, ok := nilLimiter.allow(context.Background(), rateLimitClassToken, keyA); !ok {
+		t.Fatal("nil limiter denied request")
+	}
+}
+
+func TestRateLimiterSkipsUnlimitedSubjects(t *testing.T) {
+	l := newRateLimiter(newMemoryRateLimitStore(), nil)
+	req := rateLimitRequest{addr: netip.MustParseAddr("192.0.2.1")}
+	for i := range 10_000 {
+		if _, ok := l.allow(context.Background(), rateLimitClassRegistry, req); !ok {
+			t.Fatalf("registry request %d limited by client address", i)
+		}
+	}
+}
+
+func TestNewRateLimiterFromEnvKeepsRegistryInMemory(t *testing.T) {
+	t.Setenv("RATE_LIMIT_STORE", "postgres")
+	t.Setenv("RATE_LIMIT_REGISTRY_STORE", "")
+	l, err := newRateLimiterFromEnv(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("newRateLimiterFromEnv: %v", err)
+	}
+	if _, ok := l.storeFor(rateLimitClassRegistry).(*memoryRateLimitStore); !ok {
+		t.Fatalf("registry store = %T, want memory", l.storeFor(rateLimitClassRegistry))
+	}
+	for _, class := range []rateLimitClass{rateLimitClassToken, rateLimitClassManagement} {
+		if _, ok := l.storeFor(class).(postgresRateLimitStore); !ok {
+			t.Fatalf("%s store = %T, want postgres", class, l.storeFor(class))
+		}
+	}
+
+	t.Setenv("RATE_LIMIT_REGISTRY_STORE", "postgres")
+	if l, err = newRateLimiterFromEnv(context.Background(), nil); err != nil {
+		t.Fatalf("newRateLimiterFromEnv: %v", err)
+	}
+	if _, ok := l.storeFor(rateLimitClassRegistry).(postgresRateLimitStore); !ok {
+		t.Fatalf("registry store = %T, want postgres", l.storeFor(rateLimitClassRegistry))
+	}
+
+	t.Setenv("RATE_LIMIT_REGISTRY_STORE", "redis")
+	if _, err := newRateLimiterFromEnv(context.Background(), nil); err == nil {
+		t.Fatal("unknown RATE_LIMIT_REGISTRY_STORE accepted")
+	}
+}
+
+func TestRegistryTokenRateLimitedByClientAddr(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newRegistryV2RootTestServer(t)
+	s.rateLimiter = newRateLimiter(newMemoryRateLimitStore(), nil)
+	s.rateLimiter.policies[rateLimitPolicyKey{plan: "default", class: rateLimitClassToken, subject: rateLimitSubjectIP}] = rateLimit{perMinute: 1, burst: 1}
+
+	do := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://registry.test/v2/token", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		res := httptest.NewRecorder()
+		s.router.ServeHTTP(res, req)
+		return res
+	}
+
+	if res := do(); res.Code != http.StatusUnauthorized {
+		t.Fatalf("first status = %d, want %d", res.Code, http.StatusUnauthorized)
+	}
+	res := do()
+	if res.Code != http.StatusTooManyRequests {
+		t.Fatalf("second status = %d, want %d", res.Code, http.StatusTooManyRequests)
+	}
+	if got := res.Header().Get("Retry-After"); got != "60" {
+		t.Fatalf("Retry-After = %q, want 60", got)
+	}
+	if body := res.Body.String(); !strings.Contains(body, `"code":"TOOMANYREQUESTS"`) {
+		t.Fatalf("body = %s", body)
+	}
+}
@@ -24,9 +24,14 @@ type addRegistryRequest struct {
 }
 
 type registryResponse struct {
-	ID        string `json:"id"`
-	Name      string `json:"name"`
-	SizeBytes int64  `json:"sizeBytes"`
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	SizeBytes    int64    `json:"sizeBytes"`
+	AllowedCIDRs []string `json:"allowedCidrs"`
+}
+
+type setAllowedCIDRsRequest struct {
+	AllowedCIDRs []string `json:"allowedCidrs"`
 }
 
 type addRegistryResponse struct {
@@ -79,10 +84,14 @@ func (s *Server) listRegistriesHandler(c *gin.Context) {
 		Registries: make([]registryResponse, 0, len(registries)),
 	}
 	for _, registry := range registries {
+		if !u.managesRegistry(registry.ID) {
+			continue
+		}
 		resp.Registries = append(resp.Registries, registryResponse{
-			ID:        registry.ID.String(),
-			Name:      registry.Name,
-			SizeBytes: registry.CachedSizeBytes,
+			ID:           registry.ID.String(),
+			Name:         registry.Name,
+			SizeBytes:    registry.CachedSizeBytes,
+			AllowedCIDRs: registry.AllowedCIDRs,
 		})
 	}
 	c.JSON(http.StatusOK, resp)
@@ -116,7 +125,7 @@ func (s *Server) getRegistryByIDHandler(c *gin.Context) {
 		return
 	}
 
-	if registry.TenantID != u.tenantID {
+	if registry.TenantID != u.tenantID || !u.managesRegistry(registry.ID) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "registry not found"})
 		return
 	}
@@ -136,9 +145,10 @@ func (s *Server) getRegistryByIDHandler(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, registryResponse{
-		ID:        registry.ID.String(),
-		Name:      registry.Name,
-		SizeBytes: sizeBytes,
+		ID:           registry.ID.String(),
+		Name:         registry.Name,
+		SizeBytes:    sizeBytes,
+		AllowedCIDRs: registry.AllowedCIDRs,
 	})
 }
 
@@ -174,7 +184,7 @@ func (s *Server) listRepositoriesHandler(c *gin.Context) {
 		return
 	}
 
-	if registry.TenantID != u.tenantID {
+	if registry.TenantID != u.tenantID || !u.managesRegistry(registry.ID) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "registry not found"})
 		return
 	}
@@ -242,7 +252,7 @@ func (s *Server) removeRepositoryHandler(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not get registry"})
 		return
 	}
-	if registry.TenantID != u.tenantID {
+	if registry.TenantID != u.tenantID || !u.managesRegistry(registry.ID) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "registry not found"})
 		return
 	}
@@ -322,6 +332,7 @@ func (s *Server) addRegistryHandler(c *gin.Context) {
 		KeyName:         fmt.Sprintf("default-%s-%s", req.Name, prefix),
 		SecretEncrypted: encrypted,
 		Prefix:          prefix,
+		AllowedCIDRs:    u.apiKeyCIDRs,
 	})
 	if err != nil {
 		if errors.Is(err, db.ErrConflict) {
@@ -334,13 +345,14 @@ func (s *Server) addRegistryHandler(c *gin.Context) {
 	}
 
 	if !u.onboarded {
-		if err := s.db.SetUserOnboarded(c.Request.Context(), u.id, true); err != nil {
+		if err := s.db.SetOrgOnboarded(c.Request.Context(), u.tenantID, true); err != nil {
 			logError(err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create registry"})
 			return
 		}
 	}
 
+	setAuditRegistry(c, result.Registry)
 	c.JSON(http.StatusCreated, addRegistryResponse{
 		ID:        result.Registry.ID.String(),
 		Name:      result.Registry.Name,
@@ -363,6 +375,11 @@ func (s *Server) removeRegistryHandler(c *gin.Context) {
 		return
 	}
 
+	if !u.managesRegistry(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "registry not found"})
+		return
+	}
+
 	if err := s.db.DeleteRegistryByIDAndOrg(c.Request.Context(), id, u.tenantID); err != nil {
 		if errors.Is(err, db.ErrNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "registry not found"})
@@ -378,3 +395,52 @@ func (s *Server) removeRegistryHandler(c *gin.Context) {
 
 	c.Status(http.StatusNoContent)
 }
+
+// setRegistryAllowedCIDRsHandler replaces the registry's client address
+// allowlist. An empty list lifts the restriction. Tokens already issued keep
+// the allowlist they were minted with until they expire.
+func (s *Server) setRegistryAllowedCIDRsHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	idParam := strings.TrimSpace(c.Param("id"))
+	id, err := uuid.Parse(idParam)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid registry id"})
+		return
+	}
+
+	var req setAllowedCIDRsRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	cidrs, err := normalizeCIDRAllowlist(req.AllowedCIDRs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !u.managesRegistry(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "registry not found"})
+		return
+	}
+
+	if err := s.db.SetRegistryAllowedCIDRs(c.Request.Context(), id, u.tenantID, cidrs); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "registry not found"})
+			return
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not update registry"})
+		return
+	}
+
+	c.JSON(http.StatusOK, setAllowedCIDRsRequest{AllowedCIDRs: cidrs})
+}
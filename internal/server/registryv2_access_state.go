@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/gin-gonic/gin"
+)
+
+// registryAccessStateTTL bounds how long a state change takes to reach
+// tokens that were already issued.
+const registryAccessStateTTL = 15 * time.Second
+
+type cachedRegistryAccessState struct {
+	state     db.RegistryAccessState
+	expiresAt time.Time
+}
+
+// registryAccessStates caches registry access states by namespace.
+type registryAccessStates struct {
+	mu      sync.Mutex
+	entries map[string]cachedRegistryAccessState
+}
+
+func newRegistryAccessStates() *registryAccessStates {
+	return &registryAccessStates{entries: map[string]cachedRegistryAccessState{}}
+}
+
+// registryAccessState returns the state in force for namespace. Registries
+// that cannot be looked up are treated as active; requests for unknown
+// registries fail later on their own.
+func (s *Server) registryAccessState(ctx context.Context, namespace string) db.RegistryAccessState {
+	active := db.RegistryAccessState{State: db.AccessStateActive}
+	if s.registryStates == nil {
+		return active
+	}
+
+	now := time.Now()
+	s.registryStates.mu.Lock()
+	cached, ok := s.registryStates.entries[namespace]
+	s.registryStates.mu.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached.state
+	}
+	if s.db == nil {
+		return active
+	}
+
+	state, err := s.db.GetRegistryAccessState(ctx, namespace)
+	if err != nil {
+		if !errors.Is(err, db.ErrNotFound) && !errors.Is(err, context.Canceled) {
+			logError(err)
+		}
+		return active
+	}
+
+	s.registryStates.mu.Lock()
+	for key, entry := range s.registryStates.entries {
+		if now.After(entry.expiresAt) {
+			delete(s.registryStates.entries, key)
+		}
+	}
+	s.registryStates.entries[namespace] = cachedRegistryAccessState{state: state, expiresAt: now.Add(registryAccessStateTTL)}
+	s.registryStates.mu.Unlock()
+	return state
+}
+
+// registryAccessStateMessage explains why a registry refused a request.
+func registryAccessStateMessage(state db.RegistryAccessState) string {
+	msg := "registry is suspended"
+	if state.State == db.AccessStateReadOnly {
+		msg = "registry is read-only"
+	}
+	if state.Reason != "" {
+		msg += ": " + state.Reason
+	}
+	return msg
+}
+
+// registryAccessStateAllows reports whether a registry in state accepts a
+// request with method: read-only registries serve only pulls.
+func registryAccessStateAllows(state db.AccessState, method string) bool {
+	switch state {
+	case db.AccessStateSuspended:
+		return false
+	case db.AccessStateReadOnly:
+		return method == http.MethodGet || method == http.MethodHead
+	default:
+		return true
+	}
+}
+
+// readOnlyTokenScopes drops every action but pull from requested scopes, so
+// tokens for read-only registries cannot push or delete.
+func readOnlyTokenScopes(requested []registryTokenAccess) []registryTokenAccess {
+	out := make([]registryTokenAccess, 0, len(requested))
+	for _, scope := range requested {
+		for _, action := range scope.Actions {
+			if action == "pull" || action == "*" {
+				out = append(out, registryTokenAccess{Type: scope.Type, Name: scope.Name, Actions: []string{"pull"}})
+				break
+			}
+		}
+	}
+	return out
+}
+
+// registryTokenAccessState applies the registry's state to a token request,
+// writing DENIED and returning false for suspended registries and narrowing
+// the requested scopes of read-only ones.
+func (s *Server) registryTokenAccessState(c *gin.Context, auth registryAuthContext, requested []registryTokenAccess) ([]registryTokenAccess, bool) {
+	state := s.registryAccessState(c.Request.Context(), auth.namespace)
+	switch state.State {
+	case db.AccessStateSuspended:
+		writeOCIError(c, http.StatusForbidden, "DENIED", registryAccessStateMessage(state))
+		return nil, false
+	case db.AccessStateReadOnly:
+		return readOnlyTokenScopes(requested), true
+	default:
+		return requested, true
+	}
+}
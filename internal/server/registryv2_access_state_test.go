@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/gin-gonic/gin"
+)
+
+func TestAccessStateRestrict(t *testing.T) {
+	tests := []struct {
+		a, b, want db.AccessState
+	}{
+		{a: db.AccessStateActive, b: db.AccessStateActive, want: db.AccessStateActive},
+		{a: db.AccessStateActive, b: db.AccessStateReadOnly, want: db.AccessStateReadOnly},
+		{a: db.AccessStateSuspended, b: db.AccessStateReadOnly, want: db.AccessStateSuspended},
+		{a: db.AccessStateReadOnly, b: db.AccessStateSuspended, want: db.AccessStateSuspended},
+	}
+	for _, tt := range tests {
+		if got := tt.a.Restrict(tt.b); got != tt.want {
+			t.Fatalf("%s.Restrict(%s) = %s, want %s", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestReadOnlyTokenScopes(t *testing.T) {
+	got := readOnlyTokenScopes([]registryTokenAccess{
+		{Type: "repository", Name: "alpha/app", Actions: []string{"pull", "push"}},
+		{Type: "repository", Name: "alpha/push-only", Actions: []string{"push"}},
+		{Type: "repository", Name: "alpha/all", Actions: []string{"*"}},
+	})
+	want := []registryTokenAccess{
+		{Type: "repository", Name: "alpha/app", Actions: []string{"pull"}},
+		{Type: "repository", Name: "alpha/all", Actions: []string{"pull"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("readOnlyTokenScopes = %#v, want %#v", got, want)
+	}
+}
+
+func TestRegistryBearerAuthEnforcesAccessState(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newRegistryV2RootTestServer(t)
+	s.registryStates = newRegistryAccessStates()
+	token, _, _, err := s.issueRegistryToken(registryAuthContext{namespace: "alpha"}, "registry.test", nil)
+	if err != nil {
+		t.Fatalf("issueRegistryToken: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		state      db.RegistryAccessState
+		method     string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "active", state: db.RegistryAccessState{State: db.AccessStateActive}, method: http.MethodGet, wantStatus: http.StatusOK},
+		{name: "read-only pull", state: db.RegistryAccessState{State: db.AccessStateReadOnly}, method: http.MethodGet, wantStatus: http.StatusOK},
+		{name: "read-only write", state: db.RegistryAccessState{State: db.AccessStateReadOnly, Reason: "storage migration"}, method: http.MethodDelete, wantStatus: http.StatusForbidden, wantBody: "registry is read-only: storage migration"},
+		{name: "suspended", state: db.RegistryAccessState{State: db.AccessStateSuspended}, method: http.MethodGet, wantStatus: http.StatusForbidden, wantBody: "registry is suspended"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.registryStates.entries["alpha"] = cachedRegistryAccessState{state: tt.state, expiresAt: time.Now().Add(time.Minute)}
+
+			req := httptest.NewRequest(tt.method, "http://registry.test/v2/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			res := httptest.NewRecorder()
+			s.router.ServeHTTP(res, req)
+
+			if res.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", res.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && !strings.Contains(res.Body.String(), tt.wantBody) {
+				t.Fatalf("body = %s, want %q", res.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestIntrospectRegistryTokenInactiveWhileSuspended(t *testing.T) {
+	s := &Server{
+		registryJWTKeys: newTestRegistryJWTKeyring(t),
+		registryStates:  newRegistryAccessStates(),
+	}
+	token, _, _, err := s.issueRegistryToken(registryAuthContext{namespace: "alpha"}, "registry.test", nil)
+	if err != nil {
+		t.Fatalf("issueRegistryToken: %v", err)
+	}
+
+	tests := []struct {
+		state db.AccessState
+		want  bool
+	}{
+		{state: db.AccessStateActive, want: true},
+		{state: db.AccessStateReadOnly, want: true},
+		{state: db.AccessStateSuspended, want: false},
+	}
+	for _, tt := range tests {
+		s.registryStates.entries["alpha"] = cachedRegistryAccessState{state: db.RegistryAccessState{State: tt.state}, expiresAt: time.Now().Add(time.Minute)}
+		resp := s.introspectRegistryToken(context.Background(), token, "registry.test")
+		if resp.Active != tt.want {
+			t.Fatalf("%s: active = %v, want %v", tt.state, resp.Active, tt.want)
+		}
+		if !tt.want && resp.Subject != "" {
+			t.Fatalf("%s: inactive response discloses subject %q", tt.state, resp.Subject)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -16,8 +17,13 @@ type registryAuthContext struct {
 	userID     uuid.UUID
 	namespace  string
 	registryID uuid.UUID
+	tenantID   uuid.UUID
 	apiKeyID   uuid.UUID
 	apiScopes  []db.APIKeyScope
+	// keyCIDRs and registryCIDRs are the client address allowlists of the
+	// API key and its registry; empty means unrestricted.
+	keyCIDRs      []string
+	registryCIDRs []string
 }
 
 type registryScopeRequirement struct {
@@ -71,6 +77,19 @@ func (s *Server) registryBearerAuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		addr := registryClientAddr(c)
+		if !cidrAllowlistAllows(claims.KeyCIDRs, addr) || !cidrAllowlistAllows(claims.RegistryCIDRs, addr) {
+			writeOCIError(c, http.StatusForbidden, "DENIED", "client address not allowed")
+			c.Abort()
+			return
+		}
+
+		if state := s.registryAccessState(c.Request.Context(), namespace); !registryAccessStateAllows(state.State, c.Request.Method) {
+			writeOCIError(c, http.StatusForbidden, "DENIED", registryAccessStateMessage(state))
+			c.Abort()
+			return
+		}
+
 		if reqScope.repository != "" {
 			if !registryTokenAllows(claims.Access, reqScope.repository, reqScope.action) {
 				setBearerAuthChallenge(c, realm, service, challengeScope)
@@ -80,9 +99,14 @@ func (s *Server) registryBearerAuthMiddleware() gin.HandlerFunc {
 			}
 		}
 
-		c.Set("registryAuth", registryAuthContext{
-			namespace: namespace,
-		})
+		auth := registryAuthContext{namespace: namespace}
+		if apiKeyID, err := uuid.Parse(claims.APIKeyID); err == nil {
+			auth.apiKeyID = apiKeyID
+		}
+		if tenantID, err := uuid.Parse(claims.TenantID); err == nil {
+			auth.tenantID = tenantID
+		}
+		c.Set("registryAuth", auth)
 		c.Next()
 	}
 }
@@ -92,14 +116,17 @@ func (s *Server) authenticateRegistryBasic(c *gin.Context) (registryAuthContext,
 	if !ok {
 		return registryAuthContext{}, errUnauthorized
 	}
+	return s.authenticateRegistryAPIKey(c.Request.Context(), password)
+}
 
-	providedKey := strings.TrimSpace(password)
+func (s *Server) authenticateRegistryAPIKey(ctx context.Context, rawKey string) (registryAuthContext, error) {
+	providedKey := strings.TrimSpace(rawKey)
 	prefix, err := apikey.ParsePrefix(providedKey)
 	if err != nil {
 		return registryAuthContext{}, errUnauthorized
 	}
 
-	apiKeyRec, err := s.db.GetAPIKeyByPrefix(c.Request.Context(), prefix)
+	apiKeyRec, err := s.db.GetAPIKeyByPrefix(ctx, prefix)
 	if err != nil {
 		if errors.Is(err, db.ErrNotFound) {
 			return registryAuthContext{}, errUnauthorized
@@ -112,7 +139,55 @@ func (s *Server) authenticateRegistryBasic(c *gin.Context) (registryAuthContext,
 		return registryAuthContext{}, errUnauthorized
 	}
 
-	apiScopes, err := s.db.ListAPIKeyScopesByAPIKeyID(c.Request.Context(), apiKeyRec.ID)
+	return s.registryAuthForAPIKey(ctx, apiKeyRec)
+}
+
+// authenticateRegistryRefreshToken authenticates a refresh_token grant. The
+// token only authenticates the client it was issued to.
+func (s *Server) authenticateRegistryRefreshToken(ctx context.Context, rawToken, clientID string) (registryAuthContext, error) {
+	refreshToken := strings.TrimSpace(rawToken)
+	if !validRegistryRefreshToken(refreshToken) {
+		return registryAuthContext{}, errRegistryRefreshTokenInvalid
+	}
+
+	tokenRec, err := s.db.GetLiveRegistryRefreshToken(ctx, hashRegistryRefreshToken(refreshToken))
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return registryAuthContext{}, errRegistryRefreshTokenInvalid
+		}
+		return registryAuthContext{}, err
+	}
+	// Check the client before recording the use so a token presented by
+	// another client leaves no trace on the row.
+	if tokenRec.ClientID != clientID {
+		return registryAuthContext{}, errRegistryRefreshTokenClient
+	}
+	if err := s.db.MarkRegistryRefreshTokenUsed(ctx, tokenRec.ID); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return registryAuthContext{}, errRegistryRefreshTokenInvalid
+		}
+		return registryAuthContext{}, err
+	}
+
+	// The API key row may have been deleted since the token was issued; the
+	// cascade normally removes the token too, but treat the race as revoked.
+	apiKeyRec, err := s.db.GetAPIKeyByID(ctx, tokenRec.APIKeyID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return registryAuthContext{}, errRegistryRefreshTokenInvalid
+		}
+		return registryAuthContext{}, err
+	}
+
+	auth, err := s.registryAuthForAPIKey(ctx, apiKeyRec)
+	if errors.Is(err, errUnauthorized) {
+		return registryAuthContext{}, errRegistryRefreshTokenInvalid
+	}
+	return auth, err
+}
+
+func (s *Server) registryAuthForAPIKey(ctx context.Context, apiKeyRec db.APIKey) (registryAuthContext, error) {
+	apiScopes, err := s.db.ListAPIKeyScopesByAPIKeyID(ctx, apiKeyRec.ID)
 	if err != nil {
 		return registryAuthContext{}, err
 	}
@@ -122,21 +197,24 @@ func (s *Server) authenticateRegistryBasic(c *gin.Context) (registryAuthContext,
 
 	// Derive the registry from the key's scope. Keys are currently scoped to
 	// exactly one registry, so the first scope's registry is authoritative.
-	registryRec, err := s.db.GetRegistryByID(c.Request.Context(), apiScopes[0].RegistryID)
+	registryRec, err := s.db.GetRegistryByID(ctx, apiScopes[0].RegistryID)
 	if err != nil {
 		return registryAuthContext{}, err
 	}
 
-	if _, err := s.db.UpdateAPIKeyLastUsedAt(c.Request.Context(), apiKeyRec.ID); err != nil {
+	if _, err := s.db.UpdateAPIKeyLastUsedAt(ctx, apiKeyRec.ID); err != nil {
 		logError(err)
 	}
 
 	return registryAuthContext{
-		userID:     apiKeyRec.UserID,
-		namespace:  registryRec.Name,
-		registryID: registryRec.ID,
-		apiKeyID:   apiKeyRec.ID,
-		apiScopes:  apiScopes,
+		userID:        apiKeyRec.UserID,
+		namespace:     registryRec.Name,
+		registryID:    registryRec.ID,
+		tenantID:      registryRec.TenantID,
+		apiKeyID:      apiKeyRec.ID,
+		apiScopes:     apiScopes,
+		keyCIDRs:      apiKeyRec.AllowedCIDRs,
+		registryCIDRs: registryRec.AllowedCIDRs,
 	}, nil
 }
 
@@ -214,7 +292,7 @@ func requiredRegistryScope(relativePath, method string) (registryScopeRequiremen
 
 	if method == http.MethodDelete {
 		if m := reBlobPath.FindStringSubmatch(relative); m != nil {
-			req := registryScopeRequirement{repository: m[1], action: "push"}
+			req := registryScopeRequirement{repository: m[1], action: "delete"}
 			return req, formatRepositoryScope(req.repository, req.action)
 		}
 	}
@@ -243,7 +321,7 @@ func requiredRegistryScope(relativePath, method string) (registryScopeRequiremen
 
 	if method == http.MethodDelete {
 		if m := reManifestRef.FindStringSubmatch(relative); m != nil {
-			req := registryScopeRequirement{repository: m[1], action: "push"}
+			req := registryScopeRequirement{repository: m[1], action: "delete"}
 			return req, formatRepositoryScope(req.repository, req.action)
 		}
 	}
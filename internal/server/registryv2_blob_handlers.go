@@ -1,8 +1,10 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 
@@ -231,7 +233,8 @@ func (s *Server) mountBlobHandler(c *gin.Context, repo, mountDigest, fromRepo st
 							opCount = 1
 						}
 					}
-					s.emitUsageEvent(c.Request.Context(), tenantID, registryID, nil, digest, db.MetricPushOpCount, opCount)
+					repoID := s.resolveUsageRepoID(c.Request.Context(), registryID, repo)
+					s.emitUsageEvent(c.Request.Context(), tenantID, registryID, repoID, digest, db.MetricPushOpCount, opCount)
 				}
 			}
 		}
@@ -287,6 +290,9 @@ func (s *Server) completeBlobUpload(c *gin.Context, repo, uuid, digestHex string
 	}
 	if exists {
 		_ = s.registryStorage.DeleteUpload(c.Request.Context(), uuid)
+		if !s.checkStorageQuota(c, registryID, repo, map[string]int64{digest: size}) {
+			return
+		}
 		if err := s.trackRegistryBlobDigest(c.Request.Context(), digest, size); err != nil {
 			logError(fmt.Errorf("could not update registry blob index for %s: %w", digest, err))
 		}
@@ -298,8 +304,9 @@ func (s *Server) completeBlobUpload(c *gin.Context, repo, uuid, digestHex string
 					opCount = 1
 				}
 			}
-			s.emitUsageEvent(c.Request.Context(), tenantID, registryID, nil, digest, db.MetricStorageBytes, size)
-			s.emitUsageEvent(c.Request.Context(), tenantID, registryID, nil, digest, db.MetricPushOpCount, opCount)
+			repoID := s.resolveUsageRepoID(c.Request.Context(), registryID, repo)
+			s.emitUsageEvent(c.Request.Context(), tenantID, registryID, repoID, digest, db.MetricStorageBytes, size)
+			s.emitUsageEvent(c.Request.Context(), tenantID, registryID, repoID, digest, db.MetricPushOpCount, opCount)
 		}
 		c.Header("Location", fmt.Sprintf("/v2/%s/blobs/%s", repo, digest))
 		c.Header("Docker-Content-Digest", digest)
@@ -307,6 +314,16 @@ func (s *Server) completeBlobUpload(c *gin.Context, repo, uuid, digestHex string
 		return
 	}
 
+	uploadSize, err := s.registryStorage.UploadSize(c.Request.Context(), uuid)
+	if err != nil {
+		writeOCIError(c, http.StatusInternalServerError, "UNKNOWN", "failed to read upload size")
+		return
+	}
+	if !s.checkStorageQuota(c, registryID, repo, map[string]int64{digest: uploadSize}) {
+		_ = s.registryStorage.DeleteUpload(c.Request.Context(), uuid)
+		return
+	}
+
 	size, err = s.registryStorage.StoreBlobFromUpload(c.Request.Context(), uuid, digestHex)
 	if err != nil {
 		writeOCIError(c, http.StatusInternalServerError, "UNKNOWN", "failed to finalize blob upload")
@@ -323,8 +340,9 @@ func (s *Server) completeBlobUpload(c *gin.Context, repo, uuid, digestHex string
 				opCount = 1
 			}
 		}
-		s.emitUsageEvent(c.Request.Context(), tenantID, registryID, nil, digest, db.MetricStorageBytes, size)
-		s.emitUsageEvent(c.Request.Context(), tenantID, registryID, nil, digest, db.MetricPushOpCount, opCount)
+		repoID := s.resolveUsageRepoID(c.Request.Context(), registryID, repo)
+		s.emitUsageEvent(c.Request.Context(), tenantID, registryID, repoID, digest, db.MetricStorageBytes, size)
+		s.emitUsageEvent(c.Request.Context(), tenantID, registryID, repoID, digest, db.MetricPushOpCount, opCount)
 	}
 
 	c.Header("Location", fmt.Sprintf("/v2/%s/blobs/%s", repo, digest))
@@ -383,6 +401,7 @@ func (s *Server) headBlobHandler(c *gin.Context, repo, digest string) {
 	s.noteObjectExistenceCheck(c.Request.Context(), normalizedDigest)
 
 	c.Header("Docker-Content-Digest", normalizedDigest)
+	c.Header("Accept-Ranges", "bytes")
 	c.Header("Content-Length", fmt.Sprintf("%d", size))
 	c.Status(http.StatusOK)
 }
@@ -402,26 +421,95 @@ func (s *Server) getBlobHandler(c *gin.Context, repo, digest string) {
 		return
 	}
 
-	body, size, err := s.registryStorage.GetBlob(c.Request.Context(), digestHex)
+	blob, err := openBlob(c.Request.Context(), s.registryStorage, digestHex, c.GetHeader("Range"))
 	if errors.Is(err, ErrBlobNotFound) {
 		writeOCIError(c, http.StatusNotFound, "BLOB_UNKNOWN", "blob not found")
 		return
 	}
+	if errors.Is(err, errBlobRangeNotSatisfiable) {
+		c.Header("Content-Range", fmt.Sprintf("bytes */%d", blob.size))
+		c.Status(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
 	if err != nil {
 		writeOCIError(c, http.StatusInternalServerError, "UNKNOWN", "failed to load blob")
 		return
 	}
-	defer body.Close()
+	defer blob.body.Close()
 
-	// Emit pull-op-count for direct (non-worker) blob pulls.
+	// Emit pull-op-count for direct (non-worker) blob pulls. A range from
+	// past the first byte resumes a pull rather than starting another.
+	var registryID, tenantID guuid.UUID
+	var repoID *guuid.UUID
 	if auth, authErr := s.getRegistryAuth(c); authErr == nil {
-		if registryID, tenantID, tenantErr := s.resolveTenantID(c.Request.Context(), auth, repo); tenantErr == nil {
-			s.emitUsageEvent(c.Request.Context(), tenantID, registryID, nil, "sha256:"+digestHex, db.MetricPullOpCount, 10)
+		if registryID, tenantID, err = s.resolveTenantID(c.Request.Context(), auth, repo); err == nil {
+			repoID = s.resolveUsageRepoID(c.Request.Context(), registryID, repo)
+			if blob.start == 0 {
+				s.emitUsageEvent(c.Request.Context(), tenantID, registryID, repoID, "sha256:"+digestHex, db.MetricPullOpCount, 10)
+			}
 		}
 	}
 
-	c.Header("Docker-Content-Digest", "sha256:"+digestHex)
-	c.DataFromReader(http.StatusOK, size, defaultBlobContentType, body, nil)
+	writeBlob(c, "sha256:"+digestHex, blob)
+
+	// Egress is what was written, not the blob's size: a range request is
+	// charged for its range, and a client that disconnects part way for the
+	// part it received. The request context is cancelled by then if it did.
+	if written := c.Writer.Size(); written > 0 {
+		ctx := context.WithoutCancel(c.Request.Context())
+		s.emitUsageEvent(ctx, tenantID, registryID, repoID, "sha256:"+digestHex, db.MetricPullBytes, int64(written))
+	}
+}
+
+// blobRead is a blob, or the range of one a request asked for, opened to be
+// served.
+type blobRead struct {
+	body io.ReadCloser
+	// size is the whole blob's, or -1 if it is not known.
+	size    int64
+	start   int64
+	length  int64
+	partial bool
+}
+
+// openBlob opens the blob, or just the range rawRange asks for if it is one
+// that is honoured. For a range outside the blob it returns
+// errBlobRangeNotSatisfiable with the blob's size.
+func openBlob(ctx context.Context, storage registryStorageBackend, digestHex, rawRange string) (blobRead, error) {
+	if strings.TrimSpace(rawRange) != "" {
+		size, err := storage.BlobSize(ctx, digestHex)
+		if err != nil {
+			return blobRead{}, err
+		}
+		start, length, ok, err := parseBlobRange(rawRange, size)
+		if err != nil {
+			return blobRead{size: size}, err
+		}
+		if ok {
+			body, err := storage.GetBlobRange(ctx, digestHex, start, length)
+			if err != nil {
+				return blobRead{}, err
+			}
+			return blobRead{body: body, size: size, start: start, length: length, partial: true}, nil
+		}
+	}
+	body, size, err := storage.GetBlob(ctx, digestHex)
+	if err != nil {
+		return blobRead{}, err
+	}
+	return blobRead{body: body, size: size, length: size}, nil
+}
+
+// writeBlob serves blob, with 206 Partial Content for a range.
+func writeBlob(c *gin.Context, digest string, blob blobRead) {
+	c.Header("Docker-Content-Digest", digest)
+	c.Header("Accept-Ranges", "bytes")
+	status := http.StatusOK
+	if blob.partial {
+		status = http.StatusPartialContent
+		c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", blob.start, blob.start+blob.length-1, blob.size))
+	}
+	c.DataFromReader(status, blob.length, defaultBlobContentType, blob.body, nil)
 }
 
 func (s *Server) deleteBlobHandler(c *gin.Context, repo, digest string) {
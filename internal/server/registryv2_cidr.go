@@ -0,0 +1,153 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxAllowedCIDRs bounds each allowlist; the lists are embedded in every
+// registry token issued for the key.
+const maxAllowedCIDRs = 32
+
+var errRegistryClientAddrDenied = errors.New("client address not allowed")
+
+// normalizeCIDRAllowlist validates user-supplied networks and returns them in
+// canonical form. Bare addresses become single-host prefixes.
+func normalizeCIDRAllowlist(raw []string) ([]string, error) {
+	if len(raw) > maxAllowedCIDRs {
+		return nil, fmt.Errorf("at most %d CIDRs are allowed", maxAllowedCIDRs)
+	}
+	out := make([]string, 0, len(raw))
+	seen := map[string]struct{}{}
+	for _, entry := range raw {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, err := parseAllowedCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		normalized := prefix.String()
+		if _, ok := seen[normalized]; ok {
+			continue
+		}
+		seen[normalized] = struct{}{}
+		out = append(out, normalized)
+	}
+	return out, nil
+}
+
+func parseAllowedCIDR(entry string) (netip.Prefix, error) {
+	if !strings.Contains(entry, "/") {
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(entry)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
+
+// cidrAllowlistAllows reports whether addr falls inside one of the networks.
+// An empty allowlist allows every address; an unparseable entry allows none.
+func cidrAllowlistAllows(cidrs []string, addr netip.Addr) bool {
+	if len(cidrs) == 0 {
+		return true
+	}
+	if !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, entry := range cidrs {
+		prefix, err := parseAllowedCIDR(entry)
+		if err != nil {
+			continue
+		}
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// cidrAllowlistCovers reports whether every address inner allows is also
+// allowed by outer. An empty outer allows everything; an empty inner allows
+// everything too, so it is only covered by an empty outer.
+func cidrAllowlistCovers(outer, inner []string) bool {
+	if len(outer) == 0 {
+		return true
+	}
+	if len(inner) == 0 {
+		return false
+	}
+	for _, entry := range inner {
+		prefix, err := parseAllowedCIDR(entry)
+		if err != nil {
+			return false
+		}
+		covered := false
+		for _, outerEntry := range outer {
+			outerPrefix, err := parseAllowedCIDR(outerEntry)
+			if err != nil {
+				continue
+			}
+			if outerPrefix.Bits() <= prefix.Bits() && outerPrefix.Contains(prefix.Addr()) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return false
+		}
+	}
+	return true
+}
+
+// registryClientAddr is the request's client address. X-Forwarded-For is only
+// honoured when the immediate peer is in TRUSTED_PROXIES.
+func registryClientAddr(c *gin.Context) netip.Addr {
+	addr, err := netip.ParseAddr(c.ClientIP())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// checkRegistryClientAddr enforces the API key and registry allowlists against
+// the client address before a token is issued.
+func checkRegistryClientAddr(c *gin.Context, auth registryAuthContext) error {
+	addr := registryClientAddr(c)
+	if !cidrAllowlistAllows(auth.keyCIDRs, addr) || !cidrAllowlistAllows(auth.registryCIDRs, addr) {
+		return errRegistryClientAddrDenied
+	}
+	return nil
+}
+
+// trustedProxiesFromEnv reads the comma-separated TRUSTED_PROXIES list of
+// addresses or CIDRs. Unset means no proxy is trusted and the peer address is
+// always used.
+func trustedProxiesFromEnv() []string {
+	raw := strings.TrimSpace(os.Getenv("TRUSTED_PROXIES"))
+	if raw == "" {
+		return nil
+	}
+	out := make([]string, 0)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry != "" {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestNormalizeCIDRAllowlist(t *testing.T) {
+	got, err := normalizeCIDRAllowlist([]string{" 10.1.2.3/8 ", "203.0.113.7", "2001:db8::1/32", "", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("normalizeCIDRAllowlist: %v", err)
+	}
+	want := []string{"10.0.0.0/8", "203.0.113.7/32", "2001:db8::/32"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("cidrs = %v, want %v", got, want)
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0/8"} {
+		if _, err := normalizeCIDRAllowlist([]string{invalid}); err == nil {
+			t.Fatalf("normalizeCIDRAllowlist(%q) unexpectedly succeeded", invalid)
+		}
+	}
+}
+
+func TestCIDRAllowlistAllows(t *testing.T) {
+	cidrs := []string{"10.0.0.0/8", "2001:db8::/32"}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{addr: "10.20.30.40", want: true},
+		{addr: "::ffff:10.20.30.40", want: true},
+		{addr: "2001:db8::5", want: true},
+		{addr: "192.0.2.1", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := cidrAllowlistAllows(cidrs, netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Fatalf("cidrAllowlistAllows(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+	if !cidrAllowlistAllows(nil, netip.Addr{}) {
+		t.Fatalf("empty allowlist should allow every address")
+	}
+	if cidrAllowlistAllows(cidrs, netip.Addr{}) {
+		t.Fatalf("unknown client address should not match a non-empty allowlist")
+	}
+}
+
+func TestCIDRAllowlistCovers(t *testing.T) {
+	outer := []string{"10.0.0.0/8", "2001:db8::/32"}
+	tests := []struct {
+		inner []string
+		want  bool
+	}{
+		{inner: []string{"10.1.0.0/16", "10.2.3.4/32"}, want: true},
+		{inner: []string{"10.0.0.0/8", "2001:db8:1::/48"}, want: true},
+		{inner: []string{"10.1.0.0/16", "192.0.2.0/24"}, want: false},
+		{inner: []string{"0.0.0.0/0"}, want: false},
+		{inner: nil, want: false},
+	}
+
+	for _, tt := range tests {
+		if got := cidrAllowlistCovers(outer, tt.inner); got != tt.want {
+			t.Fatalf("cidrAllowlistCovers(%v) = %v, want %v", tt.inner, got, tt.want)
+		}
+	}
+	if !cidrAllowlistCovers(nil, nil) {
+		t.Fatalf("an empty allowlist should cover an empty one")
+	}
+}
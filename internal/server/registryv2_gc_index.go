@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"bin2.io/internal/db"
 	"github.com/google/uuid"
@@ -22,7 +23,8 @@ func (s *Server) resolveTenantID(ctx context.Context, auth registryAuthContext,
 	return
 }
 
-// emitUsageEvent inserts a single usage event, logging but not propagating any error.
+// emitUsageEvent queues a single usage event for storing, logging but not
+// propagating any error.
 func (s *Server) emitUsageEvent(ctx context.Context, tenantID, registryID uuid.UUID, repoID *uuid.UUID, digest, metric string, value int64) {
 	if s.db == nil || tenantID == uuid.Nil {
 		return
@@ -34,19 +36,65 @@ func (s *Server) emitUsageEvent(ctx context.Context, tenantID, registryID uuid.U
 	}
 
 	event := db.UsageEvent{
-		ID:       uuid.New(),
-		TenantID: tenantID,
-		Digest:   normalizedDigest,
-		Metric:   metric,
-		Value:    value,
+		ID:        uuid.New(),
+		CreatedAt: time.Now().UTC(),
+		TenantID:  tenantID,
+		Digest:    normalizedDigest,
+		Metric:    metric,
+		Value:     value,
 	}
 	if registryID != uuid.Nil {
 		event.RegistryID = &registryID
 	}
 	event.RepoID = repoID
-	if err := s.db.InsertUsageEvents(ctx, []db.UsageEvent{event}); err != nil {
-		logError(fmt.Errorf("emitUsageEvent %s: %w", metric, err))
+	if s.usageEvents == nil {
+		if err := s.db.InsertUsageEvents(ctx, []db.UsageEvent{event}); err != nil {
+			logError(fmt.Errorf("emitUsageEvent %s: %w", metric, err))
+		}
+		return
+	}
+	s.usageEvents.enqueue(event)
+}
+
+// resolveUsageRepoID returns the id of repo for attributing usage to it, or nil
+// if it cannot be resolved, leaving the usage attributed to the registry.
+// Repositories are only created by manifest pushes, so blobs uploaded or
+// mounted before a new repository's first manifest are attributed to the
+// registry.
+func (s *Server) resolveUsageRepoID(ctx context.Context, registryID uuid.UUID, repo string) *uuid.UUID {
+	if s.db == nil || registryID == uuid.Nil {
+		return nil
+	}
+	repoID, err := s.db.GetRepositoryID(ctx, registryID, repoLeaf(repo))
+	if err != nil {
+		if !errors.Is(err, db.ErrNotFound) && !errors.Is(err, context.Canceled) {
+			logError(fmt.Errorf("could not resolve repository %s for usage: %w", repo, err))
+		}
+		return nil
+	}
+	return &repoID
+}
+
+// emitStorageRemovedUsageEvent emits a negative storage-bytes event for a blob
+// the tenant no longer stores, attributed where the blob's storage was
+// charged so that registry and repository balances net to zero.
+func (s *Server) emitStorageRemovedUsageEvent(ctx context.Context, tenantID, registryID uuid.UUID, repo, digest string, size int64) {
+	if s.db == nil || tenantID == uuid.Nil {
+		return
+	}
+	attribution, err := s.db.GetUsageStorageAttribution(ctx, tenantID, registryID, digest)
+	if err != nil {
+		if !errors.Is(err, db.ErrNotFound) {
+			logError(fmt.Errorf("could not resolve usage attribution for %s: %w", digest, err))
+		}
+		s.emitUsageEvent(ctx, tenantID, registryID, s.resolveUsageRepoID(ctx, registryID, repo), digest, db.MetricStorageBytes, -size)
+		return
+	}
+	var repoID *uuid.UUID
+	if attribution.RepoID != uuid.Nil {
+		repoID = &attribution.RepoID
 	}
+	s.emitUsageEvent(ctx, tenantID, attribution.RegistryID, repoID, digest, db.MetricStorageBytes, -size)
 }
 
 func (s *Server) trackRegistryBlobDigest(ctx context.Context, digest string, sizeBytes int64) error {
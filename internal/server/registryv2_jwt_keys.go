@@ -1,42 +1,236 @@
 package server
 
 import (
+	"context"
 	"crypto/ed25519"
 	"crypto/x509"
 	"fmt"
+	"log/slog"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"encoding/pem"
+
+	"bin2.io/internal/apikey"
+	"bin2.io/internal/db"
+	"github.com/golang-jwt/jwt/v5"
 )
 
-func loadRegistryJWTKeys() (ed25519.PrivateKey, ed25519.PublicKey, error) {
+// registryJWTKeyRefreshInterval bounds how long a replica keeps using a cached
+// keyset before re-reading registry_jwt_keys. Promotions must be scheduled
+// further out than this plus the JWKS cache lifetime.
+const registryJWTKeyRefreshInterval = 30 * time.Second
+
+type registryJWTKey struct {
+	kid         string
+	privateKey  ed25519.PrivateKey
+	publicKey   ed25519.PublicKey
+	activatesAt time.Time
+}
+
+// registryJWTKeySet is a point-in-time view of the registry keys: the key new
+// tokens are signed with plus every key whose tokens may still be presented
+// (or, for pending keys, soon will be).
+type registryJWTKeySet struct {
+	signing      registryJWTKey
+	verification []registryJWTKey
+}
+
+func (ks registryJWTKeySet) verificationKey(kid string) (ed25519.PublicKey, bool) {
+	for _, key := range ks.verification {
+		if key.kid == kid {
+			return key.publicKey, true
+		}
+	}
+	return nil, false
+}
+
+// verificationKeySet returns every verification key, for tokens that do not
+// name the key they were signed with.
+func (ks registryJWTKeySet) verificationKeySet() jwt.VerificationKeySet {
+	set := jwt.VerificationKeySet{Keys: make([]jwt.VerificationKey, 0, len(ks.verification))}
+	for _, key := range ks.verification {
+		set.Keys = append(set.Keys, key.publicKey)
+	}
+	return set
+}
+
+// buildRegistryJWTKeySet picks the signing key and the published verification
+// keys from keys sorted by activation time. The signing key is the most recent
+// key that has activated. Keys activating in the future are published ahead of
+// use, and a superseded key stays published until tokens it signed before its
+// successor activated have expired.
+func buildRegistryJWTKeySet(keys []registryJWTKey, now time.Time) (registryJWTKeySet, error) {
+	keys = slices.Clone(keys)
+	slices.SortStableFunc(keys, func(a, b registryJWTKey) int {
+		return a.activatesAt.Compare(b.activatesAt)
+	})
+
+	signingIdx := -1
+	for i, key := range keys {
+		if !key.activatesAt.After(now) {
+			signingIdx = i
+		}
+	}
+	if signingIdx == -1 {
+		return registryJWTKeySet{}, fmt.Errorf("no active registry jwt signing key")
+	}
+
+	retention := registryTokenTTL + registryTokenLeeway
+	set := registryJWTKeySet{signing: keys[signingIdx]}
+	for i, key := range keys {
+		switch {
+		case i >= signingIdx:
+			set.verification = append(set.verification, key)
+		case now.Sub(keys[i+1].activatesAt) < retention:
+			set.verification = append(set.verification, key)
+		}
+	}
+	return set, nil
+}
+
+// registryJWTKeyring caches the keyset and periodically reloads it so that
+// rotations performed with `init jwt-keys` reach every replica without a
+// restart. Reloads run in the background: requests are served the cached
+// keyset and never wait on the database.
+type registryJWTKeyring struct {
+	mu        sync.Mutex
+	load      func(ctx context.Context) ([]registryJWTKey, error)
+	keys      registryJWTKeySet
+	loadedAt  time.Time
+	reloading bool
+}
+
+func newStaticRegistryJWTKeyring(keys registryJWTKeySet) *registryJWTKeyring {
+	return &registryJWTKeyring{keys: keys}
+}
+
+func newRegistryJWTKeyring(ctx context.Context, load func(ctx context.Context) ([]registryJWTKey, error)) (*registryJWTKeyring, error) {
+	k := &registryJWTKeyring{load: load}
+	now := time.Now().UTC()
+	set, err := k.build(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	k.keys, k.loadedAt = set, now
+	return k, nil
+}
+
+// current returns the cached keyset, starting a reload if it is older than
+// registryJWTKeyRefreshInterval and none is running.
+func (k *registryJWTKeyring) current() registryJWTKeySet {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := time.Now().UTC()
+	if k.load != nil && !k.reloading && now.Sub(k.loadedAt) >= registryJWTKeyRefreshInterval {
+		k.reloading = true
+		go k.reload(now)
+	}
+	return k.keys
+}
+
+func (k *registryJWTKeyring) reload(now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	set, err := k.build(ctx, now)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.reloading = false
+	// A failed reload is not retried before the next interval either; the
+	// previous keyset keeps being served so that a transient database error
+	// does not take token issuance down with it.
+	k.loadedAt = now
+	if err != nil {
+		slog.Error("could not reload registry jwt keys", slog.Any("err", err))
+		return
+	}
+	k.keys = set
+}
+
+func (k *registryJWTKeyring) build(ctx context.Context, now time.Time) (registryJWTKeySet, error) {
+	keys, err := k.load(ctx)
+	if err != nil {
+		return registryJWTKeySet{}, err
+	}
+	return buildRegistryJWTKeySet(keys, now)
+}
+
+// registryJWTKeyLoader returns a loader combining the optional bootstrap key
+// from the environment with the keys stored in Postgres. The environment key
+// sorts first so any stored key that has activated supersedes it.
+func registryJWTKeyLoader(conn *db.DB, encKey [32]byte, envKey *registryJWTKey) func(ctx context.Context) ([]registryJWTKey, error) {
+	return func(ctx context.Context) ([]registryJWTKey, error) {
+		keys := make([]registryJWTKey, 0)
+		if envKey != nil {
+			keys = append(keys, *envKey)
+		}
+
+		records, err := conn.ListRegistryJWTKeys(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range records {
+			privatePEM, err := apikey.Decrypt(rec.PrivateKeyEncrypted, encKey)
+			if err != nil {
+				return nil, fmt.Errorf("could not decrypt registry jwt key %s: %w", rec.KID, err)
+			}
+			privateKey, err := parseEd25519PrivateKey(privatePEM)
+			if err != nil {
+				return nil, fmt.Errorf("registry jwt key %s: %w", rec.KID, err)
+			}
+			keys = append(keys, registryJWTKey{
+				kid:         rec.KID,
+				privateKey:  privateKey,
+				publicKey:   privateKey.Public().(ed25519.PublicKey),
+				activatesAt: rec.ActivatesAt.UTC(),
+			})
+		}
+		return keys, nil
+	}
+}
+
+// loadRegistryJWTEnvKey loads the bootstrap signing key from
+// REGISTRY_JWT_PRIVATE_KEY_PEM. It returns nil when the variable is unset so
+// deployments can rely solely on keys stored in Postgres.
+func loadRegistryJWTEnvKey() (*registryJWTKey, error) {
 	privatePEM := strings.TrimSpace(getenvDefault(
 		"REGISTRY_JWT_PRIVATE_KEY_PEM",
 		"",
 	))
 	if privatePEM == "" {
-		return nil, nil, fmt.Errorf("REGISTRY_JWT_PRIVATE_KEY_PEM is required")
+		return nil, nil
 	}
 
 	privateKey, err := parseEd25519PrivateKey(privatePEM)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
+	publicKey := privateKey.Public().(ed25519.PublicKey)
 	publicPEM := strings.TrimSpace(getenvDefault(
 		"REGISTRY_JWT_PUBLIC_KEY_PEM",
 		"",
 	))
-	if publicPEM == "" {
-		derived := privateKey.Public().(ed25519.PublicKey)
-		return privateKey, derived, nil
+	if publicPEM != "" {
+		publicKey, err = parseEd25519PublicKey(publicPEM)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	publicKey, err := parseEd25519PublicKey(publicPEM)
+	kid, err := registryJWKKeyID(publicKey)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	return privateKey, publicKey, nil
+	return &registryJWTKey{
+		kid:        kid,
+		privateKey: privateKey,
+		publicKey:  publicKey,
+	}, nil
 }
 
 func parseEd25519PrivateKey(raw string) (ed25519.PrivateKey, error) {
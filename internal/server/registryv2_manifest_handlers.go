@@ -160,12 +160,18 @@ func (s *Server) putManifestHandler(c *gin.Context, repo, reference string) {
 		normalizedChildManifestDigests,
 		subjectDigest,
 	); err != nil {
+		var exceeded *db.StorageQuotaExceededError
+		if errors.As(err, &exceeded) {
+			writeStorageQuotaExceeded(c, repo, exceeded.Usage)
+			return
+		}
 		writeOCIError(c, http.StatusInternalServerError, "UNKNOWN", "failed to store manifest")
 		return
 	}
 
 	// Emit push-op-count for the manifest itself.
-	s.emitUsageEvent(c.Request.Context(), tenantID, registryID, nil, manifestDigest, db.MetricPushOpCount, 1)
+	repoID := s.resolveUsageRepoID(c.Request.Context(), registryID, repo)
+	s.emitUsageEvent(c.Request.Context(), tenantID, registryID, repoID, manifestDigest, db.MetricPushOpCount, 1)
 
 	c.Header("Docker-Content-Digest", manifestDigest)
 	if subjectDigest != "" {
@@ -256,7 +262,7 @@ func (s *Server) deleteManifestHandler(c *gin.Context, repo, reference string) {
 		}
 		// Emit negative storage-bytes for blobs now orphaned at tenant level.
 		for _, blob := range orphaned {
-			s.emitUsageEvent(c.Request.Context(), tenantID, registryID, nil, blob.Digest, db.MetricStorageBytes, -blob.SizeBytes)
+			s.emitStorageRemovedUsageEvent(c.Request.Context(), tenantID, registryID, repo, blob.Digest, blob.SizeBytes)
 		}
 	} else {
 		deleted, deleteErr = s.db.DeleteManifestReference(
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/google/uuid"
+)
+
+const registryRefreshTokenTTL = 90 * 24 * time.Hour
+
+// errRegistryRefreshTokenClient is returned when a refresh token is presented
+// by another client than the one it was issued to.
+var errRegistryRefreshTokenClient = errors.New("refresh token was issued to another client")
+
+// errRegistryRefreshTokenInvalid is returned for a refresh token that is
+// malformed, unknown, expired or revoked, or whose API key no longer grants
+// access; the client must log in again.
+var errRegistryRefreshTokenInvalid = errors.New("refresh token is invalid, expired or revoked")
+
+var registryRefreshTokenRe = regexp.MustCompile(`^rt_[A-Za-z0-9_-]{43}$`)
+
+// issueRegistryRefreshToken mints an opaque refresh token bound to the API key.
+// Only the SHA-256 of the token is stored; the plaintext is returned once.
+func (s *Server) issueRegistryRefreshToken(ctx context.Context, apiKeyID uuid.UUID, clientID string) (string, error) {
+	token, err := generateRegistryRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s.db.AddRegistryRefreshToken(ctx, db.AddRegistryRefreshTokenArgs{
+		APIKeyID:  apiKeyID,
+		TokenHash: hashRegistryRefreshToken(token),
+		ClientID:  clientID,
+		ExpiresAt: time.Now().UTC().Add(registryRefreshTokenTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// generateRegistryRefreshToken returns a new token of the form rt_{43-char-base64url}.
+func generateRegistryRefreshToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return "rt_" + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+func validRegistryRefreshToken(token string) bool {
+	return registryRefreshTokenRe.MatchString(token)
+}
+
+func hashRegistryRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -10,7 +10,9 @@ import (
 func (s *Server) addRegistryRoutes() {
 	v2Middlewares := []gin.HandlerFunc{
 		s.apiVersionMiddleware(),
+		s.registryAuditMiddleware(),
 		s.registryBearerAuthMiddleware(),
+		s.registryRateLimitMiddleware(),
 	}
 	s.router.Any("/v2", append(v2Middlewares, s.v2RootHandler)...)
 
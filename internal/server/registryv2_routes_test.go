@@ -1,9 +1,9 @@
 package server
 
 import (
-	"crypto/ed25519"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 
@@ -50,7 +50,7 @@ func TestRegistryV2RootAcceptsBearerAuth(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	s := newRegistryV2RootTestServer(t)
-	token, _, _, err := s.issueRegistryToken("alpha", "registry.test", nil)
+	token, _, _, err := s.issueRegistryToken(registryAuthContext{namespace: "alpha"}, "registry.test", nil)
 	if err != nil {
 		t.Fatalf("issueRegistryToken: %v", err)
 	}
@@ -87,11 +87,60 @@ func TestRegistryV2RootAcceptsBearerAuth(t *testing.T) {
 	}
 }
 
+func TestRegistryBearerAuthEnforcesClientCIDRs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newRegistryV2RootTestServer(t)
+	if err := s.router.SetTrustedProxies(nil); err != nil {
+		t.Fatalf("SetTrustedProxies: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		keyCIDRs      []string
+		registryCIDRs []string
+		forwardedFor  string
+		wantStatus    int
+	}{
+		{name: "unrestricted", wantStatus: http.StatusOK},
+		{name: "key allows peer", keyCIDRs: []string{"192.0.2.0/24"}, wantStatus: http.StatusOK},
+		{name: "key denies peer", keyCIDRs: []string{"10.0.0.0/8"}, wantStatus: http.StatusForbidden},
+		{name: "registry denies peer", keyCIDRs: []string{"192.0.2.0/24"}, registryCIDRs: []string{"10.0.0.0/8"}, wantStatus: http.StatusForbidden},
+		{name: "untrusted forwarded for ignored", keyCIDRs: []string{"10.0.0.0/8"}, forwardedFor: "10.1.2.3", wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, _, _, err := s.issueRegistryToken(registryAuthContext{
+				namespace:     "alpha",
+				keyCIDRs:      tt.keyCIDRs,
+				registryCIDRs: tt.registryCIDRs,
+			}, "registry.test", nil)
+			if err != nil {
+				t.Fatalf("issueRegistryToken: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://registry.test/v2/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			res := httptest.NewRecorder()
+
+			s.router.ServeHTTP(res, req)
+
+			if res.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", res.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
 func TestRegistryV2RootRejectsUnsupportedMethod(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	s := newRegistryV2RootTestServer(t)
-	token, _, _, err := s.issueRegistryToken("alpha", "registry.test", nil)
+	token, _, _, err := s.issueRegistryToken(registryAuthContext{namespace: "alpha"}, "registry.test", nil)
 	if err != nil {
 		t.Fatalf("issueRegistryToken: %v", err)
 	}
@@ -117,10 +166,10 @@ func TestRegistryBlobDeleteDisabled(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	s := newRegistryV2RootTestServer(t)
-	token, _, _, err := s.issueRegistryToken("alpha", "registry.test", []registryTokenAccess{{
+	token, _, _, err := s.issueRegistryToken(registryAuthContext{namespace: "alpha"}, "registry.test", []registryTokenAccess{{
 		Type:    "repository",
 		Name:    "alpha/app",
-		Actions: []string{"push"},
+		Actions: []string{"delete"},
 	}})
 	if err != nil {
 		t.Fatalf("issueRegistryToken: %v", err)
@@ -150,19 +199,76 @@ func TestRegistryBlobDeleteDisabled(t *testing.T) {
 	}
 }
 
-func newRegistryV2RootTestServer(t *testing.T) *Server {
-	t.Helper()
+func TestRegistryOAuthTokenRejectsInvalidRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
 
-	publicKey, privateKey, err := ed25519.GenerateKey(nil)
-	if err != nil {
-		t.Fatalf("GenerateKey: %v", err)
+	s := newRegistryV2RootTestServer(t)
+
+	tests := []struct {
+		name string
+		form url.Values
+		want int
+		body string
+	}{
+		{
+			name: "missing client id",
+			form: url.Values{"grant_type": {"password"}, "password": {"x"}},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "unsupported grant",
+			form: url.Values{"grant_type": {"client_credentials"}, "client_id": {"docker"}},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "malformed refresh token",
+			form: url.Values{"grant_type": {"refresh_token"}, "client_id": {"docker"}, "refresh_token": {"nope"}},
+			want: http.StatusBadRequest,
+			body: `"error":"invalid_grant"`,
+		},
+		{
+			name: "malformed password",
+			form: url.Values{"grant_type": {"password"}, "client_id": {"docker"}, "password": {"nope"}},
+			want: http.StatusUnauthorized,
+		},
 	}
 
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "http://registry.test/v2/token", strings.NewReader(tt.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			res := httptest.NewRecorder()
+
+			s.router.ServeHTTP(res, req)
+
+			if res.Code != tt.want || !strings.Contains(res.Body.String(), tt.body) {
+				t.Fatalf("status = %d, want %d body=%s", res.Code, tt.want, res.Body.String())
+			}
+		})
+	}
+}
+
+func TestRegistryTokenRejectsUnsupportedMethod(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newRegistryV2RootTestServer(t)
+	req := httptest.NewRequest(http.MethodPut, "http://registry.test/v2/token", nil)
+	res := httptest.NewRecorder()
+
+	s.router.ServeHTTP(res, req)
+
+	if res.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("status = %d, want %d", res.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func newRegistryV2RootTestServer(t *testing.T) *Server {
+	t.Helper()
+
 	s := &Server{
-		router:                gin.New(),
-		registryJWTPrivateKey: privateKey,
-		registryJWTPublicKey:  publicKey,
-		registryService:       "registry.test",
+		router:          gin.New(),
+		registryJWTKeys: newTestRegistryJWTKeyring(t),
+		registryService: "registry.test",
 	}
 	s.addRegistryRoutes()
 	return s
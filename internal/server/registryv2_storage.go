@@ -17,6 +17,7 @@ type registryStorageBackend interface {
 	BlobExists(ctx context.Context, digestHex string) (bool, error)
 	BlobSize(ctx context.Context, digestHex string) (int64, error)
 	GetBlob(ctx context.Context, digestHex string) (io.ReadCloser, int64, error)
+	GetBlobRange(ctx context.Context, digestHex string, offset, length int64) (io.ReadCloser, error)
 	DeleteBlob(ctx context.Context, digestHex string) error
 	CreateUpload(ctx context.Context, id string) error
 	AppendUpload(ctx context.Context, id string, body io.Reader) (int64, error)
@@ -220,6 +220,27 @@ func (r *r2RegistryStorage) GetBlob(
 	return out.Body, size, nil
 }
 
+// GetBlobRange returns length bytes of the blob from offset, which must be
+// within it.
+func (r *r2RegistryStorage) GetBlobRange(
+	ctx context.Context,
+	digestHex string,
+	offset, length int64,
+) (io.ReadCloser, error) {
+	out, err := r.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(blobObjectKey(digestHex)),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		if isR2NotFoundErr(err) {
+			return nil, ErrBlobNotFound
+		}
+		return nil, err
+	}
+	return out.Body, nil
+}
+
 func (r *r2RegistryStorage) DeleteBlob(
 	ctx context.Context,
 	digestHex string,
@@ -14,7 +14,10 @@ import (
 	"github.com/google/uuid"
 )
 
-const registryTokenTTL = 30 * time.Minute
+const (
+	registryTokenTTL    = 30 * time.Minute
+	registryTokenLeeway = 30 * time.Second
+)
 
 type registryTokenAccess struct {
 	Type    string   `json:"type"`
@@ -24,75 +27,208 @@ type registryTokenAccess struct {
 
 type registryTokenClaims struct {
 	Access []registryTokenAccess `json:"access,omitempty"`
+	// APIKeyID identifies the API key the token was issued for, so that all of
+	// a key's tokens can be revoked at once.
+	APIKeyID string `json:"api_key_id,omitempty"`
+	// KeyCIDRs and RegistryCIDRs carry the client address allowlists in force
+	// when the token was issued so every request can be re-checked.
+	KeyCIDRs      []string `json:"key_cidrs,omitempty"`
+	RegistryCIDRs []string `json:"registry_cidrs,omitempty"`
+	// TenantID is the tenant owning the registry, whose rate limits apply to
+	// requests made with the token.
+	TenantID string `json:"tenant_id,omitempty"`
 	jwt.RegisteredClaims
 }
 
 type registryTokenResponse struct {
-	Token       string `json:"token"`
-	AccessToken string `json:"access_token"`
-	ExpiresIn   int64  `json:"expires_in"`
-	IssuedAt    string `json:"issued_at"`
+	Token        string `json:"token"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int64  `json:"expires_in"`
+	IssuedAt     string `json:"issued_at"`
 }
 
 func (s *Server) registryTokenHandler(c *gin.Context) {
-	if c.Request.Method != http.MethodGet {
+	switch c.Request.Method {
+	case http.MethodGet:
+		s.registryBasicTokenHandler(c)
+	case http.MethodPost:
+		s.registryOAuthTokenHandler(c)
+	default:
 		writeOCIError(c, http.StatusMethodNotAllowed, "UNSUPPORTED", "method not allowed")
-		return
 	}
+}
 
+// registryBasicTokenHandler serves the classic GET /v2/token flow where the
+// API key is presented as the Basic auth password.
+func (s *Server) registryBasicTokenHandler(c *gin.Context) {
 	auth, err := s.authenticateRegistryBasic(c)
+	if err == nil {
+		c.Set("registryAuth", auth)
+		err = checkRegistryClientAddr(c, auth)
+	}
 	if err != nil {
 		if errors.Is(err, errUnauthorized) {
 			writeOCIUnauthorized(c)
 			return
 		}
+		if errors.Is(err, errRegistryClientAddrDenied) {
+			writeOCIError(c, http.StatusForbidden, "DENIED", "client address not allowed")
+			return
+		}
 		logError(err)
 		writeOCIError(c, http.StatusInternalServerError, "UNKNOWN", "internal server error")
 		return
 	}
+	if s.registryRateLimited(c, rateLimitClassToken, rateLimitRequest{apiKeyID: auth.apiKeyID, tenantID: auth.tenantID}) {
+		return
+	}
 
 	service := strings.TrimSpace(c.Query("service"))
 	if service == "" {
 		service = s.registryServiceForRequest(c)
 	}
 
-	requestedScopes := parseRequestedTokenScopes(c.QueryArray("scope"))
+	requestedScopes, ok := s.registryTokenAccessState(c, auth, parseRequestedTokenScopes(c.QueryArray("scope")))
+	if !ok {
+		return
+	}
+	s.writeRegistryToken(c, auth, service, requestedScopes, "")
+}
+
+// registryOAuthTokenHandler serves the form-encoded POST /v2/token flow used by
+// docker and containerd. It supports the password grant (API key as password,
+// optionally minting a refresh token with access_type=offline) and the
+// refresh_token grant.
+func (s *Server) registryOAuthTokenHandler(c *gin.Context) {
+	if err := c.Request.ParseForm(); err != nil {
+		writeOCIError(c, http.StatusBadRequest, "UNSUPPORTED", "invalid form body")
+		return
+	}
+
+	clientID := strings.TrimSpace(c.PostForm("client_id"))
+	if clientID == "" {
+		writeOCIError(c, http.StatusBadRequest, "UNSUPPORTED", "client_id is required")
+		return
+	}
+
+	service := strings.TrimSpace(c.PostForm("service"))
+	if service == "" {
+		service = s.registryServiceForRequest(c)
+	}
+
+	var auth registryAuthContext
+	var refreshToken string
+	var err error
+	grantType := strings.TrimSpace(c.PostForm("grant_type"))
+	switch grantType {
+	case "password":
+		auth, err = s.authenticateRegistryAPIKey(c.Request.Context(), c.PostForm("password"))
+		if err == nil {
+			c.Set("registryAuth", auth)
+			err = checkRegistryClientAddr(c, auth)
+		}
+	case "refresh_token":
+		refreshToken = strings.TrimSpace(c.PostForm("refresh_token"))
+		auth, err = s.authenticateRegistryRefreshToken(c.Request.Context(), refreshToken, clientID)
+		if err == nil {
+			c.Set("registryAuth", auth)
+			err = checkRegistryClientAddr(c, auth)
+		}
+	default:
+		writeOCIError(c, http.StatusBadRequest, "UNSUPPORTED", "unsupported grant_type")
+		return
+	}
+	if err != nil {
+		if errors.Is(err, errUnauthorized) {
+			writeOCIError(c, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+			return
+		}
+		if errors.Is(err, errRegistryClientAddrDenied) {
+			writeOCIError(c, http.StatusForbidden, "DENIED", "client address not allowed")
+			return
+		}
+		if errors.Is(err, errRegistryRefreshTokenClient) || errors.Is(err, errRegistryRefreshTokenInvalid) {
+			// RFC 6749 section 5.2: the client must obtain a new grant.
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant", "error_description": err.Error()})
+			return
+		}
+		logError(err)
+		writeOCIError(c, http.StatusInternalServerError, "UNKNOWN", "internal server error")
+		return
+	}
+	if s.registryRateLimited(c, rateLimitClassToken, rateLimitRequest{apiKeyID: auth.apiKeyID, tenantID: auth.tenantID}) {
+		return
+	}
+	requestedScopes, ok := s.registryTokenAccessState(c, auth, parseRequestedTokenScopes(splitOAuthScopes(c.PostFormArray("scope"))))
+	if !ok {
+		return
+	}
+	if grantType == "password" && strings.TrimSpace(c.PostForm("access_type")) == "offline" {
+		refreshToken, err = s.issueRegistryRefreshToken(c.Request.Context(), auth.apiKeyID, clientID)
+		if err != nil {
+			logError(err)
+			writeOCIError(c, http.StatusInternalServerError, "UNKNOWN", "internal server error")
+			return
+		}
+	}
+
+	s.writeRegistryToken(c, auth, service, requestedScopes, refreshToken)
+}
+
+func (s *Server) writeRegistryToken(c *gin.Context, auth registryAuthContext, service string, requestedScopes []registryTokenAccess, refreshToken string) {
 	grantedScopes := grantRegistryTokenScopes(auth.registryID, auth.namespace, auth.apiScopes, requestedScopes)
 
-	token, expiresAt, issuedAt, err := s.issueRegistryToken(auth.namespace, service, grantedScopes)
+	token, expiresAt, issuedAt, err := s.issueRegistryToken(auth, service, grantedScopes)
 	if err != nil {
 		logError(err)
 		writeOCIError(c, http.StatusInternalServerError, "UNKNOWN", "failed to issue token")
 		return
 	}
 
+	c.Header("Cache-Control", "no-store")
 	c.JSON(http.StatusOK, registryTokenResponse{
-		Token:       token,
-		AccessToken: token,
-		ExpiresIn:   int64(expiresAt.Sub(issuedAt).Seconds()),
-		IssuedAt:    issuedAt.UTC().Format(time.RFC3339),
+		Token:        token,
+		AccessToken:  token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(expiresAt.Sub(issuedAt).Seconds()),
+		IssuedAt:     issuedAt.UTC().Format(time.RFC3339),
 	})
 }
 
-func (s *Server) issueRegistryToken(namespace, service string, access []registryTokenAccess) (string, time.Time, time.Time, error) {
+func (s *Server) issueRegistryToken(auth registryAuthContext, service string, access []registryTokenAccess) (string, time.Time, time.Time, error) {
+	signingKey := s.registryJWTKeys.current().signing
+	if signingKey.privateKey == nil {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("registry signing key is not configured")
+	}
+
 	issuedAt := time.Now().UTC()
 	expiresAt := issuedAt.Add(registryTokenTTL)
 
 	claims := registryTokenClaims{
-		Access: access,
+		Access:        access,
+		KeyCIDRs:      auth.keyCIDRs,
+		RegistryCIDRs: auth.registryCIDRs,
 		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    service,
-			Subject:   namespace,
+			Subject:   auth.namespace,
 			Audience:  jwt.ClaimStrings{service},
 			IssuedAt:  jwt.NewNumericDate(issuedAt),
-			NotBefore: jwt.NewNumericDate(issuedAt.Add(-30 * time.Second)),
+			NotBefore: jwt.NewNumericDate(issuedAt.Add(-registryTokenLeeway)),
 			ExpiresAt: jwt.NewNumericDate(expiresAt),
 			ID:        uuid.NewString(),
 		},
 	}
+	if auth.apiKeyID != uuid.Nil {
+		claims.APIKeyID = auth.apiKeyID.String()
+	}
+	if auth.tenantID != uuid.Nil {
+		claims.TenantID = auth.tenantID.String()
+	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
-	signed, err := token.SignedString(s.registryJWTPrivateKey)
+	token.Header["kid"] = signingKey.kid
+	signed, err := token.SignedString(signingKey.privateKey)
 	if err != nil {
 		return "", time.Time{}, time.Time{}, err
 	}
@@ -108,9 +244,22 @@ func (s *Server) verifyRegistryToken(tokenString, service string) (*registryToke
 			if token.Method.Alg() != jwt.SigningMethodEdDSA.Alg() {
 				return nil, fmt.Errorf("unexpected signing method")
 			}
-			return s.registryJWTPublicKey, nil
+			keys := s.registryJWTKeys.current()
+			kid, _ := token.Header["kid"].(string)
+			if kid == "" {
+				// Tokens minted before kid was introduced were signed by
+				// whichever key was active at the time, which need not be
+				// the current one after a rotation, so try every key still
+				// retained for verification.
+				return keys.verificationKeySet(), nil
+			}
+			publicKey, ok := keys.verificationKey(kid)
+			if !ok {
+				return nil, fmt.Errorf("unknown signing key %q", kid)
+			}
+			return publicKey, nil
 		},
-		jwt.WithLeeway(30*time.Second),
+		jwt.WithLeeway(registryTokenLeeway),
 		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
 	)
 	if err != nil {
@@ -129,6 +278,9 @@ func (s *Server) verifyRegistryToken(tokenString, service string) (*registryToke
 	if strings.TrimSpace(claims.Subject) == "" {
 		return nil, fmt.Errorf("token subject missing")
 	}
+	if s.registryRevocations.revoked(claims) {
+		return nil, errRegistryTokenRevoked
+	}
 	return claims, nil
 }
 
@@ -153,6 +305,16 @@ func registryTokenAllows(access []registryTokenAccess, repository, action string
 	return false
 }
 
+// splitOAuthScopes flattens OAuth2 form scopes, which are space-delimited
+// within a single value, into the one-scope-per-entry form used by GET.
+func splitOAuthScopes(rawScopes []string) []string {
+	out := make([]string, 0, len(rawScopes))
+	for _, raw := range rawScopes {
+		out = append(out, strings.Fields(raw)...)
+	}
+	return out
+}
+
 func parseRequestedTokenScopes(rawScopes []string) []registryTokenAccess {
 	scopes := make([]registryTokenAccess, 0, len(rawScopes))
 	for _, raw := range rawScopes {
@@ -270,8 +432,10 @@ func expandRequestedRegistryAction(action string) []string {
 		return []string{"pull"}
 	case "push":
 		return []string{"push"}
+	case "delete":
+		return []string{"delete"}
 	case "*":
-		return []string{"pull", "push"}
+		return []string{"pull", "push", "delete"}
 	default:
 		return nil
 	}
@@ -285,6 +449,9 @@ func apiKeyScopeAllowsAction(registryID uuid.UUID, repository, action string, ap
 		if scope.Repository != nil && *scope.Repository != repoLeaf(repository) {
 			continue
 		}
+		if scope.RepositoryPattern != nil && !matchRepositoryPattern(*scope.RepositoryPattern, repoLeaf(repository)) {
+			continue
+		}
 		if apiKeyPermissionAllows(scope.Permission, action) {
 			return true
 		}
@@ -293,15 +460,16 @@ func apiKeyScopeAllowsAction(registryID uuid.UUID, repository, action string, ap
 }
 
 // apiKeyPermissionAllows reports whether the given permission level grants the
-// requested registry action. Admin currently grants the same token-level access
-// as write (pull + push); it is reserved for future privileged operations such
-// as repository deletion or policy management that sit outside the token scope.
+// requested registry action. Deleting manifests and blobs is a separate action
+// granted only to admin keys, so keys that can push cannot wipe repositories.
 func apiKeyPermissionAllows(permission db.APIKeyPermission, action string) bool {
 	switch action {
 	case "pull":
 		return permission == db.APIKeyPermissionRead || permission == db.APIKeyPermissionWrite || permission == db.APIKeyPermissionAdmin
 	case "push":
 		return permission == db.APIKeyPermissionWrite || permission == db.APIKeyPermissionAdmin
+	case "delete":
+		return permission == db.APIKeyPermissionAdmin
 	default:
 		return false
 	}
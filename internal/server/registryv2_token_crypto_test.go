@@ -1,23 +1,25 @@
 package server
 
 import (
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
+	"errors"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
 func TestIssueAndVerifyRegistryTokenEdDSA(t *testing.T) {
-	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
-	if err != nil {
-		t.Fatalf("generate key: %v", err)
-	}
-
 	s := &Server{
-		registryJWTPrivateKey: privateKey,
-		registryJWTPublicKey:  publicKey,
+		registryJWTKeys: newTestRegistryJWTKeyring(t),
 	}
 
-	token, _, _, err := s.issueRegistryToken("alpha", "localhost:5000", nil)
+	token, _, _, err := s.issueRegistryToken(registryAuthContext{namespace: "alpha"}, "localhost:5000", nil)
 	if err != nil {
 		t.Fatalf("issue token: %v", err)
 	}
@@ -34,3 +36,227 @@ func TestIssueAndVerifyRegistryTokenEdDSA(t *testing.T) {
 		t.Fatalf("expected service mismatch error")
 	}
 }
+
+func TestVerifyRegistryTokenRevocation(t *testing.T) {
+	apiKeyID := uuid.New()
+	s := &Server{
+		registryJWTKeys:     newTestRegistryJWTKeyring(t),
+		registryRevocations: newRegistryTokenRevocations(),
+	}
+
+	token, _, issuedAt, err := s.issueRegistryToken(registryAuthContext{namespace: "alpha", apiKeyID: apiKeyID}, "localhost:5000", nil)
+	if err != nil {
+		t.Fatalf("issue token: %v", err)
+	}
+	claims, err := s.verifyRegistryToken(token, "localhost:5000")
+	if err != nil {
+		t.Fatalf("verify token: %v", err)
+	}
+	if claims.APIKeyID != apiKeyID.String() {
+		t.Fatalf("api_key_id = %q, want %q", claims.APIKeyID, apiKeyID)
+	}
+
+	jti := claims.ID
+	s.registryRevocations.replace([]db.RegistryTokenRevocation{{JTI: &jti}})
+	if _, err := s.verifyRegistryToken(token, "localhost:5000"); !errors.Is(err, errRegistryTokenRevoked) {
+		t.Fatalf("revoked jti: err = %v, want errRegistryTokenRevoked", err)
+	}
+
+	otherKey := uuid.New()
+	s.registryRevocations.replace([]db.RegistryTokenRevocation{
+		{APIKeyID: &otherKey, CreatedAt: issuedAt.Add(time.Minute)},
+		{APIKeyID: &apiKeyID, CreatedAt: issuedAt.Add(-time.Minute)},
+	})
+	if _, err := s.verifyRegistryToken(token, "localhost:5000"); err != nil {
+		t.Fatalf("token issued after key revocation rejected: %v", err)
+	}
+
+	s.registryRevocations.replace([]db.RegistryTokenRevocation{
+		{APIKeyID: &apiKeyID, CreatedAt: issuedAt.Add(-time.Minute)},
+		{APIKeyID: &apiKeyID, CreatedAt: issuedAt.Add(time.Minute)},
+	})
+	if _, err := s.verifyRegistryToken(token, "localhost:5000"); !errors.Is(err, errRegistryTokenRevoked) {
+		t.Fatalf("revoked api key: err = %v, want errRegistryTokenRevoked", err)
+	}
+}
+
+func TestVerifyRegistryTokenAcrossRotation(t *testing.T) {
+	now := time.Now().UTC()
+	oldKey := newTestRegistryJWTKey(t, "old", now.Add(-time.Hour))
+	newKey := newTestRegistryJWTKey(t, "new", now.Add(time.Hour))
+
+	before, err := buildRegistryJWTKeySet([]registryJWTKey{oldKey, newKey}, now)
+	if err != nil {
+		t.Fatalf("buildRegistryJWTKeySet: %v", err)
+	}
+	s := &Server{registryJWTKeys: newStaticRegistryJWTKeyring(before)}
+	token, _, _, err := s.issueRegistryToken(registryAuthContext{namespace: "alpha"}, "localhost:5000", nil)
+	if err != nil {
+		t.Fatalf("issue token: %v", err)
+	}
+
+	after, err := buildRegistryJWTKeySet([]registryJWTKey{oldKey, newKey}, now.Add(time.Hour+time.Minute))
+	if err != nil {
+		t.Fatalf("buildRegistryJWTKeySet: %v", err)
+	}
+	if after.signing.kid != "new" {
+		t.Fatalf("signing kid = %q, want new", after.signing.kid)
+	}
+	s.registryJWTKeys = newStaticRegistryJWTKeyring(after)
+	if _, err := s.verifyRegistryToken(token, "localhost:5000"); err != nil {
+		t.Fatalf("token signed by previous key rejected after rotation: %v", err)
+	}
+
+	retired, err := buildRegistryJWTKeySet([]registryJWTKey{oldKey, newKey}, now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("buildRegistryJWTKeySet: %v", err)
+	}
+	s.registryJWTKeys = newStaticRegistryJWTKeyring(retired)
+	if _, err := s.verifyRegistryToken(token, "localhost:5000"); err == nil {
+		t.Fatalf("expected token signed by retired key to be rejected")
+	}
+}
+
+func TestVerifyRegistryTokenWithoutKidAfterRotation(t *testing.T) {
+	now := time.Now().UTC()
+	oldKey := newTestRegistryJWTKey(t, "old", now.Add(-time.Hour))
+	newKey := newTestRegistryJWTKey(t, "new", now.Add(-time.Minute))
+
+	set, err := buildRegistryJWTKeySet([]registryJWTKey{oldKey, newKey}, now)
+	if err != nil {
+		t.Fatalf("buildRegistryJWTKeySet: %v", err)
+	}
+	if set.signing.kid != "new" {
+		t.Fatalf("signing kid = %q, want new", set.signing.kid)
+	}
+	s := &Server{registryJWTKeys: newStaticRegistryJWTKeyring(set)}
+
+	claims := registryTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "localhost:5000",
+			Subject:   "alpha",
+			Audience:  jwt.ClaimStrings{"localhost:5000"},
+			IssuedAt:  jwt.NewNumericDate(now.Add(-5 * time.Minute)),
+			ExpiresAt: jwt.NewNumericDate(now.Add(25 * time.Minute)),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(oldKey.privateKey)
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	if _, err := s.verifyRegistryToken(token, "localhost:5000"); err != nil {
+		t.Fatalf("kid-less token signed by previous key rejected: %v", err)
+	}
+
+	stranger := newTestRegistryJWTKey(t, "stranger", now)
+	token, err = jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(stranger.privateKey)
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	if _, err := s.verifyRegistryToken(token, "localhost:5000"); err == nil {
+		t.Fatalf("expected kid-less token signed by an unknown key to be rejected")
+	}
+}
+
+func TestBuildRegistryJWTKeySet(t *testing.T) {
+	now := time.Date(2026, time.March, 1, 12, 0, 0, 0, time.UTC)
+	keys := []registryJWTKey{
+		newTestRegistryJWTKey(t, "pending", now.Add(10*time.Minute)),
+		newTestRegistryJWTKey(t, "ancient", now.Add(-48*time.Hour)),
+		newTestRegistryJWTKey(t, "previous", now.Add(-24*time.Hour)),
+		newTestRegistryJWTKey(t, "active", now.Add(-5*time.Minute)),
+	}
+
+	set, err := buildRegistryJWTKeySet(keys, now)
+	if err != nil {
+		t.Fatalf("buildRegistryJWTKeySet: %v", err)
+	}
+	if set.signing.kid != "active" {
+		t.Fatalf("signing kid = %q, want active", set.signing.kid)
+	}
+
+	got := make([]string, 0, len(set.verification))
+	for _, key := range set.verification {
+		got = append(got, key.kid)
+	}
+	want := []string{"previous", "active", "pending"}
+	if len(got) != len(want) {
+		t.Fatalf("verification kids = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("verification kids = %v, want %v", got, want)
+		}
+	}
+
+	if _, err := buildRegistryJWTKeySet(keys[:1], now); err == nil {
+		t.Fatalf("expected error when no key has activated")
+	}
+}
+
+func TestRegistryJWTKeyringReloadsInBackground(t *testing.T) {
+	first := newTestRegistryJWTKey(t, "first", time.Time{})
+	second := newTestRegistryJWTKey(t, "second", time.Time{})
+
+	var loads atomic.Int32
+	release := make(chan struct{})
+	k, err := newRegistryJWTKeyring(context.Background(), func(ctx context.Context) ([]registryJWTKey, error) {
+		if loads.Add(1) == 1 {
+			return []registryJWTKey{first}, nil
+		}
+		<-release
+		return []registryJWTKey{second}, nil
+	})
+	if err != nil {
+		t.Fatalf("newRegistryJWTKeyring: %v", err)
+	}
+
+	k.mu.Lock()
+	k.loadedAt = k.loadedAt.Add(-registryJWTKeyRefreshInterval)
+	k.mu.Unlock()
+
+	// While the reload is blocked, callers get the cached keyset at once and
+	// start no further reloads.
+	for range 3 {
+		if got := k.current().signing.kid; got != "first" {
+			t.Fatalf("signing kid = %q during reload, want first", got)
+		}
+	}
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for k.current().signing.kid != "second" {
+		if time.Now().After(deadline) {
+			t.Fatal("reloaded keyset was never served")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := loads.Load(); got != 2 {
+		t.Fatalf("loads = %d, want 2", got)
+	}
+}
+
+func newTestRegistryJWTKey(t *testing.T, kid string, activatesAt time.Time) registryJWTKey {
+	t.Helper()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return registryJWTKey{
+		kid:         kid,
+		privateKey:  privateKey,
+		publicKey:   publicKey,
+		activatesAt: activatesAt,
+	}
+}
+
+func newTestRegistryJWTKeyring(t *testing.T) *registryJWTKeyring {
+	t.Helper()
+
+	key := newTestRegistryJWTKey(t, "test", time.Time{})
+	return newStaticRegistryJWTKeyring(registryJWTKeySet{
+		signing:      key,
+		verification: []registryJWTKey{key},
+	})
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// registryRevocationPollInterval bounds how stale the in-process
+	// revocation cache can get if a NOTIFY is missed.
+	registryRevocationPollInterval = time.Minute
+	registryRevocationRetryDelay   = 5 * time.Second
+)
+
+var errRegistryTokenRevoked = errors.New("registry token revoked")
+
+// registryTokenRevocations is the in-process view of registry_token_revocations
+// consulted on every bearer-authenticated request.
+type registryTokenRevocations struct {
+	mu      sync.RWMutex
+	jtis    map[string]struct{}
+	apiKeys map[uuid.UUID]time.Time
+}
+
+func newRegistryTokenRevocations() *registryTokenRevocations {
+	return &registryTokenRevocations{
+		jtis:    map[string]struct{}{},
+		apiKeys: map[uuid.UUID]time.Time{},
+	}
+}
+
+// revoked reports whether the token has been revoked by jti, or was issued for
+// an API key whose tokens were invalidated at or after the token's iat. A nil
+// receiver revokes nothing.
+func (r *registryTokenRevocations) revoked(claims *registryTokenClaims) bool {
+	if r == nil || claims == nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.jtis[claims.ID]; ok && claims.ID != "" {
+		return true
+	}
+	apiKeyID, err := uuid.Parse(claims.APIKeyID)
+	if err != nil {
+		return false
+	}
+	revokedAt, ok := r.apiKeys[apiKeyID]
+	if !ok {
+		return false
+	}
+	// iat has second precision, so a token minted in the same second as the
+	// revocation is treated as revoked; clients simply fetch another.
+	return claims.IssuedAt == nil || !claims.IssuedAt.Time.After(revokedAt)
+}
+
+func (r *registryTokenRevocations) replace(rows []db.RegistryTokenRevocation) {
+	jtis := make(map[string]struct{}, len(rows))
+	apiKeys := make(map[uuid.UUID]time.Time, len(rows))
+	for _, row := range rows {
+		if row.JTI != nil {
+			jtis[*row.JTI] = struct{}{}
+		}
+		if row.APIKeyID != nil {
+			if prev, ok := apiKeys[*row.APIKeyID]; !ok || row.CreatedAt.After(prev) {
+				apiKeys[*row.APIKeyID] = row.CreatedAt
+			}
+		}
+	}
+
+	r.mu.Lock()
+	r.jtis = jtis
+	r.apiKeys = apiKeys
+	r.mu.Unlock()
+}
+
+func (s *Server) reloadRegistryTokenRevocations(ctx context.Context) error {
+	rows, err := s.db.ListActiveRegistryTokenRevocations(ctx)
+	if err != nil {
+		return err
+	}
+	s.registryRevocations.replace(rows)
+	return nil
+}
+
+// watchRegistryTokenRevocations keeps the revocation cache in sync with
+// Postgres via LISTEN/NOTIFY, falling back to polling when idle and
+// reconnecting on failure. It returns when ctx is cancelled.
+func (s *Server) watchRegistryTokenRevocations(ctx context.Context) {
+	for {
+		err := s.db.ListenRegistryTokenRevocations(ctx, registryRevocationPollInterval, func(timedOut bool) {
+			if err := s.reloadRegistryTokenRevocations(ctx); err != nil {
+				logError(err)
+			}
+			if timedOut {
+				if _, err := s.db.DeleteExpiredRegistryTokenRevocations(ctx); err != nil {
+					logError(err)
+				}
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		logError(err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(registryRevocationRetryDelay):
+		}
+	}
+}
+
+// registryTokensExpireAt is how long a revocation must be kept: past the
+// expiry of any token issued up to now.
+func registryTokensExpireAt(now time.Time) time.Time {
+	return now.Add(registryTokenTTL + registryTokenLeeway)
+}
+
+type registryTokenIntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Subject   string `json:"sub,omitempty"`
+	JTI       string `json:"jti,omitempty"`
+	APIKeyID  string `json:"api_key_id,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+}
+
+// introspectRegistryTokenHandler handles POST /api/v1/registry-tokens/introspect
+// (RFC 7662 style, form-encoded token and optional service). It lets the edge
+// worker check revocation of tokens it has verified locally, and requires a
+// usage worker's signature. Its nonce is not recorded: a replayed request
+// only learns the answer again.
+func (s *Server) introspectRegistryTokenHandler(c *gin.Context) {
+	if _, _, _, ok := s.authenticateUsageWorker(c); !ok {
+		return
+	}
+
+	token := strings.TrimSpace(c.PostForm("token"))
+	service := strings.TrimSpace(c.PostForm("service"))
+	if service == "" {
+		service = s.registryServiceForRequest(c)
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, s.introspectRegistryToken(c.Request.Context(), token, service))
+}
+
+// introspectRegistryToken reports a token inactive when it does not verify or
+// was revoked, and also while its registry or tenant is suspended: the edge
+// worker serves pulls on introspection alone, so it must see a suspension as
+// soon as registryBearerAuthMiddleware does.
+func (s *Server) introspectRegistryToken(ctx context.Context, token, service string) registryTokenIntrospectionResponse {
+	claims, err := s.verifyRegistryToken(token, service)
+	if err != nil {
+		return registryTokenIntrospectionResponse{Active: false}
+	}
+	if s.registryAccessState(ctx, claims.Subject).State == db.AccessStateSuspended {
+		return registryTokenIntrospectionResponse{Active: false}
+	}
+
+	resp := registryTokenIntrospectionResponse{
+		Active:   true,
+		Subject:  claims.Subject,
+		JTI:      claims.ID,
+		APIKeyID: claims.APIKeyID,
+	}
+	if claims.IssuedAt != nil {
+		resp.IssuedAt = claims.IssuedAt.Unix()
+	}
+	if claims.ExpiresAt != nil {
+		resp.ExpiresAt = claims.ExpiresAt.Unix()
+	}
+	return resp
+}
+
+type revokeRegistryTokenRequest struct {
+	Token string `json:"token"`
+}
+
+// revokeRegistryTokenHandler handles POST /api/v1/registry-tokens/revoke. It
+// denylists a single leaked registry token by jti; the token must belong to a
+// registry in the caller's tenant.
+func (s *Server) revokeRegistryTokenHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	var req revokeRegistryTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Token) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token is required"})
+		return
+	}
+
+	// The audience is not checked: a token is revocable whichever service it
+	// was minted for, as long as our key signed it.
+	claims, err := s.verifyRegistryToken(strings.TrimSpace(req.Token), "")
+	if err != nil {
+		if errors.Is(err, errRegistryTokenRevoked) {
+			c.Status(http.StatusNoContent)
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token is invalid or expired"})
+		return
+	}
+	if claims.ID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token has no jti"})
+		return
+	}
+
+	reg, err := s.db.GetRegistryByName(c.Request.Context(), claims.Subject)
+	if err != nil || reg.TenantID != u.tenantID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+
+	expiresAt := registryTokensExpireAt(time.Now().UTC())
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Add(registryTokenLeeway)
+	}
+	setAuditTarget(c, claims.ID)
+	if err := s.db.RevokeRegistryToken(c.Request.Context(), claims.ID, expiresAt); err != nil {
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
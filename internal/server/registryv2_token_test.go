@@ -1,6 +1,7 @@
 package server
 
 import (
+	"slices"
 	"testing"
 
 	"bin2.io/internal/db"
@@ -48,12 +49,12 @@ func TestRequiredRegistryScope(t *testing.T) {
 		{path: "alpha/app/blobs/uploads/123", method: "PATCH", wantScope: "repository:alpha/app:push"},
 		{path: "alpha/app/blobs/uploads/123", method: "PUT", wantScope: "repository:alpha/app:push"},
 		{path: "alpha/app/blobs/sha256:abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789", method: "GET", wantScope: "repository:alpha/app:pull"},
-		{path: "alpha/app/blobs/sha256:abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789", method: "DELETE", wantScope: "repository:alpha/app:push"},
+		{path: "alpha/app/blobs/sha256:abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789", method: "DELETE", wantScope: "repository:alpha/app:delete"},
 		{path: "alpha/app/tags/list", method: "GET", wantScope: "repository:alpha/app:pull"},
 		{path: "alpha/app/referrers/sha256:abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789", method: "GET", wantScope: "repository:alpha/app:pull"},
 		{path: "alpha/app/manifests/latest", method: "GET", wantScope: "repository:alpha/app:pull"},
 		{path: "alpha/app/manifests/latest", method: "PUT", wantScope: "repository:alpha/app:push"},
-		{path: "alpha/app/manifests/latest", method: "DELETE", wantScope: "repository:alpha/app:push"},
+		{path: "alpha/app/manifests/latest", method: "DELETE", wantScope: "repository:alpha/app:delete"},
 		{path: "", method: "GET", wantScope: ""},
 		{path: "token", method: "GET", wantScope: ""},
 	}
@@ -108,3 +109,86 @@ func TestGrantRegistryTokenScopesRespectsRepoScope(t *testing.T) {
 		t.Fatalf("actions = %#v", granted[0].Actions)
 	}
 }
+
+func TestGrantRegistryTokenScopesRespectsRepoPattern(t *testing.T) {
+	registryID := uuid.New()
+	pattern := "team-a/**"
+	apiScopes := []db.APIKeyScope{{
+		RegistryID:        registryID,
+		RepositoryPattern: &pattern,
+		Permission:        db.APIKeyPermissionWrite,
+	}}
+	requested := []registryTokenAccess{
+		{Type: "repository", Name: "alpha/team-a/new-service", Actions: []string{"pull", "push"}},
+		{Type: "repository", Name: "alpha/team-b/app", Actions: []string{"pull", "push"}},
+	}
+
+	granted := grantRegistryTokenScopes(registryID, "alpha", apiScopes, requested)
+	if len(granted) != 1 || granted[0].Name != "alpha/team-a/new-service" {
+		t.Fatalf("granted = %#v", granted)
+	}
+	if !slices.Equal(granted[0].Actions, []string{"pull", "push"}) {
+		t.Fatalf("actions = %#v", granted[0].Actions)
+	}
+}
+
+func TestGrantRegistryTokenScopesDeleteRequiresAdmin(t *testing.T) {
+	registryID := uuid.New()
+	requested := []registryTokenAccess{
+		{Type: "repository", Name: "alpha/app", Actions: []string{"*"}},
+	}
+
+	tests := []struct {
+		permission db.APIKeyPermission
+		want       []string
+	}{
+		{permission: db.APIKeyPermissionRead, want: []string{"pull"}},
+		{permission: db.APIKeyPermissionWrite, want: []string{"pull", "push"}},
+		{permission: db.APIKeyPermissionAdmin, want: []string{"delete", "pull", "push"}},
+	}
+
+	for _, tt := range tests {
+		apiScopes := []db.APIKeyScope{{RegistryID: registryID, Permission: tt.permission}}
+		granted := grantRegistryTokenScopes(registryID, "alpha", apiScopes, requested)
+		if len(granted) != 1 || !slices.Equal(granted[0].Actions, tt.want) {
+			t.Fatalf("permission=%s granted = %#v, want actions %v", tt.permission, granted, tt.want)
+		}
+	}
+}
+
+func TestSplitOAuthScopes(t *testing.T) {
+	got := splitOAuthScopes([]string{
+		"repository:alpha/app:pull repository:alpha/app:push",
+		"  repository:alpha/worker:pull  ",
+		"",
+	})
+	want := []string{
+		"repository:alpha/app:pull",
+		"repository:alpha/app:push",
+		"repository:alpha/worker:pull",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("scopes = %#v, want %#v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("scopes[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestRegistryRefreshTokenFormat(t *testing.T) {
+	token, err := generateRegistryRefreshToken()
+	if err != nil {
+		t.Fatalf("generateRegistryRefreshToken: %v", err)
+	}
+	if !validRegistryRefreshToken(token) {
+		t.Fatalf("generated token %q failed validation", token)
+	}
+	if validRegistryRefreshToken("sk_0123456789abcdef_ABCDEFGHIJKLMNOPQRSTUVWXYZ234567") {
+		t.Fatalf("api key accepted as refresh token")
+	}
+	if hashRegistryRefreshToken(token) == hashRegistryRefreshToken(token+"x") {
+		t.Fatalf("distinct tokens hashed to the same value")
+	}
+}
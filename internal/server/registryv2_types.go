@@ -51,14 +51,16 @@ const (
 )
 
 var (
-	reStartUpload = regexp.MustCompile(`^(.+)/blobs/uploads/$`)
-	reUploadChunk = regexp.MustCompile(`^(.+)/blobs/uploads/([^/]+)$`)
-	reBlobPath    = regexp.MustCompile(`^(.+)/blobs/([^/]+)$`)
-	reManifestRef = regexp.MustCompile(`^(.+)/manifests/([^/]+)$`)
-	reTagsList    = regexp.MustCompile(`^(.+)/tags/list$`)
-	reReferrers   = regexp.MustCompile(`^(.+)/referrers/([^/]+)$`)
-	reDigest      = regexp.MustCompile(`^sha256:([a-fA-F0-9]{64})$`)
-	reRepoSeg     = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
-	reUUID        = regexp.MustCompile(`^[a-f0-9-]{36}$`)
-	reRange       = regexp.MustCompile(`^(\d+)-(\d+)$`)
+	reStartUpload    = regexp.MustCompile(`^(.+)/blobs/uploads/$`)
+	reUploadChunk    = regexp.MustCompile(`^(.+)/blobs/uploads/([^/]+)$`)
+	reBlobPath       = regexp.MustCompile(`^(.+)/blobs/([^/]+)$`)
+	reManifestRef    = regexp.MustCompile(`^(.+)/manifests/([^/]+)$`)
+	reTagsList       = regexp.MustCompile(`^(.+)/tags/list$`)
+	reReferrers      = regexp.MustCompile(`^(.+)/referrers/([^/]+)$`)
+	reDigest         = regexp.MustCompile(`^sha256:([a-fA-F0-9]{64})$`)
+	reRepoSeg        = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+	reRepoPatternSeg = regexp.MustCompile(`^[A-Za-z0-9._*?-]+$`)
+	reUUID           = regexp.MustCompile(`^[a-f0-9-]{36}$`)
+	reRange          = regexp.MustCompile(`^(\d+)-(\d+)$`)
+	reBlobRange      = regexp.MustCompile(`^bytes=(\d*)-(\d*)$`)
 )
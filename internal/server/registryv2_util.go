@@ -1,8 +1,10 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"path"
 	"strconv"
 	"strings"
 
@@ -66,6 +68,46 @@ func validRepoName(repo string) bool {
 	return true
 }
 
+// validRepoPattern reports whether pattern is a usable repository scope
+// pattern: path segments of repository-name characters plus the glob
+// metacharacters '*' and '?', with an optional final "**" segment.
+func validRepoPattern(pattern string) bool {
+	if pattern == "" || strings.Contains(pattern, "..") {
+		return false
+	}
+	parts := strings.Split(pattern, "/")
+	for i, part := range parts {
+		if part == "**" && i == len(parts)-1 {
+			continue
+		}
+		if part == "" || !reRepoPatternSeg.MatchString(part) || strings.Contains(part, "**") {
+			return false
+		}
+	}
+	return true
+}
+
+// matchRepositoryPattern matches a repository leaf against a scope pattern.
+// Each segment is matched with path.Match, so '*' never crosses '/'; a final
+// "**" segment matches one or more remaining segments.
+// e.g. "team-a/**" matches "team-a/app" and "team-a/tools/lint", not "team-a".
+func matchRepositoryPattern(pattern, repo string) bool {
+	patternParts := strings.Split(pattern, "/")
+	repoParts := strings.Split(repo, "/")
+	for i, part := range patternParts {
+		if part == "**" && i == len(patternParts)-1 {
+			return len(repoParts) > i
+		}
+		if i >= len(repoParts) {
+			return false
+		}
+		if ok, err := path.Match(part, repoParts[i]); err != nil || !ok {
+			return false
+		}
+	}
+	return len(repoParts) == len(patternParts)
+}
+
 func validReference(reference string) bool {
 	if reference == "" {
 		return false
@@ -123,6 +165,48 @@ func parseUploadRange(raw string) (int64, int64, error) {
 	return start, end, nil
 }
 
+// errBlobRangeNotSatisfiable is returned for a Range that no byte of the blob
+// is in.
+var errBlobRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// parseBlobRange returns the first byte and the length of the single byte
+// range a Range header asks of a blob of size bytes. ok is false for a header
+// that is not honoured, that is another unit, several ranges or a malformed
+// one; the whole blob is served for it, as RFC 9110 allows.
+func parseBlobRange(raw string, size int64) (start, length int64, ok bool, err error) {
+	matches := reBlobRange.FindStringSubmatch(strings.TrimSpace(raw))
+	if len(matches) != 3 || (matches[1] == "" && matches[2] == "") {
+		return 0, 0, false, nil
+	}
+	if matches[1] == "" {
+		suffix, err := strconv.ParseInt(matches[2], 10, 64)
+		if err != nil {
+			return 0, 0, false, nil
+		}
+		if suffix == 0 || size == 0 {
+			return 0, 0, false, errBlobRangeNotSatisfiable
+		}
+		suffix = min(suffix, size)
+		return size - suffix, suffix, true, nil
+	}
+	start, err = strconv.ParseInt(matches[1], 10, 64)
+	if err != nil {
+		return 0, 0, false, nil
+	}
+	end := size - 1
+	if matches[2] != "" {
+		last, err := strconv.ParseInt(matches[2], 10, 64)
+		if err != nil || last < start {
+			return 0, 0, false, nil
+		}
+		end = min(last, end)
+	}
+	if start >= size {
+		return 0, 0, false, errBlobRangeNotSatisfiable
+	}
+	return start, end - start + 1, true, nil
+}
+
 func uploadRangeMatchesContentLength(start, end, contentLength int64) bool {
 	if contentLength < 0 {
 		return true
@@ -38,3 +38,73 @@ func TestUploadRangeMatchesContentLength(t *testing.T) {
 		t.Fatalf("unknown content length should be accepted")
 	}
 }
+
+func TestMatchRepositoryPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		repo    string
+		want    bool
+	}{
+		{pattern: "team-a/**", repo: "team-a/app", want: true},
+		{pattern: "team-a/**", repo: "team-a/tools/lint", want: true},
+		{pattern: "team-a/**", repo: "team-a", want: false},
+		{pattern: "team-a/**", repo: "team-b/app", want: false},
+		{pattern: "team-a/*", repo: "team-a/app", want: true},
+		{pattern: "team-a/*", repo: "team-a/tools/lint", want: false},
+		{pattern: "*-prod", repo: "api-prod", want: true},
+		{pattern: "*-prod", repo: "team-a/api-prod", want: false},
+		{pattern: "app", repo: "app", want: true},
+	}
+
+	for _, tt := range tests {
+		if got := matchRepositoryPattern(tt.pattern, tt.repo); got != tt.want {
+			t.Fatalf("matchRepositoryPattern(%q, %q) = %v, want %v", tt.pattern, tt.repo, got, tt.want)
+		}
+	}
+}
+
+func TestValidRepoPattern(t *testing.T) {
+	valid := []string{"alpha/team-a/**", "alpha/*-prod", "alpha/app?"}
+	for _, pattern := range valid {
+		if !validRepoPattern(pattern) {
+			t.Fatalf("validRepoPattern(%q) = false, want true", pattern)
+		}
+	}
+
+	invalid := []string{"", "alpha/**/app", "alpha/a**", "alpha//app", "alpha/../b", "alpha/[ab]"}
+	for _, pattern := range invalid {
+		if validRepoPattern(pattern) {
+			t.Fatalf("validRepoPattern(%q) = true, want false", pattern)
+		}
+	}
+}
+
+func TestParseBlobRange(t *testing.T) {
+	tests := []struct {
+		raw           string
+		start, length int64
+		ok            bool
+		unsatisfiable bool
+	}{
+		{raw: "bytes=0-9", start: 0, length: 10, ok: true},
+		{raw: "bytes=10-", start: 10, length: 90, ok: true},
+		{raw: "bytes=90-500", start: 90, length: 10, ok: true},
+		{raw: "bytes=-30", start: 70, length: 30, ok: true},
+		{raw: "bytes=-500", start: 0, length: 100, ok: true},
+		{raw: "bytes=100-", unsatisfiable: true},
+		{raw: "bytes=-0", unsatisfiable: true},
+		{raw: "bytes=9-3"},
+		{raw: "bytes=0-1,5-6"},
+		{raw: "items=0-9"},
+		{raw: "bytes=-"},
+	}
+	for _, tc := range tests {
+		start, length, ok, err := parseBlobRange(tc.raw, 100)
+		if tc.unsatisfiable != (err != nil) || ok != tc.ok || start != tc.start || length != tc.length {
+			t.Errorf("parseBlobRange(%q, 100) = %d, %d, %v, %v", tc.raw, start, length, ok, err)
+		}
+	}
+	if _, _, _, err := parseBlobRange("bytes=-1", 0); err == nil {
+		t.Error("suffix range of an empty blob is satisfiable")
+	}
+}
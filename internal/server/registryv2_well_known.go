@@ -28,43 +28,34 @@ func (s *Server) addWellKnownRoutes() {
 }
 
 func (s *Server) registryJWKSHandler(c *gin.Context) {
-	publicKey := s.registryJWTPublicKey
-	if publicKey == nil {
+	keys := s.registryJWTKeys.current().verification
+	if len(keys) == 0 {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "registry public key is not configured",
 		})
 		return
 	}
 
-	if len(publicKey) != ed25519.PublicKeySize {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "registry public key is invalid",
-		})
-		return
-	}
-
-	encodedX := base64.RawURLEncoding.EncodeToString(publicKey)
-
-	keyID, err := registryJWKKeyID(publicKey)
-	if err != nil {
-		logError(err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "could not encode registry public key",
-		})
-		return
-	}
-
-	c.Header("Cache-Control", "public, max-age=300")
-	c.JSON(http.StatusOK, jwksResponse{
-		Keys: []jwk{{
+	out := make([]jwk, 0, len(keys))
+	for _, key := range keys {
+		if len(key.publicKey) != ed25519.PublicKeySize {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "registry public key is invalid",
+			})
+			return
+		}
+		out = append(out, jwk{
 			Kty: "OKP",
 			Use: "sig",
-			Kid: keyID,
+			Kid: key.kid,
 			Alg: "EdDSA",
 			Crv: "Ed25519",
-			X:   encodedX,
-		}},
-	})
+			X:   base64.RawURLEncoding.EncodeToString(key.publicKey),
+		})
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, jwksResponse{Keys: out})
 }
 
 func registryJWKKeyID(publicKey any) (string, error) {
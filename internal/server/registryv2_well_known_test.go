@@ -1,12 +1,11 @@
 package server
 
 import (
-	"crypto/ed25519"
-	"crypto/rand"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -14,14 +13,17 @@ import (
 func TestRegistryJWKSRoute(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
-	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	now := time.Now().UTC()
+	previous := newTestRegistryJWTKey(t, "previous", now.Add(-time.Hour))
+	active := newTestRegistryJWTKey(t, "active", now.Add(-time.Minute))
+	keys, err := buildRegistryJWTKeySet([]registryJWTKey{previous, active}, now)
 	if err != nil {
-		t.Fatalf("generate key: %v", err)
+		t.Fatalf("buildRegistryJWTKeySet: %v", err)
 	}
 
 	s := &Server{
-		router:               gin.New(),
-		registryJWTPublicKey: publicKey,
+		router:          gin.New(),
+		registryJWTKeys: newStaticRegistryJWTKeyring(keys),
 	}
 	s.addWellKnownRoutes()
 
@@ -44,10 +46,13 @@ func TestRegistryJWKSRoute(t *testing.T) {
 	if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
 		t.Fatalf("unmarshal response: %v", err)
 	}
-	if len(body.Keys) != 1 {
-		t.Fatalf("keys len = %d, want 1", len(body.Keys))
+	if len(body.Keys) != 2 {
+		t.Fatalf("keys len = %d, want 2", len(body.Keys))
 	}
-	key := body.Keys[0]
+	if body.Keys[0].Kid != "previous" || body.Keys[1].Kid != "active" {
+		t.Fatalf("kids = %q, %q", body.Keys[0].Kid, body.Keys[1].Kid)
+	}
+	key := body.Keys[1]
 	if key.Kty != "OKP" {
 		t.Fatalf("kty = %q, want OKP", key.Kty)
 	}
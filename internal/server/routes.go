@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"time"
 
+	"bin2.io/internal/db"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
@@ -12,7 +13,7 @@ func (s *Server) addRoutes() {
 	s.router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", orgHeader},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: false,
 		MaxAge:           12 * time.Hour,
@@ -26,6 +27,7 @@ func (s *Server) addRoutes() {
 	s.addRegistryRoutes()
 
 	api := s.router.Group("/api/v1")
+	api.Use(s.managementAuditMiddleware())
 	api.GET("/healthz", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	})
@@ -35,19 +37,51 @@ func (s *Server) addRoutes() {
 	registries.GET("", s.listRegistriesHandler)
 	registries.GET("/:id", s.getRegistryByIDHandler)
 	registries.GET("/exists", s.getRegistryExistsHandler)
-	registries.POST("", s.addRegistryHandler)
-	registries.DELETE("/:id", s.removeRegistryHandler)
+	registries.POST("", s.requireOrgRole(db.OrgRoleAdmin), s.addRegistryHandler)
+	registries.DELETE("/:id", s.requireOrgRole(db.OrgRoleOwner), s.removeRegistryHandler)
+	registries.PUT("/:id/allowed-cidrs", s.requireOrgRole(db.OrgRoleAdmin), s.setRegistryAllowedCIDRsHandler)
+	registries.PUT("/:id/quota", s.requireOrgRole(db.OrgRoleAdmin), s.setRegistryStorageQuotaHandler)
+	registries.DELETE("/:id/quota", s.requireOrgRole(db.OrgRoleAdmin), s.removeRegistryStorageQuotaHandler)
 
 	repositories := api.Group("/repositories")
 	repositories.Use(s.authMiddleware())
 	repositories.GET("", s.listRepositoriesHandler)
-	repositories.DELETE("/:id", s.removeRepositoryHandler)
+	repositories.DELETE("/:id", s.requireOrgRole(db.OrgRoleAdmin), s.removeRepositoryHandler)
+	repositories.PUT("/:id/quota", s.requireOrgRole(db.OrgRoleAdmin), s.setRepositoryStorageQuotaHandler)
+	repositories.DELETE("/:id/quota", s.requireOrgRole(db.OrgRoleAdmin), s.removeRepositoryStorageQuotaHandler)
+
+	quotas := api.Group("/quotas")
+	quotas.Use(s.authMiddleware())
+	quotas.GET("", s.listStorageQuotasHandler)
+	quotas.GET("/breaches", s.listStorageQuotaBreachesHandler)
 
 	apikeys := api.Group("/api-keys")
 	apikeys.Use(s.authMiddleware())
 	apikeys.POST("", s.addAPIKeyHandler)
 	apikeys.GET("", s.listAPIKeysHandler)
 	apikeys.DELETE(":id", s.removeAPIKeyHandler)
+	apikeys.DELETE(":id/refresh-tokens", s.revokeAPIKeyRefreshTokensHandler)
+	apikeys.POST(":id/revoke-tokens", s.revokeAPIKeyTokensHandler)
+	apikeys.PUT(":id/allowed-cidrs", s.setAPIKeyAllowedCIDRsHandler)
+
+	registryTokens := api.Group("/registry-tokens")
+	registryTokens.POST("/introspect", s.introspectRegistryTokenHandler)
+	registryTokens.POST("/revoke", s.authMiddleware(), s.requireOrgRole(db.OrgRoleMember), s.revokeRegistryTokenHandler)
+
+	audit := api.Group("/audit")
+	audit.Use(s.authMiddleware(), s.requireOrgRole(db.OrgRoleAdmin))
+	audit.GET("", s.listAuditEventsHandler)
+	audit.GET("/export", s.exportAuditEventsHandler)
+
+	org := api.Group("/org")
+	org.Use(s.authMiddleware())
+	org.GET("", s.getOrgHandler)
+	org.GET("/members", s.listOrgMembersHandler)
+	org.PUT("/members/:id/role", s.requireUserActor(), s.requireOrgRole(db.OrgRoleAdmin), s.setOrgMemberRoleHandler)
+	org.DELETE("/members/:id", s.requireUserActor(), s.removeOrgMemberHandler)
+	org.GET("/invitations", s.requireOrgRole(db.OrgRoleAdmin), s.listOrgInvitationsHandler)
+	org.POST("/invitations", s.requireUserActor(), s.requireOrgRole(db.OrgRoleAdmin), s.createOrgInvitationHandler)
+	org.DELETE("/invitations/:id", s.requireUserActor(), s.requireOrgRole(db.OrgRoleAdmin), s.removeOrgInvitationHandler)
 
 	users := api.Group("/users")
 	users.Use(s.authMiddleware())
@@ -56,5 +90,64 @@ func (s *Server) addRoutes() {
 	usage := api.Group("/usage")
 	usage.GET("/events", s.listUsageEventsHandler)
 	usage.GET("/summary", s.authMiddleware(), s.usageSummaryHandler)
+	usage.GET("/breakdown", s.authMiddleware(), s.usageBreakdownHandler)
+	usage.GET("/series", s.authMiddleware(), s.usageSeriesHandler)
+	usage.GET("/export", s.authMiddleware(), s.exportUsageEventsHandler)
 	usage.POST("/events", s.ingestUsageEventsHandler)
+
+	invoices := api.Group("/invoices")
+	invoices.Use(s.authMiddleware())
+	invoices.GET("", s.listInvoicesHandler)
+	invoices.GET("/:invoiceId", s.getInvoiceHandler)
+
+	budgets := api.Group("/budgets")
+	budgets.Use(s.authMiddleware())
+	budgets.GET("", s.listUsageBudgetsHandler)
+	budgets.POST("", s.requireOrgRole(db.OrgRoleAdmin), s.createUsageBudgetHandler)
+	budgets.PUT("/:id", s.requireOrgRole(db.OrgRoleAdmin), s.updateUsageBudgetHandler)
+	budgets.DELETE("/:id", s.requireOrgRole(db.OrgRoleAdmin), s.deleteUsageBudgetHandler)
+
+	s.addOperatorRoutes()
+}
+
+// addOperatorRoutes registers the cross-tenant operator API. It shares no
+// authentication with /api/v1: only operator tokens are accepted.
+func (s *Server) addOperatorRoutes() {
+	admin := s.router.Group("/admin/v1")
+	admin.Use(s.operatorAuditMiddleware(), s.operatorAuthMiddleware())
+
+	tenants := admin.Group("/tenants")
+	tenants.GET("", s.listOperatorTenantsHandler)
+	tenants.GET("/:id", s.getOperatorTenantHandler)
+	tenants.GET("/:id/usage/summary", s.operatorTenantUsageHandler(s.writeUsageSummary))
+	tenants.GET("/:id/usage/breakdown", s.operatorTenantUsageHandler(s.writeUsageBreakdown))
+	tenants.GET("/:id/usage/series", s.operatorTenantUsageHandler(s.writeUsageSeries))
+	tenants.GET("/:id/usage/export", s.operatorTenantUsageHandler(s.writeUsageEventExport))
+	tenants.GET("/:id/invoices", s.operatorTenantUsageHandler(s.writeInvoices))
+	tenants.GET("/:id/invoices/:invoiceId", s.operatorTenantUsageHandler(s.writeInvoice))
+	tenants.PUT("/:id/state", s.setOperatorTenantStateHandler)
+	tenants.PUT("/:id/plan", s.setOperatorTenantPlanHandler)
+	tenants.POST("/:id/revoke-api-keys", s.revokeOperatorTenantAPIKeysHandler)
+	tenants.GET("/:id/storage", s.getOperatorTenantStorageHandler)
+	tenants.POST("/:id/storage/reconcile", s.reconcileOperatorTenantStorageHandler)
+
+	registries := admin.Group("/registries")
+	registries.GET("", s.listOperatorRegistriesHandler)
+	registries.PUT("/:id/state", s.setOperatorRegistryStateHandler)
+	registries.POST("/:id/transfer", s.transferOperatorRegistryHandler)
+
+	admin.DELETE("/api-keys/:id", s.revokeOperatorAPIKeyHandler)
+	admin.GET("/storage-drift", s.listOperatorStorageDriftHandler)
+	admin.GET("/usage-pipeline", s.getOperatorUsagePipelineHandler)
+
+	usageWorkers := admin.Group("/usage-workers")
+	usageWorkers.GET("", s.listOperatorUsageWorkersHandler)
+	usageWorkers.POST("", s.createOperatorUsageWorkerHandler)
+	usageWorkers.DELETE("/:id", s.revokeOperatorUsageWorkerHandler)
+	usageWorkers.GET("/:id/batches", s.listOperatorUsageIngestBatchesHandler)
+
+	plans := admin.Group("/plans")
+	plans.GET("", s.listOperatorPlansHandler)
+	plans.PUT("/:name", s.putOperatorPlanHandler)
+	plans.POST("/:name/prices", s.addOperatorPlanPriceHandler)
 }
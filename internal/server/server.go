@@ -2,18 +2,18 @@ package server
 
 import (
 	"context"
-	"crypto/ed25519"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"bin2.io/internal/db"
-	"github.com/MicahParks/keyfunc/v3"
 	"github.com/gin-gonic/gin"
-	"github.com/workos/workos-go/v4/pkg/usermanagement"
 )
 
 type probeCache struct {
@@ -33,19 +33,37 @@ func (p *probeCache) shouldUpdate(digest string) bool {
 	return true
 }
 
+// shutdownTimeout bounds finishing in-flight requests, and then storing
+// queued usage events, when the server stops.
+const shutdownTimeout = 30 * time.Second
+
 type Server struct {
-	ctx                   context.Context
-	router                *gin.Engine
-	db                    *db.DB
-	registryStorage       registryStorageBackend
-	registryJWTPrivateKey ed25519.PrivateKey
-	registryJWTPublicKey  ed25519.PublicKey
-	registryService       string
-	jwks                  keyfunc.Keyfunc
-	workosClientID        string
-	apiKeyEncryptionKey   [32]byte
-	probeCache            *probeCache
-	usageIngestSecret     string
+	ctx                 context.Context
+	router              *gin.Engine
+	db                  *db.DB
+	registryStorage     registryStorageBackend
+	registryJWTKeys     *registryJWTKeyring
+	registryRevocations *registryTokenRevocations
+	registryStates      *registryAccessStates
+	registryService     string
+	identity            identityProvider
+	apiKeyEncryptionKey [32]byte
+	probeCache          *probeCache
+	// operatorTokens authenticate the /admin/v1 API; it is closed when
+	// there are none.
+	operatorTokens []operatorToken
+	// rateLimiter is nil when rate limiting is off.
+	rateLimiter *rateLimiter
+	// webhookClient delivers usage budget alerts.
+	webhookClient *http.Client
+	// storageReconciliation is the STORAGE_RECONCILIATION mode.
+	storageReconciliation string
+	// usageIngestLogRetention is how long ingested usage batches are kept.
+	usageIngestLogRetention time.Duration
+	// usageEvents stores usage events emitted while serving requests.
+	usageEvents *usagePipeline
+	// registryAudit stores the /v2 audit trail.
+	registryAudit *registryAuditWriter
 }
 
 func New() (*Server, error) {
@@ -60,22 +78,9 @@ func New() (*Server, error) {
 	var apiKeyEncryptionKey [32]byte
 	copy(apiKeyEncryptionKey[:], apiKeyEncKeyBytes)
 
-	workosAPIKey := os.Getenv("WORKOS_API_KEY")
-	if workosAPIKey == "" {
-		return nil, fmt.Errorf("WORKOS_API_KEY is not defined")
-	}
-
-	workosClientID := os.Getenv("WORKOS_CLIENT_ID")
-	if workosClientID == "" {
-		return nil, fmt.Errorf("WORKOS_CLIENT_ID is not defined")
-	}
-
-	usermanagement.SetAPIKey(workosAPIKey)
-
-	jwksURL := fmt.Sprintf("https://api.workos.com/sso/jwks/%s", workosClientID)
-	jwks, err := keyfunc.NewDefault([]string{jwksURL})
+	identity, err := newIdentityProviderFromEnv(context.Background())
 	if err != nil {
-		return nil, fmt.Errorf("could not initialize JWKS: %w", err)
+		return nil, err
 	}
 
 	cfg, err := db.NewConfigFromEnv()
@@ -97,32 +102,83 @@ func New() (*Server, error) {
 		return nil, fmt.Errorf("could not initialize registry storage: %w", err)
 	}
 
-	registryJWTPrivateKey, registryJWTPublicKey, err := loadRegistryJWTKeys()
+	registryJWTEnvKey, err := loadRegistryJWTEnvKey()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not load registry jwt keys: %w", err)
+	}
+	registryJWTKeys, err := newRegistryJWTKeyring(
+		context.Background(),
+		registryJWTKeyLoader(conn, apiKeyEncryptionKey, registryJWTEnvKey),
+	)
 	if err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("could not load registry jwt keys: %w", err)
 	}
 
-	usageIngestSecret := strings.TrimSpace(os.Getenv("USAGE_INGEST_SECRET"))
-	if usageIngestSecret == "" {
+	if os.Getenv("USAGE_INGEST_SECRET") != "" {
+		slog.Warn("Usage", slog.String("ignored", "USAGE_INGEST_SECRET; edge workers sign requests with their own secrets, see init admin usage-workers"))
+	}
+
+	operatorTokens, err := operatorTokensFromEnv()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	storageReconciliation, err := storageReconciliationModeFromEnv()
+	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("USAGE_INGEST_SECRET is not defined")
+		return nil, err
+	}
+
+	usageIngestLogRetention, err := usageIngestLogRetentionFromEnv()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	rateLimiter, err := newRateLimiterFromEnv(context.Background(), conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not initialize rate limiting: %w", err)
+	}
+
+	router := gin.Default()
+	if err := router.SetTrustedProxies(trustedProxiesFromEnv()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
 	}
 
 	s := &Server{
-		ctx:                   context.Background(),
-		router:                gin.Default(),
-		db:                    conn,
-		registryStorage:       rs,
-		registryJWTPrivateKey: registryJWTPrivateKey,
-		registryJWTPublicKey:  registryJWTPublicKey,
-		registryService:       strings.TrimSpace(getenvDefault("REGISTRY_SERVICE", "")),
-		jwks:                  jwks,
-		workosClientID:        workosClientID,
-		apiKeyEncryptionKey:   apiKeyEncryptionKey,
-		probeCache:            &probeCache{recent: make(map[string]time.Time)},
-		usageIngestSecret:     usageIngestSecret,
+		ctx:                     context.Background(),
+		router:                  router,
+		db:                      conn,
+		registryStorage:         rs,
+		registryJWTKeys:         registryJWTKeys,
+		registryRevocations:     newRegistryTokenRevocations(),
+		registryStates:          newRegistryAccessStates(),
+		registryService:         strings.TrimSpace(getenvDefault("REGISTRY_SERVICE", "")),
+		identity:                identity,
+		apiKeyEncryptionKey:     apiKeyEncryptionKey,
+		probeCache:              &probeCache{recent: make(map[string]time.Time)},
+		operatorTokens:          operatorTokens,
+		rateLimiter:             rateLimiter,
+		webhookClient:           newUsageWebhookClient(),
+		storageReconciliation:   storageReconciliation,
+		usageIngestLogRetention: usageIngestLogRetention,
+	}
+	if err := s.reloadRegistryTokenRevocations(context.Background()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not load registry token revocations: %w", err)
 	}
+	if s.usageEvents, err = newUsagePipelineFromEnv(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.registryAudit = newRegistryAuditWriter(func(ctx context.Context, events []db.AuditEvent) {
+		storeRegistryAuditEvents(ctx, conn, events)
+	})
 	s.addRoutes()
 	return s, nil
 }
@@ -133,10 +189,56 @@ func (s *Server) Context() context.Context {
 
 func (s *Server) Run(ctx context.Context, listen string) error {
 	s.ctx = ctx
-	return s.router.Run(listen)
+	go s.watchRegistryTokenRevocations(ctx)
+	go s.runUsageRollups(ctx)
+	go s.runUsageBudgets(ctx)
+	go s.runUsageIngestLogPruning(ctx)
+	if s.usageEvents != nil {
+		go s.runUsageBacklogReports(ctx)
+	}
+	if s.storageReconciliation != storageReconciliationOff {
+		go s.runStorageReconciliation(ctx)
+	}
+	if s.rateLimiter != nil {
+		go s.rateLimiter.run(ctx)
+	}
+
+	srv := &http.Server{Addr: listen, Handler: s.router}
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logError(fmt.Errorf("could not shut down gracefully: %w", err))
+		}
+	}()
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-shutdown
+	return nil
 }
 
+// Close stores the usage and audit events still queued, reports the usage
+// events left to replay, and closes the database.
 func (s *Server) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if s.usageEvents != nil {
+		if err := s.usageEvents.close(ctx); err != nil {
+			logError(fmt.Errorf("could not store queued usage events: %w", err))
+		}
+		if err := s.reportUsageBacklog(ctx, s.usageEvents.snapshot().backlog()); err != nil {
+			logError(fmt.Errorf("could not report usage backlog: %w", err))
+		}
+	}
+	if s.registryAudit != nil {
+		if err := s.registryAudit.close(ctx); err != nil {
+			logError(fmt.Errorf("could not store queued audit events: %w", err))
+		}
+	}
 	if s.db != nil {
 		s.db.Close()
 	}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type storageQuotaRequest struct {
+	SoftLimitBytes *int64 `json:"softLimitBytes"`
+	HardLimitBytes *int64 `json:"hardLimitBytes"`
+}
+
+type storageQuotaResponse struct {
+	Scope          string  `json:"scope"`
+	ID             string  `json:"id"`
+	Name           string  `json:"name,omitempty"`
+	Plan           string  `json:"plan,omitempty"`
+	SoftLimitBytes *int64  `json:"softLimitBytes"`
+	HardLimitBytes *int64  `json:"hardLimitBytes"`
+	UsedBytes      int64   `json:"usedBytes"`
+	UpdatedAt      *string `json:"updatedAt,omitempty"`
+}
+
+type storageQuotaBreachResponse struct {
+	ID         string  `json:"id"`
+	Scope      string  `json:"scope"`
+	ScopeID    string  `json:"scopeId"`
+	LimitBytes int64   `json:"limitBytes"`
+	UsedBytes  int64   `json:"usedBytes"`
+	CreatedAt  string  `json:"createdAt"`
+	ResolvedAt *string `json:"resolvedAt"`
+}
+
+func validateStorageQuotaRequest(req storageQuotaRequest) error {
+	if req.SoftLimitBytes == nil && req.HardLimitBytes == nil {
+		return fmt.Errorf("softLimitBytes or hardLimitBytes is required")
+	}
+	if req.SoftLimitBytes != nil && *req.SoftLimitBytes <= 0 {
+		return fmt.Errorf("softLimitBytes must be positive")
+	}
+	if req.HardLimitBytes != nil && *req.HardLimitBytes <= 0 {
+		return fmt.Errorf("hardLimitBytes must be positive")
+	}
+	if req.SoftLimitBytes != nil && req.HardLimitBytes != nil && *req.SoftLimitBytes > *req.HardLimitBytes {
+		return fmt.Errorf("softLimitBytes must not exceed hardLimitBytes")
+	}
+	return nil
+}
+
+func newStorageQuotaResponse(usage db.StorageQuotaUsage) storageQuotaResponse {
+	scope, scopeID := usage.Quota.Scope()
+	resp := storageQuotaResponse{
+		Scope:          scope,
+		ID:             scopeID.String(),
+		Name:           usage.Name,
+		Plan:           usage.Quota.Plan,
+		SoftLimitBytes: usage.Quota.SoftLimitBytes,
+		HardLimitBytes: usage.Quota.HardLimitBytes,
+		UsedBytes:      usage.UsedBytes,
+	}
+	if usage.Quota.ID != uuid.Nil {
+		updatedAt := usage.Quota.UpdatedAt.UTC().Format(time.RFC3339)
+		resp.UpdatedAt = &updatedAt
+	}
+	return resp
+}
+
+// storageQuotaExceededMessage describes the hard limit a push would exceed.
+func storageQuotaExceededMessage(usage db.StorageQuotaUsage) string {
+	scope, _ := usage.Quota.Scope()
+	if usage.Name != "" {
+		scope += " " + usage.Name
+	}
+	return fmt.Sprintf("storage quota exceeded: %s stores %d of %d bytes and this push adds %d",
+		scope, usage.UsedBytes, *usage.Quota.HardLimitBytes, usage.AddedBytes)
+}
+
+// checkStorageQuota reports whether storing objects, a map of digest to
+// size, in repo keeps its tenant, registry and repository within their hard
+// limits, writing a DENIED error when it does not. It refuses blob uploads
+// early; the manifest push that links them is held to the limits when it is
+// stored. Quotas are not enforced here when they cannot be read.
+func (s *Server) checkStorageQuota(c *gin.Context, registryID uuid.UUID, repo string, objects map[string]int64) bool {
+	if s.db == nil || registryID == uuid.Nil {
+		return true
+	}
+	usages, err := s.db.CheckStorageQuotas(c.Request.Context(), registryID, repoLeaf(repo), objects)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			logError(fmt.Errorf("could not check storage quota for %s: %w", repo, err))
+		}
+		return true
+	}
+	for _, usage := range usages {
+		if usage.ExceedsHardLimit() {
+			writeStorageQuotaExceeded(c, repo, usage)
+			return false
+		}
+	}
+	return true
+}
+
+// writeStorageQuotaExceeded writes the DENIED error for a push to repo that
+// would exceed usage's hard limit.
+func writeStorageQuotaExceeded(c *gin.Context, repo string, usage db.StorageQuotaUsage) {
+	if scope, _ := usage.Quota.Scope(); scope == db.StorageQuotaScopeRepository {
+		usage.Name = repo
+	}
+	writeOCIError(c, http.StatusForbidden, "DENIED", storageQuotaExceededMessage(usage))
+}
+
+// listStorageQuotasHandler returns the organization's storage use against its
+// quota and every registry and repository quota it has set.
+func (s *Server) listStorageQuotasHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	usages, err := s.db.ListStorageQuotaUsage(c.Request.Context(), u.tenantID)
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list storage quotas"})
+		return
+	}
+
+	out := make([]storageQuotaResponse, 0, len(usages))
+	for _, usage := range usages {
+		if usage.Quota.RegistryID != nil && !u.managesRegistry(*usage.Quota.RegistryID) {
+			continue
+		}
+		out = append(out, newStorageQuotaResponse(usage))
+	}
+	c.JSON(http.StatusOK, gin.H{"quotas": out})
+}
+
+func (s *Server) listStorageQuotaBreachesHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	breaches, err := s.db.ListStorageQuotaBreaches(c.Request.Context(), u.tenantID)
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list storage quota breaches"})
+		return
+	}
+
+	out := make([]storageQuotaBreachResponse, 0, len(breaches))
+	for _, b := range breaches {
+		if b.Scope != db.StorageQuotaScopeTenant && (b.RegistryID == nil || !u.managesRegistry(*b.RegistryID)) {
+			continue
+		}
+		resp := storageQuotaBreachResponse{
+			ID:         b.ID.String(),
+			Scope:      b.Scope,
+			ScopeID:    b.ScopeID.String(),
+			LimitBytes: b.LimitBytes,
+			UsedBytes:  b.UsedBytes,
+			CreatedAt:  b.CreatedAt.UTC().Format(time.RFC3339),
+		}
+		if b.ResolvedAt != nil {
+			resolvedAt := b.ResolvedAt.UTC().Format(time.RFC3339)
+			resp.ResolvedAt = &resolvedAt
+		}
+		out = append(out, resp)
+	}
+	c.JSON(http.StatusOK, gin.H{"breaches": out})
+}
+
+func (s *Server) setRegistryStorageQuotaHandler(c *gin.Context) {
+	s.setStorageQuota(c, db.StorageQuotaScopeRegistry)
+}
+
+func (s *Server) removeRegistryStorageQuotaHandler(c *gin.Context) {
+	s.removeStorageQuota(c, db.StorageQuotaScopeRegistry)
+}
+
+func (s *Server) setRepositoryStorageQuotaHandler(c *gin.Context) {
+	s.setStorageQuota(c, db.StorageQuotaScopeRepository)
+}
+
+func (s *Server) removeRepositoryStorageQuotaHandler(c *gin.Context) {
+	s.removeStorageQuota(c, db.StorageQuotaScopeRepository)
+}
+
+// storageQuotaScopeIDs reads the :id parameter as the ID of a registry or
+// repository.
+func storageQuotaScopeIDs(c *gin.Context, scope string) (registryID, repositoryID *uuid.UUID, ok bool) {
+	id, err := uuid.Parse(strings.TrimSpace(c.Param("id")))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + scope + " id"})
+		return nil, nil, false
+	}
+	if scope == db.StorageQuotaScopeRepository {
+		return nil, &id, true
+	}
+	return &id, nil, true
+}
+
+// requireManagedQuotaScope writes a 404 unless u manages the registry the
+// quota scope is in.
+func (s *Server) requireManagedQuotaScope(c *gin.Context, u user, scope string, registryID, repositoryID *uuid.UUID) bool {
+	if u.apiKeyID == uuid.Nil {
+		return true
+	}
+	if repositoryID != nil {
+		id, err := s.db.GetRepositoryRegistryID(c.Request.Context(), *repositoryID)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			logError(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not look up " + scope})
+			return false
+		}
+		registryID = &id
+	}
+	if registryID == nil || !u.managesRegistry(*registryID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": scope + " not found"})
+		return false
+	}
+	return true
+}
+
+func (s *Server) setStorageQuota(c *gin.Context, scope string) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	registryID, repositoryID, ok := storageQuotaScopeIDs(c, scope)
+	if !ok {
+		return
+	}
+
+	if !s.requireManagedQuotaScope(c, u, scope, registryID, repositoryID) {
+		return
+	}
+
+	var req storageQuotaRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	if err := validateStorageQuotaRequest(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = s.db.SetStorageQuota(c.Request.Context(), db.SetStorageQuotaArgs{
+		TenantID:       u.tenantID,
+		RegistryID:     registryID,
+		RepositoryID:   repositoryID,
+		SoftLimitBytes: req.SoftLimitBytes,
+		HardLimitBytes: req.HardLimitBytes,
+	})
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": scope + " not found"})
+			return
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not set storage quota"})
+		return
+	}
+
+	c.JSON(http.StatusOK, req)
+}
+
+func (s *Server) removeStorageQuota(c *gin.Context, scope string) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	registryID, repositoryID, ok := storageQuotaScopeIDs(c, scope)
+	if !ok {
+		return
+	}
+
+	if !s.requireManagedQuotaScope(c, u, scope, registryID, repositoryID) {
+		return
+	}
+
+	if err := s.db.DeleteStorageQuota(c.Request.Context(), u.tenantID, registryID, repositoryID); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "storage quota not found"})
+			return
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not remove storage quota"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
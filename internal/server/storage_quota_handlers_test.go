@@ -0,0 +1,95 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"bin2.io/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func TestValidateStorageQuotaRequest(t *testing.T) {
+	n := func(v int64) *int64 { return &v }
+	tests := []struct {
+		name    string
+		req     storageQuotaRequest
+		wantErr bool
+	}{
+		{name: "hard only", req: storageQuotaRequest{HardLimitBytes: n(10)}},
+		{name: "soft only", req: storageQuotaRequest{SoftLimitBytes: n(10)}},
+		{name: "soft below hard", req: storageQuotaRequest{SoftLimitBytes: n(5), HardLimitBytes: n(10)}},
+		{name: "soft equals hard", req: storageQuotaRequest{SoftLimitBytes: n(10), HardLimitBytes: n(10)}},
+		{name: "empty", req: storageQuotaRequest{}, wantErr: true},
+		{name: "zero hard", req: storageQuotaRequest{HardLimitBytes: n(0)}, wantErr: true},
+		{name: "negative soft", req: storageQuotaRequest{SoftLimitBytes: n(-1)}, wantErr: true},
+		{name: "soft above hard", req: storageQuotaRequest{SoftLimitBytes: n(11), HardLimitBytes: n(10)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateStorageQuotaRequest(tt.req); (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStorageQuotaUsageExceedsHardLimit(t *testing.T) {
+	hard := int64(100)
+	registryID := uuid.New()
+	quota := db.StorageQuota{TenantID: uuid.New(), RegistryID: &registryID, HardLimitBytes: &hard}
+
+	tests := []struct {
+		name  string
+		used  int64
+		added int64
+		want  bool
+	}{
+		{name: "within", used: 60, added: 40},
+		{name: "over", used: 60, added: 41, want: true},
+		// Pushing nothing new is allowed even once over the limit, e.g.
+		// after the quota was lowered.
+		{name: "already over adding nothing", used: 150},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usage := db.StorageQuotaUsage{Quota: quota, UsedBytes: tt.used, AddedBytes: tt.added}
+			if got := usage.ExceedsHardLimit(); got != tt.want {
+				t.Fatalf("ExceedsHardLimit() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	usage := db.StorageQuotaUsage{Quota: quota, Name: "alpha", UsedBytes: 60, AddedBytes: 41}
+	want := "storage quota exceeded: registry alpha stores 60 of 100 bytes and this push adds 41"
+	if got := storageQuotaExceededMessage(usage); got != want {
+		t.Fatalf("message = %q, want %q", got, want)
+	}
+}
+
+func TestWriteStorageQuotaExceeded(t *testing.T) {
+	hard := int64(100)
+	registryID, repositoryID := uuid.New(), uuid.New()
+	quota := db.StorageQuota{TenantID: uuid.New(), RegistryID: &registryID, RepositoryID: &repositoryID, HardLimitBytes: &hard}
+	var err error = fmt.Errorf("store manifest: %w", &db.StorageQuotaExceededError{
+		Usage: db.StorageQuotaUsage{Quota: quota, UsedBytes: 90, AddedBytes: 20},
+	})
+
+	var exceeded *db.StorageQuotaExceededError
+	if !errors.As(err, &exceeded) {
+		t.Fatalf("errors.As(%v) = false", err)
+	}
+	res := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(res)
+	c.Request = httptest.NewRequest(http.MethodPut, "/v2/alpha/app/manifests/latest", nil)
+	writeStorageQuotaExceeded(c, "alpha/app", exceeded.Usage)
+
+	want := "storage quota exceeded: repository alpha/app stores 90 of 100 bytes and this push adds 20"
+	if res.Code != http.StatusForbidden || !strings.Contains(res.Body.String(), `"DENIED"`) || !strings.Contains(res.Body.String(), want) {
+		t.Fatalf("response = %d %s", res.Code, res.Body.String())
+	}
+}
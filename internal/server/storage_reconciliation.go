@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// storageReconciliationInterval is how often storage is reconciled across
+// replicas; each replica checks whether it is due every usageRollupInterval.
+const storageReconciliationInterval = time.Hour
+
+// Modes of STORAGE_RECONCILIATION.
+const (
+	storageReconciliationOff    = "off"
+	storageReconciliationReport = "report"
+	storageReconciliationRepair = "repair"
+)
+
+// storageReconciliationModeFromEnv reads STORAGE_RECONCILIATION: report (the
+// default) records drift, repair also corrects drift that persists between
+// runs while no replica has usage events queued or journaled, and off
+// disables the job.
+func storageReconciliationModeFromEnv() (string, error) {
+	switch mode := strings.ToLower(getenvDefault("STORAGE_RECONCILIATION", storageReconciliationReport)); mode {
+	case storageReconciliationOff, storageReconciliationReport, storageReconciliationRepair:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown STORAGE_RECONCILIATION %q", mode)
+	}
+}
+
+// runStorageReconciliation compares recorded storage with what tenants store
+// until ctx is cancelled.
+func (s *Server) runStorageReconciliation(ctx context.Context) {
+	ticker := time.NewTicker(usageRollupInterval)
+	defer ticker.Stop()
+	for {
+		s.reconcileStorage(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconcileStorage runs a reconciliation if one is due and logs every tenant
+// whose recorded storage drifted.
+func (s *Server) reconcileStorage(ctx context.Context) {
+	repair := s.storageReconciliation == storageReconciliationRepair
+	drifted, ran, err := s.db.ReconcileStorage(ctx, time.Now().UTC(), storageReconciliationInterval, repair)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			logError(fmt.Errorf("could not reconcile storage: %w", err))
+		}
+		return
+	}
+	if !ran {
+		return
+	}
+	for _, r := range drifted {
+		slog.Warn("Usage",
+			slog.String("storage drift", r.TenantID.String()),
+			slog.Int64("actualBytes", r.ActualBytes),
+			slog.Int64("recordedBytes", r.RecordedBytes),
+			slog.Int64("correctedBytes", r.CorrectedBytes))
+	}
+	slog.Info("Usage", slog.Int("reconciled storage, tenants drifted", len(drifted)))
+}
+
+type storageReconciliationResponse struct {
+	TenantID       string `json:"tenantId"`
+	CheckedAt      string `json:"checkedAt"`
+	ActualBytes    int64  `json:"actualBytes"`
+	RecordedBytes  int64  `json:"recordedBytes"`
+	DriftBytes     int64  `json:"driftBytes"`
+	CorrectedBytes int64  `json:"correctedBytes"`
+}
+
+func newStorageReconciliationResponse(r db.StorageReconciliation) storageReconciliationResponse {
+	return storageReconciliationResponse{
+		TenantID:       r.TenantID.String(),
+		CheckedAt:      r.CheckedAt.UTC().Format(time.RFC3339),
+		ActualBytes:    r.ActualBytes,
+		RecordedBytes:  r.RecordedBytes,
+		DriftBytes:     r.DriftBytes(),
+		CorrectedBytes: r.CorrectedBytes,
+	}
+}
+
+// listOperatorStorageDriftHandler handles GET /admin/v1/storage-drift: the
+// drift recorded by recent reconciliations, optionally for one tenant.
+func (s *Server) listOperatorStorageDriftHandler(c *gin.Context) {
+	tenantID := uuid.Nil
+	if raw := strings.TrimSpace(c.Query("tenant")); raw != "" {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid tenant id"})
+			return
+		}
+		tenantID = id
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+
+	recs, err := s.db.ListStorageReconciliations(c.Request.Context(), tenantID, limit)
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list storage drift"})
+		return
+	}
+	out := make([]storageReconciliationResponse, 0, len(recs))
+	for _, r := range recs {
+		out = append(out, newStorageReconciliationResponse(r))
+	}
+	c.JSON(http.StatusOK, gin.H{"reconciliations": out})
+}
+
+// getOperatorTenantStorageHandler measures a tenant's storage drift now
+// without correcting it.
+func (s *Server) getOperatorTenantStorageHandler(c *gin.Context) {
+	tenantID, ok := operatorID(c, "tenant")
+	if !ok {
+		return
+	}
+	r, err := s.db.MeasureTenantStorage(c.Request.Context(), tenantID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "tenant not found"})
+			return
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not measure storage"})
+		return
+	}
+	c.JSON(http.StatusOK, newStorageReconciliationResponse(r))
+}
+
+// reconcileOperatorTenantStorageHandler corrects a tenant's storage drift
+// now with a reconciliation usage event. It refuses while any replica has
+// usage events queued or journaled, which the correction would count twice.
+func (s *Server) reconcileOperatorTenantStorageHandler(c *gin.Context) {
+	tenantID, ok := operatorID(c, "tenant")
+	if !ok {
+		return
+	}
+	setAuditTenants(c, tenantID)
+
+	r, err := s.db.CorrectTenantStorage(c.Request.Context(), tenantID, time.Now().UTC())
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "tenant not found"})
+			return
+		}
+		if errors.Is(err, db.ErrUsageBacklog) {
+			c.JSON(http.StatusConflict, gin.H{"error": "usage events are still queued or journaled; retry once every replica has stored them"})
+			return
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not reconcile storage"})
+		return
+	}
+	c.JSON(http.StatusOK, newStorageReconciliationResponse(r))
+}
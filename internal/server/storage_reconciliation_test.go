@@ -0,0 +1,82 @@
+package server
+
+import (
+	"testing"
+
+	"bin2.io/internal/db"
+	"github.com/google/uuid"
+)
+
+func TestStorageReconciliationModeFromEnv(t *testing.T) {
+	for raw, want := range map[string]string{
+		"":       storageReconciliationReport,
+		"repair": storageReconciliationRepair,
+		" OFF ":  storageReconciliationOff,
+	} {
+		t.Setenv("STORAGE_RECONCILIATION", raw)
+		got, err := storageReconciliationModeFromEnv()
+		if err != nil || got != want {
+			t.Fatalf("STORAGE_RECONCILIATION=%q: mode = %q, %v, want %q", raw, got, err, want)
+		}
+	}
+	t.Setenv("STORAGE_RECONCILIATION", "fix")
+	if _, err := storageReconciliationModeFromEnv(); err == nil {
+		t.Fatal("unknown mode accepted")
+	}
+}
+
+func TestStorageReconciliationResponseDrift(t *testing.T) {
+	resp := newStorageReconciliationResponse(db.StorageReconciliation{ActualBytes: 100, RecordedBytes: 250})
+	if resp.DriftBytes != -150 {
+		t.Fatalf("drift = %d, want -150 when more is recorded than stored", resp.DriftBytes)
+	}
+}
+
+func TestPlanStorageCorrections(t *testing.T) {
+	steady, changed, seenOnce, settled := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	measured := []db.StorageReconciliation{
+		{TenantID: steady, ActualBytes: 100, RecordedBytes: 70},
+		{TenantID: changed, ActualBytes: 100, RecordedBytes: 90},
+		{TenantID: seenOnce, ActualBytes: 50, RecordedBytes: 80},
+		{TenantID: settled, ActualBytes: 40, RecordedBytes: 40},
+	}
+	previous := map[uuid.UUID]int64{steady: 30, changed: 30, settled: 5}
+
+	got := db.PlanStorageCorrections(measured, previous)
+	want := map[uuid.UUID]int64{steady: 30, changed: 0, seenOnce: 0}
+	if len(got) != len(want) {
+		t.Fatalf("planned %d reconciliations, want %d: %+v", len(got), len(want), got)
+	}
+	for _, r := range got {
+		corrected, ok := want[r.TenantID]
+		if !ok {
+			t.Fatalf("tenant without drift recorded: %+v", r)
+		}
+		if r.CorrectedBytes != corrected {
+			t.Errorf("tenant with drift %d corrected by %d, want %d", r.DriftBytes(), r.CorrectedBytes, corrected)
+		}
+	}
+}
+
+func TestStorageReconciliationRemainingDrift(t *testing.T) {
+	tenantID := uuid.New()
+	// The previous run corrected 30 bytes of drift; until its event is
+	// counted the balance is still short by the same 30.
+	last := db.StorageReconciliation{TenantID: tenantID, ActualBytes: 100, RecordedBytes: 70, CorrectedBytes: 30}
+	if got := last.RemainingDriftBytes(); got != 0 {
+		t.Fatalf("remaining drift = %d, want 0 after a full correction", got)
+	}
+	previous := map[uuid.UUID]int64{tenantID: last.RemainingDriftBytes()}
+
+	// Counted, the correction leaves no drift to record.
+	fixed := db.StorageReconciliation{TenantID: tenantID, ActualBytes: 100, RecordedBytes: 100}
+	if got := db.PlanStorageCorrections([]db.StorageReconciliation{fixed}, previous); len(got) != 0 {
+		t.Fatalf("planned %+v after the correction was counted", got)
+	}
+	// Drift that recurs after a correction is new, so it is only recorded.
+	recurred := db.StorageReconciliation{TenantID: tenantID, ActualBytes: 130, RecordedBytes: 100}
+	got := db.PlanStorageCorrections([]db.StorageReconciliation{recurred}, previous)
+	if len(got) != 1 || got[0].CorrectedBytes != 0 {
+		t.Fatalf("planned %+v for drift first seen after a correction", got)
+	}
+}
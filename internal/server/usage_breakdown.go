@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/google/uuid"
+)
+
+// usageBreakdownByRegistry and usageBreakdownByRepository are the
+// granularities of a usage breakdown.
+const (
+	usageBreakdownByRegistry   = "registry"
+	usageBreakdownByRepository = "repository"
+)
+
+// usageBreakdownInput is a period's usage split by attribution, gathered the
+// same way loadUsagePeriodSummary gathers a tenant's.
+type usageBreakdownInput struct {
+	openingStorageBytes map[db.UsageAttribution]int64
+	storageDeltas       map[db.UsageAttribution][]usageStorageDelta
+	pushOpCount         map[db.UsageAttribution]int64
+	pullOpCount         map[db.UsageAttribution]int64
+	pullBytes           map[db.UsageAttribution]int64
+}
+
+func newUsageBreakdownInput() usageBreakdownInput {
+	return usageBreakdownInput{
+		openingStorageBytes: make(map[db.UsageAttribution]int64),
+		storageDeltas:       make(map[db.UsageAttribution][]usageStorageDelta),
+		pushOpCount:         make(map[db.UsageAttribution]int64),
+		pullOpCount:         make(map[db.UsageAttribution]int64),
+		pullBytes:           make(map[db.UsageAttribution]int64),
+	}
+}
+
+func (in usageBreakdownInput) addTotals(totals []db.UsageAttributedTotal, key func(db.UsageAttribution) db.UsageAttribution) {
+	for _, t := range totals {
+		switch t.Metric {
+		case db.MetricPushOpCount:
+			in.pushOpCount[key(t.UsageAttribution)] += t.Value
+		case db.MetricPullOpCount:
+			in.pullOpCount[key(t.UsageAttribution)] += t.Value
+		case db.MetricPullBytes:
+			in.pullBytes[key(t.UsageAttribution)] += t.Value
+		}
+	}
+}
+
+func (in usageBreakdownInput) addOpeningStorage(totals []db.UsageAttributedTotal, key func(db.UsageAttribution) db.UsageAttribution) {
+	for _, t := range totals {
+		if t.Metric == db.MetricStorageBytes {
+			in.openingStorageBytes[key(t.UsageAttribution)] += t.Value
+		}
+	}
+}
+
+// usageBreakdownItem is the usage summary of one registry or repository and
+// its charges.
+type usageBreakdownItem struct {
+	db.UsageAttribution
+	Summary usagePeriodSummary
+	Charges usageCharges
+}
+
+// loadUsageBreakdown summarizes the tenant's usage in [from, asOf) per
+// registry, or per repository when byRepository is set, reading rollups for
+// closed days and raw usage events for the rest.
+func (s *Server) loadUsageBreakdown(ctx context.Context, tenantID uuid.UUID, from, to, asOf time.Time, byRepository bool) ([]usageBreakdownItem, error) {
+	key := func(a db.UsageAttribution) db.UsageAttribution {
+		if !byRepository {
+			a.RepoID = uuid.Nil
+		}
+		return a
+	}
+
+	rolledThrough, err := s.db.GetUsageRolledThrough(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rollupStart, rollupEnd := usageRollupSpan(from, asOf, rolledThrough)
+
+	in := newUsageBreakdownInput()
+	base := floorUTCDay(from)
+	if rolledThrough.Before(base) {
+		base = rolledThrough
+	}
+	balances, err := s.db.ListUsageStorageBalancesByAttribution(ctx, tenantID, base)
+	if err != nil {
+		return nil, err
+	}
+	in.addOpeningStorage(balances, key)
+	if base.Before(from) {
+		sinceBase, err := s.db.SumUsageMetricsByAttributionBetween(ctx, tenantID, base, from)
+		if err != nil {
+			return nil, err
+		}
+		in.addOpeningStorage(sinceBase, key)
+	}
+
+	addEvents := func(start, end time.Time) error {
+		if !end.After(start) {
+			return nil
+		}
+		totals, err := s.db.SumUsageMetricsByAttributionBetween(ctx, tenantID, start, end)
+		if err != nil {
+			return err
+		}
+		deltas, err := s.db.ListUsageStorageDeltasByAttributionBetween(ctx, tenantID, start, end)
+		if err != nil {
+			return err
+		}
+		in.addTotals(totals, key)
+		for _, delta := range deltas {
+			k := key(delta.UsageAttribution)
+			in.storageDeltas[k] = append(in.storageDeltas[k], usageStorageDelta{From: delta.CreatedAt, To: delta.CreatedAt, Value: delta.Value})
+		}
+		return nil
+	}
+
+	if err := addEvents(from, rollupStart); err != nil {
+		return nil, err
+	}
+	if rollupEnd.After(rollupStart) {
+		rollups, err := s.db.ListUsageDailyRollupsByAttribution(ctx, tenantID, rollupStart, rollupEnd)
+		if err != nil {
+			return nil, err
+		}
+		// Rollups for one attribution can arrive split by repository when
+		// grouping by registry; merge each day's before converting them.
+		merged := make(map[db.UsageAttribution][]db.UsageDailyRollup)
+		var order []db.UsageAttribution
+		for _, r := range rollups {
+			k := key(r.UsageAttribution)
+			if _, ok := merged[k]; !ok {
+				order = append(order, k)
+			}
+			merged[k] = mergeUsageDailyRollup(merged[k], r.UsageDailyRollup)
+		}
+		for _, k := range order {
+			in.storageDeltas[k] = append(in.storageDeltas[k], usageRollupStorageDeltas(merged[k])...)
+			in.pushOpCount[k] += sumUsageRollups(merged[k], db.MetricPushOpCount)
+			in.pullOpCount[k] += sumUsageRollups(merged[k], db.MetricPullOpCount)
+			in.pullBytes[k] += sumUsageRollups(merged[k], db.MetricPullBytes)
+		}
+	}
+	if err := addEvents(rollupEnd, asOf); err != nil {
+		return nil, err
+	}
+
+	return calculateUsageBreakdown(from, to, asOf, in)
+}
+
+// mergeUsageDailyRollup adds r to rollups, which are ordered by day, summing
+// it into an existing rollup of the same day and metric.
+func mergeUsageDailyRollup(rollups []db.UsageDailyRollup, r db.UsageDailyRollup) []db.UsageDailyRollup {
+	for i := len(rollups) - 1; i >= 0 && rollups[i].Day.Equal(r.Day); i-- {
+		if rollups[i].Metric == r.Metric {
+			rollups[i].Value += r.Value
+			rollups[i].DayEndWeight.Add(rollups[i].DayEndWeight, r.DayEndWeight)
+			return rollups
+		}
+	}
+	return append(rollups, r)
+}
+
+// calculateUsageBreakdown applies calculateUsagePeriodSummary to each
+// attribution that had storage or operations in the period. Items are ordered
+// by registry and repository id.
+func calculateUsageBreakdown(from, to, asOf time.Time, in usageBreakdownInput) ([]usageBreakdownItem, error) {
+	var keys []db.UsageAttribution
+	seen := make(map[db.UsageAttribution]bool)
+	addKey := func(k db.UsageAttribution) {
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	for k, v := range in.openingStorageBytes {
+		if v != 0 {
+			addKey(k)
+		}
+	}
+	for k, v := range in.storageDeltas {
+		if len(v) > 0 {
+			addKey(k)
+		}
+	}
+	for k, v := range in.pushOpCount {
+		if v != 0 {
+			addKey(k)
+		}
+	}
+	for k, v := range in.pullOpCount {
+		if v != 0 {
+			addKey(k)
+		}
+	}
+	for k, v := range in.pullBytes {
+		if v != 0 {
+			addKey(k)
+		}
+	}
+	slices.SortFunc(keys, compareUsageAttribution)
+
+	items := make([]usageBreakdownItem, 0, len(keys))
+	for _, k := range keys {
+		summary, err := calculateUsagePeriodSummary(from, to, asOf, in.openingStorageBytes[k], in.storageDeltas[k], in.pushOpCount[k], in.pullOpCount[k])
+		if err != nil {
+			return nil, err
+		}
+		summary.PullBytes = in.pullBytes[k]
+		items = append(items, usageBreakdownItem{UsageAttribution: k, Summary: summary})
+	}
+	return items, nil
+}
+
+// compareUsageAttribution orders attributions by registry and repository id.
+func compareUsageAttribution(a, b db.UsageAttribution) int {
+	if c := bytes.Compare(a.RegistryID[:], b.RegistryID[:]); c != 0 {
+		return c
+	}
+	return bytes.Compare(a.RepoID[:], b.RepoID[:])
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func TestCalculateUsageBreakdownSumsToTenantSummary(t *testing.T) {
+	from := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2026, time.April, 1, 0, 0, 0, 0, time.UTC)
+	asOf := time.Date(2026, time.March, 20, 13, 0, 0, 0, time.UTC)
+	registry := uuid.New()
+	api := db.UsageAttribution{RegistryID: registry, RepoID: uuid.New()}
+	web := db.UsageAttribution{RegistryID: registry, RepoID: uuid.New()}
+	legacy := db.UsageAttribution{}
+
+	in := newUsageBreakdownInput()
+	in.openingStorageBytes[api] = 2 << 30
+	in.openingStorageBytes[legacy] = 1 << 30
+	in.storageDeltas[api] = usageStorageEventDeltas([]db.UsageEventDelta{
+		{CreatedAt: from.Add(2 * time.Hour), Value: 1 << 20},
+		{CreatedAt: from.Add(5 * 24 * time.Hour), Value: -(2 << 30)},
+	})
+	in.storageDeltas[web] = usageStorageEventDeltas([]db.UsageEventDelta{
+		{CreatedAt: from.Add(3 * 24 * time.Hour), Value: 3 << 30},
+	})
+	in.pushOpCount[api] = 4
+	in.pullOpCount[web] = 90
+
+	items, err := calculateUsageBreakdown(from, to, asOf, in)
+	if err != nil {
+		t.Fatalf("calculateUsageBreakdown: %v", err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("items = %d, want 3", len(items))
+	}
+	if items[0].UsageAttribution != legacy {
+		t.Fatalf("first item = %+v, want unattributed usage first", items[0].UsageAttribution)
+	}
+
+	var tenantDeltas []usageStorageDelta
+	tenantDeltas = append(tenantDeltas, in.storageDeltas[api][0], in.storageDeltas[web][0], in.storageDeltas[api][1])
+	tenant, err := calculateUsagePeriodSummary(from, to, asOf, 3<<30, tenantDeltas, 4, 90)
+	if err != nil {
+		t.Fatalf("calculateUsagePeriodSummary: %v", err)
+	}
+
+	byteNanos := big.NewInt(0)
+	total := new(big.Rat)
+	var closing int64
+	for _, item := range items {
+		byteNanos.Add(byteNanos, item.Summary.StorageByteNanos)
+		total.Add(total, calculateUsageCharges(from, to, []usagePricedSummary{{Summary: item.Summary, Price: builtinPlanPrice}}).totalUSD())
+		closing += item.Summary.StorageClosingBytes
+	}
+	if byteNanos.Cmp(tenant.StorageByteNanos) != 0 {
+		t.Fatalf("byte-nanoseconds = %s, want %s", byteNanos, tenant.StorageByteNanos)
+	}
+	tenantTotal := calculateUsageCharges(from, to, []usagePricedSummary{{Summary: tenant, Price: builtinPlanPrice}}).totalUSD()
+	if total.Cmp(tenantTotal) != 0 {
+		t.Fatalf("total charge = %s, want %s", total.FloatString(12), tenantTotal.FloatString(12))
+	}
+	if closing != tenant.StorageClosingBytes {
+		t.Fatalf("closing bytes = %d, want %d", closing, tenant.StorageClosingBytes)
+	}
+}
+
+func TestCalculateUsageBreakdownSkipsIdleAttributions(t *testing.T) {
+	from := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	in := newUsageBreakdownInput()
+	in.openingStorageBytes[db.UsageAttribution{RegistryID: uuid.New()}] = 0
+	in.pushOpCount[db.UsageAttribution{RegistryID: uuid.New()}] = 0
+
+	items, err := calculateUsageBreakdown(from, to, to, in)
+	if err != nil {
+		t.Fatalf("calculateUsageBreakdown: %v", err)
+	}
+	if len(items) != 0 {
+		t.Fatalf("items = %d, want 0", len(items))
+	}
+}
+
+func TestCalculateUsageBreakdownIncludesPullBytes(t *testing.T) {
+	from := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	models := db.UsageAttribution{RegistryID: uuid.New(), RepoID: uuid.New()}
+	in := newUsageBreakdownInput()
+	in.addTotals([]db.UsageAttributedTotal{{UsageAttribution: models, Metric: db.MetricPullBytes, Value: 40 << 30}}, func(a db.UsageAttribution) db.UsageAttribution { return a })
+
+	items, err := calculateUsageBreakdown(from, to, to, in)
+	if err != nil {
+		t.Fatalf("calculateUsageBreakdown: %v", err)
+	}
+	if len(items) != 1 || items[0].UsageAttribution != models || items[0].Summary.PullBytes != 40<<30 {
+		t.Fatalf("items = %+v, want the repository's 40 GiB of egress", items)
+	}
+}
+
+func TestMergeUsageDailyRollup(t *testing.T) {
+	day := time.Date(2026, time.March, 3, 0, 0, 0, 0, time.UTC)
+	rollup := func(day time.Time, metric string, value, weight int64) db.UsageDailyRollup {
+		return db.UsageDailyRollup{Day: day, Metric: metric, Value: value, DayEndWeight: big.NewInt(weight)}
+	}
+
+	var rollups []db.UsageDailyRollup
+	rollups = mergeUsageDailyRollup(rollups, rollup(day, db.MetricPullOpCount, 3, 0))
+	rollups = mergeUsageDailyRollup(rollups, rollup(day, db.MetricStorageBytes, 10, 100))
+	rollups = mergeUsageDailyRollup(rollups, rollup(day, db.MetricPullOpCount, 2, 0))
+	rollups = mergeUsageDailyRollup(rollups, rollup(day, db.MetricStorageBytes, -4, -20))
+	rollups = mergeUsageDailyRollup(rollups, rollup(day.AddDate(0, 0, 1), db.MetricStorageBytes, 1, 5))
+
+	if len(rollups) != 3 {
+		t.Fatalf("rollups = %d, want 3", len(rollups))
+	}
+	if rollups[0].Value != 5 {
+		t.Fatalf("pull rollup = %d, want 5", rollups[0].Value)
+	}
+	if rollups[1].Value != 6 || rollups[1].DayEndWeight.Int64() != 80 {
+		t.Fatalf("storage rollup = %d/%s, want 6/80", rollups[1].Value, rollups[1].DayEndWeight)
+	}
+}
+
+func TestResolveIngestUsageRepoIDRejectsInvalidRepository(t *testing.T) {
+	registryID := uuid.New()
+
+	tests := []struct {
+		name       string
+		repoID     string
+		repository string
+	}{
+		{name: "invalid repo id", repoID: "not-a-uuid"},
+		{name: "other namespace", repository: "other/app"},
+		{name: "namespace only", repository: "acme"},
+		{name: "invalid name", repository: "acme/../app"},
+	}
+	for _, tt := range tests {
+		_, err := resolveIngestUsageRepoID(context.Background(), nil, registryID, "acme", tt.repoID, tt.repository)
+		var reqErr usageIngestRequestError
+		if !errors.As(err, &reqErr) {
+			t.Fatalf("%s: err = %v, want request error", tt.name, err)
+		}
+	}
+
+	repoID, err := resolveIngestUsageRepoID(context.Background(), nil, registryID, "acme", "", "")
+	if err != nil || repoID != nil {
+		t.Fatalf("unattributed event = %v, %v; want nil, nil", repoID, err)
+	}
+}
+
+type fakeUsageIngestRepositories struct {
+	registry   db.Registry
+	registryID uuid.UUID
+	ids        map[string]uuid.UUID
+}
+
+func (f fakeUsageIngestRepositories) GetRegistryByName(ctx context.Context, name string) (db.Registry, error) {
+	if name != f.registry.Name {
+		return db.Registry{}, db.ErrNotFound
+	}
+	return f.registry, nil
+}
+
+func (f fakeUsageIngestRepositories) RepositoryBelongsToRegistry(ctx context.Context, repositoryID, registryID uuid.UUID) (bool, error) {
+	for _, id := range f.ids {
+		if id == repositoryID {
+			return registryID == f.registryID, nil
+		}
+	}
+	return false, nil
+}
+
+func (f fakeUsageIngestRepositories) GetRepositoryID(ctx context.Context, registryID uuid.UUID, name string) (uuid.UUID, error) {
+	if id, ok := f.ids[name]; ok && registryID == f.registryID {
+		return id, nil
+	}
+	return uuid.Nil, db.ErrNotFound
+}
+
+func TestResolveIngestUsageRepoIDFromRepository(t *testing.T) {
+	registryID, appID := uuid.New(), uuid.New()
+	repos := fakeUsageIngestRepositories{registryID: registryID, ids: map[string]uuid.UUID{"team/app": appID}}
+
+	// The pull worker sends the repository as it appears in /v2 URLs.
+	repoID, err := resolveIngestUsageRepoID(context.Background(), repos, registryID, "acme", "", "acme/team/app")
+	if err != nil || repoID == nil || *repoID != appID {
+		t.Fatalf("acme/team/app = %v, %v; want %s", repoID, err, appID)
+	}
+	repoID, err = resolveIngestUsageRepoID(context.Background(), repos, registryID, "acme", appID.String(), "")
+	if err != nil || repoID == nil || *repoID != appID {
+		t.Fatalf("repoId = %v, %v; want %s", repoID, err, appID)
+	}
+	// Pulls from a repository deleted since are attributed to the registry.
+	repoID, err = resolveIngestUsageRepoID(context.Background(), repos, registryID, "acme", "", "acme/gone")
+	if err != nil || repoID != nil {
+		t.Fatalf("acme/gone = %v, %v; want nil, nil", repoID, err)
+	}
+}
+
+func TestUsageBreakdownHandlerRejectsInvalidGrouping(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := &Server{}
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/api/v1/usage/breakdown?from=2026-03-01T00:00:00Z&to=2026-04-01T00:00:00Z&by=tag", nil)
+	ctx.Set("user", user{tenantID: newTestUUID(t)})
+
+	server.usageBreakdownHandler(ctx)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+}
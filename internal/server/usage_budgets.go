@@ -0,0 +1,587 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"bin2.io/internal/apikey"
+	"bin2.io/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// usageBudgetInterval is how often each replica evaluates budgets and
+// delivers pending alerts.
+const usageBudgetInterval = 5 * time.Minute
+
+const (
+	// usageWebhookTimeout bounds one delivery attempt.
+	usageWebhookTimeout = 10 * time.Second
+	// usageWebhookMaxAttempts is how many times an alert is tried before it
+	// is given up on, roughly a day after it fired.
+	usageWebhookMaxAttempts = 10
+	// usageWebhookBatch is how many alerts a replica claims at a time.
+	usageWebhookBatch = 50
+	// usageWebhookSignatureHeader carries the alert's signature as
+	// t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">.
+	usageWebhookSignatureHeader = "Bin2-Signature"
+	// usageWebhookIDHeader identifies an alert across retries so receivers
+	// can drop duplicates.
+	usageWebhookIDHeader = "Bin2-Webhook-Id"
+	// usageWebhookEventBudgetThreshold is the event type of budget alerts.
+	usageWebhookEventBudgetThreshold = "usage.budget.threshold_crossed"
+)
+
+// usageWebhookRetryAfter is how long to wait before retrying an alert that
+// has been tried attempts times: a minute, doubling up to six hours.
+func usageWebhookRetryAfter(attempts int) time.Duration {
+	const maxWait = 6 * time.Hour
+	if attempts < 1 {
+		attempts = 1
+	}
+	if attempts > 10 {
+		return maxWait
+	}
+	return min(time.Minute<<(attempts-1), maxWait)
+}
+
+// usageBudgetValue returns the budget metric's value for the period so far.
+func usageBudgetValue(metric string, summary usagePeriodSummary, charges usageCharges) *big.Rat {
+	switch metric {
+	case db.BudgetMetricChargeUSD:
+		return charges.totalUSD()
+	case db.BudgetMetricStorageGiBMonths:
+		return summary.storageGiBMonths()
+	case db.BudgetMetricPushOpCount:
+		return big.NewRat(summary.PushOpCount, 1)
+	case db.BudgetMetricPullOpCount:
+		return big.NewRat(summary.PullOpCount, 1)
+	}
+	return new(big.Rat)
+}
+
+// crossedUsageBudgetThresholds returns the thresholds in
+// db.UsageBudgetThresholds that value has reached.
+func crossedUsageBudgetThresholds(value, limit *big.Rat) []int {
+	var crossed []int
+	for _, threshold := range db.UsageBudgetThresholds {
+		at := new(big.Rat).Mul(limit, big.NewRat(int64(threshold), 100))
+		if value.Cmp(at) >= 0 {
+			crossed = append(crossed, threshold)
+		}
+	}
+	return crossed
+}
+
+// runUsageBudgets evaluates budgets and delivers their alerts until ctx is
+// cancelled.
+func (s *Server) runUsageBudgets(ctx context.Context) {
+	ticker := time.NewTicker(usageBudgetInterval)
+	defer ticker.Stop()
+	for {
+		now := time.Now().UTC()
+		if err := s.evaluateUsageBudgets(ctx, now); err != nil && !errors.Is(err, context.Canceled) {
+			logError(err)
+		}
+		if err := s.deliverUsageBudgetAlerts(ctx, now); err != nil && !errors.Is(err, context.Canceled) {
+			logError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// evaluateUsageBudgets records an alert for every threshold each budget has
+// crossed in the current month. Thresholds that already fired this month are
+// skipped by the database, so each fires once per period. A tenant whose
+// usage cannot be summarized is logged and its budgets skipped until the
+// next run.
+func (s *Server) evaluateUsageBudgets(ctx context.Context, now time.Time) error {
+	budgets, err := s.db.ListUsageBudgets(ctx, uuid.Nil)
+	if err != nil {
+		return err
+	}
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+
+	var summary usagePeriodSummary
+	var charges usageCharges
+	tenantID := uuid.Nil
+	skip := false
+	for _, b := range budgets {
+		if b.TenantID != tenantID {
+			tenantID = b.TenantID
+			summary, charges, _, err = s.loadPricedUsageSummary(ctx, b.TenantID, from, to, now)
+			skip = err != nil
+			if err != nil {
+				if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+					return err
+				}
+				logError(fmt.Errorf("could not summarize usage of tenant %s for its budgets: %w", b.TenantID, err))
+			}
+		}
+		if skip {
+			continue
+		}
+		value := usageBudgetValue(b.Metric, summary, charges)
+		for _, threshold := range crossedUsageBudgetThresholds(value, b.Limit) {
+			_, err := s.db.InsertUsageBudgetAlert(ctx, db.UsageBudgetAlert{
+				BudgetID:         b.ID,
+				PeriodStart:      from,
+				ThresholdPercent: threshold,
+				Value:            value,
+				Limit:            b.Limit,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deliverUsageBudgetAlerts sends every alert that is due to its budget's
+// webhook.
+func (s *Server) deliverUsageBudgetAlerts(ctx context.Context, now time.Time) error {
+	for {
+		deliveries, err := s.db.ClaimUsageBudgetAlerts(ctx, now, usageWebhookBatch, usageWebhookMaxAttempts, usageWebhookRetryAfter)
+		if err != nil {
+			return err
+		}
+		for _, d := range deliveries {
+			deliveryErr := ""
+			if err := s.deliverUsageBudgetAlert(ctx, d); err != nil {
+				if errors.Is(err, context.Canceled) {
+					return err
+				}
+				deliveryErr = err.Error()
+			}
+			if err := s.db.FinishUsageBudgetAlertDelivery(ctx, d.Alert, deliveryErr); err != nil {
+				return err
+			}
+		}
+		if len(deliveries) < usageWebhookBatch {
+			return nil
+		}
+	}
+}
+
+// usageBudgetWebhookPayload is the body of a budget alert webhook.
+type usageBudgetWebhookPayload struct {
+	ID               string                `json:"id"`
+	Type             string                `json:"type"`
+	TenantID         string                `json:"tenantId"`
+	Budget           usageBudgetWebhookRef `json:"budget"`
+	PeriodStart      string                `json:"periodStart"`
+	PeriodEnd        string                `json:"periodEnd"`
+	ThresholdPercent int                   `json:"thresholdPercent"`
+	Value            string                `json:"value"`
+	FiredAt          string                `json:"firedAt"`
+}
+
+type usageBudgetWebhookRef struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Metric string `json:"metric"`
+	Limit  string `json:"limit"`
+}
+
+// usageBudgetAlertID identifies an alert the same way on every attempt.
+func usageBudgetAlertID(a db.UsageBudgetAlert) uuid.UUID {
+	return uuid.NewSHA1(a.BudgetID, []byte(a.PeriodStart.UTC().Format(time.RFC3339)+"/"+strconv.Itoa(a.ThresholdPercent)))
+}
+
+func newUsageBudgetWebhookPayload(d db.UsageBudgetDelivery) usageBudgetWebhookPayload {
+	return usageBudgetWebhookPayload{
+		ID:       usageBudgetAlertID(d.Alert).String(),
+		Type:     usageWebhookEventBudgetThreshold,
+		TenantID: d.Budget.TenantID.String(),
+		Budget: usageBudgetWebhookRef{
+			ID:     d.Budget.ID.String(),
+			Name:   d.Budget.Name,
+			Metric: d.Budget.Metric,
+			Limit:  formatUsageDecimal(d.Alert.Limit, 12),
+		},
+		PeriodStart:      d.Alert.PeriodStart.Format(time.RFC3339),
+		PeriodEnd:        d.Alert.PeriodStart.AddDate(0, 1, 0).Format(time.RFC3339),
+		ThresholdPercent: d.Alert.ThresholdPercent,
+		Value:            formatUsageDecimal(d.Alert.Value, 12),
+		FiredAt:          d.Alert.FiredAt.UTC().Format(time.RFC3339),
+	}
+}
+
+func (s *Server) deliverUsageBudgetAlert(ctx context.Context, d db.UsageBudgetDelivery) error {
+	secret, err := apikey.Decrypt(d.Budget.WebhookSecretEncrypted, s.apiKeyEncryptionKey)
+	if err != nil {
+		return fmt.Errorf("could not decrypt webhook secret: %w", err)
+	}
+	body, err := json.Marshal(newUsageBudgetWebhookPayload(d))
+	if err != nil {
+		return err
+	}
+	return postUsageWebhook(ctx, s.webhookClient, d.Budget.WebhookURL, secret, usageBudgetAlertID(d.Alert).String(), body, time.Now())
+}
+
+// signUsageWebhook returns the signature header value for body sent at ts.
+func signUsageWebhook(secret string, ts time.Time, body []byte) string {
+	t := strconv.FormatInt(ts.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postUsageWebhook sends a signed webhook, failing unless the receiver
+// answers with a 2xx status.
+func postUsageWebhook(ctx context.Context, client *http.Client, rawURL, secret, id string, body []byte, now time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, usageWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bin2-webhooks")
+	req.Header.Set(usageWebhookIDHeader, id)
+	req.Header.Set(usageWebhookSignatureHeader, signUsageWebhook(secret, now, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// newUsageWebhookClient returns the client webhooks are sent with. It does
+// not follow redirects and refuses to connect to loopback, private or
+// link-local addresses, so tenants cannot aim webhooks at internal services.
+func newUsageWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: usageWebhookTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !publicWebhookIP(ip) {
+				return fmt.Errorf("webhook address %s is not public", host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func publicWebhookIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast())
+}
+
+// validateUsageWebhookURL accepts absolute https URLs without credentials.
+func validateUsageWebhookURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil || u.Fragment != "" {
+		return "", fmt.Errorf("webhookUrl must be an https URL without credentials")
+	}
+	return u.String(), nil
+}
+
+// generateUsageWebhookSecret returns a new webhook signing secret.
+func generateUsageWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+type usageBudgetRequest struct {
+	Name       string `json:"name"`
+	Metric     string `json:"metric"`
+	Limit      string `json:"limit"`
+	WebhookURL string `json:"webhookUrl"`
+}
+
+// validate checks the request, returning the parsed limit and webhook URL.
+// The metric is only checked when creating, since it cannot change.
+func (req *usageBudgetRequest) validate(create bool) (*big.Rat, string, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return nil, "", fmt.Errorf("name is required")
+	}
+	if create {
+		switch req.Metric = strings.TrimSpace(req.Metric); req.Metric {
+		case db.BudgetMetricChargeUSD, db.BudgetMetricStorageGiBMonths, db.BudgetMetricPushOpCount, db.BudgetMetricPullOpCount:
+		default:
+			return nil, "", fmt.Errorf("metric must be %s, %s, %s, or %s",
+				db.BudgetMetricChargeUSD, db.BudgetMetricStorageGiBMonths, db.BudgetMetricPushOpCount, db.BudgetMetricPullOpCount)
+		}
+	}
+	limit, err := db.ParsePlanAmount(req.Limit)
+	if err != nil || limit.Sign() == 0 {
+		return nil, "", fmt.Errorf("limit must be a positive decimal number")
+	}
+	webhookURL, err := validateUsageWebhookURL(req.WebhookURL)
+	if err != nil {
+		return nil, "", err
+	}
+	return limit, webhookURL, nil
+}
+
+type usageBudgetAlertResponse struct {
+	ThresholdPercent int     `json:"thresholdPercent"`
+	Value            string  `json:"value"`
+	FiredAt          string  `json:"firedAt"`
+	DeliveredAt      *string `json:"deliveredAt"`
+	Attempts         int     `json:"attempts"`
+	LastError        string  `json:"lastError,omitempty"`
+}
+
+type usageBudgetResponse struct {
+	ID            string                     `json:"id"`
+	Name          string                     `json:"name"`
+	Metric        string                     `json:"metric"`
+	Limit         string                     `json:"limit"`
+	WebhookURL    string                     `json:"webhookUrl"`
+	WebhookSecret string                     `json:"webhookSecret,omitempty"`
+	CreatedAt     string                     `json:"createdAt"`
+	UpdatedAt     string                     `json:"updatedAt"`
+	CurrentValue  string                     `json:"currentValue,omitempty"`
+	Alerts        []usageBudgetAlertResponse `json:"alerts,omitempty"`
+}
+
+func newUsageBudgetResponse(b db.UsageBudget) usageBudgetResponse {
+	return usageBudgetResponse{
+		ID:         b.ID.String(),
+		Name:       b.Name,
+		Metric:     b.Metric,
+		Limit:      formatUsageDecimal(b.Limit, 12),
+		WebhookURL: b.WebhookURL,
+		CreatedAt:  b.CreatedAt.UTC().Format(time.RFC3339),
+		UpdatedAt:  b.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// listUsageBudgetsHandler returns the organization's budgets with their
+// value so far this month and the alerts they fired.
+func (s *Server) listUsageBudgetsHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	budgets, err := s.db.ListUsageBudgets(ctx, u.tenantID)
+	var alerts []db.UsageBudgetAlert
+	if err == nil {
+		alerts, err = s.db.ListUsageBudgetAlerts(ctx, u.tenantID, from)
+	}
+	var summary usagePeriodSummary
+	var charges usageCharges
+	if err == nil && len(budgets) > 0 {
+		summary, charges, _, err = s.loadPricedUsageSummary(ctx, u.tenantID, from, from.AddDate(0, 1, 0), now)
+	}
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list budgets"})
+		return
+	}
+
+	out := make([]usageBudgetResponse, 0, len(budgets))
+	for _, b := range budgets {
+		resp := newUsageBudgetResponse(b)
+		resp.CurrentValue = formatUsageDecimal(usageBudgetValue(b.Metric, summary, charges), 12)
+		resp.Alerts = []usageBudgetAlertResponse{}
+		for _, a := range alerts {
+			if a.BudgetID != b.ID {
+				continue
+			}
+			alert := usageBudgetAlertResponse{
+				ThresholdPercent: a.ThresholdPercent,
+				Value:            formatUsageDecimal(a.Value, 12),
+				FiredAt:          a.FiredAt.UTC().Format(time.RFC3339),
+				Attempts:         a.Attempts,
+				LastError:        a.LastError,
+			}
+			if a.DeliveredAt != nil {
+				deliveredAt := a.DeliveredAt.UTC().Format(time.RFC3339)
+				alert.DeliveredAt = &deliveredAt
+			}
+			resp.Alerts = append(resp.Alerts, alert)
+		}
+		out = append(out, resp)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"periodStart": from.Format(time.RFC3339),
+		"periodEnd":   from.AddDate(0, 1, 0).Format(time.RFC3339),
+		"budgets":     out,
+	})
+}
+
+// createUsageBudgetHandler creates a budget and returns its webhook signing
+// secret, which is not shown again.
+func (s *Server) createUsageBudgetHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	var req usageBudgetRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	limit, webhookURL, err := req.validate(true)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	secret, err := generateUsageWebhookSecret()
+	if err != nil {
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	encrypted, err := apikey.Encrypt(secret, s.apiKeyEncryptionKey)
+	if err != nil {
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	budget, err := s.db.CreateUsageBudget(c.Request.Context(), db.UsageBudget{
+		ID:                     uuid.New(),
+		TenantID:               u.tenantID,
+		Name:                   req.Name,
+		Metric:                 req.Metric,
+		Limit:                  limit,
+		WebhookURL:             webhookURL,
+		WebhookSecretEncrypted: encrypted,
+	})
+	if err != nil {
+		if errors.Is(err, db.ErrConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": "budget name already exists"})
+			return
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create budget"})
+		return
+	}
+	setAuditTarget(c, budget.ID.String())
+
+	resp := newUsageBudgetResponse(budget)
+	resp.WebhookSecret = secret
+	c.JSON(http.StatusCreated, resp)
+}
+
+func (s *Server) updateUsageBudgetHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid budget id"})
+		return
+	}
+	var req usageBudgetRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	limit, webhookURL, err := req.validate(false)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	budget, err := s.db.UpdateUsageBudget(c.Request.Context(), u.tenantID, id, req.Name, limit, webhookURL)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "budget not found"})
+		case errors.Is(err, db.ErrConflict):
+			c.JSON(http.StatusConflict, gin.H{"error": "budget name already exists"})
+		case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		default:
+			logError(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not update budget"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, newUsageBudgetResponse(budget))
+}
+
+func (s *Server) deleteUsageBudgetHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid budget id"})
+		return
+	}
+
+	if err := s.db.DeleteUsageBudget(c.Request.Context(), u.tenantID, id); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "budget not found"})
+			return
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not delete budget"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"bin2.io/internal/db"
+)
+
+func TestCrossedUsageBudgetThresholds(t *testing.T) {
+	limit := big.NewRat(10, 1)
+	for _, tc := range []struct {
+		value *big.Rat
+		want  []int
+	}{
+		{big.NewRat(49, 10), nil},
+		{big.NewRat(5, 1), []int{50}},
+		{big.NewRat(79999, 10000), []int{50}},
+		{big.NewRat(8, 1), []int{50, 80}},
+		{big.NewRat(10, 1), []int{50, 80, 100}},
+		{big.NewRat(250, 1), []int{50, 80, 100}},
+	} {
+		if got := crossedUsageBudgetThresholds(tc.value, limit); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("crossedUsageBudgetThresholds(%s) = %v, want %v", tc.value.FloatString(4), got, tc.want)
+		}
+	}
+}
+
+func TestUsageBudgetValue(t *testing.T) {
+	summary := usagePeriodSummary{PushOpCount: 7, PullOpCount: 900}
+	charges := usageCharges{
+		StorageUSD:   big.NewRat(1, 2),
+		PushUSD:      big.NewRat(1, 4),
+		PullUSD:      big.NewRat(1, 4),
+		PullBytesUSD: big.NewRat(1, 2),
+		MinimumUSD:   new(big.Rat),
+	}
+	for metric, want := range map[string]string{
+		db.BudgetMetricChargeUSD:   "3/2",
+		db.BudgetMetricPushOpCount: "7",
+		db.BudgetMetricPullOpCount: "900",
+	} {
+		if got := usageBudgetValue(metric, summary, charges).RatString(); got != want {
+			t.Errorf("usageBudgetValue(%s) = %s, want %s", metric, got, want)
+		}
+	}
+}
+
+func TestUsageWebhookRetryAfter(t *testing.T) {
+	if got := usageWebhookRetryAfter(1); got != time.Minute {
+		t.Fatalf("first retry after %s, want 1m", got)
+	}
+	if got := usageWebhookRetryAfter(4); got != 8*time.Minute {
+		t.Fatalf("fourth retry after %s, want 8m", got)
+	}
+	if got := usageWebhookRetryAfter(usageWebhookMaxAttempts); got != 6*time.Hour {
+		t.Fatalf("last retry after %s, want 6h", got)
+	}
+}
+
+func TestPostUsageWebhookSigned(t *testing.T) {
+	const secret = "whsec_test"
+	body := []byte(`{"type":"usage.budget.threshold_crossed"}`)
+	now := time.Unix(1767225600, 0)
+
+	var gotSignature, gotID string
+	var gotBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSignature = r.Header.Get(usageWebhookSignatureHeader)
+		gotID = r.Header.Get(usageWebhookIDHeader)
+		gotBody, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	if err := postUsageWebhook(context.Background(), srv.Client(), srv.URL, secret, "alert-1", body, now); err != nil {
+		t.Fatalf("postUsageWebhook: %v", err)
+	}
+	if gotID != "alert-1" || string(gotBody) != string(body) {
+		t.Fatalf("received id %q body %q", gotID, gotBody)
+	}
+
+	t0, v1, ok := strings.Cut(gotSignature, ",v1=")
+	if !ok || t0 != "t="+strconv.FormatInt(now.Unix(), 10) {
+		t.Fatalf("signature = %q", gotSignature)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(now.Unix(), 10) + "." + string(body)))
+	if v1 != hex.EncodeToString(mac.Sum(nil)) {
+		t.Fatalf("signature %q does not verify", gotSignature)
+	}
+}
+
+func TestPostUsageWebhookRejectsNon2xx(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	if err := postUsageWebhook(context.Background(), srv.Client(), srv.URL, "s", "id", []byte("{}"), time.Now()); err == nil {
+		t.Fatal("postUsageWebhook succeeded on a 503")
+	}
+}
+
+func TestUsageWebhookClientRefusesInternalAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	if err := postUsageWebhook(context.Background(), newUsageWebhookClient(), srv.URL, "s", "id", []byte("{}"), time.Now()); err == nil {
+		t.Fatal("webhook client connected to a loopback address")
+	}
+	for ip, want := range map[string]bool{
+		"203.0.113.7":     true,
+		"2001:db8::1":     true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"192.168.0.1":     false,
+		"169.254.169.254": false,
+		"::1":             false,
+		"fd00::1":         false,
+		"0.0.0.0":         false,
+	} {
+		if got := publicWebhookIP(net.ParseIP(ip)); got != want {
+			t.Errorf("publicWebhookIP(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestValidateUsageWebhookURL(t *testing.T) {
+	for raw, ok := range map[string]bool{
+		"https://hooks.example.com/bin2":  true,
+		" https://hooks.example.com/x ":   true,
+		"http://hooks.example.com/bin2":   false,
+		"https://user:pw@hooks.example":   false,
+		"https:///no-host":                false,
+		"hooks.example.com/bin2":          false,
+		"https://hooks.example.com/#frag": false,
+	} {
+		if _, err := validateUsageWebhookURL(raw); (err == nil) != ok {
+			t.Errorf("validateUsageWebhookURL(%q) error = %v, want ok %v", raw, err, ok)
+		}
+	}
+}
+
+func TestUsageBudgetRequestValidate(t *testing.T) {
+	req := usageBudgetRequest{Name: " monthly ", Metric: db.BudgetMetricChargeUSD, Limit: "25.50", WebhookURL: "https://hooks.example.com"}
+	limit, _, err := req.validate(true)
+	if err != nil || limit.RatString() != "51/2" || req.Name != "monthly" {
+		t.Fatalf("validate = %v, %v (name %q)", limit, err, req.Name)
+	}
+	for _, bad := range []usageBudgetRequest{
+		{Name: "x", Metric: "bytes", Limit: "1", WebhookURL: "https://hooks.example.com"},
+		{Name: "x", Metric: db.BudgetMetricChargeUSD, Limit: "0", WebhookURL: "https://hooks.example.com"},
+		{Name: "x", Metric: db.BudgetMetricChargeUSD, Limit: "-1", WebhookURL: "https://hooks.example.com"},
+		{Name: "", Metric: db.BudgetMetricChargeUSD, Limit: "1", WebhookURL: "https://hooks.example.com"},
+	} {
+		if _, _, err := bad.validate(true); err == nil {
+			t.Errorf("validate(%+v) succeeded", bad)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -38,34 +40,9 @@ func (s *Server) listUsageEventsHandler(c *gin.Context) {
 		return
 	}
 
-	type eventResponse struct {
-		ID         string  `json:"id"`
-		CreatedAt  string  `json:"createdAt"`
-		RegistryID *string `json:"registryId,omitempty"`
-		RepoID     *string `json:"repoId,omitempty"`
-		Digest     string  `json:"digest,omitempty"`
-		Metric     string  `json:"metric"`
-		Value      int64   `json:"value"`
-	}
-
-	out := make([]eventResponse, 0, len(events))
+	out := make([]usageEventResponse, 0, len(events))
 	for _, e := range events {
-		resp := eventResponse{
-			ID:        e.ID.String(),
-			CreatedAt: e.CreatedAt.UTC().Format(time.RFC3339),
-			Digest:    e.Digest,
-			Metric:    e.Metric,
-			Value:     e.Value,
-		}
-		if e.RegistryID != nil {
-			s := e.RegistryID.String()
-			resp.RegistryID = &s
-		}
-		if e.RepoID != nil {
-			s := e.RepoID.String()
-			resp.RepoID = &s
-		}
-		out = append(out, resp)
+		out = append(out, newUsageEventResponse(e, time.RFC3339))
 	}
 	c.JSON(http.StatusOK, out)
 }
@@ -76,7 +53,12 @@ func (s *Server) usageSummaryHandler(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
 	}
+	s.writeUsageSummary(c, u.tenantID)
+}
 
+// writeUsageSummary responds with the tenant's usage for the calendar month
+// given by the from and to query parameters.
+func (s *Server) writeUsageSummary(c *gin.Context, tenantID uuid.UUID) {
 	from, to, err := usageSummaryWindow(c.Query("from"), c.Query("to"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -84,7 +66,7 @@ func (s *Server) usageSummaryHandler(c *gin.Context) {
 	}
 	asOf := usageSummaryAsOf(from, to, time.Now().UTC())
 
-	pushOpCount, err := s.db.SumUsageMetricByTenantBetween(c.Request.Context(), u.tenantID, db.MetricPushOpCount, from, asOf)
+	summary, charges, segments, err := s.loadPricedUsageSummary(c.Request.Context(), tenantID, from, to, asOf)
 	if err != nil {
 		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 			return
@@ -94,27 +76,110 @@ func (s *Server) usageSummaryHandler(c *gin.Context) {
 		return
 	}
 
-	pullOpCount, err := s.db.SumUsageMetricByTenantBetween(c.Request.Context(), u.tenantID, db.MetricPullOpCount, from, asOf)
+	c.Header("Cache-Control", "no-store")
+	resp := usageSummaryResponse{
+		From:                 summary.From.Format(time.RFC3339),
+		To:                   summary.To.Format(time.RFC3339),
+		AsOf:                 summary.AsOf.Format(time.RFC3339),
+		Plans:                make([]usagePlanResponse, 0, len(segments)),
+		usageChargesResponse: newUsageChargesResponse(summary, charges),
+	}
+	for _, seg := range segments {
+		resp.Plans = append(resp.Plans, usagePlanResponse{
+			Plan: seg.Plan,
+			From: seg.From.Format(time.RFC3339),
+			To:   seg.To.Format(time.RFC3339),
+		})
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+type usageSummaryResponse struct {
+	From  string              `json:"from"`
+	To    string              `json:"to"`
+	AsOf  string              `json:"asOf"`
+	Plans []usagePlanResponse `json:"plans"`
+	usageChargesResponse
+}
+
+// usagePlanResponse is the plan a tenant was charged under for part of a
+// period.
+type usagePlanResponse struct {
+	Plan string `json:"plan"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// usageChargesResponse is the usage and charges of a tenant, registry or
+// repository over a period.
+type usageChargesResponse struct {
+	PushOpCount         int64  `json:"pushOpCount"`
+	PullOpCount         int64  `json:"pullOpCount"`
+	PullBytes           int64  `json:"pullBytes"`
+	StorageOpeningBytes int64  `json:"storageOpeningBytes"`
+	StorageClosingBytes int64  `json:"storageClosingBytes"`
+	StorageByteSeconds  string `json:"storageByteSeconds"`
+	StorageGiBHours     string `json:"storageGiBHours"`
+	StorageGiBMonths    string `json:"storageGiBMonths"`
+	StorageChargeUSD    string `json:"storageChargeUsd"`
+	PushChargeUSD       string `json:"pushChargeUsd"`
+	PullChargeUSD       string `json:"pullChargeUsd"`
+	PullBytesChargeUSD  string `json:"pullBytesChargeUsd"`
+	MinimumChargeUSD    string `json:"minimumChargeUsd"`
+	TotalChargeUSD      string `json:"totalChargeUsd"`
+}
+
+func newUsageChargesResponse(summary usagePeriodSummary, charges usageCharges) usageChargesResponse {
+	return usageChargesResponse{
+		PushOpCount:         summary.PushOpCount,
+		PullOpCount:         summary.PullOpCount,
+		PullBytes:           summary.PullBytes,
+		StorageOpeningBytes: summary.StorageOpeningBytes,
+		StorageClosingBytes: summary.StorageClosingBytes,
+		StorageByteSeconds:  formatUsageDecimal(summary.storageByteSeconds(), 9),
+		StorageGiBHours:     formatUsageDecimal(summary.storageGiBHours(), 12),
+		StorageGiBMonths:    formatUsageDecimal(summary.storageGiBMonths(), 12),
+		StorageChargeUSD:    formatUsageDecimal(charges.StorageUSD, 12),
+		PushChargeUSD:       formatUsageDecimal(charges.PushUSD, 12),
+		PullChargeUSD:       formatUsageDecimal(charges.PullUSD, 12),
+		PullBytesChargeUSD:  formatUsageDecimal(charges.PullBytesUSD, 12),
+		MinimumChargeUSD:    formatUsageDecimal(charges.MinimumUSD, 12),
+		TotalChargeUSD:      formatUsageDecimal(charges.totalUSD(), 12),
+	}
+}
+
+func (s *Server) usageBreakdownHandler(c *gin.Context) {
+	u, err := s.getUser(c)
 	if err != nil {
-		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-			return
-		}
-		logError(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to summarize usage"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
 	}
+	s.writeUsageBreakdown(c, u.tenantID)
+}
 
-	openingStorageBytes, err := s.db.SumUsageMetricByTenantBefore(c.Request.Context(), u.tenantID, db.MetricStorageBytes, from)
+// writeUsageBreakdown responds with the tenant's usage for the calendar month
+// given by the from and to query parameters, split by registry or, with
+// by=repository, by repository. Usage not attributed to a registry or
+// repository is reported without one. Items are charged at the plan's rates;
+// allowances and minimum charges only apply to the tenant's summary.
+func (s *Server) writeUsageBreakdown(c *gin.Context, tenantID uuid.UUID) {
+	from, to, err := usageSummaryWindow(c.Query("from"), c.Query("to"))
 	if err != nil {
-		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-			return
-		}
-		logError(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to summarize usage"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	by := strings.TrimSpace(c.DefaultQuery("by", usageBreakdownByRegistry))
+	if by != usageBreakdownByRegistry && by != usageBreakdownByRepository {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "by must be registry or repository"})
+		return
+	}
+	asOf := usageSummaryAsOf(from, to, time.Now().UTC())
 
-	storageDeltas, err := s.db.ListUsageMetricDeltasByTenantBetween(c.Request.Context(), u.tenantID, db.MetricStorageBytes, from, asOf)
+	items, err := s.loadPricedUsageBreakdown(c.Request.Context(), tenantID, from, to, asOf, by == usageBreakdownByRepository)
+	var registryNames, repoNames map[uuid.UUID]string
+	if err == nil {
+		registryNames, repoNames, err = s.lookupUsageBreakdownNames(c.Request.Context(), items)
+	}
 	if err != nil {
 		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 			return
@@ -124,124 +189,243 @@ func (s *Server) usageSummaryHandler(c *gin.Context) {
 		return
 	}
 
-	summary, err := calculateUsagePeriodSummary(from, to, asOf, openingStorageBytes, storageDeltas, pushOpCount, pullOpCount)
-	if err != nil {
-		logError(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to summarize usage"})
-		return
+	type itemResponse struct {
+		RegistryID     string `json:"registryId,omitempty"`
+		RegistryName   string `json:"registryName,omitempty"`
+		RepositoryID   string `json:"repositoryId,omitempty"`
+		RepositoryName string `json:"repositoryName,omitempty"`
+		usageChargesResponse
+	}
+	type breakdownResponse struct {
+		From  string         `json:"from"`
+		To    string         `json:"to"`
+		AsOf  string         `json:"asOf"`
+		By    string         `json:"by"`
+		Items []itemResponse `json:"items"`
 	}
 
-	type summaryResponse struct {
-		From                string `json:"from"`
-		To                  string `json:"to"`
-		AsOf                string `json:"asOf"`
-		PushOpCount         int64  `json:"pushOpCount"`
-		PullOpCount         int64  `json:"pullOpCount"`
-		StorageOpeningBytes int64  `json:"storageOpeningBytes"`
-		StorageClosingBytes int64  `json:"storageClosingBytes"`
-		StorageByteSeconds  string `json:"storageByteSeconds"`
-		StorageGiBHours     string `json:"storageGiBHours"`
-		StorageGiBMonths    string `json:"storageGiBMonths"`
-		StorageChargeUSD    string `json:"storageChargeUsd"`
-		TotalChargeUSD      string `json:"totalChargeUsd"`
+	resp := breakdownResponse{
+		From:  from.Format(time.RFC3339),
+		To:    to.Format(time.RFC3339),
+		AsOf:  asOf.Format(time.RFC3339),
+		By:    by,
+		Items: make([]itemResponse, 0, len(items)),
+	}
+	for _, item := range items {
+		out := itemResponse{usageChargesResponse: newUsageChargesResponse(item.Summary, item.Charges)}
+		if item.RegistryID != uuid.Nil {
+			out.RegistryID = item.RegistryID.String()
+			out.RegistryName = registryNames[item.RegistryID]
+		}
+		if item.RepoID != uuid.Nil {
+			out.RepositoryID = item.RepoID.String()
+			out.RepositoryName = repoNames[item.RepoID]
+		}
+		resp.Items = append(resp.Items, out)
 	}
 
 	c.Header("Cache-Control", "no-store")
-	c.JSON(http.StatusOK, summaryResponse{
-		From:                summary.From.Format(time.RFC3339),
-		To:                  summary.To.Format(time.RFC3339),
-		AsOf:                summary.AsOf.Format(time.RFC3339),
-		PushOpCount:         summary.PushOpCount,
-		PullOpCount:         summary.PullOpCount,
-		StorageOpeningBytes: summary.StorageOpeningBytes,
-		StorageClosingBytes: summary.StorageClosingBytes,
-		StorageByteSeconds:  formatUsageDecimal(summary.storageByteSeconds(), 9),
-		StorageGiBHours:     formatUsageDecimal(summary.storageGiBHours(), 12),
-		StorageGiBMonths:    formatUsageDecimal(summary.storageGiBMonths(), 12),
-		StorageChargeUSD:    formatUsageDecimal(summary.storageChargeUSD(), 12),
-		TotalChargeUSD:      formatUsageDecimal(summary.totalChargeUSD(), 12),
-	})
+	c.JSON(http.StatusOK, resp)
+}
+
+// lookupUsageBreakdownNames returns the current names of the items'
+// registries and repositories. Deleted ones have none.
+func (s *Server) lookupUsageBreakdownNames(ctx context.Context, items []usageBreakdownItem) (map[uuid.UUID]string, map[uuid.UUID]string, error) {
+	var registryIDs, repoIDs []uuid.UUID
+	for _, item := range items {
+		if item.RegistryID != uuid.Nil {
+			registryIDs = append(registryIDs, item.RegistryID)
+		}
+		if item.RepoID != uuid.Nil {
+			repoIDs = append(repoIDs, item.RepoID)
+		}
+	}
+	return s.db.GetUsageAttributionNames(ctx, registryIDs, repoIDs)
 }
 
 // ingestUsageEventsHandler handles POST /api/v1/usage/events.
-// Used by the CF worker to push pull-op-count events. Requires the
-// USAGE_INGEST_SECRET shared secret; this endpoint is not accessible to
-// end-user registry tokens.
+// Used by the CF worker to push pull-op-count and pull-bytes events. Requests
+// must be signed by a registered usage worker, each with a fresh nonce, and
+// may only carry the metrics and values the worker is allowed; this endpoint
+// is not accessible to end-user registry tokens. Every accepted batch is
+// logged with the worker that submitted it. An event that is invalid or not
+// allowed is rejected on its own and logged with the batch; the response is
+// 204 if none was, otherwise 200 with the rejected events.
 func (s *Server) ingestUsageEventsHandler(c *gin.Context) {
-	authHeader := strings.TrimSpace(c.GetHeader("Authorization"))
-	secret := ""
-	if len(authHeader) > 7 && strings.EqualFold(authHeader[:7], "bearer ") {
-		secret = strings.TrimSpace(authHeader[7:])
-	}
-	if secret == "" || secret != s.usageIngestSecret {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+	worker, sig, raw, ok := s.authenticateUsageWorker(c)
+	if !ok {
 		return
 	}
 
-	type ingestRequest struct {
-		Namespace string `json:"namespace"`
-		ID        string `json:"id"`
-		RepoID    string `json:"repoId"`
-		Digest    string `json:"digest"`
-		Metric    string `json:"metric"`
-		Value     int64  `json:"value"`
-	}
-
-	var body []ingestRequest
-	if err := c.ShouldBindJSON(&body); err != nil {
+	var body []usageIngestEvent
+	if err := json.Unmarshal(raw, &body); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
 		return
 	}
+	if len(body) > usageIngestMaxEvents {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d events may be sent at once", usageIngestMaxEvents)})
+		return
+	}
 
+	batch := db.UsageIngestBatch{
+		ID:       uuid.New(),
+		WorkerID: worker.ID,
+		Nonce:    sig.Nonce,
+		SignedAt: sig.Timestamp,
+		ClientIP: c.ClientIP(),
+	}
 	events := make([]db.UsageEvent, 0, len(body))
-	for _, req := range body {
-		namespace := strings.TrimSpace(req.Namespace)
-		if namespace == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "namespace is required"})
-			return
-		}
-		reg, err := s.db.GetRegistryByName(c.Request.Context(), namespace)
+	for i, req := range body {
+		event, err := newIngestedUsageEvent(c.Request.Context(), s.db, worker, req)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown namespace: " + namespace})
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return
+			}
+			var reqErr usageIngestRequestError
+			if errors.As(err, &reqErr) {
+				batch.Rejected = append(batch.Rejected, req.rejection(i, reqErr.message))
+				continue
+			}
+			logError(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to resolve usage event"})
 			return
 		}
-		id, err := uuid.Parse(req.ID)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid event id: " + req.ID})
+		events = append(events, event)
+	}
+
+	if err := s.db.IngestUsageBatch(c.Request.Context(), batch, events); err != nil {
+		if errors.Is(err, db.ErrConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": "request was already received"})
 			return
 		}
-		if req.Metric != db.MetricPullOpCount && req.Metric != db.MetricPushOpCount && req.Metric != db.MetricStorageBytes {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid metric: " + req.Metric})
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 			return
 		}
-		digest, err := normalizeUsageEventDigest(req.Digest)
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store events"})
+		return
+	}
+
+	if len(batch.Rejected) == 0 {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rejected": newUsageIngestRejectionResponses(batch.Rejected)})
+}
+
+// usageIngestEvent is an event as a worker submits it.
+type usageIngestEvent struct {
+	Namespace  string `json:"namespace"`
+	ID         string `json:"id"`
+	RepoID     string `json:"repoId"`
+	Repository string `json:"repository"`
+	Digest     string `json:"digest"`
+	Metric     string `json:"metric"`
+	Value      int64  `json:"value"`
+}
+
+func (req usageIngestEvent) rejection(position int, reason string) db.UsageIngestRejection {
+	return db.UsageIngestRejection{
+		Position:  position,
+		EventID:   req.ID,
+		Namespace: req.Namespace,
+		Metric:    req.Metric,
+		Value:     req.Value,
+		Reason:    reason,
+	}
+}
+
+// newIngestedUsageEvent returns the event req describes if worker may submit
+// it, otherwise a usageIngestRequestError saying why not.
+func newIngestedUsageEvent(ctx context.Context, repos usageIngestRepositories, worker db.UsageWorker, req usageIngestEvent) (db.UsageEvent, error) {
+	namespace := strings.TrimSpace(req.Namespace)
+	if namespace == "" {
+		return db.UsageEvent{}, usageIngestRequestError{message: "namespace is required"}
+	}
+	id, err := uuid.Parse(req.ID)
+	if err != nil {
+		return db.UsageEvent{}, usageIngestRequestError{message: "invalid event id: " + req.ID}
+	}
+	if err := checkUsageWorkerEvent(worker, req.Metric, req.Value); err != nil {
+		return db.UsageEvent{}, usageIngestRequestError{message: err.Error()}
+	}
+	digest, err := normalizeUsageEventDigest(req.Digest)
+	if err != nil {
+		return db.UsageEvent{}, usageIngestRequestError{message: "invalid digest: " + req.Digest}
+	}
+	reg, err := repos.GetRegistryByName(ctx, namespace)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return db.UsageEvent{}, usageIngestRequestError{message: "unknown namespace: " + namespace}
+		}
+		return db.UsageEvent{}, err
+	}
+	repoID, err := resolveIngestUsageRepoID(ctx, repos, reg.ID, namespace, req.RepoID, req.Repository)
+	if err != nil {
+		return db.UsageEvent{}, err
+	}
+	return db.UsageEvent{
+		ID:         id,
+		TenantID:   reg.TenantID,
+		RegistryID: &reg.ID,
+		RepoID:     repoID,
+		Digest:     digest,
+		Metric:     req.Metric,
+		Value:      req.Value,
+	}, nil
+}
+
+type usageIngestRequestError struct {
+	message string
+}
+
+func (e usageIngestRequestError) Error() string {
+	return e.message
+}
+
+// usageIngestRepositories looks up the registries and repositories ingested
+// events name; *db.DB implements it.
+type usageIngestRepositories interface {
+	GetRegistryByName(ctx context.Context, name string) (db.Registry, error)
+	RepositoryBelongsToRegistry(ctx context.Context, repositoryID, registryID uuid.UUID) (bool, error)
+	GetRepositoryID(ctx context.Context, registryID uuid.UUID, name string) (uuid.UUID, error)
+}
+
+// resolveIngestUsageRepoID returns the repository an ingested event is
+// attributed to: repoID if it is in the registry, otherwise the repository
+// named by its full path, which is "<namespace>/<name>" as in /v2 URLs. Events
+// naming neither are attributed to the registry alone.
+func resolveIngestUsageRepoID(ctx context.Context, repos usageIngestRepositories, registryID uuid.UUID, namespace, rawRepoID, repository string) (*uuid.UUID, error) {
+	rawRepoID = strings.TrimSpace(rawRepoID)
+	repository = strings.TrimSpace(repository)
+	if rawRepoID != "" {
+		repoID, err := uuid.Parse(rawRepoID)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid digest: " + req.Digest})
-			return
+			return nil, usageIngestRequestError{message: "invalid repoId: " + rawRepoID}
 		}
-		event := db.UsageEvent{
-			ID:         id,
-			TenantID:   reg.TenantID,
-			RegistryID: &reg.ID,
-			Digest:     digest,
-			Metric:     req.Metric,
-			Value:      req.Value,
+		ok, err := repos.RepositoryBelongsToRegistry(ctx, repoID, registryID)
+		if err != nil {
+			return nil, err
 		}
-		if req.RepoID != "" {
-			if repoID, err := uuid.Parse(req.RepoID); err == nil {
-				event.RepoID = &repoID
-			}
+		if !ok {
+			return nil, usageIngestRequestError{message: "repoId is not in namespace " + namespace}
 		}
-		events = append(events, event)
+		return &repoID, nil
 	}
-
-	if err := s.db.InsertUsageEvents(c.Request.Context(), events); err != nil {
-		logError(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store events"})
-		return
+	if repository == "" {
+		return nil, nil
 	}
-
-	c.Status(http.StatusNoContent)
+	if !validRepoName(repository) || registryNamespace(repository) != namespace || repoLeaf(repository) == repository {
+		return nil, usageIngestRequestError{message: "repository must be a repository in namespace " + namespace}
+	}
+	repoID, err := repos.GetRepositoryID(ctx, registryID, repoLeaf(repository))
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &repoID, nil
 }
 
 // resolveUsageAuth tries WorkOS JWT auth first, then falls back to registry
@@ -272,3 +456,75 @@ func (s *Server) resolveUsageAuth(c *gin.Context) (tenantID, registryID uuid.UUI
 	}
 	return reg.TenantID, reg.ID, nil
 }
+
+func (s *Server) exportUsageEventsHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	s.writeUsageEventExport(c, u.tenantID)
+}
+
+// writeUsageEventExport streams the tenant's raw usage events for the
+// calendar month given by the from and to query parameters as NDJSON.
+func (s *Server) writeUsageEventExport(c *gin.Context, tenantID uuid.UUID) {
+	from, to, err := usageSummaryWindow(c.Query("from"), c.Query("to"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", `attachment; filename="usage-events-`+from.Format("2006-01")+`.ndjson"`)
+	c.Status(http.StatusOK)
+
+	enc := json.NewEncoder(c.Writer)
+	written := 0
+	err = s.db.StreamUsageEvents(c.Request.Context(), tenantID, from, to, func(e db.UsageEvent) error {
+		if err := enc.Encode(newUsageEventResponse(e, time.RFC3339Nano)); err != nil {
+			return err
+		}
+		written++
+		if written%500 == 0 {
+			c.Writer.Flush()
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		// Headers are already sent; the truncated body is the only signal.
+		logError(fmt.Errorf("exportUsageEvents: %w", err))
+	}
+}
+
+// usageEventResponse is a raw usage event as the API returns it.
+type usageEventResponse struct {
+	ID         string  `json:"id"`
+	CreatedAt  string  `json:"createdAt"`
+	RegistryID *string `json:"registryId,omitempty"`
+	RepoID     *string `json:"repoId,omitempty"`
+	Digest     string  `json:"digest,omitempty"`
+	Metric     string  `json:"metric"`
+	Value      int64   `json:"value"`
+	Reason     string  `json:"reason,omitempty"`
+}
+
+func newUsageEventResponse(e db.UsageEvent, timeLayout string) usageEventResponse {
+	resp := usageEventResponse{
+		ID:        e.ID.String(),
+		CreatedAt: e.CreatedAt.UTC().Format(timeLayout),
+		Digest:    e.Digest,
+		Metric:    e.Metric,
+		Value:     e.Value,
+		Reason:    e.Reason,
+	}
+	if e.RegistryID != nil {
+		id := e.RegistryID.String()
+		resp.RegistryID = &id
+	}
+	if e.RepoID != nil {
+		id := e.RepoID.String()
+		resp.RepoID = &id
+	}
+	return resp
+}
@@ -0,0 +1,503 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// usagePipelineCapacity is how many events wait in memory to be stored
+	// before further ones are journaled instead.
+	usagePipelineCapacity = 10000
+	// usagePipelineOverflowCapacity is how many events that found the queue
+	// full wait in memory to be journaled before a request journals them.
+	usagePipelineOverflowCapacity = 10 * usagePipelineCapacity
+	// usagePipelineBatchSize is the most events stored in one statement.
+	usagePipelineBatchSize = 500
+	// usagePipelineFlushInterval is the longest an event waits in memory.
+	usagePipelineFlushInterval = time.Second
+	// usagePipelineInsertTimeout bounds storing one batch.
+	usagePipelineInsertTimeout = 10 * time.Second
+	// usagePipelineReplayInterval is how often journaled events are retried.
+	usagePipelineReplayInterval = 30 * time.Second
+	// usageBacklogHeartbeat is how often a replica reports an unchanged
+	// backlog; changes are reported within usagePipelineFlushInterval.
+	usageBacklogHeartbeat = time.Minute
+)
+
+// errUsagePipelineFull is why events that found the queue full were journaled.
+var errUsagePipelineFull = errors.New("usage pipeline is full")
+
+// usagePipeline stores usage events emitted while serving requests in
+// batches, off the request path. Batches that cannot be stored are written
+// to a journal on local disk and replayed once Postgres is back; event ids
+// make replays idempotent. Events that find the queue full are journaled in
+// batches by a goroutine of their own, so that neither requests nor a slow
+// Postgres hold them up.
+type usagePipeline struct {
+	insert  func(context.Context, []db.UsageEvent) error
+	journal *usageJournal
+	events  chan db.UsageEvent
+	done    chan struct{}
+	// batched is how many events taken off events are not yet stored or
+	// journaled.
+	batched atomic.Int64
+
+	// mu guards closed against sends on events and overflowed while they
+	// are being closed.
+	mu     sync.RWMutex
+	closed bool
+
+	overflowMu   sync.Mutex
+	overflow     []db.UsageEvent
+	overflowed   chan struct{}
+	overflowDone chan struct{}
+
+	statsMu sync.Mutex
+	stats   usagePipelineStats
+}
+
+// usagePipelineStats describe one replica's pipeline.
+type usagePipelineStats struct {
+	Queued          int        `json:"queued"`
+	Batched         int        `json:"batched"`
+	Overflow        int        `json:"overflow"`
+	Capacity        int        `json:"capacity"`
+	JournalFiles    int        `json:"journalFiles"`
+	StoredEvents    int64      `json:"storedEvents"`
+	JournaledEvents int64      `json:"journaledEvents"`
+	ReplayedEvents  int64      `json:"replayedEvents"`
+	RejectedEvents  int64      `json:"rejectedEvents"`
+	SpilledBatches  int64      `json:"spilledBatches"`
+	LastStoredAt    *time.Time `json:"lastStoredAt"`
+	LastError       string     `json:"lastError,omitempty"`
+}
+
+// newUsagePipelineFromEnv starts a pipeline journaling to USAGE_JOURNAL_DIR,
+// "usage-journal" by default.
+func newUsagePipelineFromEnv(conn *db.DB) (*usagePipeline, error) {
+	journal, err := newUsageJournal(getenvDefault("USAGE_JOURNAL_DIR", "usage-journal"))
+	if err != nil {
+		return nil, err
+	}
+	return newUsagePipeline(conn.InsertUsageEvents, journal), nil
+}
+
+func newUsagePipeline(insert func(context.Context, []db.UsageEvent) error, journal *usageJournal) *usagePipeline {
+	p := &usagePipeline{
+		insert:  insert,
+		journal: journal,
+		events:  make(chan db.UsageEvent, usagePipelineCapacity),
+		done:    make(chan struct{}),
+
+		overflowed:   make(chan struct{}, 1),
+		overflowDone: make(chan struct{}),
+	}
+	go p.run()
+	go p.runOverflow()
+	return p
+}
+
+// enqueue queues e for storing without waiting on Postgres or the disk.
+// When the queue is full, e is handed to the overflow goroutine to journal;
+// when the pipeline is closed, e is journaled here.
+func (p *usagePipeline) enqueue(e db.UsageEvent) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		p.spill([]db.UsageEvent{e}, errors.New("usage pipeline is closed"))
+		return
+	}
+	select {
+	case p.events <- e:
+	default:
+		p.addOverflow(e)
+	}
+}
+
+// addOverflow holds e for the overflow goroutine. If it has fallen
+// usagePipelineOverflowCapacity events behind, the events held are
+// journaled here, in one file, rather than held in memory.
+func (p *usagePipeline) addOverflow(e db.UsageEvent) {
+	p.overflowMu.Lock()
+	p.overflow = append(p.overflow, e)
+	var backlog []db.UsageEvent
+	if len(p.overflow) >= usagePipelineOverflowCapacity {
+		backlog, p.overflow = p.overflow, nil
+	}
+	p.overflowMu.Unlock()
+	if backlog != nil {
+		p.spill(backlog, errUsagePipelineFull)
+		return
+	}
+	select {
+	case p.overflowed <- struct{}{}:
+	default:
+	}
+}
+
+// close stores queued events, journaling what cannot be stored, and waits
+// until done or ctx expires.
+func (p *usagePipeline) close(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.events)
+		close(p.overflowed)
+	}
+	p.mu.Unlock()
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *usagePipeline) run() {
+	defer close(p.done)
+	flush := time.NewTicker(usagePipelineFlushInterval)
+	defer flush.Stop()
+	replay := time.NewTicker(usagePipelineReplayInterval)
+	defer replay.Stop()
+
+	p.replay()
+	batch := make([]db.UsageEvent, 0, usagePipelineBatchSize)
+	for {
+		select {
+		case e, ok := <-p.events:
+			if !ok {
+				p.store(batch)
+				p.batched.Store(0)
+				<-p.overflowDone
+				p.replay()
+				return
+			}
+			batch = append(batch, e)
+			p.batched.Store(int64(len(batch)))
+			if len(batch) >= usagePipelineBatchSize {
+				p.store(batch)
+				batch = batch[:0]
+				p.batched.Store(0)
+			}
+		case <-flush.C:
+			if len(batch) > 0 {
+				p.store(batch)
+				batch = batch[:0]
+				p.batched.Store(0)
+			}
+		case <-replay.C:
+			p.replay()
+		}
+	}
+}
+
+// runOverflow journals the events that found the queue full until the
+// pipeline is closed.
+func (p *usagePipeline) runOverflow() {
+	defer close(p.overflowDone)
+	for range p.overflowed {
+		p.spillOverflow()
+	}
+	p.spillOverflow()
+}
+
+// spillOverflow journals the events held for it, usagePipelineBatchSize to a
+// file, so that each file is replayed as one batch.
+func (p *usagePipeline) spillOverflow() {
+	p.overflowMu.Lock()
+	events := p.overflow
+	p.overflow = nil
+	p.overflowMu.Unlock()
+	for len(events) > 0 {
+		n := min(len(events), usagePipelineBatchSize)
+		p.spill(events[:n], errUsagePipelineFull)
+		events = events[n:]
+	}
+}
+
+// store inserts batch, journaling it if Postgres cannot be reached.
+func (p *usagePipeline) store(batch []db.UsageEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := p.insertBatch(batch); err != nil {
+		p.spill(batch, err)
+		return
+	}
+	p.record(func(s *usagePipelineStats) { s.StoredEvents += int64(len(batch)) })
+}
+
+// insertBatch inserts batch. If Postgres rejects it, the events are retried
+// one by one so that a single invalid event is dropped, not the batch.
+func (p *usagePipeline) insertBatch(batch []db.UsageEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), usagePipelineInsertTimeout)
+	defer cancel()
+	err := p.insert(ctx, batch)
+	if db.IsRejected(err) {
+		err = p.insertEach(ctx, batch)
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	p.record(func(s *usagePipelineStats) { s.LastStoredAt = &now })
+	return nil
+}
+
+func (p *usagePipeline) insertEach(ctx context.Context, batch []db.UsageEvent) error {
+	for _, e := range batch {
+		err := p.insert(ctx, []db.UsageEvent{e})
+		if err == nil {
+			continue
+		}
+		if !db.IsRejected(err) {
+			return err
+		}
+		logError(fmt.Errorf("dropping usage event %s: %w", e.ID, err))
+		p.record(func(s *usagePipelineStats) { s.RejectedEvents++ })
+	}
+	return nil
+}
+
+// spill journals events that could not be stored. Events are only lost if
+// the journal cannot be written either.
+func (p *usagePipeline) spill(events []db.UsageEvent, cause error) {
+	p.record(func(s *usagePipelineStats) {
+		s.SpilledBatches++
+		s.LastError = cause.Error()
+	})
+	if err := p.journal.append(events); err != nil {
+		logError(fmt.Errorf("lost %d usage events: %v, and could not journal them: %w", len(events), cause, err))
+		return
+	}
+	p.record(func(s *usagePipelineStats) { s.JournaledEvents += int64(len(events)) })
+	slog.Warn("Usage", slog.Int("journaled events", len(events)), slog.String("cause", cause.Error()))
+}
+
+// replay stores journaled events oldest first, stopping at the first file
+// that cannot be stored. Unreadable files are set aside as .corrupt.
+func (p *usagePipeline) replay() {
+	paths, err := p.journal.files()
+	if err != nil {
+		logError(fmt.Errorf("could not list usage journal: %w", err))
+		return
+	}
+	for _, path := range paths {
+		events, err := readUsageJournalFile(path)
+		if err != nil {
+			logError(fmt.Errorf("could not read usage journal %s: %w", path, err))
+			if err := os.Rename(path, path+".corrupt"); err != nil {
+				logError(fmt.Errorf("could not set aside usage journal %s: %w", path, err))
+				return
+			}
+			continue
+		}
+		if err := p.insertBatch(events); err != nil {
+			return
+		}
+		if err := os.Remove(path); err != nil {
+			logError(fmt.Errorf("could not remove usage journal %s: %w", path, err))
+			return
+		}
+		p.record(func(s *usagePipelineStats) { s.ReplayedEvents += int64(len(events)) })
+		slog.Info("Usage", slog.Int("replayed journaled events", len(events)))
+	}
+}
+
+func (p *usagePipeline) record(fn func(*usagePipelineStats)) {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	fn(&p.stats)
+}
+
+// snapshot returns the pipeline's current stats.
+func (p *usagePipeline) snapshot() usagePipelineStats {
+	p.statsMu.Lock()
+	stats := p.stats
+	p.statsMu.Unlock()
+	stats.Queued = len(p.events)
+	stats.Batched = int(p.batched.Load())
+	p.overflowMu.Lock()
+	stats.Overflow = len(p.overflow)
+	p.overflowMu.Unlock()
+	stats.Capacity = cap(p.events)
+	if paths, err := p.journal.files(); err == nil {
+		stats.JournalFiles = len(paths)
+	}
+	return stats
+}
+
+// usageBacklog is what a replica reports of the usage events it has yet to
+// store, so that storage is not repaired while they are pending.
+type usageBacklog struct {
+	pendingEvents int
+	journalFiles  int
+}
+
+func (b usageBacklog) empty() bool {
+	return b.pendingEvents == 0 && b.journalFiles == 0
+}
+
+// backlog returns the events waiting in memory and the journal files
+// waiting to be replayed.
+func (s usagePipelineStats) backlog() usageBacklog {
+	return usageBacklog{pendingEvents: s.Queued + s.Batched + s.Overflow, journalFiles: s.JournalFiles}
+}
+
+// usageBacklogReportDue reports whether cur is to be reported, given the
+// backlog last reported at lastAt, if any: at once when it became empty or
+// not or its journal changed, otherwise every usageBacklogHeartbeat.
+func usageBacklogReportDue(last *usageBacklog, lastAt time.Time, cur usageBacklog, now time.Time) bool {
+	if last == nil || last.empty() != cur.empty() || last.journalFiles != cur.journalFiles {
+		return true
+	}
+	return !now.Before(lastAt.Add(usageBacklogHeartbeat))
+}
+
+// runUsageBacklogReports reports the replica's usage backlog until ctx is
+// cancelled. Storage drift is measured against stored usage events only, and
+// is not repaired while any replica reports events still queued or
+// journaled: they would count again once stored. Events emitted within
+// usagePipelineFlushInterval before a repair may not be reported yet.
+func (s *Server) runUsageBacklogReports(ctx context.Context) {
+	ticker := time.NewTicker(usagePipelineFlushInterval)
+	defer ticker.Stop()
+	var (
+		last   *usageBacklog
+		lastAt time.Time
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cur, now := s.usageEvents.snapshot().backlog(), time.Now()
+		if !usageBacklogReportDue(last, lastAt, cur, now) {
+			continue
+		}
+		if err := s.reportUsageBacklog(ctx, cur); err != nil {
+			if !errors.Is(err, context.Canceled) {
+				logError(fmt.Errorf("could not report usage backlog: %w", err))
+			}
+			continue
+		}
+		last, lastAt = &cur, now
+	}
+}
+
+func (s *Server) reportUsageBacklog(ctx context.Context, b usageBacklog) error {
+	return s.db.ReportUsageBacklog(ctx, replicaName(), b.pendingEvents, b.journalFiles)
+}
+
+// replicaName names the replica in reports to operators and other replicas.
+func replicaName() string {
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// usageJournal is a directory of NDJSON files of usage events waiting to be
+// stored. Each file is written whole and renamed into place, so a file is
+// either complete or absent.
+type usageJournal struct {
+	dir string
+}
+
+func newUsageJournal(dir string) (*usageJournal, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create usage journal directory: %w", err)
+	}
+	return &usageJournal{dir: dir}, nil
+}
+
+// append durably writes events to a new journal file.
+func (j *usageJournal) append(events []db.UsageEvent) error {
+	name := fmt.Sprintf("%020d-%s", time.Now().UnixNano(), uuid.NewString())
+	tmp := filepath.Join(j.dir, name+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err = enc.Encode(e); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(j.dir, name+".ndjson"))
+}
+
+// files returns the journal's complete files, oldest first.
+func (j *usageJournal) files() ([]string, error) {
+	entries, err := os.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".ndjson") {
+			paths = append(paths, filepath.Join(j.dir, entry.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func readUsageJournalFile(path string) ([]db.UsageEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var events []db.UsageEvent
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var e db.UsageEvent
+		if err := dec.Decode(&e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// getOperatorUsagePipelineHandler reports the usage pipeline backlog of the
+// replica serving the request.
+func (s *Server) getOperatorUsagePipelineHandler(c *gin.Context) {
+	if s.usageEvents == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "usage pipeline is not running"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"replica": replicaName(), "pipeline": s.usageEvents.snapshot()})
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// fakeUsageStore records inserted events and fails while down is set.
+type fakeUsageStore struct {
+	mu      sync.Mutex
+	down    bool
+	reject  map[uuid.UUID]bool
+	batches [][]db.UsageEvent
+}
+
+func (f *fakeUsageStore) insert(ctx context.Context, events []db.UsageEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return errors.New("connection refused")
+	}
+	for _, e := range events {
+		if f.reject[e.ID] {
+			return &pgconn.PgError{Code: "23514"}
+		}
+	}
+	f.batches = append(f.batches, append([]db.UsageEvent(nil), events...))
+	return nil
+}
+
+func (f *fakeUsageStore) stored() map[uuid.UUID]bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := map[uuid.UUID]bool{}
+	for _, b := range f.batches {
+		for _, e := range b {
+			ids[e.ID] = true
+		}
+	}
+	return ids
+}
+
+func newTestUsageEvent() db.UsageEvent {
+	return db.UsageEvent{ID: uuid.New(), CreatedAt: time.Now().UTC(), TenantID: uuid.New(), Metric: db.MetricPullOpCount, Value: 1}
+}
+
+func closeTestUsagePipeline(t *testing.T, p *usagePipeline) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+}
+
+func TestUsagePipelineBatchesAndFlushesOnClose(t *testing.T) {
+	journal, err := newUsageJournal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &fakeUsageStore{}
+	p := newUsagePipeline(store.insert, journal)
+
+	var want []uuid.UUID
+	for range usagePipelineBatchSize + 3 {
+		e := newTestUsageEvent()
+		want = append(want, e.ID)
+		p.enqueue(e)
+	}
+	closeTestUsagePipeline(t, p)
+
+	stored := store.stored()
+	for _, id := range want {
+		if !stored[id] {
+			t.Fatalf("event %s was not stored", id)
+		}
+	}
+	for _, b := range store.batches {
+		if len(b) > usagePipelineBatchSize {
+			t.Fatalf("batch of %d events, want at most %d", len(b), usagePipelineBatchSize)
+		}
+	}
+	if stats := p.snapshot(); stats.StoredEvents != int64(len(want)) || stats.JournalFiles != 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestUsagePipelineJournalsWhileDownAndReplays(t *testing.T) {
+	dir := t.TempDir()
+	journal, err := newUsageJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &fakeUsageStore{down: true}
+	p := newUsagePipeline(store.insert, journal)
+	e := newTestUsageEvent()
+	p.enqueue(e)
+	closeTestUsagePipeline(t, p)
+
+	if stats := p.snapshot(); stats.JournaledEvents != 1 || stats.JournalFiles != 1 {
+		t.Fatalf("stats = %+v, want the event journaled", stats)
+	}
+	p.enqueue(newTestUsageEvent())
+	if stats := p.snapshot(); stats.JournalFiles != 2 {
+		t.Fatalf("event enqueued after close was not journaled: %+v", stats)
+	}
+
+	store.mu.Lock()
+	store.down = false
+	store.mu.Unlock()
+	p = newUsagePipeline(store.insert, journal)
+	closeTestUsagePipeline(t, p)
+
+	if !store.stored()[e.ID] {
+		t.Fatal("journaled event was not replayed")
+	}
+	got := store.batches[0][0]
+	if !got.CreatedAt.Equal(e.CreatedAt) || got.TenantID != e.TenantID || got.Value != e.Value {
+		t.Fatalf("replayed %+v, want %+v", got, e)
+	}
+	if paths, _ := filepath.Glob(filepath.Join(dir, "*")); len(paths) != 0 {
+		t.Fatalf("journal still holds %v", paths)
+	}
+}
+
+func TestUsagePipelineJournalsOverflowInBatches(t *testing.T) {
+	journal, err := newUsageJournal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &fakeUsageStore{}
+	inserting, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	insert := func(ctx context.Context, events []db.UsageEvent) error {
+		once.Do(func() {
+			close(inserting)
+			<-release
+		})
+		return store.insert(ctx, events)
+	}
+	p := newUsagePipeline(insert, journal)
+
+	// Hold the pipeline in its first insert, then fill the queue.
+	var want []uuid.UUID
+	enqueue := func(n int) {
+		for range n {
+			e := newTestUsageEvent()
+			want = append(want, e.ID)
+			p.enqueue(e)
+		}
+	}
+	enqueue(usagePipelineBatchSize)
+	<-inserting
+	enqueue(usagePipelineCapacity)
+	if len(p.events) != usagePipelineCapacity {
+		t.Fatalf("queued %d events, want a full queue of %d", len(p.events), usagePipelineCapacity)
+	}
+
+	overflow := usagePipelineBatchSize + 1
+	enqueue(overflow)
+	deadline := time.Now().Add(5 * time.Second)
+	for p.snapshot().JournaledEvents < int64(overflow) {
+		if time.Now().After(deadline) {
+			t.Fatalf("overflow was not journaled: %+v", p.snapshot())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := p.snapshot()
+	if stats.JournalFiles < 2 || stats.JournalFiles >= overflow {
+		t.Fatalf("overflow of %d events journaled in %d files, want batches of at most %d", overflow, stats.JournalFiles, usagePipelineBatchSize)
+	}
+	paths, err := journal.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		events, err := readUsageJournalFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) > usagePipelineBatchSize {
+			t.Fatalf("journal file of %d events, want at most %d", len(events), usagePipelineBatchSize)
+		}
+	}
+
+	close(release)
+	closeTestUsagePipeline(t, p)
+	stored := store.stored()
+	for _, id := range want {
+		if !stored[id] {
+			t.Fatalf("event %s was not stored", id)
+		}
+	}
+	if stats := p.snapshot(); stats.JournalFiles != 0 || stats.Overflow != 0 {
+		t.Fatalf("stats = %+v after close", stats)
+	}
+}
+
+func TestUsagePipelineDropsRejectedEventsOnly(t *testing.T) {
+	journal, err := newUsageJournal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, good := newTestUsageEvent(), newTestUsageEvent()
+	store := &fakeUsageStore{reject: map[uuid.UUID]bool{bad.ID: true}}
+	p := newUsagePipeline(store.insert, journal)
+	p.enqueue(bad)
+	p.enqueue(good)
+	closeTestUsagePipeline(t, p)
+
+	stored := store.stored()
+	if stored[bad.ID] || !stored[good.ID] {
+		t.Fatalf("stored = %v, want only the valid event", stored)
+	}
+	if stats := p.snapshot(); stats.RejectedEvents != 1 || stats.JournalFiles != 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestUsageJournalSetsAsideCorruptFiles(t *testing.T) {
+	dir := t.TempDir()
+	journal, err := newUsageJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := filepath.Join(dir, "00000000000000000001-x.ndjson")
+	if err := os.WriteFile(corrupt, []byte("{not json\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	e := newTestUsageEvent()
+	if err := journal.append([]db.UsageEvent{e}); err != nil {
+		t.Fatal(err)
+	}
+
+	store := &fakeUsageStore{}
+	p := newUsagePipeline(store.insert, journal)
+	closeTestUsagePipeline(t, p)
+
+	if !store.stored()[e.ID] {
+		t.Fatal("journal after the corrupt file was not replayed")
+	}
+	if _, err := os.Stat(corrupt + ".corrupt"); err != nil {
+		t.Fatalf("corrupt journal was not set aside: %v", err)
+	}
+}
+
+func TestUsageBacklogReportDue(t *testing.T) {
+	now := time.Now()
+	empty, pending, journaled := usageBacklog{}, usageBacklog{pendingEvents: 3}, usageBacklog{journalFiles: 1}
+	tests := []struct {
+		name   string
+		last   *usageBacklog
+		lastAt time.Time
+		cur    usageBacklog
+		want   bool
+	}{
+		{name: "first report", cur: empty, want: true},
+		{name: "unchanged", last: &empty, lastAt: now.Add(-time.Second), cur: empty, want: false},
+		{name: "heartbeat", last: &empty, lastAt: now.Add(-usageBacklogHeartbeat), cur: empty, want: true},
+		{name: "events queued", last: &empty, lastAt: now.Add(-time.Second), cur: pending, want: true},
+		{name: "more events queued", last: &pending, lastAt: now.Add(-time.Second), cur: usageBacklog{pendingEvents: 7}, want: false},
+		{name: "journaled", last: &pending, lastAt: now.Add(-time.Second), cur: journaled, want: true},
+		{name: "replayed", last: &journaled, lastAt: now.Add(-time.Second), cur: empty, want: true},
+	}
+	for _, tt := range tests {
+		if got := usageBacklogReportDue(tt.last, tt.lastAt, tt.cur, now); got != tt.want {
+			t.Fatalf("%s: usageBacklogReportDue = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUsagePipelineBacklogCountsJournal(t *testing.T) {
+	journal, err := newUsageJournal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &fakeUsageStore{down: true}
+	p := newUsagePipeline(store.insert, journal)
+	p.enqueue(newTestUsageEvent())
+	closeTestUsagePipeline(t, p)
+
+	if b := p.snapshot().backlog(); b.empty() || b.journalFiles != 1 || b.pendingEvents != 0 {
+		t.Fatalf("backlog = %+v, want the journaled event", b)
+	}
+}
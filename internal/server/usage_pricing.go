@@ -0,0 +1,348 @@
+package server
+
+import (
+	"context"
+	"math/big"
+	"slices"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/google/uuid"
+)
+
+// builtinPlanPrice prices usage when neither the tenant's plan nor the
+// default plan has a price in effect.
+var builtinPlanPrice = db.PlanPrice{
+	Plan:                     db.DefaultPlan,
+	StorageUSDPerGiBMonth:    big.NewRat(1, 50),
+	PushUSDPerOp:             big.NewRat(1, 100000),
+	PullUSDPerOp:             big.NewRat(1, 500000),
+	PullUSDPerGiB:            new(big.Rat),
+	IncludedStorageGiBMonths: new(big.Rat),
+	IncludedPullGiB:          new(big.Rat),
+	MinimumChargeUSD:         new(big.Rat),
+}
+
+// usagePriceSegment is part of a period charged under one plan and price.
+type usagePriceSegment struct {
+	From  time.Time
+	To    time.Time
+	Plan  string
+	Price db.PlanPrice
+}
+
+// planPriceAt returns the price of plan in effect at t, falling back to the
+// default plan's and then to builtinPlanPrice. prices are ordered by plan and
+// effective time.
+func planPriceAt(prices []db.PlanPrice, plan string, t time.Time) db.PlanPrice {
+	for _, name := range []string{plan, db.DefaultPlan} {
+		found := -1
+		for i, p := range prices {
+			if p.Plan == name && !p.EffectiveFrom.After(t) {
+				found = i
+			}
+		}
+		if found >= 0 {
+			return prices[found]
+		}
+	}
+	return builtinPlanPrice
+}
+
+// usagePriceSegments splits [from, to) wherever the tenant's plan or its
+// price changes. changes starts with the plan in effect at from.
+func usagePriceSegments(from, to time.Time, changes []db.TenantPlanChange, prices []db.PlanPrice) []usagePriceSegment {
+	bounds := []time.Time{from}
+	for _, c := range changes {
+		if c.EffectiveFrom.After(from) && c.EffectiveFrom.Before(to) {
+			bounds = append(bounds, c.EffectiveFrom)
+		}
+	}
+	for _, p := range prices {
+		if p.EffectiveFrom.After(from) && p.EffectiveFrom.Before(to) {
+			bounds = append(bounds, p.EffectiveFrom)
+		}
+	}
+	slices.SortFunc(bounds, func(a, b time.Time) int { return a.Compare(b) })
+	bounds = slices.CompactFunc(bounds, func(a, b time.Time) bool { return a.Equal(b) })
+	bounds = append(bounds, to)
+
+	var segments []usagePriceSegment
+	for i := 0; i+1 < len(bounds); i++ {
+		start := bounds[i]
+		plan := db.DefaultPlan
+		for _, c := range changes {
+			if !c.EffectiveFrom.After(start) {
+				plan = c.Plan
+			}
+		}
+		price := planPriceAt(prices, plan, start)
+		if n := len(segments); n > 0 && segments[n-1].Plan == plan &&
+			segments[n-1].Price.Plan == price.Plan && segments[n-1].Price.EffectiveFrom.Equal(price.EffectiveFrom) {
+			segments[n-1].To = bounds[i+1]
+			continue
+		}
+		segments = append(segments, usagePriceSegment{From: start, To: bounds[i+1], Plan: plan, Price: price})
+	}
+	return segments
+}
+
+// planRatesOnly returns p without its included allowances or minimum charge,
+// which apply to a tenant as a whole rather than to its registries.
+func planRatesOnly(p db.PlanPrice) db.PlanPrice {
+	p.IncludedStorageGiBMonths = new(big.Rat)
+	p.IncludedPushOps = 0
+	p.IncludedPullOps = 0
+	p.IncludedPullGiB = new(big.Rat)
+	p.MinimumChargeUSD = new(big.Rat)
+	return p
+}
+
+// usagePricedSummary is the usage over one price segment of a period.
+type usagePricedSummary struct {
+	Summary usagePeriodSummary
+	Plan    string
+	Price   db.PlanPrice
+}
+
+// usageCharges are a period's charges. MinimumUSD is what is added to bring
+// parts of the period up to their plan's minimum charge.
+type usageCharges struct {
+	StorageUSD   *big.Rat
+	PushUSD      *big.Rat
+	PullUSD      *big.Rat
+	PullBytesUSD *big.Rat
+	MinimumUSD   *big.Rat
+}
+
+func (c usageCharges) totalUSD() *big.Rat {
+	total := new(big.Rat).Add(c.StorageUSD, c.PushUSD)
+	total.Add(total, c.PullUSD)
+	total.Add(total, c.PullBytesUSD)
+	return total.Add(total, c.MinimumUSD)
+}
+
+// Kinds of usage line items. Included kinds credit a plan's allowance back
+// against the usage before it.
+const (
+	usageLineStorage           = "storage"
+	usageLineStorageIncluded   = "storage-included"
+	usageLinePushOps           = "push-ops"
+	usageLinePushIncluded      = "push-ops-included"
+	usageLinePullOps           = "pull-ops"
+	usageLinePullIncluded      = "pull-ops-included"
+	usageLinePullBytes         = "pull-bytes"
+	usageLinePullBytesIncluded = "pull-bytes-included"
+	usageLineMinimum           = "minimum"
+)
+
+// usageLineItem is one charge or credit for part of a period.
+type usageLineItem struct {
+	From         time.Time
+	To           time.Time
+	Plan         string
+	Kind         string
+	Quantity     *big.Rat
+	UnitPriceUSD *big.Rat
+}
+
+func (l usageLineItem) amountUSD() *big.Rat {
+	return new(big.Rat).Mul(l.Quantity, l.UnitPriceUSD)
+}
+
+// calculateUsageLineItems itemizes the charges for each part of the calendar
+// month [from, to) at its price: usage at the plan's rates, the allowances
+// used as credits, and a top-up to the minimum charge. Allowances and minimum
+// charges are per month, so each part gets its share of them by duration. A
+// part summarized as of before its end, in the month still open, is charged
+// the minimum only for the time elapsed, so interim totals do not bill time
+// that has not passed.
+func calculateUsageLineItems(from, to time.Time, parts []usagePricedSummary) []usageLineItem {
+	periodNanos := to.Sub(from).Nanoseconds()
+	if periodNanos <= 0 {
+		return nil
+	}
+	gib := big.NewInt(1024 * 1024 * 1024)
+	gibPeriod := new(big.Int).Mul(gib, big.NewInt(periodNanos))
+
+	var lines []usageLineItem
+	for _, part := range parts {
+		share := big.NewRat(part.Summary.To.Sub(part.Summary.From).Nanoseconds(), periodNanos)
+		price := part.Price
+		first := len(lines)
+		add := func(kind, includedKind string, used, included, rate *big.Rat) {
+			line := usageLineItem{From: part.Summary.From, To: part.Summary.To, Plan: part.Plan, Kind: kind, Quantity: used, UnitPriceUSD: rate}
+			lines = append(lines, line)
+			if free := new(big.Rat).Sub(used, usageOverage(used, included)); free.Sign() > 0 {
+				line.Kind = includedKind
+				line.Quantity = free.Neg(free)
+				lines = append(lines, line)
+			}
+		}
+
+		gibMonths := new(big.Rat).SetFrac(part.Summary.StorageByteNanos, gibPeriod)
+		add(usageLineStorage, usageLineStorageIncluded, gibMonths, new(big.Rat).Mul(price.IncludedStorageGiBMonths, share), price.StorageUSDPerGiBMonth)
+		add(usageLinePushOps, usageLinePushIncluded, big.NewRat(part.Summary.PushOpCount, 1), new(big.Rat).Mul(big.NewRat(price.IncludedPushOps, 1), share), price.PushUSDPerOp)
+		add(usageLinePullOps, usageLinePullIncluded, big.NewRat(part.Summary.PullOpCount, 1), new(big.Rat).Mul(big.NewRat(price.IncludedPullOps, 1), share), price.PullUSDPerOp)
+		pulledGiB := new(big.Rat).SetFrac(big.NewInt(part.Summary.PullBytes), gib)
+		add(usageLinePullBytes, usageLinePullBytesIncluded, pulledGiB, new(big.Rat).Mul(price.IncludedPullGiB, share), price.PullUSDPerGiB)
+
+		subtotal := new(big.Rat)
+		for _, line := range lines[first:] {
+			subtotal.Add(subtotal, line.amountUSD())
+		}
+		elapsed := big.NewRat(part.Summary.AsOf.Sub(part.Summary.From).Nanoseconds(), periodNanos)
+		minimum := new(big.Rat).Mul(price.MinimumChargeUSD, elapsed)
+		if subtotal.Cmp(minimum) < 0 {
+			lines = append(lines, usageLineItem{
+				From:         part.Summary.From,
+				To:           part.Summary.To,
+				Plan:         part.Plan,
+				Kind:         usageLineMinimum,
+				Quantity:     big.NewRat(1, 1),
+				UnitPriceUSD: minimum.Sub(minimum, subtotal),
+			})
+		}
+	}
+	return lines
+}
+
+// calculateUsageCharges totals calculateUsageLineItems by metric.
+func calculateUsageCharges(from, to time.Time, parts []usagePricedSummary) usageCharges {
+	charges := usageCharges{
+		StorageUSD:   new(big.Rat),
+		PushUSD:      new(big.Rat),
+		PullUSD:      new(big.Rat),
+		PullBytesUSD: new(big.Rat),
+		MinimumUSD:   new(big.Rat),
+	}
+	for _, line := range calculateUsageLineItems(from, to, parts) {
+		var total *big.Rat
+		switch line.Kind {
+		case usageLineStorage, usageLineStorageIncluded:
+			total = charges.StorageUSD
+		case usageLinePushOps, usageLinePushIncluded:
+			total = charges.PushUSD
+		case usageLinePullOps, usageLinePullIncluded:
+			total = charges.PullUSD
+		case usageLinePullBytes, usageLinePullBytesIncluded:
+			total = charges.PullBytesUSD
+		default:
+			total = charges.MinimumUSD
+		}
+		total.Add(total, line.amountUSD())
+	}
+	return charges
+}
+
+// usageOverage returns how far used exceeds included, or zero.
+func usageOverage(used, included *big.Rat) *big.Rat {
+	over := new(big.Rat).Sub(used, included)
+	if over.Sign() < 0 {
+		return new(big.Rat)
+	}
+	return over
+}
+
+// mergeUsagePeriodSummaries joins the summaries of consecutive parts of the
+// period [from, to) into one.
+func mergeUsagePeriodSummaries(from, to, asOf time.Time, parts []usagePricedSummary) usagePeriodSummary {
+	summary := usagePeriodSummary{
+		From:             from.UTC(),
+		To:               to.UTC(),
+		AsOf:             asOf.UTC(),
+		StorageByteNanos: big.NewInt(0),
+	}
+	for i, part := range parts {
+		if i == 0 {
+			summary.StorageOpeningBytes = part.Summary.StorageOpeningBytes
+		}
+		summary.PushOpCount += part.Summary.PushOpCount
+		summary.PullOpCount += part.Summary.PullOpCount
+		summary.PullBytes += part.Summary.PullBytes
+		summary.StorageByteNanos.Add(summary.StorageByteNanos, part.Summary.StorageByteNanos)
+		summary.StorageClosingBytes = part.Summary.StorageClosingBytes
+	}
+	return summary
+}
+
+// loadUsagePriceSegments returns the plans and prices the tenant's usage in
+// [from, to) is charged under.
+func (s *Server) loadUsagePriceSegments(ctx context.Context, tenantID uuid.UUID, from, to time.Time) ([]usagePriceSegment, error) {
+	changes, err := s.db.ListTenantPlanChanges(ctx, tenantID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	plans := []string{db.DefaultPlan}
+	for _, c := range changes {
+		plans = append(plans, c.Plan)
+	}
+	prices, err := s.db.ListPlanPrices(ctx, plans)
+	if err != nil {
+		return nil, err
+	}
+	return usagePriceSegments(from, to, changes, prices), nil
+}
+
+// loadPricedUsageParts summarizes the tenant's usage in [from, asOf) for
+// each plan and price in effect over [from, to).
+func (s *Server) loadPricedUsageParts(ctx context.Context, tenantID uuid.UUID, from, to, asOf time.Time) ([]usagePricedSummary, []usagePriceSegment, error) {
+	segments, err := s.loadUsagePriceSegments(ctx, tenantID, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	parts := make([]usagePricedSummary, 0, len(segments))
+	for _, seg := range segments {
+		summary, err := s.loadUsagePeriodSummary(ctx, tenantID, seg.From, seg.To, usageSummaryAsOf(seg.From, seg.To, asOf))
+		if err != nil {
+			return nil, nil, err
+		}
+		parts = append(parts, usagePricedSummary{Summary: summary, Plan: seg.Plan, Price: seg.Price})
+	}
+	return parts, segments, nil
+}
+
+// loadPricedUsageSummary summarizes the tenant's usage in [from, asOf) and
+// charges it under the plans and prices in effect over [from, to).
+func (s *Server) loadPricedUsageSummary(ctx context.Context, tenantID uuid.UUID, from, to, asOf time.Time) (usagePeriodSummary, usageCharges, []usagePriceSegment, error) {
+	parts, segments, err := s.loadPricedUsageParts(ctx, tenantID, from, to, asOf)
+	if err != nil {
+		return usagePeriodSummary{}, usageCharges{}, nil, err
+	}
+	return mergeUsagePeriodSummaries(from, to, asOf, parts), calculateUsageCharges(from, to, parts), segments, nil
+}
+
+// loadPricedUsageBreakdown is loadUsageBreakdown charged under the plans and
+// prices in effect over [from, to). Items are charged at their plan's rates
+// alone, since allowances and minimum charges apply to the whole tenant.
+func (s *Server) loadPricedUsageBreakdown(ctx context.Context, tenantID uuid.UUID, from, to, asOf time.Time, byRepository bool) ([]usageBreakdownItem, error) {
+	segments, err := s.loadUsagePriceSegments(ctx, tenantID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	parts := make(map[db.UsageAttribution][]usagePricedSummary)
+	var keys []db.UsageAttribution
+	for _, seg := range segments {
+		items, err := s.loadUsageBreakdown(ctx, tenantID, seg.From, seg.To, usageSummaryAsOf(seg.From, seg.To, asOf), byRepository)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			if _, ok := parts[item.UsageAttribution]; !ok {
+				keys = append(keys, item.UsageAttribution)
+			}
+			parts[item.UsageAttribution] = append(parts[item.UsageAttribution], usagePricedSummary{Summary: item.Summary, Plan: seg.Plan, Price: planRatesOnly(seg.Price)})
+		}
+	}
+	slices.SortFunc(keys, compareUsageAttribution)
+
+	items := make([]usageBreakdownItem, 0, len(keys))
+	for _, k := range keys {
+		items = append(items, usageBreakdownItem{
+			UsageAttribution: k,
+			Summary:          mergeUsagePeriodSummaries(from, to, asOf, parts[k]),
+			Charges:          calculateUsageCharges(from, to, parts[k]),
+		})
+	}
+	return items, nil
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"bin2.io/internal/db"
+)
+
+func TestUsagePriceSegments(t *testing.T) {
+	from := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	proStart := time.Date(2026, time.March, 11, 0, 0, 0, 0, time.UTC)
+	repriced := time.Date(2026, time.March, 21, 0, 0, 0, 0, time.UTC)
+
+	prices := []db.PlanPrice{
+		{Plan: db.DefaultPlan, EffectiveFrom: time.Unix(0, 0).UTC(), StorageUSDPerGiBMonth: big.NewRat(1, 50)},
+		{Plan: "pro", EffectiveFrom: time.Unix(0, 0).UTC(), StorageUSDPerGiBMonth: big.NewRat(1, 100)},
+		{Plan: "pro", EffectiveFrom: repriced, StorageUSDPerGiBMonth: big.NewRat(1, 200)},
+	}
+	changes := []db.TenantPlanChange{
+		{EffectiveFrom: from, Plan: db.DefaultPlan},
+		{EffectiveFrom: proStart, Plan: "pro"},
+	}
+
+	segments := usagePriceSegments(from, to, changes, prices)
+	want := []struct {
+		from, to time.Time
+		plan     string
+		rate     *big.Rat
+	}{
+		{from, proStart, db.DefaultPlan, big.NewRat(1, 50)},
+		{proStart, repriced, "pro", big.NewRat(1, 100)},
+		{repriced, to, "pro", big.NewRat(1, 200)},
+	}
+	if len(segments) != len(want) {
+		t.Fatalf("segments = %+v, want %d", segments, len(want))
+	}
+	for i, w := range want {
+		seg := segments[i]
+		if !seg.From.Equal(w.from) || !seg.To.Equal(w.to) || seg.Plan != w.plan || seg.Price.StorageUSDPerGiBMonth.Cmp(w.rate) != 0 {
+			t.Fatalf("segment %d = %s..%s %s at %s, want %s..%s %s at %s", i,
+				seg.From, seg.To, seg.Plan, seg.Price.StorageUSDPerGiBMonth.RatString(),
+				w.from, w.to, w.plan, w.rate.RatString())
+		}
+	}
+}
+
+func TestUsagePriceSegmentsFallBackToDefaultPlan(t *testing.T) {
+	from := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	changes := []db.TenantPlanChange{{EffectiveFrom: from, Plan: "unpriced"}}
+
+	segments := usagePriceSegments(from, to, changes, nil)
+	if len(segments) != 1 || segments[0].Plan != "unpriced" || segments[0].Price.StorageUSDPerGiBMonth.Cmp(builtinPlanPrice.StorageUSDPerGiBMonth) != 0 {
+		t.Fatalf("segments = %+v, want one unpriced segment at the built-in price", segments)
+	}
+
+	defaultPrice := db.PlanPrice{Plan: db.DefaultPlan, EffectiveFrom: time.Unix(0, 0).UTC(), StorageUSDPerGiBMonth: big.NewRat(3, 100)}
+	segments = usagePriceSegments(from, to, changes, []db.PlanPrice{defaultPrice})
+	if len(segments) != 1 || segments[0].Price.StorageUSDPerGiBMonth.Cmp(defaultPrice.StorageUSDPerGiBMonth) != 0 {
+		t.Fatalf("segments = %+v, want the default plan's price", segments)
+	}
+}
+
+func TestCalculateUsageChargesProratesAllowancesAndMinimum(t *testing.T) {
+	from := time.Date(2026, time.April, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	mid := from.AddDate(0, 0, 15)
+
+	free := db.PlanPrice{
+		StorageUSDPerGiBMonth:    big.NewRat(1, 10),
+		PushUSDPerOp:             big.NewRat(1, 100),
+		PullUSDPerOp:             big.NewRat(1, 1000),
+		PullUSDPerGiB:            new(big.Rat),
+		IncludedStorageGiBMonths: big.NewRat(1, 1),
+		IncludedPushOps:          100,
+		IncludedPullOps:          1000,
+		IncludedPullGiB:          new(big.Rat),
+		MinimumChargeUSD:         new(big.Rat),
+	}
+	paid := planRatesOnly(free)
+	paid.MinimumChargeUSD = big.NewRat(10, 1)
+
+	// Half the month on each plan: 2 GiB stored throughout, 80 pushes and 600
+	// pulls in the first half, 10 pushes in the second.
+	first, err := calculateUsagePeriodSummary(from, mid, mid, 2<<30, nil, 80, 600)
+	if err != nil {
+		t.Fatalf("calculateUsagePeriodSummary: %v", err)
+	}
+	second, err := calculateUsagePeriodSummary(mid, to, to, 2<<30, nil, 10, 0)
+	if err != nil {
+		t.Fatalf("calculateUsagePeriodSummary: %v", err)
+	}
+
+	charges := calculateUsageCharges(from, to, []usagePricedSummary{
+		{Summary: first, Price: free},
+		{Summary: second, Price: paid},
+	})
+	// First half: 1 GiB-month stored against 0.5 included, 80 pushes against
+	// 50, 600 pulls against 500. Second half: 1 GiB-month and 10 pushes with
+	// no allowance, 0.2 USD against a 5 USD prorated minimum.
+	wantStorage := big.NewRat(1, 20)
+	wantStorage.Add(wantStorage, big.NewRat(1, 10))
+	wantPush := big.NewRat(30, 100)
+	wantPush.Add(wantPush, big.NewRat(10, 100))
+	wantPull := big.NewRat(100, 1000)
+	wantMinimum := big.NewRat(5, 1)
+	wantMinimum.Sub(wantMinimum, big.NewRat(1, 5))
+
+	for _, tt := range []struct {
+		name      string
+		got, want *big.Rat
+	}{
+		{"StorageUSD", charges.StorageUSD, wantStorage},
+		{"PushUSD", charges.PushUSD, wantPush},
+		{"PullUSD", charges.PullUSD, wantPull},
+		{"MinimumUSD", charges.MinimumUSD, wantMinimum},
+	} {
+		if tt.got.Cmp(tt.want) != 0 {
+			t.Fatalf("%s = %s, want %s", tt.name, tt.got.FloatString(12), tt.want.FloatString(12))
+		}
+	}
+	if got, want := formatUsageDecimal(charges.totalUSD(), 2), "5.45"; got != want {
+		t.Fatalf("totalUSD = %s, want %s", got, want)
+	}
+
+	merged := mergeUsagePeriodSummaries(from, to, to, []usagePricedSummary{{Summary: first}, {Summary: second}})
+	whole, err := calculateUsagePeriodSummary(from, to, to, 2<<30, nil, 90, 600)
+	if err != nil {
+		t.Fatalf("calculateUsagePeriodSummary: %v", err)
+	}
+	if merged.StorageByteNanos.Cmp(whole.StorageByteNanos) != 0 || merged.PushOpCount != 90 || merged.StorageClosingBytes != 2<<30 {
+		t.Fatalf("merged = %+v, want %+v", merged, whole)
+	}
+}
+
+func TestCalculateUsageChargesProratesMinimumOfOpenMonth(t *testing.T) {
+	from := time.Date(2026, time.April, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	price := db.PlanPrice{
+		StorageUSDPerGiBMonth:    new(big.Rat),
+		PushUSDPerOp:             new(big.Rat),
+		PullUSDPerOp:             new(big.Rat),
+		PullUSDPerGiB:            new(big.Rat),
+		IncludedStorageGiBMonths: new(big.Rat),
+		IncludedPullGiB:          new(big.Rat),
+		MinimumChargeUSD:         big.NewRat(30, 1),
+	}
+
+	// Six days into a 30-day month only a fifth of the minimum is due.
+	summary, err := calculateUsagePeriodSummary(from, to, from.AddDate(0, 0, 6), 0, nil, 0, 0)
+	if err != nil {
+		t.Fatalf("calculateUsagePeriodSummary: %v", err)
+	}
+	charges := calculateUsageCharges(from, to, []usagePricedSummary{{Summary: summary, Price: price}})
+	if charges.MinimumUSD.Cmp(big.NewRat(6, 1)) != 0 {
+		t.Fatalf("MinimumUSD = %s, want 6", charges.MinimumUSD.FloatString(2))
+	}
+
+	// Once the month has closed the whole minimum is.
+	summary, err = calculateUsagePeriodSummary(from, to, to, 0, nil, 0, 0)
+	if err != nil {
+		t.Fatalf("calculateUsagePeriodSummary: %v", err)
+	}
+	charges = calculateUsageCharges(from, to, []usagePricedSummary{{Summary: summary, Price: price}})
+	if charges.MinimumUSD.Cmp(big.NewRat(30, 1)) != 0 {
+		t.Fatalf("MinimumUSD = %s, want 30", charges.MinimumUSD.FloatString(2))
+	}
+}
+
+func TestCalculateUsageChargesPricesPullBytes(t *testing.T) {
+	from := time.Date(2026, time.April, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	mid := from.AddDate(0, 0, 15)
+
+	price := db.PlanPrice{
+		StorageUSDPerGiBMonth:    new(big.Rat),
+		PushUSDPerOp:             new(big.Rat),
+		PullUSDPerOp:             new(big.Rat),
+		PullUSDPerGiB:            big.NewRat(1, 100),
+		IncludedStorageGiBMonths: new(big.Rat),
+		IncludedPullGiB:          big.NewRat(100, 1),
+		MinimumChargeUSD:         new(big.Rat),
+	}
+
+	// 80 GiB pulled in each half of the month, each against half of the
+	// 100 GiB allowance.
+	var parts []usagePricedSummary
+	for _, bounds := range [][2]time.Time{{from, mid}, {mid, to}} {
+		summary, err := calculateUsagePeriodSummary(bounds[0], bounds[1], bounds[1], 0, nil, 0, 0)
+		if err != nil {
+			t.Fatalf("calculateUsagePeriodSummary: %v", err)
+		}
+		summary.PullBytes = 80 << 30
+		parts = append(parts, usagePricedSummary{Summary: summary, Price: price})
+	}
+
+	charges := calculateUsageCharges(from, to, parts)
+	if want := big.NewRat(60, 100); charges.PullBytesUSD.Cmp(want) != 0 {
+		t.Fatalf("PullBytesUSD = %s, want %s", charges.PullBytesUSD.FloatString(12), want.FloatString(12))
+	}
+	if charges.totalUSD().Cmp(charges.PullBytesUSD) != 0 {
+		t.Fatalf("totalUSD = %s, want only egress", charges.totalUSD().FloatString(12))
+	}
+	if merged := mergeUsagePeriodSummaries(from, to, to, parts); merged.PullBytes != 160<<30 {
+		t.Fatalf("merged PullBytes = %d, want %d", merged.PullBytes, int64(160<<30))
+	}
+
+	charges = calculateUsageCharges(from, to, []usagePricedSummary{{Summary: parts[0].Summary, Price: planRatesOnly(price)}})
+	if want := big.NewRat(80, 100); charges.PullBytesUSD.Cmp(want) != 0 {
+		t.Fatalf("rates-only PullBytesUSD = %s, want %s", charges.PullBytesUSD.FloatString(12), want.FloatString(12))
+	}
+}
+
+func TestOperatorPlanPriceRequestValidates(t *testing.T) {
+	now := time.Date(2026, time.March, 10, 0, 0, 0, 0, time.UTC)
+	valid := operatorPlanPriceRequest{StorageUSDPerGiBMonth: "0.02", PushUSDPerOp: "0.00001", PullUSDPerOp: "0"}
+
+	price, err := valid.planPrice("pro", now)
+	if err != nil {
+		t.Fatalf("planPrice: %v", err)
+	}
+	if !price.EffectiveFrom.Equal(now) || price.StorageUSDPerGiBMonth.Cmp(big.NewRat(1, 50)) != 0 || price.MinimumChargeUSD.Sign() != 0 {
+		t.Fatalf("price = %+v, want effective now at 0.02/GiB-month with no minimum", price)
+	}
+	if price.PullUSDPerGiB.Sign() != 0 || price.IncludedPullGiB.Sign() != 0 {
+		t.Fatalf("price = %+v, want egress free by default", price)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*operatorPlanPriceRequest)
+	}{
+		{"past", func(r *operatorPlanPriceRequest) { r.EffectiveFrom = "2026-03-01T00:00:00Z" }},
+		{"missing rate", func(r *operatorPlanPriceRequest) { r.PullUSDPerOp = "" }},
+		{"negative", func(r *operatorPlanPriceRequest) { r.PushUSDPerOp = "-0.1" }},
+		{"fraction", func(r *operatorPlanPriceRequest) { r.StorageUSDPerGiBMonth = "1/3" }},
+		{"exponent", func(r *operatorPlanPriceRequest) { r.MinimumChargeUSD = "1e3" }},
+		{"negative allowance", func(r *operatorPlanPriceRequest) { r.IncludedPullOps = -1 }},
+		{"negative egress", func(r *operatorPlanPriceRequest) { r.PullUSDPerGiB = "-0.01" }},
+	}
+	for _, tt := range tests {
+		req := valid
+		tt.modify(&req)
+		if _, err := req.planPrice("pro", now); err == nil {
+			t.Fatalf("%s: expected error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/google/uuid"
+)
+
+// usageRollupInterval is how often each replica checks for a closed day to
+// roll up.
+const usageRollupInterval = 5 * time.Minute
+
+// runUsageRollups rolls up closed days of usage, and invoices closed months
+// once their days are rolled up, until ctx is cancelled.
+func (s *Server) runUsageRollups(ctx context.Context) {
+	ticker := time.NewTicker(usageRollupInterval)
+	defer ticker.Stop()
+	for {
+		s.rollupUsage(ctx)
+		s.invoiceClosedMonths(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rollupUsage rolls up every day that has closed since the last rollup.
+func (s *Server) rollupUsage(ctx context.Context) {
+	for {
+		day, ok, err := s.db.RollupUsageDay(ctx, time.Now().UTC())
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				logError(err)
+			}
+			return
+		}
+		if !ok {
+			return
+		}
+		slog.Info("Usage", slog.String("rolled up", day.Format(time.DateOnly)))
+	}
+}
+
+func floorUTCDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func ceilUTCDay(t time.Time) time.Time {
+	day := floorUTCDay(t)
+	if day.Before(t) {
+		return day.AddDate(0, 0, 1)
+	}
+	return day
+}
+
+// usageRollupSpan returns the whole UTC days in [from, asOf) that have been
+// rolled up, as [start, end). start equals end when there are none.
+func usageRollupSpan(from, asOf, rolledThrough time.Time) (time.Time, time.Time) {
+	start := ceilUTCDay(from)
+	end := floorUTCDay(asOf)
+	if rolledThrough.Before(end) {
+		end = rolledThrough
+	}
+	if !end.After(start) {
+		return from, from
+	}
+	return start, end
+}
+
+// loadUsagePeriodSummary summarizes the tenant's usage in [from, asOf),
+// reading rollups for closed days and raw usage events for the rest.
+func (s *Server) loadUsagePeriodSummary(ctx context.Context, tenantID uuid.UUID, from, to, asOf time.Time) (usagePeriodSummary, error) {
+	rolledThrough, err := s.db.GetUsageRolledThrough(ctx)
+	if err != nil {
+		return usagePeriodSummary{}, err
+	}
+	rollupStart, rollupEnd := usageRollupSpan(from, asOf, rolledThrough)
+	openingStorageBytes, err := s.loadUsageStorageBalance(ctx, tenantID, from, rolledThrough)
+	if err != nil {
+		return usagePeriodSummary{}, err
+	}
+
+	var storageDeltas []usageStorageDelta
+	var pushOpCount, pullOpCount, pullBytes int64
+	addEvents := func(start, end time.Time) error {
+		if !end.After(start) {
+			return nil
+		}
+		push, err := s.db.SumUsageMetricByTenantBetween(ctx, tenantID, db.MetricPushOpCount, start, end)
+		if err != nil {
+			return err
+		}
+		pull, err := s.db.SumUsageMetricByTenantBetween(ctx, tenantID, db.MetricPullOpCount, start, end)
+		if err != nil {
+			return err
+		}
+		pulled, err := s.db.SumUsageMetricByTenantBetween(ctx, tenantID, db.MetricPullBytes, start, end)
+		if err != nil {
+			return err
+		}
+		deltas, err := s.db.ListUsageMetricDeltasByTenantBetween(ctx, tenantID, db.MetricStorageBytes, start, end)
+		if err != nil {
+			return err
+		}
+		pushOpCount += push
+		pullOpCount += pull
+		pullBytes += pulled
+		storageDeltas = append(storageDeltas, usageStorageEventDeltas(deltas)...)
+		return nil
+	}
+
+	if err := addEvents(from, rollupStart); err != nil {
+		return usagePeriodSummary{}, err
+	}
+	if rollupEnd.After(rollupStart) {
+		rollups, err := s.db.ListUsageDailyRollupsByTenant(ctx, tenantID, rollupStart, rollupEnd)
+		if err != nil {
+			return usagePeriodSummary{}, err
+		}
+		storageDeltas = append(storageDeltas, usageRollupStorageDeltas(rollups)...)
+		pushOpCount += sumUsageRollups(rollups, db.MetricPushOpCount)
+		pullOpCount += sumUsageRollups(rollups, db.MetricPullOpCount)
+		pullBytes += sumUsageRollups(rollups, db.MetricPullBytes)
+	}
+	if err := addEvents(rollupEnd, asOf); err != nil {
+		return usagePeriodSummary{}, err
+	}
+
+	summary, err := calculateUsagePeriodSummary(from, to, asOf, openingStorageBytes, storageDeltas, pushOpCount, pullOpCount)
+	if err != nil {
+		return usagePeriodSummary{}, err
+	}
+	summary.PullBytes = pullBytes
+	return summary, nil
+}
+
+// loadUsageStorageBalance returns the tenant's storage balance at from: the
+// checkpoint of the last rolled-up day before it plus raw events since.
+func (s *Server) loadUsageStorageBalance(ctx context.Context, tenantID uuid.UUID, from, rolledThrough time.Time) (int64, error) {
+	base := floorUTCDay(from)
+	if rolledThrough.Before(base) {
+		base = rolledThrough
+	}
+	balance, err := s.db.GetUsageStorageBalance(ctx, tenantID, base)
+	if err != nil {
+		return 0, err
+	}
+	if base.Before(from) {
+		sinceBase, err := s.db.SumUsageMetricByTenantBetween(ctx, tenantID, db.MetricStorageBytes, base, from)
+		if err != nil {
+			return 0, err
+		}
+		balance += sinceBase
+	}
+	return balance, nil
+}
+
+// usageRollupStorageDeltas converts the storage rollups, ordered by day, to
+// one delta per day.
+func usageRollupStorageDeltas(rollups []db.UsageDailyRollup) []usageStorageDelta {
+	var out []usageStorageDelta
+	for _, r := range rollups {
+		if r.Metric != db.MetricStorageBytes {
+			continue
+		}
+		out = append(out, usageStorageDelta{From: r.Day, To: r.Day.AddDate(0, 0, 1), Value: r.Value, Weight: r.DayEndWeight})
+	}
+	return out
+}
+
+func sumUsageRollups(rollups []db.UsageDailyRollup, metric string) int64 {
+	var total int64
+	for _, r := range rollups {
+		if r.Metric == metric {
+			total += r.Value
+		}
+	}
+	return total
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"bin2.io/internal/db"
+)
+
+func TestUsageRollupSpan(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, time.March, d, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name               string
+		from, asOf, rolled time.Time
+		wantStart, wantEnd time.Time
+	}{
+		{name: "closed month", from: day(1), asOf: day(31), rolled: day(31), wantStart: day(1), wantEnd: day(31)},
+		{name: "current day raw", from: day(1), asOf: day(15).Add(9 * time.Hour), rolled: day(20), wantStart: day(1), wantEnd: day(15)},
+		{name: "rollups behind", from: day(1), asOf: day(15).Add(9 * time.Hour), rolled: day(10), wantStart: day(1), wantEnd: day(10)},
+		{name: "partial first day", from: day(1).Add(6 * time.Hour), asOf: day(5), rolled: day(5), wantStart: day(2), wantEnd: day(5)},
+		{name: "nothing rolled", from: day(10), asOf: day(12), rolled: day(10), wantStart: day(10), wantEnd: day(10)},
+		{name: "within a day", from: day(3).Add(time.Hour), asOf: day(3).Add(2 * time.Hour), rolled: day(20), wantStart: day(3).Add(time.Hour), wantEnd: day(3).Add(time.Hour)},
+	}
+	for _, tt := range tests {
+		start, end := usageRollupSpan(tt.from, tt.asOf, tt.rolled)
+		if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+			t.Fatalf("%s: span = [%s, %s), want [%s, %s)", tt.name, start, end, tt.wantStart, tt.wantEnd)
+		}
+	}
+}
+
+// rollUpStorage aggregates deltas by UTC day the way RollupUsageDay does.
+func rollUpStorage(deltas []db.UsageEventDelta) []db.UsageDailyRollup {
+	var out []db.UsageDailyRollup
+	for _, delta := range deltas {
+		day := floorUTCDay(delta.CreatedAt)
+		if len(out) == 0 || !out[len(out)-1].Day.Equal(day) {
+			out = append(out, db.UsageDailyRollup{Day: day, Metric: db.MetricStorageBytes, DayEndWeight: big.NewInt(0)})
+		}
+		r := &out[len(out)-1]
+		r.Value += delta.Value
+		weight := new(big.Int).Mul(big.NewInt(delta.Value), big.NewInt(day.AddDate(0, 0, 1).Sub(delta.CreatedAt).Nanoseconds()))
+		r.DayEndWeight.Add(r.DayEndWeight, weight)
+	}
+	return out
+}
+
+func TestCalculateUsagePeriodSummaryFromRollupsMatchesEvents(t *testing.T) {
+	from := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2026, time.April, 1, 0, 0, 0, 0, time.UTC)
+	asOf := time.Date(2026, time.March, 20, 13, 0, 0, 0, time.UTC)
+	rolledThrough := time.Date(2026, time.March, 20, 0, 0, 0, 0, time.UTC)
+
+	deltas := []db.UsageEventDelta{
+		{CreatedAt: from.Add(90 * time.Minute), Value: 5 << 30},
+		{CreatedAt: from.Add(23*time.Hour + 59*time.Minute), Value: 1 << 20},
+		{CreatedAt: from.Add(3*24*time.Hour + 7*time.Second), Value: -(2 << 30)},
+		{CreatedAt: from.Add(3*24*time.Hour + 8*time.Hour + 123456*time.Microsecond), Value: 700},
+		{CreatedAt: rolledThrough.Add(-time.Microsecond), Value: 1 << 30},
+		{CreatedAt: rolledThrough.Add(2 * time.Hour), Value: -(1 << 20)},
+	}
+	const opening = 3 << 30
+
+	fromEvents, err := calculateUsagePeriodSummary(from, to, asOf, opening, usageStorageEventDeltas(deltas), 4, 9)
+	if err != nil {
+		t.Fatalf("calculateUsagePeriodSummary from events: %v", err)
+	}
+
+	var closed, today []db.UsageEventDelta
+	for _, delta := range deltas {
+		if delta.CreatedAt.Before(rolledThrough) {
+			closed = append(closed, delta)
+		} else {
+			today = append(today, delta)
+		}
+	}
+	mixed := append(usageRollupStorageDeltas(rollUpStorage(closed)), usageStorageEventDeltas(today)...)
+	fromRollups, err := calculateUsagePeriodSummary(from, to, asOf, opening, mixed, 4, 9)
+	if err != nil {
+		t.Fatalf("calculateUsagePeriodSummary from rollups: %v", err)
+	}
+
+	if fromRollups.StorageByteNanos.Cmp(fromEvents.StorageByteNanos) != 0 {
+		t.Fatalf("byte-nanoseconds from rollups = %s, from events = %s", fromRollups.StorageByteNanos, fromEvents.StorageByteNanos)
+	}
+	if fromRollups.StorageClosingBytes != fromEvents.StorageClosingBytes {
+		t.Fatalf("closing bytes from rollups = %d, from events = %d", fromRollups.StorageClosingBytes, fromEvents.StorageClosingBytes)
+	}
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Granularities of a usage series. Buckets start on UTC boundaries; weeks
+// start on Monday.
+const (
+	usageGranularityHour  = "hour"
+	usageGranularityDay   = "day"
+	usageGranularityWeek  = "week"
+	usageGranularityMonth = "month"
+)
+
+// maxUsageSeriesBuckets bounds the points a single series request returns.
+const maxUsageSeriesBuckets = 1000
+
+// floorUsageGranularity returns the start of the bucket containing t.
+func floorUsageGranularity(t time.Time, granularity string) time.Time {
+	t = t.UTC()
+	switch granularity {
+	case usageGranularityHour:
+		return t.Truncate(time.Hour)
+	case usageGranularityWeek:
+		day := floorUTCDay(t)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case usageGranularityMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return floorUTCDay(t)
+	}
+}
+
+// nextUsageGranularity returns the start of the bucket after the one
+// starting at t.
+func nextUsageGranularity(t time.Time, granularity string) time.Time {
+	switch granularity {
+	case usageGranularityHour:
+		return t.Add(time.Hour)
+	case usageGranularityWeek:
+		return t.AddDate(0, 0, 7)
+	case usageGranularityMonth:
+		return t.AddDate(0, 1, 0)
+	default:
+		return t.AddDate(0, 0, 1)
+	}
+}
+
+// usageSeriesWindow parses a series request: any from and to, and a
+// granularity defaulting to day. It returns the bucket boundaries: from,
+// every bucket start after it and before to, and to.
+func usageSeriesWindow(fromRaw, toRaw, granularityRaw string) ([]time.Time, string, error) {
+	fromRaw = strings.TrimSpace(fromRaw)
+	toRaw = strings.TrimSpace(toRaw)
+	if fromRaw == "" || toRaw == "" {
+		return nil, "", fmt.Errorf("from and to are required")
+	}
+	from, err := time.Parse(time.RFC3339, fromRaw)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid from value")
+	}
+	to, err := time.Parse(time.RFC3339, toRaw)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid to value")
+	}
+	from = from.UTC()
+	to = to.UTC()
+	if !to.After(from) {
+		return nil, "", fmt.Errorf("to must be after from")
+	}
+
+	granularity := strings.TrimSpace(granularityRaw)
+	if granularity == "" {
+		granularity = usageGranularityDay
+	}
+	switch granularity {
+	case usageGranularityHour, usageGranularityDay, usageGranularityWeek, usageGranularityMonth:
+	default:
+		return nil, "", fmt.Errorf("granularity must be hour, day, week, or month")
+	}
+
+	bounds := []time.Time{from}
+	for next := nextUsageGranularity(floorUsageGranularity(from, granularity), granularity); next.Before(to); next = nextUsageGranularity(next, granularity) {
+		if len(bounds) == maxUsageSeriesBuckets {
+			return nil, "", fmt.Errorf("from and to span more than %d %s buckets", maxUsageSeriesBuckets, granularity)
+		}
+		bounds = append(bounds, next)
+	}
+	return append(bounds, to), granularity, nil
+}
+
+// usageSeriesBucket returns the index of the bucket containing t.
+func usageSeriesBucket(starts []time.Time, t time.Time) int {
+	return sort.Search(len(starts), func(i int) bool { return starts[i].After(t) }) - 1
+}
+
+// calculateUsageSeries summarizes each bucket between bounds that has
+// started by asOf, carrying the storage balance from one into the next.
+// storageDeltas are ordered by time and each lies within one bucket; pushOps
+// and pullOps hold one count per bucket.
+func calculateUsageSeries(bounds []time.Time, asOf time.Time, openingStorageBytes int64, storageDeltas []usageStorageDelta, pushOps, pullOps []int64) ([]usagePeriodSummary, error) {
+	points := make([]usagePeriodSummary, 0, len(bounds)-1)
+	balance := openingStorageBytes
+	next := 0
+	for i := 0; i+1 < len(bounds) && asOf.After(bounds[i]); i++ {
+		start, end := bounds[i], bounds[i+1]
+		bucketAsOf := end
+		if asOf.Before(end) {
+			bucketAsOf = asOf
+		}
+		last := next
+		for last < len(storageDeltas) && storageDeltas[last].From.Before(end) {
+			last++
+		}
+		summary, err := calculateUsagePeriodSummary(start, end, bucketAsOf, balance, storageDeltas[next:last], pushOps[i], pullOps[i])
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, summary)
+		balance = summary.StorageClosingBytes
+		next = last
+	}
+	return points, nil
+}
+
+// loadUsageSeries summarizes the tenant's usage in each bucket between
+// bounds up to asOf. Closed days come from rollups except in hourly series,
+// which rollups are too coarse for.
+func (s *Server) loadUsageSeries(ctx context.Context, tenantID uuid.UUID, bounds []time.Time, asOf time.Time, granularity string) ([]usagePeriodSummary, error) {
+	from := bounds[0]
+	starts := bounds[:len(bounds)-1]
+
+	rolledThrough, err := s.db.GetUsageRolledThrough(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rollupStart, rollupEnd := usageRollupSpan(from, asOf, rolledThrough)
+	if granularity == usageGranularityHour {
+		rollupStart, rollupEnd = asOf, asOf
+	}
+	openingStorageBytes, err := s.loadUsageStorageBalance(ctx, tenantID, from, rolledThrough)
+	if err != nil {
+		return nil, err
+	}
+
+	var storageDeltas []usageStorageDelta
+	pushOps := make([]int64, len(starts))
+	pullOps := make([]int64, len(starts))
+	pullBytes := make([]int64, len(starts))
+	addOps := func(bucket int, metric string, value int64) {
+		switch metric {
+		case db.MetricPushOpCount:
+			pushOps[bucket] += value
+		case db.MetricPullOpCount:
+			pullOps[bucket] += value
+		case db.MetricPullBytes:
+			pullBytes[bucket] += value
+		}
+	}
+	addEvents := func(start, end time.Time) error {
+		if !end.After(start) {
+			return nil
+		}
+		totals, err := s.db.SumUsageOpsByBucket(ctx, tenantID, starts, start, end)
+		if err != nil {
+			return err
+		}
+		deltas, err := s.db.ListUsageMetricDeltasByTenantBetween(ctx, tenantID, db.MetricStorageBytes, start, end)
+		if err != nil {
+			return err
+		}
+		for _, t := range totals {
+			addOps(t.Bucket, t.Metric, t.Value)
+		}
+		storageDeltas = append(storageDeltas, usageStorageEventDeltas(deltas)...)
+		return nil
+	}
+
+	if err := addEvents(from, rollupStart); err != nil {
+		return nil, err
+	}
+	if rollupEnd.After(rollupStart) {
+		rollups, err := s.db.ListUsageDailyRollupsByTenant(ctx, tenantID, rollupStart, rollupEnd)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rollups {
+			addOps(usageSeriesBucket(starts, r.Day), r.Metric, r.Value)
+		}
+		storageDeltas = append(storageDeltas, usageRollupStorageDeltas(rollups)...)
+	}
+	if err := addEvents(rollupEnd, asOf); err != nil {
+		return nil, err
+	}
+
+	points, err := calculateUsageSeries(bounds, asOf, openingStorageBytes, storageDeltas, pushOps, pullOps)
+	if err != nil {
+		return nil, err
+	}
+	for i := range points {
+		points[i].PullBytes = pullBytes[i]
+	}
+	return points, nil
+}
+
+func (s *Server) usageSeriesHandler(c *gin.Context) {
+	u, err := s.getUser(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	s.writeUsageSeries(c, u.tenantID)
+}
+
+// writeUsageSeries responds with the tenant's usage per bucket of the
+// granularity query parameter between the from and to query parameters.
+// Buckets that have not started yet are omitted.
+func (s *Server) writeUsageSeries(c *gin.Context, tenantID uuid.UUID) {
+	bounds, granularity, err := usageSeriesWindow(c.Query("from"), c.Query("to"), c.Query("granularity"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	from, to := bounds[0], bounds[len(bounds)-1]
+	asOf := usageSummaryAsOf(from, to, time.Now().UTC())
+
+	points, err := s.loadUsageSeries(c.Request.Context(), tenantID, bounds, asOf, granularity)
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to summarize usage"})
+		return
+	}
+
+	type pointResponse struct {
+		From                string `json:"from"`
+		To                  string `json:"to"`
+		PushOpCount         int64  `json:"pushOpCount"`
+		PullOpCount         int64  `json:"pullOpCount"`
+		PullBytes           int64  `json:"pullBytes"`
+		StorageClosingBytes int64  `json:"storageClosingBytes"`
+		StorageByteSeconds  string `json:"storageByteSeconds"`
+	}
+	type seriesResponse struct {
+		From        string          `json:"from"`
+		To          string          `json:"to"`
+		AsOf        string          `json:"asOf"`
+		Granularity string          `json:"granularity"`
+		Points      []pointResponse `json:"points"`
+	}
+
+	resp := seriesResponse{
+		From:        from.Format(time.RFC3339),
+		To:          to.Format(time.RFC3339),
+		AsOf:        asOf.Format(time.RFC3339),
+		Granularity: granularity,
+		Points:      make([]pointResponse, 0, len(points)),
+	}
+	for _, point := range points {
+		resp.Points = append(resp.Points, pointResponse{
+			From:                point.From.Format(time.RFC3339),
+			To:                  point.To.Format(time.RFC3339),
+			PushOpCount:         point.PushOpCount,
+			PullOpCount:         point.PullOpCount,
+			PullBytes:           point.PullBytes,
+			StorageClosingBytes: point.StorageClosingBytes,
+			StorageByteSeconds:  formatUsageDecimal(point.storageByteSeconds(), 9),
+		})
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"bin2.io/internal/db"
+)
+
+func TestUsageSeriesWindow(t *testing.T) {
+	tests := []struct {
+		name        string
+		from, to    string
+		granularity string
+		want        []string
+	}{
+		{
+			name: "days default", from: "2026-03-01T12:00:00Z", to: "2026-03-03T06:00:00Z",
+			want: []string{"2026-03-01T12:00:00Z", "2026-03-02T00:00:00Z", "2026-03-03T00:00:00Z", "2026-03-03T06:00:00Z"},
+		},
+		{
+			name: "weeks start monday", from: "2026-03-04T00:00:00Z", to: "2026-03-20T00:00:00Z", granularity: "week",
+			want: []string{"2026-03-04T00:00:00Z", "2026-03-09T00:00:00Z", "2026-03-16T00:00:00Z", "2026-03-20T00:00:00Z"},
+		},
+		{
+			name: "months", from: "2026-01-15T00:00:00Z", to: "2026-03-01T00:00:00Z", granularity: "month",
+			want: []string{"2026-01-15T00:00:00Z", "2026-02-01T00:00:00Z", "2026-03-01T00:00:00Z"},
+		},
+		{
+			name: "hours in offset zone", from: "2026-03-01T10:30:00+02:00", to: "2026-03-01T10:30:00Z", granularity: "hour",
+			want: []string{"2026-03-01T08:30:00Z", "2026-03-01T09:00:00Z", "2026-03-01T10:00:00Z", "2026-03-01T10:30:00Z"},
+		},
+	}
+	for _, tt := range tests {
+		bounds, _, err := usageSeriesWindow(tt.from, tt.to, tt.granularity)
+		if err != nil {
+			t.Fatalf("%s: usageSeriesWindow: %v", tt.name, err)
+		}
+		if len(bounds) != len(tt.want) {
+			t.Fatalf("%s: bounds = %v, want %v", tt.name, bounds, tt.want)
+		}
+		for i, want := range tt.want {
+			if got := bounds[i].Format(time.RFC3339); got != want {
+				t.Fatalf("%s: bounds[%d] = %s, want %s", tt.name, i, got, want)
+			}
+		}
+	}
+}
+
+func TestUsageSeriesWindowRejectsInvalidRequests(t *testing.T) {
+	tests := []struct {
+		name, from, to, granularity string
+	}{
+		{name: "missing to", from: "2026-03-01T00:00:00Z"},
+		{name: "reversed", from: "2026-03-02T00:00:00Z", to: "2026-03-01T00:00:00Z"},
+		{name: "unknown granularity", from: "2026-03-01T00:00:00Z", to: "2026-03-02T00:00:00Z", granularity: "minute"},
+		{name: "too many buckets", from: "2026-01-01T00:00:00Z", to: "2026-03-01T00:00:00Z", granularity: "hour"},
+	}
+	for _, tt := range tests {
+		if _, _, err := usageSeriesWindow(tt.from, tt.to, tt.granularity); err == nil {
+			t.Fatalf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestCalculateUsageSeriesMatchesPeriodSummary(t *testing.T) {
+	from := time.Date(2026, time.March, 1, 6, 0, 0, 0, time.UTC)
+	to := time.Date(2026, time.March, 8, 0, 0, 0, 0, time.UTC)
+	asOf := time.Date(2026, time.March, 5, 13, 0, 0, 0, time.UTC)
+	bounds, _, err := usageSeriesWindow(from.Format(time.RFC3339), to.Format(time.RFC3339), "day")
+	if err != nil {
+		t.Fatalf("usageSeriesWindow: %v", err)
+	}
+
+	deltas := []db.UsageEventDelta{
+		{CreatedAt: from.Add(time.Hour), Value: 5 << 30},
+		{CreatedAt: from.Add(30 * time.Hour), Value: -(1 << 30)},
+		{CreatedAt: from.Add(31 * time.Hour), Value: 1 << 20},
+		{CreatedAt: asOf.Add(-time.Minute), Value: -(1 << 20)},
+	}
+	storage := usageStorageEventDeltas(deltas)
+	// Roll up March 3, as the loader would for a closed day.
+	day := time.Date(2026, time.March, 3, 0, 0, 0, 0, time.UTC)
+	rolled := rollUpStorage([]db.UsageEventDelta{{CreatedAt: day.Add(9 * time.Hour), Value: 2 << 30}})
+	storage = append(storage[:3], append(usageRollupStorageDeltas(rolled), storage[3:]...)...)
+
+	pushOps := make([]int64, len(bounds)-1)
+	pullOps := make([]int64, len(bounds)-1)
+	pushOps[0], pushOps[2], pullOps[4] = 3, 1, 40
+
+	points, err := calculateUsageSeries(bounds, asOf, 1<<30, storage, pushOps, pullOps)
+	if err != nil {
+		t.Fatalf("calculateUsageSeries: %v", err)
+	}
+	if len(points) != 5 {
+		t.Fatalf("points = %d, want 5 started buckets", len(points))
+	}
+
+	whole, err := calculateUsagePeriodSummary(from, to, asOf, 1<<30, storage, 4, 40)
+	if err != nil {
+		t.Fatalf("calculateUsagePeriodSummary: %v", err)
+	}
+	byteNanos := big.NewInt(0)
+	var push, pull int64
+	for _, point := range points {
+		byteNanos.Add(byteNanos, point.StorageByteNanos)
+		push += point.PushOpCount
+		pull += point.PullOpCount
+	}
+	if byteNanos.Cmp(whole.StorageByteNanos) != 0 {
+		t.Fatalf("byte-nanoseconds = %s, want %s", byteNanos, whole.StorageByteNanos)
+	}
+	if last := points[len(points)-1]; last.StorageClosingBytes != whole.StorageClosingBytes || !last.AsOf.Equal(asOf) {
+		t.Fatalf("last point = %d bytes as of %s, want %d as of %s", last.StorageClosingBytes, last.AsOf, whole.StorageClosingBytes, asOf)
+	}
+	if push != 4 || pull != 40 {
+		t.Fatalf("ops = %d/%d, want 4/40", push, pull)
+	}
+	if points[2].StorageClosingBytes != points[1].StorageClosingBytes+2<<30 {
+		t.Fatalf("rolled-up day closing = %d, want %d", points[2].StorageClosingBytes, points[1].StorageClosingBytes+2<<30)
+	}
+}
+
+func TestUsageSeriesBucket(t *testing.T) {
+	starts := []time.Time{
+		time.Date(2026, time.March, 1, 6, 0, 0, 0, time.UTC),
+		time.Date(2026, time.March, 2, 0, 0, 0, 0, time.UTC),
+		time.Date(2026, time.March, 3, 0, 0, 0, 0, time.UTC),
+	}
+	if got := usageSeriesBucket(starts, starts[1]); got != 1 {
+		t.Fatalf("bucket at start = %d, want 1", got)
+	}
+	if got := usageSeriesBucket(starts, starts[2].Add(5*time.Hour)); got != 2 {
+		t.Fatalf("bucket in last = %d, want 2", got)
+	}
+}
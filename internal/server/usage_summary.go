@@ -9,37 +9,49 @@ import (
 	"bin2.io/internal/db"
 )
 
-var (
-	storageRateUSDPerGiBMonth = big.NewRat(1, 50)
-	pushRateUSDPerOp          = big.NewRat(1, 100000)
-	pullRateUSDPerOp          = big.NewRat(1, 500000)
-)
-
 type usagePeriodSummary struct {
 	From                time.Time
 	To                  time.Time
 	AsOf                time.Time
 	PushOpCount         int64
 	PullOpCount         int64
+	PullBytes           int64
 	StorageOpeningBytes int64
 	StorageClosingBytes int64
 	StorageByteNanos    *big.Int
 }
 
+// usageStorageDelta is a change in stored bytes over [From, To): a single
+// usage event when From equals To, or a rolled-up day. Weight is the
+// byte-nanoseconds the change accrued before To: the sum of each event's
+// value times the time from the event to To.
+type usageStorageDelta struct {
+	From   time.Time
+	To     time.Time
+	Value  int64
+	Weight *big.Int
+}
+
+// usageStorageEventDeltas converts raw usage event deltas.
+func usageStorageEventDeltas(deltas []db.UsageEventDelta) []usageStorageDelta {
+	out := make([]usageStorageDelta, 0, len(deltas))
+	for _, delta := range deltas {
+		out = append(out, usageStorageDelta{From: delta.CreatedAt, To: delta.CreatedAt, Value: delta.Value})
+	}
+	return out
+}
+
 func calculateUsagePeriodSummary(
 	from, to time.Time,
 	asOf time.Time,
 	openingStorageBytes int64,
-	storageDeltas []db.UsageEventDelta,
+	storageDeltas []usageStorageDelta,
 	pushOpCount int64,
 	pullOpCount int64,
 ) (usagePeriodSummary, error) {
 	if !to.After(from) {
 		return usagePeriodSummary{}, fmt.Errorf("usage period end must be after start")
 	}
-	if openingStorageBytes < 0 {
-		return usagePeriodSummary{}, fmt.Errorf("opening storage balance is negative")
-	}
 	if asOf.Before(from) || asOf.After(to) {
 		return usagePeriodSummary{}, fmt.Errorf("usage period as-of must be within the requested period")
 	}
@@ -59,37 +71,43 @@ func calculateUsagePeriodSummary(
 	runningBytes := openingStorageBytes
 
 	for _, delta := range storageDeltas {
-		at := delta.CreatedAt.UTC()
-		if at.Before(summary.From) || !at.Before(summary.AsOf) {
+		start := delta.From.UTC()
+		end := delta.To.UTC()
+		instant := start.Equal(end)
+		if start.Before(summary.From) || end.Before(start) || end.After(summary.AsOf) || (instant && !start.Before(summary.AsOf)) {
 			return usagePeriodSummary{}, fmt.Errorf("storage delta outside requested period")
 		}
-		if at.Before(cursor) {
+		if start.Before(cursor) {
 			return usagePeriodSummary{}, fmt.Errorf("storage deltas must be ordered by time")
 		}
-		if at.After(cursor) {
-			accumulateStorageByteNanos(summary.StorageByteNanos, runningBytes, at.Sub(cursor))
-			cursor = at
-		}
+		accumulateStorageByteNanos(summary.StorageByteNanos, runningBytes, end.Sub(cursor), delta.Weight)
+		cursor = end
 		runningBytes += delta.Value
-		if runningBytes < 0 {
-			return usagePeriodSummary{}, fmt.Errorf("storage balance became negative at %s", at.Format(time.RFC3339Nano))
-		}
 	}
 
 	if summary.AsOf.After(cursor) {
-		accumulateStorageByteNanos(summary.StorageByteNanos, runningBytes, summary.AsOf.Sub(cursor))
+		accumulateStorageByteNanos(summary.StorageByteNanos, runningBytes, summary.AsOf.Sub(cursor), nil)
 	}
 
 	summary.StorageClosingBytes = runningBytes
 	return summary, nil
 }
 
-func accumulateStorageByteNanos(total *big.Int, bytes int64, duration time.Duration) {
-	if bytes == 0 || duration <= 0 {
-		return
+// accumulateStorageByteNanos adds to total what a balance of bytes held for
+// duration, plus the weight of changes within it, accrued. The balance may
+// fall below zero when removals were recorded for storage whose addition was
+// not; until reconciliation corrects it, that time accrues nothing.
+func accumulateStorageByteNanos(total *big.Int, bytes int64, duration time.Duration, weight *big.Int) {
+	accrued := new(big.Int)
+	if duration > 0 {
+		accrued.Mul(big.NewInt(bytes), big.NewInt(duration.Nanoseconds()))
+	}
+	if weight != nil {
+		accrued.Add(accrued, weight)
+	}
+	if accrued.Sign() > 0 {
+		total.Add(total, accrued)
 	}
-	product := new(big.Int).Mul(big.NewInt(bytes), big.NewInt(duration.Nanoseconds()))
-	total.Add(total, product)
 }
 
 func usageSummaryWindow(fromRaw, toRaw string) (time.Time, time.Time, error) {
@@ -153,23 +171,6 @@ func (s usagePeriodSummary) storageGiBMonths() *big.Rat {
 	return new(big.Rat).Quo(new(big.Rat).SetInt(s.StorageByteNanos), new(big.Rat).SetInt(denominator))
 }
 
-func (s usagePeriodSummary) storageChargeUSD() *big.Rat {
-	return new(big.Rat).Mul(s.storageGiBMonths(), storageRateUSDPerGiBMonth)
-}
-
-func (s usagePeriodSummary) pushChargeUSD() *big.Rat {
-	return new(big.Rat).Mul(big.NewRat(s.PushOpCount, 1), pushRateUSDPerOp)
-}
-
-func (s usagePeriodSummary) pullChargeUSD() *big.Rat {
-	return new(big.Rat).Mul(big.NewRat(s.PullOpCount, 1), pullRateUSDPerOp)
-}
-
-func (s usagePeriodSummary) totalChargeUSD() *big.Rat {
-	total := new(big.Rat).Add(s.storageChargeUSD(), s.pushChargeUSD())
-	return total.Add(total, s.pullChargeUSD())
-}
-
 func formatUsageDecimal(value *big.Rat, scale int) string {
 	if value == nil {
 		return "0"
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -21,10 +22,10 @@ func TestCalculateUsagePeriodSummaryTimeWeightedStorage(t *testing.T) {
 		to,
 		to,
 		0,
-		[]db.UsageEventDelta{
+		usageStorageEventDeltas([]db.UsageEventDelta{
 			{CreatedAt: from, Value: tenGiB},
 			{CreatedAt: from.Add(10 * 24 * time.Hour), Value: -tenGiB},
-		},
+		}),
 		3,
 		5,
 	)
@@ -48,29 +49,49 @@ func TestCalculateUsagePeriodSummaryTimeWeightedStorage(t *testing.T) {
 	if got := formatUsageDecimal(summary.storageGiBMonths(), 12); got != "3.225806451613" {
 		t.Fatalf("storageGiBMonths = %s, want 3.225806451613", got)
 	}
-	if got := formatUsageDecimal(summary.storageChargeUSD(), 12); got != "0.064516129032" {
-		t.Fatalf("storageChargeUSD = %s, want 0.064516129032", got)
+	charges := calculateUsageCharges(summary.From, summary.To, []usagePricedSummary{{Summary: summary, Price: builtinPlanPrice}})
+	if got := formatUsageDecimal(charges.StorageUSD, 12); got != "0.064516129032" {
+		t.Fatalf("StorageUSD = %s, want 0.064516129032", got)
 	}
-	if got := formatUsageDecimal(summary.totalChargeUSD(), 12); got != "0.064556129032" {
-		t.Fatalf("totalChargeUSD = %s, want 0.064556129032", got)
+	if got := formatUsageDecimal(charges.totalUSD(), 12); got != "0.064556129032" {
+		t.Fatalf("totalUSD = %s, want 0.064556129032", got)
 	}
 }
 
-func TestCalculateUsagePeriodSummaryRejectsNegativeBalance(t *testing.T) {
+func TestCalculateUsagePeriodSummaryNegativeBalanceAccruesNothing(t *testing.T) {
 	from := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
 	to := from.Add(24 * time.Hour)
 
-	_, err := calculateUsagePeriodSummary(
+	// A removal recorded for storage whose addition was not leaves the
+	// balance at -100 bytes until reconciliation adds 300 six hours later,
+	// leaving the 200 bytes actually stored.
+	summary, err := calculateUsagePeriodSummary(
 		from,
 		to,
 		to,
 		0,
-		[]db.UsageEventDelta{{CreatedAt: from.Add(time.Hour), Value: -1}},
+		usageStorageEventDeltas([]db.UsageEventDelta{
+			{CreatedAt: from.Add(time.Hour), Value: -100},
+			{CreatedAt: from.Add(6 * time.Hour), Value: 300},
+		}),
 		0,
 		0,
 	)
-	if err == nil {
-		t.Fatal("calculateUsagePeriodSummary returned nil error, want error")
+	if err != nil {
+		t.Fatalf("calculateUsagePeriodSummary returned error: %v", err)
+	}
+	if summary.StorageClosingBytes != 200 {
+		t.Fatalf("StorageClosingBytes = %d, want 200", summary.StorageClosingBytes)
+	}
+	want := big.NewInt(200 * int64(18*time.Hour))
+	if summary.StorageByteNanos.Cmp(want) != 0 {
+		t.Fatalf("StorageByteNanos = %s, want %s", summary.StorageByteNanos, want)
+	}
+
+	// A later period opening below zero is summarized too.
+	summary, err = calculateUsagePeriodSummary(to, to.Add(time.Hour), to.Add(time.Hour), -100, nil, 0, 0)
+	if err != nil || summary.StorageByteNanos.Sign() != 0 {
+		t.Fatalf("negative opening balance = %s, %v; want 0, nil", summary.StorageByteNanos, err)
 	}
 }
 
@@ -123,9 +144,9 @@ func TestCalculateUsagePeriodSummaryUsesAsOfForCurrentMonthAccrual(t *testing.T)
 		to,
 		asOf,
 		0,
-		[]db.UsageEventDelta{
+		usageStorageEventDeltas([]db.UsageEventDelta{
 			{CreatedAt: asOf.Add(-1 * time.Hour), Value: oneGiB},
-		},
+		}),
 		0,
 		0,
 	)
@@ -0,0 +1,477 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bin2.io/internal/apikey"
+	"bin2.io/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// usageWorkerSignatureHeader carries an edge worker's request signature
+	// as id=<worker id>,t=<unix seconds>,n=<nonce>,v1=<hex HMAC-SHA256>.
+	usageWorkerSignatureHeader = "Bin2-Worker-Signature"
+	// usageWorkerSignatureTolerance is how far a signature's timestamp may
+	// be from the server's clock.
+	usageWorkerSignatureTolerance = 5 * time.Minute
+	// usageWorkerMaxBodyBytes bounds the body of a signed request.
+	usageWorkerMaxBodyBytes = 1 << 20
+	// usageIngestMaxEvents bounds the events in one ingested batch.
+	usageIngestMaxEvents = 1000
+	// defaultUsageIngestLogRetention is how long ingested batches are logged
+	// unless USAGE_INGEST_LOG_RETENTION says otherwise.
+	defaultUsageIngestLogRetention = 30 * 24 * time.Hour
+	// usageIngestLogPruneInterval is how often each replica prunes the log.
+	usageIngestLogPruneInterval = time.Hour
+	// usageIngestLogPruneBatch bounds the batches deleted in one statement.
+	usageIngestLogPruneBatch = 1000
+)
+
+// usageWorkerSignature is a parsed usageWorkerSignatureHeader.
+type usageWorkerSignature struct {
+	WorkerID  uuid.UUID
+	Timestamp time.Time
+	Nonce     string
+	MAC       []byte
+}
+
+// parseUsageWorkerSignature parses a usageWorkerSignatureHeader value.
+func parseUsageWorkerSignature(raw string) (usageWorkerSignature, error) {
+	var sig usageWorkerSignature
+	var haveID, haveTimestamp bool
+	for _, field := range strings.Split(raw, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch key {
+		case "id":
+			id, err := uuid.Parse(value)
+			if err != nil {
+				return usageWorkerSignature{}, errors.New("invalid worker id")
+			}
+			sig.WorkerID, haveID = id, true
+		case "t":
+			unix, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return usageWorkerSignature{}, errors.New("invalid signature timestamp")
+			}
+			sig.Timestamp, haveTimestamp = time.Unix(unix, 0).UTC(), true
+		case "n":
+			if !validUsageWorkerNonce(value) {
+				return usageWorkerSignature{}, errors.New("nonce must be 16 to 128 letters, digits, '-' or '_'")
+			}
+			sig.Nonce = value
+		case "v1":
+			mac, err := hex.DecodeString(value)
+			if err != nil || len(mac) != sha256.Size {
+				return usageWorkerSignature{}, errors.New("invalid signature")
+			}
+			sig.MAC = mac
+		}
+	}
+	if !haveID || !haveTimestamp || sig.Nonce == "" || sig.MAC == nil {
+		return usageWorkerSignature{}, fmt.Errorf("%s must carry id, t, n and v1", usageWorkerSignatureHeader)
+	}
+	return sig, nil
+}
+
+func validUsageWorkerNonce(nonce string) bool {
+	if len(nonce) < 16 || len(nonce) > 128 {
+		return false
+	}
+	for _, r := range nonce {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// usageWorkerMAC returns the HMAC-SHA256 a worker signs a request with. It
+// covers the timestamp, nonce, method and path as well as the body, so a
+// signature is not valid for another request.
+func usageWorkerMAC(secret string, ts time.Time, nonce, method, path string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, part := range []string{strconv.FormatInt(ts.Unix(), 10), nonce, method, path} {
+		mac.Write([]byte(part))
+		mac.Write([]byte("."))
+	}
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// verify checks that sig was made with secret for the request at a time
+// within usageWorkerSignatureTolerance of now.
+func (sig usageWorkerSignature) verify(secret, method, path string, body []byte, now time.Time) error {
+	if d := now.Sub(sig.Timestamp); d > usageWorkerSignatureTolerance || d < -usageWorkerSignatureTolerance {
+		return errors.New("signature timestamp is too far from the server's clock")
+	}
+	if !hmac.Equal(sig.MAC, usageWorkerMAC(secret, sig.Timestamp, sig.Nonce, method, path, body)) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+// authenticateUsageWorker verifies the request's worker signature and returns
+// the worker and signature with the request body, which it also restores for
+// later reads. Otherwise it responds and returns false.
+func (s *Server) authenticateUsageWorker(c *gin.Context) (db.UsageWorker, usageWorkerSignature, []byte, bool) {
+	sig, err := parseUsageWorkerSignature(c.GetHeader(usageWorkerSignatureHeader))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return db.UsageWorker{}, usageWorkerSignature{}, nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, usageWorkerMaxBodyBytes+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "could not read request body"})
+		return db.UsageWorker{}, usageWorkerSignature{}, nil, false
+	}
+	if len(body) > usageWorkerMaxBodyBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body is too large"})
+		return db.UsageWorker{}, usageWorkerSignature{}, nil, false
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	worker, err := s.db.GetUsageWorker(c.Request.Context(), sig.WorkerID)
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return db.UsageWorker{}, usageWorkerSignature{}, nil, false
+		}
+		if !errors.Is(err, db.ErrNotFound) {
+			logError(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not authenticate worker"})
+			return db.UsageWorker{}, usageWorkerSignature{}, nil, false
+		}
+	}
+	if err != nil || worker.RevokedAt != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return db.UsageWorker{}, usageWorkerSignature{}, nil, false
+	}
+	secret, err := apikey.Decrypt(worker.SecretEncrypted, s.apiKeyEncryptionKey)
+	if err != nil {
+		logError(fmt.Errorf("could not decrypt usage worker %s secret: %w", worker.ID, err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not authenticate worker"})
+		return db.UsageWorker{}, usageWorkerSignature{}, nil, false
+	}
+	if err := sig.verify(secret, c.Request.Method, c.Request.URL.EscapedPath(), body, time.Now()); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return db.UsageWorker{}, usageWorkerSignature{}, nil, false
+	}
+	return worker, sig, body, true
+}
+
+// usageIngestLogRetentionFromEnv reads USAGE_INGEST_LOG_RETENTION, a duration
+// such as 720h. It may not be shorter than twice usageWorkerSignatureTolerance:
+// a batch's nonce is what rejects a replay of its request for as long as the
+// request's signature can be accepted.
+func usageIngestLogRetentionFromEnv() (time.Duration, error) {
+	raw := getenvDefault("USAGE_INGEST_LOG_RETENTION", "")
+	if raw == "" {
+		return defaultUsageIngestLogRetention, nil
+	}
+	retention, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid USAGE_INGEST_LOG_RETENTION %q: %w", raw, err)
+	}
+	if retention < 2*usageWorkerSignatureTolerance {
+		return 0, fmt.Errorf("USAGE_INGEST_LOG_RETENTION %s is shorter than %s, which replay protection needs", retention, 2*usageWorkerSignatureTolerance)
+	}
+	return retention, nil
+}
+
+// runUsageIngestLogPruning deletes ingested batches older than the retention
+// until ctx is cancelled.
+func (s *Server) runUsageIngestLogPruning(ctx context.Context) {
+	ticker := time.NewTicker(usageIngestLogPruneInterval)
+	defer ticker.Stop()
+	for {
+		s.pruneUsageIngestLog(ctx, time.Now().UTC())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pruneUsageIngestLog deletes the batches received before the retention
+// ending at now, usageIngestLogPruneBatch at a time.
+func (s *Server) pruneUsageIngestLog(ctx context.Context, now time.Time) {
+	before := now.Add(-s.usageIngestLogRetention)
+	var pruned int64
+	for {
+		n, err := s.db.DeleteUsageIngestBatchesBefore(ctx, before, usageIngestLogPruneBatch)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				logError(fmt.Errorf("could not prune usage ingest log: %w", err))
+			}
+			return
+		}
+		pruned += n
+		if n < usageIngestLogPruneBatch {
+			break
+		}
+	}
+	if pruned > 0 {
+		slog.Info("Usage", slog.Int64("pruned ingest batches", pruned))
+	}
+}
+
+// checkUsageWorkerEvent reports why worker may not submit an event of value
+// for metric, if it may not.
+func checkUsageWorkerEvent(worker db.UsageWorker, metric string, value int64) error {
+	allowed, ok := worker.Metric(metric)
+	if !ok {
+		return fmt.Errorf("worker may not submit metric %q", metric)
+	}
+	if value < allowed.MinValue || value > allowed.MaxValue {
+		return fmt.Errorf("%s value %d is outside %d..%d", metric, value, allowed.MinValue, allowed.MaxValue)
+	}
+	return nil
+}
+
+// generateUsageWorkerSecret returns a new worker signing secret.
+func generateUsageWorkerSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "uwsec_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+type usageWorkerMetricBody struct {
+	Metric   string `json:"metric"`
+	MinValue int64  `json:"minValue"`
+	MaxValue int64  `json:"maxValue"`
+}
+
+type operatorUsageWorkerRequest struct {
+	Name    string                  `json:"name"`
+	Metrics []usageWorkerMetricBody `json:"metrics"`
+}
+
+// usageWorker validates the request, returning the worker it describes.
+func (req operatorUsageWorkerRequest) usageWorker() (db.UsageWorker, error) {
+	w := db.UsageWorker{Name: strings.TrimSpace(req.Name)}
+	if w.Name == "" {
+		return db.UsageWorker{}, errors.New("name is required")
+	}
+	if len(req.Metrics) == 0 {
+		return db.UsageWorker{}, errors.New("metrics are required")
+	}
+	seen := map[string]bool{}
+	for _, m := range req.Metrics {
+		metric := db.UsageWorkerMetric{Metric: m.Metric, MinValue: m.MinValue, MaxValue: m.MaxValue}
+		if err := metric.Validate(); err != nil {
+			return db.UsageWorker{}, err
+		}
+		if seen[m.Metric] {
+			return db.UsageWorker{}, fmt.Errorf("metric %q is listed twice", m.Metric)
+		}
+		seen[m.Metric] = true
+		w.Metrics = append(w.Metrics, metric)
+	}
+	return w, nil
+}
+
+type operatorUsageWorkerResponse struct {
+	ID        string                  `json:"id"`
+	Name      string                  `json:"name"`
+	Metrics   []usageWorkerMetricBody `json:"metrics"`
+	CreatedAt string                  `json:"createdAt"`
+	RevokedAt *string                 `json:"revokedAt"`
+	// Secret is only returned when the worker is created.
+	Secret string `json:"secret,omitempty"`
+}
+
+func newOperatorUsageWorkerResponse(w db.UsageWorker) operatorUsageWorkerResponse {
+	resp := operatorUsageWorkerResponse{
+		ID:        w.ID.String(),
+		Name:      w.Name,
+		Metrics:   make([]usageWorkerMetricBody, 0, len(w.Metrics)),
+		CreatedAt: w.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	for _, m := range w.Metrics {
+		resp.Metrics = append(resp.Metrics, usageWorkerMetricBody{Metric: m.Metric, MinValue: m.MinValue, MaxValue: m.MaxValue})
+	}
+	if w.RevokedAt != nil {
+		revokedAt := w.RevokedAt.UTC().Format(time.RFC3339)
+		resp.RevokedAt = &revokedAt
+	}
+	return resp
+}
+
+// listOperatorUsageWorkersHandler handles GET /admin/v1/usage-workers.
+func (s *Server) listOperatorUsageWorkersHandler(c *gin.Context) {
+	workers, err := s.db.ListUsageWorkers(c.Request.Context())
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list usage workers"})
+		return
+	}
+	out := make([]operatorUsageWorkerResponse, 0, len(workers))
+	for _, w := range workers {
+		out = append(out, newOperatorUsageWorkerResponse(w))
+	}
+	c.JSON(http.StatusOK, gin.H{"workers": out})
+}
+
+// createOperatorUsageWorkerHandler handles POST /admin/v1/usage-workers,
+// registering an edge worker. Its signing secret is only returned here.
+func (s *Server) createOperatorUsageWorkerHandler(c *gin.Context) {
+	var req operatorUsageWorkerRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	w, err := req.usageWorker()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	w.ID = uuid.New()
+	setAuditTarget(c, w.ID.String())
+
+	secret, err := generateUsageWorkerSecret()
+	if err != nil {
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	if w.SecretEncrypted, err = apikey.Encrypt(secret, s.apiKeyEncryptionKey); err != nil {
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	created, err := s.db.CreateUsageWorker(c.Request.Context(), w)
+	if err != nil {
+		if errors.Is(err, db.ErrConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": "a usage worker with this name already exists"})
+			return
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create usage worker"})
+		return
+	}
+	resp := newOperatorUsageWorkerResponse(created)
+	resp.Secret = secret
+	c.JSON(http.StatusCreated, resp)
+}
+
+// revokeOperatorUsageWorkerHandler handles DELETE /admin/v1/usage-workers/:id.
+// The worker's requests are refused from then on; its ingest log is kept.
+func (s *Server) revokeOperatorUsageWorkerHandler(c *gin.Context) {
+	id, ok := operatorID(c, "usage worker")
+	if !ok {
+		return
+	}
+	setAuditTarget(c, id.String())
+	if err := s.db.RevokeUsageWorker(c.Request.Context(), id); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "usage worker not found or already revoked"})
+			return
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not revoke usage worker"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+type usageIngestBatchResponse struct {
+	ID         string   `json:"id"`
+	WorkerID   string   `json:"workerId"`
+	Nonce      string   `json:"nonce"`
+	SignedAt   string   `json:"signedAt"`
+	ReceivedAt string   `json:"receivedAt"`
+	ClientIP   string   `json:"clientIp"`
+	EventIDs   []string `json:"eventIds"`
+
+	Rejected []usageIngestRejectionResponse `json:"rejected"`
+}
+
+type usageIngestRejectionResponse struct {
+	Position  int    `json:"position"`
+	EventID   string `json:"id"`
+	Namespace string `json:"namespace"`
+	Metric    string `json:"metric"`
+	Value     int64  `json:"value"`
+	Reason    string `json:"reason"`
+}
+
+func newUsageIngestRejectionResponses(rejected []db.UsageIngestRejection) []usageIngestRejectionResponse {
+	out := make([]usageIngestRejectionResponse, 0, len(rejected))
+	for _, r := range rejected {
+		out = append(out, usageIngestRejectionResponse{
+			Position:  r.Position,
+			EventID:   r.EventID,
+			Namespace: r.Namespace,
+			Metric:    r.Metric,
+			Value:     r.Value,
+			Reason:    r.Reason,
+		})
+	}
+	return out
+}
+
+// listOperatorUsageIngestBatchesHandler handles GET
+// /admin/v1/usage-workers/:id/batches: the batches of usage events the worker
+// submitted, newest first, as far back as USAGE_INGEST_LOG_RETENTION.
+func (s *Server) listOperatorUsageIngestBatchesHandler(c *gin.Context) {
+	id, ok := operatorID(c, "usage worker")
+	if !ok {
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	batches, err := s.db.ListUsageIngestBatches(c.Request.Context(), id, limit)
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list ingest batches"})
+		return
+	}
+	out := make([]usageIngestBatchResponse, 0, len(batches))
+	for _, b := range batches {
+		item := usageIngestBatchResponse{
+			ID:         b.ID.String(),
+			WorkerID:   b.WorkerID.String(),
+			Nonce:      b.Nonce,
+			SignedAt:   b.SignedAt.UTC().Format(time.RFC3339),
+			ReceivedAt: b.ReceivedAt.UTC().Format(time.RFC3339),
+			ClientIP:   b.ClientIP,
+			EventIDs:   make([]string, 0, len(b.EventIDs)),
+			Rejected:   newUsageIngestRejectionResponses(b.Rejected),
+		}
+		for _, eventID := range b.EventIDs {
+			item.EventIDs = append(item.EventIDs, eventID.String())
+		}
+		out = append(out, item)
+	}
+	c.JSON(http.StatusOK, gin.H{"batches": out})
+}
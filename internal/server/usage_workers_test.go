@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"bin2.io/internal/db"
+	"github.com/google/uuid"
+)
+
+// signTestUsageWorkerRequest returns the signature header an edge worker
+// sends with a request.
+func signTestUsageWorkerRequest(workerID uuid.UUID, secret string, ts time.Time, nonce, method, path string, body []byte) string {
+	mac := usageWorkerMAC(secret, ts, nonce, method, path, body)
+	return fmt.Sprintf("id=%s,t=%d,n=%s,v1=%s", workerID, ts.Unix(), nonce, hex.EncodeToString(mac))
+}
+
+func TestParseUsageWorkerSignature(t *testing.T) {
+	workerID := uuid.New()
+	now := time.Unix(1767225600, 0).UTC()
+	header := signTestUsageWorkerRequest(workerID, "uwsec_test", now, "0123456789abcdef", http.MethodPost, "/api/v1/usage/events", nil)
+
+	sig, err := parseUsageWorkerSignature(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.WorkerID != workerID || !sig.Timestamp.Equal(now) || sig.Nonce != "0123456789abcdef" || len(sig.MAC) != 32 {
+		t.Fatalf("parsed %+v", sig)
+	}
+
+	for _, raw := range []string{
+		"",
+		strings.Replace(header, "id="+workerID.String(), "id=worker", 1),
+		strings.Replace(header, ",t=", ",t=soon", 1),
+		strings.Replace(header, "n=0123456789abcdef", "n=short", 1),
+		strings.Replace(header, "n=0123456789abcdef", "n=0123456789abcde!", 1),
+		strings.Replace(header, ",v1=", ",v1=zz", 1),
+		strings.Replace(header, ",n=0123456789abcdef", "", 1),
+	} {
+		if _, err := parseUsageWorkerSignature(raw); err == nil {
+			t.Errorf("parseUsageWorkerSignature(%q) succeeded", raw)
+		}
+	}
+}
+
+func TestUsageWorkerSignatureVerify(t *testing.T) {
+	const secret = "uwsec_test"
+	const path = "/api/v1/usage/events"
+	workerID := uuid.New()
+	body := []byte(`[{"namespace":"acme","metric":"pull-bytes","value":512}]`)
+	now := time.Unix(1767225600, 0)
+
+	sign := func(ts time.Time) usageWorkerSignature {
+		sig, err := parseUsageWorkerSignature(signTestUsageWorkerRequest(workerID, secret, ts, "0123456789abcdef", http.MethodPost, path, body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+
+	if err := sign(now.Add(-time.Minute)).verify(secret, http.MethodPost, path, body, now); err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+	for name, err := range map[string]error{
+		"stale":         sign(now.Add(-usageWorkerSignatureTolerance-time.Second)).verify(secret, http.MethodPost, path, body, now),
+		"future":        sign(now.Add(usageWorkerSignatureTolerance+time.Second)).verify(secret, http.MethodPost, path, body, now),
+		"wrong secret":  sign(now).verify("uwsec_other", http.MethodPost, path, body, now),
+		"tampered body": sign(now).verify(secret, http.MethodPost, path, []byte(strings.Replace(string(body), "512", "0", 1)), now),
+		"other path":    sign(now).verify(secret, http.MethodPost, "/api/v1/registry-tokens/introspect", body, now),
+		"other method":  sign(now).verify(secret, http.MethodPut, path, body, now),
+	} {
+		if err == nil {
+			t.Errorf("%s signature accepted", name)
+		}
+	}
+
+	sig := sign(now)
+	sig.Nonce = "fedcba9876543210"
+	if err := sig.verify(secret, http.MethodPost, path, body, now); err == nil {
+		t.Error("signature accepted with another nonce")
+	}
+}
+
+func TestCheckUsageWorkerEvent(t *testing.T) {
+	worker := db.UsageWorker{Metrics: []db.UsageWorkerMetric{
+		{Metric: db.MetricPullOpCount, MinValue: 1, MaxValue: 1},
+		{Metric: db.MetricPullBytes, MinValue: 0, MaxValue: 1 << 40},
+	}}
+	for _, tc := range []struct {
+		metric string
+		value  int64
+		ok     bool
+	}{
+		{db.MetricPullOpCount, 1, true},
+		{db.MetricPullBytes, 1 << 30, true},
+		{db.MetricPullOpCount, 1000, false},
+		{db.MetricPullBytes, -1, false},
+		{db.MetricStorageBytes, 0, false},
+		{db.MetricPushOpCount, 1, false},
+	} {
+		if err := checkUsageWorkerEvent(worker, tc.metric, tc.value); (err == nil) != tc.ok {
+			t.Errorf("checkUsageWorkerEvent(%s, %d) = %v", tc.metric, tc.value, err)
+		}
+	}
+}
+
+func TestNewIngestedUsageEventRejectsOnlyInvalidEvents(t *testing.T) {
+	registry := db.Registry{ID: uuid.New(), TenantID: uuid.New(), Name: "acme"}
+	repos := fakeUsageIngestRepositories{registry: registry, registryID: registry.ID, ids: map[string]uuid.UUID{"app": uuid.New()}}
+	worker := db.UsageWorker{Metrics: []db.UsageWorkerMetric{
+		{Metric: db.MetricPullOpCount, MinValue: 1, MaxValue: 1},
+		{Metric: db.MetricPullBytes, MinValue: 0, MaxValue: 1 << 40},
+	}}
+	valid := usageIngestEvent{Namespace: "acme", ID: uuid.NewString(), Repository: "acme/app", Metric: db.MetricPullBytes, Value: 512}
+
+	event, err := newIngestedUsageEvent(context.Background(), repos, worker, valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.TenantID != registry.TenantID || event.RepoID == nil || *event.RepoID != repos.ids["app"] || event.Value != 512 {
+		t.Fatalf("event = %+v", event)
+	}
+
+	for name, mutate := range map[string]func(*usageIngestEvent){
+		"out of range":       func(e *usageIngestEvent) { e.Value = -1 },
+		"metric not allowed": func(e *usageIngestEvent) { e.Metric = db.MetricStorageBytes },
+		"unknown namespace":  func(e *usageIngestEvent) { e.Namespace = "other" },
+		"no namespace":       func(e *usageIngestEvent) { e.Namespace = "" },
+		"bad id":             func(e *usageIngestEvent) { e.ID = "event" },
+		"bad digest":         func(e *usageIngestEvent) { e.Digest = "sha256:zz" },
+		"foreign repo":       func(e *usageIngestEvent) { e.Repository = "other/app" },
+	} {
+		req := valid
+		mutate(&req)
+		_, err := newIngestedUsageEvent(context.Background(), repos, worker, req)
+		var reqErr usageIngestRequestError
+		if !errors.As(err, &reqErr) {
+			t.Errorf("%s: err = %v, want the event rejected", name, err)
+		}
+	}
+}
+
+func TestOperatorUsageWorkerRequestValidate(t *testing.T) {
+	valid := operatorUsageWorkerRequest{
+		Name: " edge ",
+		Metrics: []usageWorkerMetricBody{
+			{Metric: db.MetricPullOpCount, MinValue: 1, MaxValue: 1},
+			{Metric: db.MetricPullBytes, MinValue: 0, MaxValue: 1 << 40},
+		},
+	}
+	w, err := valid.usageWorker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Name != "edge" || len(w.Metrics) != 2 {
+		t.Fatalf("usageWorker() = %+v", w)
+	}
+
+	for name, req := range map[string]operatorUsageWorkerRequest{
+		"no name":    {Metrics: valid.Metrics},
+		"no metrics": {Name: "edge"},
+		"unknown":    {Name: "edge", Metrics: []usageWorkerMetricBody{{Metric: "egress", MaxValue: 1}}},
+		"empty range": {Name: "edge", Metrics: []usageWorkerMetricBody{
+			{Metric: db.MetricPullBytes, MinValue: 10, MaxValue: 1},
+		}},
+		"duplicate": {Name: "edge", Metrics: []usageWorkerMetricBody{
+			{Metric: db.MetricPullBytes, MaxValue: 1},
+			{Metric: db.MetricPullBytes, MaxValue: 2},
+		}},
+	} {
+		if _, err := req.usageWorker(); err == nil {
+			t.Errorf("%s: request accepted", name)
+		}
+	}
+}
+
+func TestGenerateUsageWorkerSecret(t *testing.T) {
+	a, err := generateUsageWorkerSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := generateUsageWorkerSecret()
+	if !strings.HasPrefix(a, "uwsec_") || len(a) != len("uwsec_")+43 || a == b {
+		t.Fatalf("secrets %q and %q", a, b)
+	}
+}
+
+func TestUsageIngestLogRetentionFromEnv(t *testing.T) {
+	for raw, want := range map[string]time.Duration{
+		"":      defaultUsageIngestLogRetention,
+		"168h":  7 * 24 * time.Hour,
+		" 10m ": 2 * usageWorkerSignatureTolerance,
+	} {
+		t.Setenv("USAGE_INGEST_LOG_RETENTION", raw)
+		got, err := usageIngestLogRetentionFromEnv()
+		if err != nil || got != want {
+			t.Fatalf("USAGE_INGEST_LOG_RETENTION=%q: retention = %s, %v, want %s", raw, got, err, want)
+		}
+	}
+	for _, raw := range []string{"a week", "5m", "-1h"} {
+		t.Setenv("USAGE_INGEST_LOG_RETENTION", raw)
+		if _, err := usageIngestLogRetentionFromEnv(); err == nil {
+			t.Errorf("USAGE_INGEST_LOG_RETENTION=%q accepted", raw)
+		}
+	}
+}
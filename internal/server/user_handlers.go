@@ -1,15 +1,32 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"net/http"
 
+	"bin2.io/internal/db"
 	"github.com/gin-gonic/gin"
 )
 
 type currentUserResponse struct {
-	Onboarded bool `json:"onboarded"`
+	Onboarded   bool                    `json:"onboarded"`
+	OrgID       string                  `json:"orgId"`
+	Role        string                  `json:"role"`
+	State       string                  `json:"state"`
+	Memberships []orgMembershipResponse `json:"memberships"`
 }
 
+type orgMembershipResponse struct {
+	OrgID   string `json:"orgId"`
+	Name    string `json:"name"`
+	Role    string `json:"role"`
+	State   string `json:"state"`
+	Default bool   `json:"default"`
+}
+
+// getCurrentUserHandler describes the caller in the organization the request
+// acts on and lists every organization they can select with X-Org-ID.
 func (s *Server) getCurrentUserHandler(c *gin.Context) {
 	u, err := s.getUser(c)
 	if err != nil {
@@ -17,7 +34,37 @@ func (s *Server) getCurrentUserHandler(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, currentUserResponse{
-		Onboarded: u.onboarded,
-	})
+	memberships, err := s.db.ListUserMemberships(c.Request.Context(), u.id)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		logError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, newCurrentUserResponse(u, memberships))
+}
+
+// newCurrentUserResponse describes u with memberships, flagging their
+// default organization.
+func newCurrentUserResponse(u user, memberships []db.OrgMembership) currentUserResponse {
+	out := make([]orgMembershipResponse, 0, len(memberships))
+	for _, membership := range memberships {
+		out = append(out, orgMembershipResponse{
+			OrgID:   membership.OrgID.String(),
+			Name:    membership.OrgName,
+			Role:    string(membership.Role),
+			State:   string(membership.State),
+			Default: membership.OrgID == u.defaultTenantID,
+		})
+	}
+	return currentUserResponse{
+		Onboarded:   u.onboarded,
+		OrgID:       u.tenantID.String(),
+		Role:        string(u.role),
+		State:       string(u.tenantState),
+		Memberships: out,
+	}
 }
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"testing"
+
+	"bin2.io/internal/db"
+	"github.com/google/uuid"
+)
+
+func TestNewCurrentUserResponseListsMemberships(t *testing.T) {
+	first, second := uuid.New(), uuid.New()
+	u := user{id: uuid.New(), defaultTenantID: first, tenantID: second, role: db.OrgRoleMember, tenantState: db.AccessStateActive}
+	memberships := []db.OrgMembership{
+		{OrgID: first, OrgName: "first", Role: db.OrgRoleOwner, State: db.AccessStateActive},
+		{OrgID: second, OrgName: "second", Role: db.OrgRoleMember, State: db.AccessStateActive},
+	}
+
+	got := newCurrentUserResponse(u, memberships)
+	if got.OrgID != second.String() || got.Role != string(db.OrgRoleMember) {
+		t.Fatalf("acting as %s %s, want the selected organization", got.OrgID, got.Role)
+	}
+	if len(got.Memberships) != 2 {
+		t.Fatalf("memberships = %+v, want both", got.Memberships)
+	}
+	if !got.Memberships[0].Default || got.Memberships[0].Role != string(db.OrgRoleOwner) {
+		t.Fatalf("first membership = %+v, want the default owner", got.Memberships[0])
+	}
+	if got.Memberships[1].Default || got.Memberships[1].Name != "second" {
+		t.Fatalf("second membership = %+v, want the selected non-default", got.Memberships[1])
+	}
+}
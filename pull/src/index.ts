@@ -9,6 +9,17 @@ const defaultService = "localhost:5000";
 const defaultTokenRealm = "http://localhost:5000/v2/token";
 const defaultBlobType = "application/octet-stream";
 
+// Matches the API's JWKS Cache-Control max-age. Tokens carrying an unknown
+// kid force a refetch (at most once per cooldown), so a freshly promoted
+// signing key is picked up without waiting for the cache to expire.
+const jwksCacheMaxAgeMs = 300_000;
+const jwksCooldownMs = 30_000;
+
+// Revocation verdicts from the API are cached per token for this long, which
+// bounds how long a revoked token keeps working at the edge.
+const revocationCacheTtlMs = 30_000;
+const revocationCacheMaxEntries = 10_000;
+
 const repoSegmentRe = /^[A-Za-z0-9._-]+$/;
 const registryNameRe = /^[A-Za-z0-9_-]+$/;
 const digestRe = /^sha256:([a-fA-F0-9]{64})$/;
@@ -19,7 +30,8 @@ type Env = {
   REGISTRY_TOKEN_REALM?: string;
   REGISTRY_JWKS_URL?: string;
   REGISTRY_API_ORIGIN?: string;
-  USAGE_INGEST_SECRET?: string;
+  USAGE_WORKER_ID?: string;
+  USAGE_WORKER_SECRET?: string;
 };
 
 type RegistryTokenAccess = {
@@ -31,6 +43,7 @@ type RegistryTokenAccess = {
 type JWKSResolver = ReturnType<typeof createRemoteJWKSet>;
 
 const jwksCache = new Map<string, JWKSResolver>();
+const revocationCache = new Map<string, { active: boolean; checkedAt: number }>();
 
 export default {
   async fetch(request: Request, env: Env, ctx: ExecutionContext): Promise<Response> {
@@ -150,6 +163,16 @@ async function handleManifest(
   if (accept !== null) {
     forwardHeaders.set("Accept", accept);
   }
+  // Lets the API attribute the pull (audit trail, CIDR allowlists) to the
+  // real client once Cloudflare's ranges are listed in TRUSTED_PROXIES.
+  const clientIP = request.headers.get("CF-Connecting-IP");
+  if (clientIP !== null) {
+    forwardHeaders.set("X-Forwarded-For", clientIP);
+  }
+  const userAgent = request.headers.get("User-Agent");
+  if (userAgent !== null) {
+    forwardHeaders.set("User-Agent", userAgent);
+  }
 
   let upstreamResponse: Response;
   try {
@@ -214,17 +237,39 @@ async function handleBlob(
 
   const digestHex = digestMatch[1].toLowerCase();
   const key = blobObjectKey(digestHex);
-  const object = await env.BUCKET.get(key);
+  let range: BlobRange | null = null;
+  const rangeHeader = method === "GET" ? request.headers.get("Range") ?? "" : "";
+  if (rangeHeader.trim() !== "") {
+    const head = await env.BUCKET.head(key);
+    if (head === null) {
+      return ociError(method, 404, "BLOB_UNKNOWN", "blob unknown");
+    }
+    const parsed = parseBlobRange(rangeHeader, head.size);
+    if (parsed === "unsatisfiable") {
+      return new Response(null, {
+        status: 416,
+        headers: apiHeaders({ "Content-Range": `bytes */${head.size}` }),
+      });
+    }
+    range = parsed;
+  }
+
+  const object = await env.BUCKET.get(key, range === null ? undefined : { range });
   if (object === null) {
     return ociError(method, 404, "BLOB_UNKNOWN", "blob unknown");
   }
 
+  const length = range === null ? object.size : range.length;
   const contentType = blobType(object.httpMetadata?.contentType);
   const headers = apiHeaders({
     "Content-Type": contentType,
-    "Content-Length": String(object.size),
+    "Content-Length": String(length),
     "Docker-Content-Digest": `sha256:${digestHex}`,
+    "Accept-Ranges": "bytes",
   });
+  if (range !== null) {
+    headers.set("Content-Range", `bytes ${range.offset}-${range.offset + range.length - 1}/${object.size}`);
+  }
 
   if (method === "HEAD") {
     return new Response(null, {
@@ -233,42 +278,174 @@ async function handleBlob(
     });
   }
 
-  ctx.waitUntil(postPullUsageEvent(env, auth.namespace, `sha256:${digestHex}`));
+  // Only the bytes served are metered, and a range from past the first byte
+  // resumes a pull rather than starting another.
+  const body = new FixedLengthStream(length);
+  ctx.waitUntil(
+    meterBody(object.body, body.writable).then((bytes) =>
+      postPullUsageEvents(
+        env,
+        auth.namespace,
+        repo,
+        `sha256:${digestHex}`,
+        bytes,
+        range === null || range.offset === 0,
+      )
+    ),
+  );
 
-  return new Response(object.body, {
-    status: 200,
+  return new Response(body.readable, {
+    status: range === null ? 200 : 206,
     headers,
   });
 }
 
-async function postPullUsageEvent(
+type BlobRange = { offset: number; length: number };
+
+// parseBlobRange returns the single byte range a Range header asks of a blob
+// of size bytes, as the API does. It returns null for a header that is not
+// honoured, that is another unit, several ranges or a malformed one, which is
+// served the whole blob, and "unsatisfiable" for a range outside the blob.
+function parseBlobRange(raw: string, size: number): BlobRange | "unsatisfiable" | null {
+  const match = raw.trim().match(/^bytes=(\d*)-(\d*)$/);
+  if (match === null || (match[1] === "" && match[2] === "")) {
+    return null;
+  }
+  if (match[1] === "") {
+    const suffix = Number(match[2]);
+    if (!Number.isSafeInteger(suffix)) {
+      return null;
+    }
+    if (suffix === 0 || size === 0) {
+      return "unsatisfiable";
+    }
+    const length = Math.min(suffix, size);
+    return { offset: size - length, length };
+  }
+  const start = Number(match[1]);
+  if (!Number.isSafeInteger(start)) {
+    return null;
+  }
+  let end = size - 1;
+  if (match[2] !== "") {
+    const last = Number(match[2]);
+    if (!Number.isSafeInteger(last) || last < start) {
+      return null;
+    }
+    end = Math.min(last, end);
+  }
+  if (start >= size) {
+    return "unsatisfiable";
+  }
+  return { offset: start, length: end - start + 1 };
+}
+
+// meterBody copies body into writable and resolves with the bytes the client
+// took, which is less than the blob when it disconnects part way. A write
+// resolves once the runtime accepts the chunk, so at most one chunk more than
+// the client received is counted.
+async function meterBody(
+  body: ReadableStream<Uint8Array>,
+  writable: WritableStream<ArrayBufferView>,
+): Promise<number> {
+  const reader = body.getReader();
+  const writer = writable.getWriter();
+  let bytes = 0;
+  try {
+    for (;;) {
+      const { done, value } = await reader.read();
+      if (done) {
+        break;
+      }
+      await writer.write(value);
+      bytes += value.byteLength;
+    }
+    await writer.close();
+  } catch {
+    await Promise.allSettled([reader.cancel(), writer.abort()]);
+  }
+  return bytes;
+}
+
+function usageWorkerConfigured(env: Env): boolean {
+  return (env.USAGE_WORKER_ID ?? "").trim() !== "" && (env.USAGE_WORKER_SECRET ?? "").trim() !== "";
+}
+
+// signedApiPost POSTs body to the API signed as this usage worker: an
+// HMAC-SHA256 over the timestamp, a fresh nonce, the method, the path and the
+// body, which the API checks and records so the request cannot be replayed.
+async function signedApiPost(env: Env, path: string, contentType: string, body: string): Promise<Response> {
+  const workerId = (env.USAGE_WORKER_ID ?? "").trim();
+  const secret = (env.USAGE_WORKER_SECRET ?? "").trim();
+  const timestamp = Math.floor(Date.now() / 1000).toString();
+  const nonce = crypto.randomUUID().replaceAll("-", "");
+  const key = await crypto.subtle.importKey(
+    "raw",
+    new TextEncoder().encode(secret),
+    { name: "HMAC", hash: "SHA-256" },
+    false,
+    ["sign"],
+  );
+  const mac = await crypto.subtle.sign(
+    "HMAC",
+    key,
+    new TextEncoder().encode(`${timestamp}.${nonce}.POST.${path}.${body}`),
+  );
+  const signature = [...new Uint8Array(mac)].map((b) => b.toString(16).padStart(2, "0")).join("");
+  return fetch(`${apiOrigin(env)}${path}`, {
+    method: "POST",
+    headers: {
+      "Bin2-Worker-Signature": `id=${workerId},t=${timestamp},n=${nonce},v1=${signature}`,
+      "Content-Type": contentType,
+    },
+    body,
+  });
+}
+
+async function postPullUsageEvents(
   env: Env,
   namespace: string,
+  repository: string,
   digest: string,
+  bytes: number,
+  countPull: boolean,
 ): Promise<void> {
-  const secret = (env.USAGE_INGEST_SECRET ?? "").trim();
-  if (secret === "") {
-    console.error("usage event POST skipped: USAGE_INGEST_SECRET not configured");
+  if (!usageWorkerConfigured(env)) {
+    console.error("usage event POST skipped: USAGE_WORKER_ID or USAGE_WORKER_SECRET not configured");
     return;
   }
-  const url = `${apiOrigin(env)}/api/v1/usage/events`;
   try {
-    const resp = await fetch(url, {
-      method: "POST",
-      headers: {
-        "Authorization": `Bearer ${secret}`,
-        "Content-Type": "application/json",
-      },
-      body: JSON.stringify([{
-        namespace,
-        id: crypto.randomUUID(),
-        digest,
-        metric: "pull-op-count",
-        value: 1,
-      }]),
-    });
+    const resp = await signedApiPost(
+      env,
+      "/api/v1/usage/events",
+      "application/json",
+      JSON.stringify([
+        ...(countPull
+          ? [
+            {
+              namespace,
+              repository,
+              id: crypto.randomUUID(),
+              digest,
+              metric: "pull-op-count",
+              value: 1,
+            },
+          ]
+          : []),
+        {
+          namespace,
+          repository,
+          id: crypto.randomUUID(),
+          digest,
+          metric: "pull-bytes",
+          value: bytes,
+        },
+      ]),
+    );
     if (!resp.ok) {
       console.error(`usage event POST failed: ${resp.status}`);
+    } else if (resp.status === 200) {
+      console.error(`usage events rejected: ${await resp.text()}`);
     }
   } catch (err) {
     console.error("usage event POST threw:", err);
@@ -350,6 +527,34 @@ async function authenticate(
     };
   }
 
+  if (!(await tokenActive(env, token, claims, service))) {
+    return {
+      namespace: "",
+      response: unauthorizedResponse(
+        request.method,
+        realm,
+        service,
+        scope,
+      ),
+    };
+  }
+
+  const clientIP = request.headers.get("CF-Connecting-IP") ?? "";
+  if (
+    !cidrAllowlistAllows(claims.key_cidrs, clientIP) ||
+    !cidrAllowlistAllows(claims.registry_cidrs, clientIP)
+  ) {
+    return {
+      namespace: "",
+      response: ociError(
+        request.method,
+        403,
+        "DENIED",
+        "client address not allowed",
+      ),
+    };
+  }
+
   const namespace = (claims.sub ?? "").trim();
   if (namespace === "" || !validRegistryName(namespace)) {
     return {
@@ -381,6 +586,176 @@ async function authenticate(
   };
 }
 
+// tokenActive asks the API's introspection endpoint whether a locally verified
+// token has been revoked or its registry or tenant suspended. It fails open when the API is unreachable or the
+// worker has no shared secret, so blob pulls keep working during an API outage.
+async function tokenActive(
+  env: Env,
+  token: string,
+  claims: JWTPayload,
+  service: string,
+): Promise<boolean> {
+  const cacheKey = claims.jti ?? token;
+  const now = Date.now();
+  const cached = revocationCache.get(cacheKey);
+  if (cached !== undefined && now - cached.checkedAt < revocationCacheTtlMs) {
+    return cached.active;
+  }
+
+  if (!usageWorkerConfigured(env)) {
+    return true;
+  }
+
+  let active = true;
+  try {
+    const resp = await signedApiPost(
+      env,
+      "/api/v1/registry-tokens/introspect",
+      "application/x-www-form-urlencoded",
+      new URLSearchParams({ token, service }).toString(),
+    );
+    if (!resp.ok) {
+      console.error(`token introspection failed: ${resp.status}`);
+      return true;
+    }
+    const body = await resp.json() as { active?: unknown };
+    active = body.active === true;
+  } catch (err) {
+    console.error("token introspection threw:", err);
+    return true;
+  }
+
+  if (revocationCache.size >= revocationCacheMaxEntries) {
+    revocationCache.clear();
+  }
+  revocationCache.set(cacheKey, { active, checkedAt: now });
+  return active;
+}
+
+// cidrAllowlistAllows mirrors the API's check of the key_cidrs and
+// registry_cidrs claims: an absent or empty list allows every address.
+function cidrAllowlistAllows(raw: unknown, ip: string): boolean {
+  if (!Array.isArray(raw) || raw.length === 0) {
+    return true;
+  }
+  const addr = parseIPAddress(ip);
+  if (addr === null) {
+    return false;
+  }
+  for (const entry of raw) {
+    if (typeof entry !== "string") {
+      continue;
+    }
+    const slash = entry.indexOf("/");
+    if (slash === -1) {
+      continue;
+    }
+    const network = parseIPAddress(entry.slice(0, slash));
+    let bits = Number(entry.slice(slash + 1));
+    if (network === null || !Number.isInteger(bits)) {
+      continue;
+    }
+    if (!entry.includes(":")) {
+      bits += 96; // IPv4 addresses are compared in their IPv4-mapped form.
+    }
+    if (bits < 0 || bits > 128) {
+      continue;
+    }
+    if (prefixMatches(network, addr, bits)) {
+      return true;
+    }
+  }
+  return false;
+}
+
+function prefixMatches(network: Uint8Array, addr: Uint8Array, bits: number): boolean {
+  for (let i = 0; i < 16 && bits > 0; i++, bits -= 8) {
+    const mask = bits >= 8 ? 0xff : (0xff << (8 - bits)) & 0xff;
+    if ((network[i] & mask) !== (addr[i] & mask)) {
+      return false;
+    }
+  }
+  return true;
+}
+
+// parseIPAddress returns a 16-byte address, mapping IPv4 into ::ffff:0:0/96.
+function parseIPAddress(raw: string): Uint8Array | null {
+  const ip = raw.trim();
+  const out = new Uint8Array(16);
+  if (!ip.includes(":")) {
+    const v4 = parseIPv4(ip);
+    if (v4 === null) {
+      return null;
+    }
+    out[10] = 0xff;
+    out[11] = 0xff;
+    out.set(v4, 12);
+    return out;
+  }
+
+  const halves = ip.split("::");
+  if (halves.length > 2) {
+    return null;
+  }
+  const parseGroups = (part: string): number[] | null => {
+    if (part === "") {
+      return [];
+    }
+    const groups: number[] = [];
+    const pieces = part.split(":");
+    for (let i = 0; i < pieces.length; i++) {
+      const piece = pieces[i];
+      if (i === pieces.length - 1 && piece.includes(".")) {
+        const v4 = parseIPv4(piece);
+        if (v4 === null) {
+          return null;
+        }
+        groups.push((v4[0] << 8) | v4[1], (v4[2] << 8) | v4[3]);
+        continue;
+      }
+      if (!/^[0-9a-fA-F]{1,4}$/.test(piece)) {
+        return null;
+      }
+      groups.push(parseInt(piece, 16));
+    }
+    return groups;
+  };
+  const head = parseGroups(halves[0]);
+  const tail = halves.length === 2 ? parseGroups(halves[1]) : [];
+  if (head === null || tail === null) {
+    return null;
+  }
+  const missing = 8 - head.length - tail.length;
+  if ((halves.length === 1 && missing !== 0) || missing < 0) {
+    return null;
+  }
+  const groups = [...head, ...new Array(halves.length === 2 ? missing : 0).fill(0), ...tail];
+  for (let i = 0; i < 8; i++) {
+    out[i * 2] = groups[i] >> 8;
+    out[i * 2 + 1] = groups[i] & 0xff;
+  }
+  return out;
+}
+
+function parseIPv4(ip: string): number[] | null {
+  const parts = ip.split(".");
+  if (parts.length !== 4) {
+    return null;
+  }
+  const out: number[] = [];
+  for (const part of parts) {
+    if (!/^[0-9]{1,3}$/.test(part)) {
+      return null;
+    }
+    const n = Number(part);
+    if (n > 255) {
+      return null;
+    }
+    out.push(n);
+  }
+  return out;
+}
+
 function tokenAllowsPull(claims: JWTPayload, repository: string): boolean {
   const accessRaw = claims.access;
   if (!Array.isArray(accessRaw)) {
@@ -587,7 +962,10 @@ function loadJWKSResolver(env: Env): JWKSResolver {
   const url = jwksURL(env);
   let resolver = jwksCache.get(url);
   if (resolver === undefined) {
-    resolver = createRemoteJWKSet(new URL(url));
+    resolver = createRemoteJWKSet(new URL(url), {
+      cacheMaxAge: jwksCacheMaxAgeMs,
+      cooldownDuration: jwksCooldownMs,
+    });
     jwksCache.set(url, resolver);
   }
   return resolver;
@@ -182,7 +182,7 @@ print(data.get('token', ''))
     return 1
   fi
 
-  local pos_storage_count push_total pull_total neg_count
+  local pos_storage_count push_total pull_total pull_bytes neg_count
   pos_storage_count=$(printf '%s' "${events}" | python3 -c "
 import sys, json
 data = json.load(sys.stdin)
@@ -199,6 +199,12 @@ print(sum(e['value'] for e in data if e['metric'] == 'push-op-count'))
 import sys, json
 data = json.load(sys.stdin)
 print(sum(e['value'] for e in data if e['metric'] == 'pull-op-count'))
+")
+
+  pull_bytes=$(printf '%s' "${events}" | python3 -c "
+import sys, json
+data = json.load(sys.stdin)
+print(sum(e['value'] for e in data if e['metric'] == 'pull-bytes'))
 ")
 
   neg_count=$(printf '%s' "${events}" | python3 -c "
@@ -230,6 +236,13 @@ print(sum(1 for e in data if e['metric'] == 'storage-bytes' and e['value'] < 0))
     failed=1
   fi
 
+  if [[ "${pull_bytes}" -gt 0 ]]; then
+    printf '  pull-bytes total value: %s [OK]\n' "${pull_bytes}"
+  else
+    printf '  FAIL: expected pull-bytes total value > 0, got %s\n' "${pull_bytes}"
+    failed=1
+  fi
+
   if [[ "${neg_count}" -gt 0 ]]; then
     printf '  negative storage-bytes (from deletes): %s [OK]\n' "${neg_count}"
   else
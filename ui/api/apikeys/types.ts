@@ -1,6 +1,7 @@
 export interface APIKeyScope {
   registryId: string;
   repository: string | null;
+  repositoryPattern?: string | null;
   permission: 'read' | 'write' | 'admin';
   createdAt: string;
 }
@@ -12,6 +13,7 @@ export interface APIKey {
   secretKey: string;
   createdAt: string;
   lastUsedAt: string | null;
+  allowedCidrs: string[];
   scopes: APIKeyScope[];
 }
 
@@ -4,11 +4,23 @@ export type UsageSummary = {
   asOf: string;
   pushOpCount: number;
   pullOpCount: number;
+  pullBytes: number;
   storageOpeningBytes: number;
   storageClosingBytes: number;
   storageByteSeconds: string;
   storageGiBHours: string;
   storageGiBMonths: string;
   storageChargeUsd: string;
+  pushChargeUsd: string;
+  pullChargeUsd: string;
+  pullBytesChargeUsd: string;
+  minimumChargeUsd: string;
   totalChargeUsd: string;
+  plans: UsagePlanPeriod[];
+};
+
+export type UsagePlanPeriod = {
+  plan: string;
+  from: string;
+  to: string;
 };
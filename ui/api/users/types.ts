@@ -1,3 +1,19 @@
+export type OrgRole = "owner" | "admin" | "member" | "viewer";
+
+export type OrgState = "active" | "read_only" | "suspended";
+
+export interface OrgMembership {
+  orgId: string;
+  name: string;
+  role: OrgRole;
+  state: OrgState;
+  default: boolean;
+}
+
 export interface CurrentUser {
   onboarded: boolean;
+  orgId: string;
+  role: OrgRole;
+  state: OrgState;
+  memberships: OrgMembership[];
 }